@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"services/jutzo"
+)
+
+// Routine for an administrator to grant a right to a user directly
+func handleGrantRight(c *gin.Context, engine jutzo.Engine) {
+	userInfo, err := engine.GrantRight(c.Param("username"), c.Param("right"))
+	if err == nil {
+		recordAudit(c, engine, jutzo.AuditRightGranted, c.Param("username"), c.Param("right"))
+	}
+	respondWithUser(c, userInfo, err, "Unable to grant right")
+}
+
+// Routine for an administrator to revoke a right granted to a user directly
+func handleRevokeRight(c *gin.Context, engine jutzo.Engine) {
+	userInfo, err := engine.RevokeRight(c.Param("username"), c.Param("right"))
+	if err == nil {
+		recordAudit(c, engine, jutzo.AuditRightRevoked, c.Param("username"), c.Param("right"))
+	}
+	respondWithUser(c, userInfo, err, "Unable to revoke right")
+}
+
+// Routine for an administrator to enable or disable a user's login
+func handleSetLoginEnabled(c *gin.Context, engine jutzo.Engine, enabled bool) {
+	userInfo, err := engine.SetLoginEnabled(c.Param("username"), enabled)
+	if err == nil && enabled {
+		recordAudit(c, engine, jutzo.AuditLoginEnabled, c.Param("username"), "")
+	} else if err == nil {
+		recordAudit(c, engine, jutzo.AuditLoginDisabled, c.Param("username"), "")
+	}
+	respondWithUser(c, userInfo, err, "Unable to change login")
+}
+
+// Routine for an administrator to mark a user's email as validated
+func handleForceEmailValidation(c *gin.Context, engine jutzo.Engine) {
+	userInfo, err := engine.ForceEmailValidation(c.Param("username"))
+	if err == nil {
+		recordAudit(c, engine, jutzo.AuditEmailValidated, c.Param("username"), "by an administrator")
+	}
+	respondWithUser(c, userInfo, err, "Unable to validate email")
+}
+
+// Routine for an administrator to delete a user
+func handleDeleteUser(c *gin.Context, engine jutzo.Engine) {
+	if pseudonym, err := engine.DeleteUser(c.Param("username")); err == nil {
+		recordAudit(c, engine, jutzo.AuditUserDeleted, pseudonym, "")
+		c.String(http.StatusOK, "OK")
+	} else if err == jutzo.ErrLastAdmin {
+		c.String(http.StatusConflict, err.Error())
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "User not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to delete user: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to lift a lockout caused by failed logins
+func handleUnlockUser(c *gin.Context, engine jutzo.Engine) {
+	if err := engine.UnlockUser(c.Param("username")); err == nil {
+		recordAudit(c, engine, jutzo.AuditUserUnlocked, c.Param("username"), "")
+		c.String(http.StatusOK, "OK")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to unlock user: %s", err.Error())
+	}
+}
+
+// respondWithUser sends the user's rights and status after an administrative
+// change, or the appropriate status for the error
+func respondWithUser(c *gin.Context, userInfo jutzo.UserInfo, err error, failure string) {
+	if err == nil {
+		c.JSON(http.StatusOK, userRights(userInfo))
+	} else if err == jutzo.ErrLastAdmin {
+		c.String(http.StatusConflict, err.Error())
+	} else if err == jutzo.ErrInvalidRole {
+		c.String(http.StatusBadRequest, err.Error())
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "User not found")
+	} else {
+		c.String(http.StatusInternalServerError, "%s: %s", failure, err.Error())
+	}
+}
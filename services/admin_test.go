@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"sync"
+	"testing"
+)
+
+func TestAdminUserManagement(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	registerTestUser(t, engine, "carol")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/admin/user/:username/rights/:right", func(c *gin.Context) { handleGrantRight(c, engine) })
+	router.POST("/admin/user/:username/disable", func(c *gin.Context) { handleSetLoginEnabled(c, engine, false) })
+	router.POST("/admin/user/:username/enable", func(c *gin.Context) { handleSetLoginEnabled(c, engine, true) })
+	router.DELETE("/admin/user/:username", func(c *gin.Context) { handleDeleteUser(c, engine) })
+	send := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+	audited := func() []jutzo.AuditEvent {
+		events, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditRightGranted,
+			jutzo.AuditLoginEnabled, jutzo.AuditLoginDisabled, jutzo.AuditUserDeleted}})
+		return events
+	}
+
+	// The response describes the user, without the password hash
+	recorder := send(http.MethodPut, "/admin/user/carol/rights/invite")
+	var response map[string]any
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &response) != nil {
+		t.Fatalf("Grant failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if _, hasHash := response["passwordHash"]; hasHash || response["disabled"] != false {
+		t.Errorf("Unexpected response: %v", response)
+	}
+	if events := audited(); len(events) != 1 || events[0].Type != jutzo.AuditRightGranted ||
+		events[0].Target != "carol" || events[0].Detail != "invite" {
+		t.Errorf("Grant was not audited: %v", events)
+	}
+	if carol, _ := engine.GetUser("carol"); !carol.HasRights([]string{"invite"}) {
+		t.Errorf("Right was not granted: %v", carol.GetAllRights())
+	}
+	if recorder = send(http.MethodPost, "/admin/user/bob/enable"); recorder.Code != http.StatusOK {
+		t.Errorf("Enable failed: %d", recorder.Code)
+	}
+
+	// The last administrator can't be disabled or deleted
+	if recorder = send(http.MethodPost, "/admin/user/bob/disable"); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected conflict disabling the last admin, got %d", recorder.Code)
+	}
+	if recorder = send(http.MethodDelete, "/admin/user/bob"); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected conflict deleting the last admin, got %d", recorder.Code)
+	}
+	if bob, err := engine.GetUser("bob"); err != nil || bob.IsDisabled() {
+		t.Errorf("Refused changes were kept: %v %v", bob, err)
+	}
+	if events := audited(); len(events) != 2 {
+		t.Errorf("Refused changes were audited: %v", events)
+	}
+
+	// Unknown users are not found
+	if recorder = send(http.MethodDelete, "/admin/user/nobody"); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected not found, got %d", recorder.Code)
+	}
+	if recorder = send(http.MethodPut, "/admin/user/nobody/rights/blog"); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected not found, got %d", recorder.Code)
+	}
+}
+
+func TestConcurrentDemotionsKeepAnAdministrator(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	registerTestUser(t, engine, "carol")
+	if _, err := engine.AssignRole("carol", jutzo.AdministratorRole); err != nil {
+		t.Fatalf("Unable to make carol an administrator: %s", err.Error())
+	}
+
+	// Either administrator can be demoted, but not both
+	var wait sync.WaitGroup
+	results := make([]error, 2)
+	for i, user := range []string{"bob", "carol"} {
+		wait.Add(1)
+		go func(i int, user string) {
+			defer wait.Done()
+			_, results[i] = engine.UnassignRole(user, jutzo.AdministratorRole)
+		}(i, user)
+	}
+	wait.Wait()
+	if (results[0] == nil) == (results[1] == nil) || (results[0] != jutzo.ErrLastAdmin && results[1] != jutzo.ErrLastAdmin) {
+		t.Errorf("Expected exactly one demotion to be refused: %v", results)
+	}
+	if count, _ := engine.GetDatabase().GetAdminCount(); count != 1 {
+		t.Errorf("Expected one administrator to be left, got %d", count)
+	}
+
+	// Nor can the one that is left be disabled or deleted
+	admin := "bob"
+	if results[0] == nil {
+		admin = "carol"
+	}
+	if _, err := engine.SetLoginEnabled(admin, false); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept, got %v", err)
+	}
+	if _, err := engine.DeleteUser(admin); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept, got %v", err)
+	}
+}
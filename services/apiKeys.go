@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"services/jutzo"
+	"time"
+)
+
+// Routine to create a new API key for the logged-in user. The key
+// is returned in the response and cannot be retrieved again
+//
+// API key management requires an interactive session; an API key
+// can't be used to create more keys
+func handleCreateAPIKey(c *gin.Context, engine jutzo.Engine) {
+
+	// createAPIKeyPayload is used to request a new key. The key can have
+	// any subset of the user's rights, and may optionally expire
+	type createAPIKeyPayload struct {
+		Name          string   `json:"name" binding:"required"`
+		Rights        []string `json:"rights" binding:"required"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+
+	if userSession, ok := getInteractiveSession(c); ok {
+		var payload createAPIKeyPayload
+		err := c.BindJSON(&payload)
+		if checkValidPayload(c, err) {
+			expiresIn := time.Duration(payload.ExpiresInDays) * 24 * time.Hour
+			username := userSession.GetUserInfo().GetUsername()
+			if key, apiKey, err := engine.CreateAPIKey(username, payload.Name, payload.Rights, expiresIn); err == nil {
+				c.JSON(http.StatusOK, gin.H{"key": key, "apiKey": apiKey})
+			} else if err == jutzo.ErrRightNotHeld {
+				c.String(http.StatusForbidden, err.Error())
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to create API key: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Routine to list the API keys of the logged-in user
+func handleListAPIKeys(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		if apiKeys, err := engine.ListAPIKeys(userSession.GetUserInfo().GetUsername()); err == nil {
+			if apiKeys == nil {
+				apiKeys = []jutzo.APIKey{}
+			}
+			c.JSON(http.StatusOK, apiKeys)
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to list API keys: %s", err.Error())
+		}
+	}
+}
+
+// Routine to revoke one of the logged-in user's API keys
+func handleRevokeAPIKey(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		if err := engine.RevokeAPIKey(userSession.GetUserInfo().GetUsername(), c.Param("id")); err == nil {
+			c.String(http.StatusOK, "OK")
+		} else if err == sql.ErrNoRows {
+			c.String(http.StatusNotFound, "API key not found")
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to revoke API key: %s", err.Error())
+		}
+	}
+}
+
+// Get the user session from the context, making sure it is from an
+// interactive login rather than an API key or a session delegated to an
+// OAuth client. If it isn't, the request is rejected and false is returned
+func getInteractiveSession(c *gin.Context) (jutzo.UserSession, bool) {
+	if userSession, ok := getUserSessionFromContext(c); !ok {
+		c.String(http.StatusUnauthorized, "Invalid session")
+		return nil, false
+	} else if isAPIKeySession(c) {
+		c.String(http.StatusForbidden, "This operation cannot be performed with an API key")
+		return nil, false
+	} else if userSession.GetClientInfo().ClientID != "" {
+		c.String(http.StatusForbidden, "This operation cannot be performed by an OAuth client")
+		return nil, false
+	} else {
+		return userSession, true
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"services/jutzo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordAudit of an event caused by the request. The actor is the logged-in
+// user, if there is one. The request carries on if the event can't be recorded
+func recordAudit(c *gin.Context, engine jutzo.Engine, eventType string, target string, detail string) {
+	event := jutzo.AuditEvent{Type: eventType, Target: target, Detail: detail}
+	if userSession, ok := getUserSessionFromContext(c); ok {
+		event.Actor = userSession.GetUserInfo().GetUsername()
+	}
+	storeAuditEvent(c, engine, event)
+}
+
+// recordLogin attempt for the user. The user is the actor of a successful
+// login; nobody is for a failed one
+func recordLogin(c *gin.Context, engine jutzo.Engine, eventType string, user string, detail string) {
+	event := jutzo.AuditEvent{Type: eventType, Target: user, Detail: detail}
+	if eventType == jutzo.AuditLoginSucceeded {
+		event.Actor = user
+	}
+	storeAuditEvent(c, engine, event)
+}
+
+// storeAuditEvent with the address and user agent of the client making the request
+func storeAuditEvent(c *gin.Context, engine jutzo.Engine, event jutzo.AuditEvent) {
+	client := getClientInfo(c)
+	event.IP, event.UserAgent = client.IP, client.UserAgent
+	if err := engine.RecordAuditEvent(event); err != nil {
+		log.Printf("Unable to record %s event for %s: %s", event.Type, event.Target, err.Error())
+	}
+}
+
+// Routine for an administrator to query the audit log. The events can be
+// filtered by type (a comma separated list), actor, target, user (actor or
+// target), ip and time (since and until, in RFC 3339 format). Events come
+// newest first; the next page starts before the ID of the last event returned.
+// With format=csv the events are returned as a CSV attachment
+func handleListAuditEvents(c *gin.Context, engine jutzo.Engine) {
+	query := jutzo.AuditQuery{
+		Actor:  c.Query("actor"),
+		Target: c.Query("target"),
+		User:   c.Query("user"),
+		IP:     c.Query("ip"),
+	}
+	if types := c.Query("type"); types != "" {
+		query.Types = strings.Split(types, ",")
+	}
+
+	var err error
+	if since := c.Query("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.String(http.StatusBadRequest, "Malformed since: %s", err.Error())
+			return
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			c.String(http.StatusBadRequest, "Malformed until: %s", err.Error())
+			return
+		}
+	}
+	if before := c.Query("before"); before != "" {
+		if query.Before, err = strconv.ParseInt(before, 10, 64); err != nil {
+			c.String(http.StatusBadRequest, "Malformed before: %s", err.Error())
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			c.String(http.StatusBadRequest, "Malformed limit: %s", err.Error())
+			return
+		}
+	}
+
+	if events, err := engine.ListAuditEvents(query); err == nil {
+		if events == nil {
+			events = []jutzo.AuditEvent{}
+		}
+		if c.Query("format") == "csv" {
+			writeAuditCSV(c, events)
+		} else {
+			c.JSON(http.StatusOK, events)
+		}
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to list audit events: %s", err.Error())
+	}
+}
+
+// csvSafe stops a value supplied by a user from being taken as a formula
+// when the CSV is opened in a spreadsheet
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// writeAuditCSV sends the events as a CSV attachment, with a header row
+func writeAuditCSV(c *gin.Context, events []jutzo.AuditEvent) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="jutzo-audit.csv"`)
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.Write([]string{"id", "time", "type", "actor", "target", "ip", "userAgent", "detail"})
+	for _, event := range events {
+		_ = writer.Write([]string{strconv.FormatInt(event.ID, 10), event.Time.UTC().Format(time.RFC3339),
+			event.Type, csvSafe(event.Actor), csvSafe(event.Target), event.IP, csvSafe(event.UserAgent), csvSafe(event.Detail)})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Unable to write audit events: %s", err.Error())
+	}
+}
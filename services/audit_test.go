@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditQuery(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	for _, event := range []jutzo.AuditEvent{
+		{Time: time.Date(2022, 4, 30, 12, 0, 0, 0, time.UTC), Type: jutzo.AuditLogoff, Actor: "bob", IP: "10.0.0.2"},
+		{Time: time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC), Type: jutzo.AuditLoginFailed, Target: "=cmd|' /C calc'!A0",
+			IP: "10.0.0.1", UserAgent: "curl/7.79", Detail: "invalid username or password"},
+		{Time: time.Date(2022, 5, 2, 12, 0, 0, 0, time.UTC), Type: jutzo.AuditLoginFailed, Target: "bob", IP: "10.0.0.1"},
+		{Time: time.Date(2022, 5, 3, 12, 0, 0, 0, time.UTC), Type: jutzo.AuditLogoff, Actor: "bob", IP: "10.0.0.2"},
+	} {
+		if err := engine.RecordAuditEvent(event); err != nil {
+			t.Fatalf("Unable to record an event: %s", err.Error())
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/admin/audit", func(c *gin.Context) { handleListAuditEvents(c, engine) })
+	query := func(parameters string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/audit?"+parameters, nil))
+		return recorder
+	}
+	rowsFor := func(parameters string) [][]string {
+		recorder := query(parameters + "&format=csv")
+		rows, err := csv.NewReader(recorder.Body).ReadAll()
+		if recorder.Code != http.StatusOK || err != nil || len(rows) == 0 || rows[0][0] != "id" {
+			t.Fatalf("Unexpected CSV for %s: %d %s", parameters, recorder.Code, recorder.Body.String())
+		}
+		return rows[1:]
+	}
+
+	// The filters select the events, newest first, and the next page starts before the last one
+	if rows := rowsFor("type=login.failed,logoff&user=bob&since=2022-05-01T00:00:00Z"); len(rows) != 2 ||
+		rows[0][2] != jutzo.AuditLogoff || rows[1][2] != jutzo.AuditLoginFailed {
+		t.Errorf("Unexpected events: %v", rows)
+	}
+	if rows := rowsFor("ip=10.0.0.1&limit=1"); len(rows) != 1 || rows[0][4] != "bob" {
+		t.Errorf("Unexpected events: %v", rows)
+	} else if rows = rowsFor("ip=10.0.0.1&before=" + rows[0][0]); len(rows) != 1 || rows[0][1] != "2022-05-01T12:00:00Z" {
+		t.Errorf("Unexpected next page: %v", rows)
+	}
+	if recorder := query("since=yesterday"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Malformed time was accepted: %d", recorder.Code)
+	}
+
+	// User supplied values can't become formulas in the CSV export
+	if rows := rowsFor("until=2022-05-02T00:00:00Z&since=2022-05-01T00:00:00Z"); len(rows) != 1 ||
+		rows[0][4] != "'=cmd|' /C calc'!A0" {
+		t.Errorf("Unexpected CSV rows: %v", rows)
+	}
+}
+
+func TestErasedUsersArePseudonymized(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	registerTestUser(t, engine, "carol")
+	registerTestUser(t, engine, "dave")
+	for _, event := range []jutzo.AuditEvent{
+		{Type: jutzo.AuditLoginSucceeded, Actor: "carol", Target: "carol", IP: "192.0.2.1", UserAgent: "Firefox"},
+		{Type: jutzo.AuditLoginFailed, Target: "carol", IP: "192.0.2.9", UserAgent: "curl"},
+		{Type: jutzo.AuditRightGranted, Actor: "bob", Target: "carol", IP: "192.0.2.2", Detail: "blog"},
+		{Type: jutzo.AuditLoginSucceeded, Actor: "dave", Target: "dave", IP: "192.0.2.3"},
+	} {
+		if err := engine.RecordAuditEvent(event); err != nil {
+			t.Fatalf("Unable to record an event: %s", err.Error())
+		}
+	}
+
+	// The deleted user is only known by their pseudonym, and where they connected
+	// from is forgotten. What others did to them keeps where the others were
+	pseudonym, err := engine.DeleteUser("carol")
+	if err != nil || !strings.HasPrefix(pseudonym, "deleted-") {
+		t.Fatalf("Unable to delete the user: %q %v", pseudonym, err)
+	}
+	if events, _ := engine.ListAuditEvents(jutzo.AuditQuery{User: "carol"}); len(events) != 0 {
+		t.Errorf("Events still name the deleted user: %+v", events)
+	}
+	events, _ := engine.ListAuditEvents(jutzo.AuditQuery{User: pseudonym})
+	if len(events) != 3 || events[0].Actor != "bob" || events[0].IP != "192.0.2.2" || events[0].Detail != "blog" ||
+		events[1].IP != "" || events[1].UserAgent != "" || events[2].Actor != pseudonym || events[2].IP != "" {
+		t.Errorf("Unexpected pseudonymized events: %+v", events)
+	}
+	if events, _ := engine.ListAuditEvents(jutzo.AuditQuery{User: "dave"}); len(events) != 1 || events[0].IP != "192.0.2.3" {
+		t.Errorf("Another user's events were changed: %+v", events)
+	}
+
+	// An anonymized user is known by their new name
+	if _, err := engine.GetDatabase().StoreDeletionRequest("dave", true, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatalf("Unable to request deletion: %s", err.Error())
+	}
+	if purged, err := engine.PurgeAccountDeletions(); err != nil || purged != 1 {
+		t.Fatalf("Unable to purge: %d %v", purged, err)
+	}
+	anonymized, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditUserAnonymized}})
+	if len(anonymized) != 1 || !strings.HasPrefix(anonymized[0].Target, "deleted-") {
+		t.Fatalf("Unexpected anonymization events: %+v", anonymized)
+	}
+	if events, _ := engine.ListAuditEvents(jutzo.AuditQuery{User: anonymized[0].Target}); len(events) != 2 ||
+		events[1].Actor != anonymized[0].Target || events[1].IP != "" {
+		t.Errorf("Unexpected pseudonymized events: %+v", events)
+	}
+}
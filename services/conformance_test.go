@@ -0,0 +1,902 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"path/filepath"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"testing"
+	"time"
+)
+
+// The conformance suites are run against every implementation of the
+// database and the session cache, so that they all behave the same way.
+// Postgres and Redis are only tested when TestPostgresURL and TestRedisURL
+// say where to find them
+
+func TestMemoryDatabaseConformance(t *testing.T) {
+	db := impl.NewMemoryConnection(TestConfig{map[string]string{}})
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Unable to connect: %s", err.Error())
+	}
+	testDatabaseConformance(t, db)
+}
+
+func TestPostgresDatabaseConformance(t *testing.T) {
+	if PostgresURL == "" {
+		t.Skip("TestPostgresURL is not set")
+	}
+	connectAndWipe(t)
+	db := impl.NewPostgresConnection(TestConfig{NormalConfig})
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Unable to connect: %s", err.Error())
+	}
+	defer db.Shutdown()
+	testDatabaseConformance(t, db)
+	testAuditEventsImmutable(t, directConnect(t))
+}
+
+func TestSQLiteDatabaseConformance(t *testing.T) {
+	if len(impl.SQLiteUpgradeStatements) != impl.SupportedSchema {
+		t.Fatalf("SQLite upgrades to schema %d rather than %d", len(impl.SQLiteUpgradeStatements), impl.SupportedSchema)
+	}
+	config := TestConfig{map[string]string{"JUTZO_SQLITE_PATH": filepath.Join(t.TempDir(), "jutzo.db")}}
+	db := impl.NewSQLiteConnection(config)
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Unable to connect: %s", err.Error())
+	}
+	testDatabaseConformance(t, db)
+	_ = db.Shutdown()
+
+	// What was stored is there when the file is opened again
+	db = impl.NewSQLiteConnection(config)
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Unable to reconnect: %s", err.Error())
+	}
+	defer db.Shutdown()
+	if userInfo, err := db.RetrieveUserInformation("alice"); err != nil || !userInfo.HasRights([]string{"admin"}) {
+		t.Errorf("User not kept: %v %v", userInfo, err)
+	}
+
+	direct, err := sql.Open("sqlite", "file:"+config.vars["JUTZO_SQLITE_PATH"])
+	if err != nil {
+		t.Fatalf("Unable to open the database directly: %s", err.Error())
+	}
+	defer direct.Close()
+	testAuditEventsImmutable(t, direct)
+
+	// Users whose keys collided when they were added are counted
+	if _, err = direct.Exec(`update jutzo_registered_user set email_key = null where username = 'alice'`); err != nil {
+		t.Fatalf("Unable to clear a key: %s", err.Error())
+	}
+	if collisions, err := db.CountKeyCollisions(); err != nil || collisions.Usernames != 0 || collisions.Emails != 1 {
+		t.Errorf("Unexpected key collisions: %+v %v", collisions, err)
+	}
+}
+
+// shortSessionTimeouts let the session caches be seen expiring sessions
+// without waiting long
+var shortSessionTimeouts = map[string]string{
+	"JUTZO_SESSION_IDLE_MINUTES": "1s",
+	"JUTZO_REFRESH_TOKEN_HOURS":  "3s",
+}
+
+func TestMemorySessionCacheConformance(t *testing.T) {
+	cache, err := impl.NewMemoryCache(TestConfig{map[string]string{}})
+	if err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	testSessionCacheConformance(t, cache)
+	if cache, err = impl.NewMemoryCache(TestConfig{shortSessionTimeouts}); err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	testSessionExpiryConformance(t, cache)
+}
+
+func TestRedisSessionCacheConformance(t *testing.T) {
+	if RedisURL == "" {
+		t.Skip("TestRedisURL is not set")
+	}
+	cache, err := impl.NewRedisCache(TestConfig{NormalConfig})
+	if err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	testSessionCacheConformance(t, cache)
+	if cache, err = impl.NewRedisCache(withSettings(NormalConfig, shortSessionTimeouts)); err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	testSessionExpiryConformance(t, cache)
+}
+
+func TestPostgresSessionCacheConformance(t *testing.T) {
+	if PostgresURL == "" {
+		t.Skip("TestPostgresURL is not set")
+	}
+
+	// The cache's tables are made when the database is upgraded
+	connectAndWipe(t)
+	db := impl.NewPostgresConnection(TestConfig{NormalConfig})
+	if err := db.Connect(); err != nil {
+		t.Fatalf("Unable to connect: %s", err.Error())
+	}
+	defer db.Shutdown()
+
+	cache, err := impl.NewPostgresCache(TestConfig{NormalConfig})
+	if err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	testSessionCacheConformance(t, cache)
+	_ = cache.Disconnect()
+	if cache, err = impl.NewPostgresCache(withSettings(NormalConfig, shortSessionTimeouts)); err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	defer cache.Disconnect()
+	testSessionExpiryConformance(t, cache)
+}
+
+func TestBackendSelection(t *testing.T) {
+	if db, err := impl.NewDatabaseConnection(TestConfig{map[string]string{"JUTZO_DATABASE": "memory"}}); err != nil {
+		t.Errorf("Unable to select the in-memory database: %s", err.Error())
+	} else if _, ok := db.(*impl.MemoryConnection); !ok {
+		t.Errorf("Unexpected database %T", db)
+	}
+	if db, _ := impl.NewDatabaseConnection(TestConfig{map[string]string{}}); db == nil {
+		t.Errorf("No default database")
+	} else if _, ok := db.(*impl.PostgresConnection); !ok {
+		t.Errorf("Unexpected default database %T", db)
+	}
+	if db, err := impl.NewDatabaseConnection(TestConfig{map[string]string{"JUTZO_DATABASE": "sqlite"}}); err != nil {
+		t.Errorf("Unable to select the SQLite database: %s", err.Error())
+	} else if _, ok := db.(*impl.SQLiteConnection); !ok {
+		t.Errorf("Unexpected database %T", db)
+	}
+	if cache, err := impl.NewUserSessionCache(TestConfig{map[string]string{"JUTZO_SESSION_STORE": "memory"}}); err != nil {
+		t.Errorf("Unable to select the in-memory session cache: %s", err.Error())
+	} else if _, ok := cache.(*impl.MemoryCache); !ok {
+		t.Errorf("Unexpected session cache %T", cache)
+	}
+	if cache, err := impl.NewUserSessionCache(TestConfig{map[string]string{"JUTZO_SESSION_STORE": "postgres"}}); err == nil || cache != nil {
+		t.Errorf("Expected the Postgres session cache to require JUTZO_DB_URL, got %v %v", cache, err)
+	}
+	if _, err := impl.NewDatabaseConnection(TestConfig{map[string]string{"JUTZO_DATABASE": "mysql"}}); err == nil {
+		t.Errorf("Expected an unknown database to be refused")
+	}
+	if _, err := impl.NewUserSessionCache(TestConfig{map[string]string{"JUTZO_SESSION_STORE": "memcached"}}); err == nil {
+		t.Errorf("Expected an unknown session cache to be refused")
+	}
+}
+
+// testDatabaseConformance checks a freshly connected, empty database
+func testDatabaseConformance(t *testing.T, db jutzo.DatabaseConnection) {
+
+	// Users are compared by their normalized, case folded usernames and emails
+	alice, err := db.StoreUser("alice", "Alice@Example.com", []byte("hash"), jutzo.AuthSourceLocal)
+	if err != nil {
+		t.Fatalf("Unable to store a user: %s", err.Error())
+	}
+	if !slices.Equal(alice.GetRoles(), []string{jutzo.DefaultUserRole}) || !slices.Equal(alice.GetAllRights(), []string{"blog", "login"}) ||
+		alice.IsEmailValidated() || alice.IsDisabled() || alice.GetCreationTime().IsZero() || alice.GetAuthSource() != jutzo.AuthSourceLocal {
+		t.Errorf("Unexpected new user: %+v", alice)
+	}
+	if usernameExists, emailExists, err := db.CheckForUsernameOrEmail("ALICE", "bob@example.com"); err != nil || !usernameExists || emailExists {
+		t.Errorf("Username check failed: %v %v %v", usernameExists, emailExists, err)
+	}
+	if collisions, err := db.CountKeyCollisions(); err != nil || collisions.Usernames != 0 || collisions.Emails != 0 {
+		t.Errorf("Unexpected key collisions: %+v %v", collisions, err)
+	}
+	if usernameExists, emailExists, err := db.CheckForUsernameOrEmail("bob", "alice@example.COM"); err != nil || usernameExists || !emailExists {
+		t.Errorf("Email check failed: %v %v %v", usernameExists, emailExists, err)
+	}
+	if _, err = db.StoreUser("Alice", "other@example.com", []byte("hash"), jutzo.AuthSourceLocal); err == nil {
+		t.Errorf("Stored a user whose username differs only in case")
+	}
+	if userInfo, err := db.RetrieveUserInformation("ALICE"); err != nil || userInfo.GetUsername() != "alice" ||
+		string(userInfo.GetPasswordHash()) != "hash" {
+		t.Errorf("Unable to retrieve the user ignoring case: %v %v", userInfo, err)
+	}
+	if userInfo, err := db.RetrieveUserByEmail("alice@example.com"); err != nil || userInfo.GetUsername() != "alice" {
+		t.Errorf("Unable to retrieve the user by email: %v %v", userInfo, err)
+	}
+	if _, err = db.RetrieveUserInformation("nobody"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown user, got %v", err)
+	}
+	if _, err = db.RetrieveUserByEmail("nobody@example.com"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown email, got %v", err)
+	}
+	if err = db.UpdatePasswordHash("alice", []byte("rehashed")); err != nil {
+		t.Errorf("Unable to update the password hash: %s", err.Error())
+	}
+	if err = db.UpdatePasswordHash("nobody", []byte("rehashed")); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows updating an unknown user's password, got %v", err)
+	}
+
+	// Changes to the user are stored, and the user's rights follow their roles
+	alice.GrantRight("invite")
+	alice.AssignRole(jutzo.AdministratorRole)
+	alice.SetEmail("alice@example.org")
+	if err = db.UpdateUserInfo(alice); err != nil {
+		t.Fatalf("Unable to update the user: %s", err.Error())
+	}
+	alice, _ = db.RetrieveUserInformation("alice")
+	if !slices.Equal(alice.GetAllRights(), []string{"admin", "blog", "invite", "login"}) ||
+		!slices.Equal(alice.GetGrantedRights(), []string{"invite"}) || alice.GetEmail() != "alice@example.org" ||
+		string(alice.GetPasswordHash()) != "rehashed" {
+		t.Errorf("Update not stored: %+v", alice)
+	}
+	if count, err := db.GetAdminCount(); err != nil || count != 1 {
+		t.Errorf("Expected one administrator, got %d %v", count, err)
+	}
+
+	// The last enabled administrator can't be disabled, deleted or anonymized
+	alice.SetDisabled(true)
+	if err = db.UpdateUserInfo(alice); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept disabling them, got %v", err)
+	}
+	if err = db.DeleteUser("alice"); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept deleting them, got %v", err)
+	}
+	if err = db.AnonymizeUser("alice", "anonymous-0", "anonymous-0@invalid"); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept anonymizing them, got %v", err)
+	}
+	if alice, _ = db.RetrieveUserInformation("alice"); alice.IsDisabled() {
+		t.Errorf("Refused change to the administrator was kept")
+	}
+	if count, _ := db.GetAdminCount(); count != 1 {
+		t.Errorf("Refused changes lost the administrator")
+	}
+	if err = db.UpdateUserInfo(impl.NewUserInfo("nobody", "nobody@example.com", nil, false, nil, time.Now())); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows updating an unknown user, got %v", err)
+	}
+
+	// Emails are validated once
+	bob, _ := db.StoreUser("bob", "bob@example.com", []byte("hash"), jutzo.AuthSourceLocal)
+	bob.SetEmail("ALICE@example.org")
+	if err = db.UpdateUserInfo(bob); err != jutzo.ErrEmailInUse {
+		t.Errorf("Expected another user's email to be refused, got %v", err)
+	}
+	bob.SetEmail("bob@example.com")
+	if uniqueID, email, err := db.CreateValidationFor("bob"); err != nil || email != "bob@example.com" {
+		t.Errorf("Unable to create a validation: %s %v", email, err)
+	} else if username, err := db.CompleteValidationFor(uniqueID); err != nil || username != "bob" {
+		t.Errorf("Unable to complete the validation: %s %v", username, err)
+	} else if _, err = db.CompleteValidationFor(uniqueID); err != sql.ErrNoRows {
+		t.Errorf("Expected a validation to only complete once, got %v", err)
+	}
+	if bob, _ = db.RetrieveUserInformation("bob"); !bob.IsEmailValidated() {
+		t.Errorf("Email not validated")
+	}
+	if carol, err := db.StoreUser("carol", "carol@example.com", []byte(""), jutzo.AuthSourceExternal); err != nil ||
+		carol.GetAuthSource() != jutzo.AuthSourceExternal {
+		t.Errorf("Unexpected user without a password: %+v %v", carol, err)
+	}
+	if err = db.MarkEmailValidated("carol"); err != nil {
+		t.Errorf("Unable to mark the email validated: %s", err.Error())
+	}
+	if err = db.MarkEmailValidated("nobody"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows validating an unknown user, got %v", err)
+	}
+
+	// Users are listed a page at a time
+	page, err := db.ListUsers(jutzo.UserQuery{Limit: 2})
+	if err != nil || page.Total != 3 || len(page.Users) != 2 || page.Users[0].GetUsername() != "alice" ||
+		page.Users[1].GetUsername() != "bob" || page.NextCursor == "" || len(page.Users[0].GetPasswordHash()) != 0 {
+		t.Fatalf("Unexpected first page: %+v %v", page, err)
+	}
+	if page, err = db.ListUsers(jutzo.UserQuery{Limit: 2, Cursor: page.NextCursor}); err != nil || len(page.Users) != 1 ||
+		page.Users[0].GetUsername() != "carol" || page.NextCursor != "" {
+		t.Errorf("Unexpected second page: %+v %v", page, err)
+	}
+	if page, err = db.ListUsers(jutzo.UserQuery{Sort: jutzo.UserSortCreated, Descending: true}); err != nil || len(page.Users) != 3 ||
+		page.Users[0].GetUsername() != "carol" {
+		t.Errorf("Unexpected newest first listing: %+v %v", page, err)
+	}
+	validated := false
+	for query, expected := range map[*jutzo.UserQuery][]string{
+		{EmailContains: "CAROL@"}:                  {"carol"},
+		{Role: jutzo.AdministratorRole}:            {"alice"},
+		{Right: "login"}:                           {"alice", "bob", "carol"},
+		{Right: "admin"}:                           {"alice"},
+		{Validated: &validated}:                    {"alice"},
+		{CreatedUntil: time.Now().Add(-time.Hour)}: nil,
+	} {
+		page, err = db.ListUsers(*query)
+		var usernames []string
+		for _, userInfo := range page.Users {
+			usernames = append(usernames, userInfo.GetUsername())
+		}
+		if err != nil || !slices.Equal(usernames, expected) || page.Total != len(expected) {
+			t.Errorf("Unexpected users for %+v: %v %v", *query, usernames, err)
+		}
+	}
+	if _, err = db.ListUsers(jutzo.UserQuery{Sort: "email"}); err != jutzo.ErrInvalidUserQuery {
+		t.Errorf("Expected an unknown sort to be refused, got %v", err)
+	}
+
+	t.Run("APIKeys", func(t *testing.T) { testAPIKeyConformance(t, db) })
+	t.Run("Settings", func(t *testing.T) { testSettingConformance(t, db) })
+	t.Run("Invites", func(t *testing.T) { testInviteConformance(t, db) })
+	t.Run("Identities", func(t *testing.T) { testIdentityConformance(t, db) })
+	t.Run("OAuthClients", func(t *testing.T) { testOAuthClientConformance(t, db) })
+	t.Run("Roles", func(t *testing.T) { testRoleConformance(t, db) })
+	t.Run("Audit", func(t *testing.T) { testAuditConformance(t, db) })
+	t.Run("SCIMTokens", func(t *testing.T) { testSCIMTokenConformance(t, db) })
+	t.Run("Deletion", func(t *testing.T) { testDeletionConformance(t, db) })
+}
+
+func testAPIKeyConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	apiKey, err := db.StoreAPIKey("bob", "laptop", "key-hash", []string{"blog"}, time.Time{})
+	if err != nil || apiKey.GetId() == "" || apiKey.GetCreationTime().IsZero() {
+		t.Fatalf("Unable to store an API key: %v %v", apiKey, err)
+	}
+	_, _ = db.StoreAPIKey("bob", "phone", "other-hash", []string{"blog", "login"}, time.Now().Add(time.Hour))
+	if _, err = db.StoreAPIKey("bob", "copy", "key-hash", nil, time.Time{}); err == nil {
+		t.Errorf("Stored two keys with the same hash")
+	}
+	if err = db.TouchAPIKey(apiKey.GetId()); err != nil {
+		t.Errorf("Unable to touch the key: %s", err.Error())
+	}
+	if found, err := db.RetrieveAPIKeyByHash("key-hash"); err != nil || found.GetId() != apiKey.GetId() ||
+		found.GetUsername() != "bob" || !slices.Equal(found.GetRights(), []string{"blog"}) ||
+		!found.GetExpirationTime().IsZero() || found.GetLastUsed().IsZero() {
+		t.Errorf("Unexpected key: %+v %v", found, err)
+	}
+	if _, err = db.RetrieveAPIKeyByHash("no-hash"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown key, got %v", err)
+	}
+	if keys, err := db.ListAPIKeys("bob"); err != nil || len(keys) != 2 || keys[0].GetName() != "laptop" ||
+		keys[1].GetExpirationTime().IsZero() {
+		t.Errorf("Unexpected keys: %v %v", keys, err)
+	}
+	if err = db.DeleteAPIKey("alice", apiKey.GetId()); err != sql.ErrNoRows {
+		t.Errorf("Deleted another user's key: %v", err)
+	}
+	if err = db.DeleteAPIKey("bob", apiKey.GetId()); err != nil {
+		t.Errorf("Unable to delete the key: %s", err.Error())
+	}
+	if _, err = db.RetrieveAPIKeyByHash("key-hash"); err != sql.ErrNoRows {
+		t.Errorf("Deleted key still found: %v", err)
+	}
+}
+
+func testSettingConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	if _, err := db.RetrieveSetting("conformance"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown setting, got %v", err)
+	}
+	_ = db.StoreSetting("conformance", "one")
+	if err := db.StoreSetting("conformance", "two"); err != nil {
+		t.Errorf("Unable to replace the setting: %s", err.Error())
+	}
+	if value, err := db.RetrieveSetting("conformance"); err != nil || value != "two" {
+		t.Errorf("Unexpected setting: %s %v", value, err)
+	}
+}
+
+func testInviteConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	invite, err := db.StoreInvite("alice", "invite-hash", []string{"blog"}, time.Time{})
+	if err != nil || invite.GetId() == "" || invite.GetUsedBy() != "" {
+		t.Fatalf("Unable to store an invite: %v %v", invite, err)
+	}
+	_, _ = db.StoreInvite("alice", "expired-hash", nil, time.Now().Add(-48*time.Hour))
+
+	// Each invite can only be claimed once, unless it is released
+	if claimed, err := db.ClaimInvite("invite-hash", "dave"); err != nil || claimed.GetUsedBy() != "dave" ||
+		!slices.Equal(claimed.GetRights(), []string{"blog"}) {
+		t.Errorf("Unable to claim the invite: %v %v", claimed, err)
+	}
+	if _, err = db.ClaimInvite("invite-hash", "erin"); err != sql.ErrNoRows {
+		t.Errorf("Claimed an invite twice: %v", err)
+	}
+	if err = db.ReleaseInvite("invite-hash"); err != nil {
+		t.Errorf("Unable to release the invite: %s", err.Error())
+	}
+	if _, err = db.ClaimInvite("invite-hash", "erin"); err != nil {
+		t.Errorf("Unable to claim a released invite: %s", err.Error())
+	}
+	if _, err = db.ClaimInvite("expired-hash", "erin"); err != sql.ErrNoRows {
+		t.Errorf("Claimed an expired invite: %v", err)
+	}
+	if err = db.ReleaseInvite("no-hash"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows releasing an unknown invite, got %v", err)
+	}
+
+	if invites, err := db.ListInvites("alice"); err != nil || len(invites) != 2 || invites[0].GetId() != invite.GetId() ||
+		invites[0].GetUsedBy() != "erin" || invites[1].GetExpirationTime().IsZero() {
+		t.Errorf("Unexpected invites: %v %v", invites, err)
+	}
+	if err = db.DeleteInvite("bob", invite.GetId()); err != sql.ErrNoRows {
+		t.Errorf("Deleted another user's invite: %v", err)
+	}
+	if err = db.DeleteInvite("alice", invite.GetId()); err != nil {
+		t.Errorf("Unable to delete the invite: %s", err.Error())
+	}
+}
+
+func testIdentityConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	if err := db.StoreExternalIdentity("google", "123", "bob"); err != nil {
+		t.Fatalf("Unable to link an identity: %s", err.Error())
+	}
+	_ = db.StoreExternalIdentity("github", "456", "bob")
+	if err := db.StoreExternalIdentity("google", "123", "alice"); err == nil {
+		t.Errorf("Linked an identity to two users")
+	}
+	if username, err := db.RetrieveExternalIdentity("google", "123"); err != nil || username != "bob" {
+		t.Errorf("Unexpected linked user: %s %v", username, err)
+	}
+	if _, err := db.RetrieveExternalIdentity("github", "123"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown identity, got %v", err)
+	}
+	if identities, err := db.ListExternalIdentities("bob"); err != nil || len(identities) != 2 ||
+		identities[0].Provider != "google" || identities[1].Subject != "456" {
+		t.Errorf("Unexpected identities: %v %v", identities, err)
+	}
+}
+
+func testOAuthClientConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	if _, err := db.StoreOAuthClient("wiki", "Wiki", []string{"https://wiki.example.com/cb"}, "secret-hash"); err != nil {
+		t.Fatalf("Unable to store a client: %s", err.Error())
+	}
+	_, _ = db.StoreOAuthClient("app", "App", []string{"https://app.example.com/a", "https://app.example.com/b"}, "")
+	if _, err := db.StoreOAuthClient("wiki", "Other", nil, ""); err == nil {
+		t.Errorf("Stored two clients with the same ID")
+	}
+	if client, err := db.RetrieveOAuthClient("app"); err != nil || client.IsConfidential() || len(client.GetRedirectURIs()) != 2 {
+		t.Errorf("Unexpected public client: %+v %v", client, err)
+	}
+	if client, err := db.RetrieveOAuthClient("wiki"); err != nil || !client.IsConfidential() || client.GetName() != "Wiki" {
+		t.Errorf("Unexpected confidential client: %+v %v", client, err)
+	}
+	if clients, err := db.ListOAuthClients(); err != nil || len(clients) != 2 || clients[0].GetClientId() != "wiki" {
+		t.Errorf("Unexpected clients: %v %v", clients, err)
+	}
+	if err := db.DeleteOAuthClient("app"); err != nil {
+		t.Errorf("Unable to delete the client: %s", err.Error())
+	}
+	if _, err := db.RetrieveOAuthClient("app"); err != sql.ErrNoRows {
+		t.Errorf("Deleted client still found: %v", err)
+	}
+	if err := db.DeleteOAuthClient("app"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows deleting an unknown client, got %v", err)
+	}
+}
+
+func testRoleConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	if err := db.StoreRole("editor", "Edits things", []string{"edit", "blog"}, []string{jutzo.DefaultUserRole}); err != nil {
+		t.Fatalf("Unable to store a role: %s", err.Error())
+	}
+	if err := db.StoreRole("broken", "", nil, []string{"no-such-role"}); err == nil {
+		t.Errorf("Stored a role inheriting from an unknown role")
+	}
+	if role, err := db.RetrieveRole("editor"); err != nil || role.GetDescription() != "Edits things" ||
+		!slices.Equal(role.GetRights(), []string{"blog", "edit"}) ||
+		!slices.Equal(role.GetInheritedRoles(), []string{jutzo.DefaultUserRole}) {
+		t.Errorf("Unexpected role: %+v %v", role, err)
+	}
+	if _, err := db.RetrieveRole("nobody"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown role, got %v", err)
+	}
+	var names []string
+	if roles, err := db.ListRoles(); err == nil {
+		for _, role := range roles {
+			names = append(names, role.GetName())
+		}
+	}
+	if !slices.Equal(names, []string{jutzo.AdministratorRole, "editor", jutzo.DefaultUserRole}) {
+		t.Errorf("Unexpected roles: %v", names)
+	}
+
+	// Role members include those holding the role through inheritance
+	carol, _ := db.RetrieveUserInformation("carol")
+	carol.RemoveRole(jutzo.DefaultUserRole)
+	carol.AssignRole("editor")
+	if err := db.UpdateUserInfo(carol); err != nil {
+		t.Fatalf("Unable to assign the role: %s", err.Error())
+	}
+	if carol, _ = db.RetrieveUserInformation("carol"); !slices.Equal(carol.GetAllRights(), []string{"blog", "edit", "login"}) {
+		t.Errorf("Unexpected rights through the role: %v", carol.GetAllRights())
+	}
+	if members, err := db.ListRoleMembers(jutzo.DefaultUserRole); err != nil || !slices.Equal(members, []string{"alice", "bob", "carol"}) {
+		t.Errorf("Unexpected members: %v %v", members, err)
+	}
+	carol.AssignRole("no-such-role")
+	if err := db.UpdateUserInfo(carol); err == nil {
+		t.Errorf("Assigned an unknown role")
+	}
+
+	// Deleting the role takes it away from its users
+	if err := db.DeleteRole("editor"); err != nil {
+		t.Errorf("Unable to delete the role: %s", err.Error())
+	}
+	if carol, _ = db.RetrieveUserInformation("carol"); len(carol.GetRoles()) != 0 || len(carol.GetAllRights()) != 0 {
+		t.Errorf("Deleted role still held: %v %v", carol.GetRoles(), carol.GetAllRights())
+	}
+	if err := db.DeleteRole("editor"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows deleting an unknown role, got %v", err)
+	}
+
+	// A role can't lose the admin right, or be deleted, when it makes the only administrator
+	_ = db.StoreRole("keeper", "", []string{"admin"}, nil)
+	carol.AssignRole("keeper")
+	alice, _ := db.RetrieveUserInformation("alice")
+	alice.RemoveRole(jutzo.AdministratorRole)
+	if err := db.UpdateUserInfo(carol); err != nil {
+		t.Fatalf("Unable to assign the role: %s", err.Error())
+	} else if err = db.UpdateUserInfo(alice); err != nil {
+		t.Fatalf("Unable to remove the role: %s", err.Error())
+	}
+	if err := db.StoreRole("keeper", "", []string{"blog"}, nil); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept redefining the role, got %v", err)
+	}
+	if err := db.DeleteRole("keeper"); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept deleting the role, got %v", err)
+	}
+	if role, err := db.RetrieveRole("keeper"); err != nil || !slices.Equal(role.GetRights(), []string{"admin"}) {
+		t.Errorf("Refused change to the role was kept: %+v %v", role, err)
+	}
+	if carol, _ = db.RetrieveUserInformation("carol"); !slices.Equal(carol.GetRoles(), []string{"keeper"}) {
+		t.Errorf("Refused deletion took the role away: %v", carol.GetRoles())
+	}
+	alice.AssignRole(jutzo.AdministratorRole)
+	if err := db.UpdateUserInfo(alice); err != nil {
+		t.Errorf("Unable to restore the role: %s", err.Error())
+	} else if err = db.DeleteRole("keeper"); err != nil {
+		t.Errorf("Unable to delete the role once there is another administrator: %s", err.Error())
+	}
+}
+
+func testAuditConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	now := time.Now().UTC().Truncate(time.Second)
+	events := []jutzo.AuditEvent{
+		{Time: now.Add(-2 * time.Minute), Type: jutzo.AuditLoginSucceeded, Actor: "alice", IP: "192.0.2.1"},
+		{Time: now.Add(-time.Minute), Type: jutzo.AuditLoginFailed, Actor: "bob", IP: "192.0.2.2"},
+		{Time: now, Type: jutzo.AuditRoleAssigned, Actor: "alice", Target: "bob", Detail: "editor"},
+	}
+	for _, event := range events {
+		if err := db.StoreAuditEvent(event); err != nil {
+			t.Fatalf("Unable to store an event: %s", err.Error())
+		}
+	}
+
+	found, err := db.ListAuditEvents(jutzo.AuditQuery{})
+	if err != nil || len(found) != 3 || found[0].Type != jutzo.AuditRoleAssigned || found[0].ID <= found[1].ID ||
+		found[0].Detail != "editor" {
+		t.Fatalf("Unexpected events: %+v %v", found, err)
+	}
+	for _, test := range []struct {
+		query    jutzo.AuditQuery
+		expected int
+	}{
+		{jutzo.AuditQuery{Actor: "alice"}, 2},
+		{jutzo.AuditQuery{User: "bob"}, 2},
+		{jutzo.AuditQuery{Target: "bob", Types: []string{jutzo.AuditRoleAssigned}}, 1},
+		{jutzo.AuditQuery{IP: "192.0.2.2"}, 1},
+		{jutzo.AuditQuery{Since: now.Add(-90 * time.Second), Until: now}, 1},
+		{jutzo.AuditQuery{Before: found[0].ID}, 2},
+		{jutzo.AuditQuery{Limit: 1}, 1},
+	} {
+		if events, err := db.ListAuditEvents(test.query); err != nil || len(events) != test.expected {
+			t.Errorf("Expected %d events for %+v, got %d %v", test.expected, test.query, len(events), err)
+		}
+	}
+
+	// Erasing a user replaces their name with a pseudonym, and forgets where
+	// they connected from; what happened, and when, is kept
+	if err := db.PseudonymizeAuditEvents("bob", "deleted-bob"); err != nil {
+		t.Fatalf("Unable to pseudonymize events: %s", err.Error())
+	}
+	if events, err := db.ListAuditEvents(jutzo.AuditQuery{User: "bob"}); err != nil || len(events) != 0 {
+		t.Errorf("Events still name the user: %+v %v", events, err)
+	}
+	pseudonymized, err := db.ListAuditEvents(jutzo.AuditQuery{User: "deleted-bob"})
+	if err != nil || len(pseudonymized) != 2 || pseudonymized[0].Target != "deleted-bob" || pseudonymized[0].Actor != "alice" ||
+		pseudonymized[0].Detail != "editor" || pseudonymized[1].Actor != "deleted-bob" || pseudonymized[1].IP != "" ||
+		!pseudonymized[1].Time.Equal(now.Add(-time.Minute)) {
+		t.Errorf("Unexpected pseudonymized events: %+v %v", pseudonymized, err)
+	}
+	if events, err := db.ListAuditEvents(jutzo.AuditQuery{IP: "192.0.2.1"}); err != nil || len(events) != 1 {
+		t.Errorf("Another user's events were changed: %+v %v", events, err)
+	}
+}
+
+// testAuditEventsImmutable checks, through a direct connection, that stored audit
+// events can't be changed or deleted other than by pseudonymizing them
+func testAuditEventsImmutable(t *testing.T, direct *sql.DB) {
+	var count int
+	if err := direct.QueryRow(`select count(*) from jutzo_audit_event`).Scan(&count); err != nil || count == 0 {
+		t.Fatalf("No audit events to change: %d %v", count, err)
+	}
+	for _, statement := range []string{
+		`update jutzo_audit_event set detail = 'changed'`,
+		`update jutzo_audit_event set actor = 'someone'`,
+		`delete from jutzo_audit_event`,
+	} {
+		if _, err := direct.Exec(statement); err == nil {
+			t.Errorf("Audit events were changed by: %s", statement)
+		}
+	}
+}
+
+func testSCIMTokenConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	token, err := db.StoreSCIMToken("alice", "okta", "scim-hash")
+	if err != nil || token.ID == "" || token.CreatedBy != "alice" || !token.LastUsed.IsZero() {
+		t.Fatalf("Unable to store a SCIM token: %+v %v", token, err)
+	}
+	if err = db.TouchSCIMToken(token.ID); err != nil {
+		t.Errorf("Unable to touch the token: %s", err.Error())
+	}
+	if found, err := db.RetrieveSCIMTokenByHash("scim-hash"); err != nil || found.ID != token.ID || found.LastUsed.IsZero() {
+		t.Errorf("Unexpected token: %+v %v", found, err)
+	}
+	if _, err = db.RetrieveSCIMTokenByHash("no-hash"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows for an unknown token, got %v", err)
+	}
+	if tokens, err := db.ListSCIMTokens(); err != nil || len(tokens) != 1 || tokens[0].Name != "okta" {
+		t.Errorf("Unexpected tokens: %v %v", tokens, err)
+	}
+	if err = db.DeleteSCIMToken(token.ID); err != nil {
+		t.Errorf("Unable to delete the token: %s", err.Error())
+	}
+	if err = db.DeleteSCIMToken(token.ID); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows deleting an unknown token, got %v", err)
+	}
+}
+
+func testDeletionConformance(t *testing.T, db jutzo.DatabaseConnection) {
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err := db.StoreDeletionRequest("bob", false, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to store a deletion request: %s", err.Error())
+	}
+	if request, err := db.StoreDeletionRequest("bob", true, now.Add(-time.Hour)); err != nil || !request.Anonymize ||
+		request.Username != "bob" {
+		t.Errorf("Unable to replace the deletion request: %+v %v", request, err)
+	}
+	_, _ = db.StoreDeletionRequest("carol", false, now.Add(24*time.Hour))
+	if request, err := db.RetrieveDeletionRequest("bob"); err != nil || !request.Anonymize {
+		t.Errorf("Unexpected deletion request: %+v %v", request, err)
+	}
+	if due, err := db.ListDueDeletions(now); err != nil || len(due) != 1 || due[0].Username != "bob" {
+		t.Errorf("Unexpected due deletions: %v %v", due, err)
+	}
+	if err := db.DeleteDeletionRequest("carol"); err != nil {
+		t.Errorf("Unable to delete the deletion request: %s", err.Error())
+	}
+	if _, err := db.RetrieveDeletionRequest("carol"); err != sql.ErrNoRows {
+		t.Errorf("Deleted request still found: %v", err)
+	}
+	if err := db.DeleteDeletionRequest("carol"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows deleting an unknown request, got %v", err)
+	}
+
+	// Anonymizing renames the user and takes away what identifies them
+	_, _ = db.StoreAPIKey("bob", "laptop", "anonymous-hash", nil, time.Time{})
+	if bob, err := db.RetrieveUserInformation("bob"); err == nil {
+		bob.SetProfile(jutzo.UserProfile{DisplayName: "Bob", Bio: "Likes bikes", AvatarURL: "https://example.com/bob.png",
+			Timezone: "Europe/Zurich", Locale: "de-CH",
+			Notifications: jutzo.NotificationPreferences{NewContent: true, Digest: jutzo.DigestWeekly}})
+		if err = db.UpdateUserInfo(bob); err != nil {
+			t.Fatalf("Unable to store the profile: %s", err.Error())
+		}
+	}
+	if err := db.AnonymizeUser("bob", "anonymous-1", "anonymous-1@invalid"); err != nil {
+		t.Fatalf("Unable to anonymize the user: %s", err.Error())
+	}
+	if _, err := db.RetrieveUserInformation("bob"); err != sql.ErrNoRows {
+		t.Errorf("Anonymized user still found by their old name: %v", err)
+	}
+	if anonymous, err := db.RetrieveUserInformation("anonymous-1"); err != nil || !anonymous.IsDisabled() ||
+		len(anonymous.GetRoles()) != 0 || len(anonymous.GetPasswordHash()) != 0 || anonymous.GetEmail() != "anonymous-1@invalid" {
+		t.Errorf("Unexpected anonymized user: %+v %v", anonymous, err)
+	}
+	if anonymous, err := db.RetrieveUserInformation("anonymous-1"); err != nil ||
+		anonymous.GetProfile() != (jutzo.UserProfile{Notifications: jutzo.DefaultNotificationPreferences}) {
+		t.Errorf("Anonymized user kept their profile: %+v %v", anonymous, err)
+	}
+	if keys, _ := db.ListAPIKeys("anonymous-1"); len(keys) != 0 {
+		t.Errorf("Anonymized user kept their keys")
+	}
+	if identities, _ := db.ListExternalIdentities("anonymous-1"); len(identities) != 0 {
+		t.Errorf("Anonymized user kept their identities")
+	}
+	if _, err := db.RetrieveDeletionRequest("anonymous-1"); err != sql.ErrNoRows {
+		t.Errorf("Anonymized user kept their deletion request")
+	}
+
+	// Deleting a user takes everything that belongs to them with it, and the
+	// invite they registered with no longer names them, but stays used
+	_, _ = db.StoreAPIKey("carol", "laptop", "deleted-hash", nil, time.Time{})
+	invite, _ := db.StoreInvite("alice", "deleted-invite", nil, time.Time{})
+	_, _ = db.ClaimInvite("deleted-invite", "carol")
+	if err := db.DeleteUser("carol"); err != nil {
+		t.Fatalf("Unable to delete the user: %s", err.Error())
+	}
+	if _, err := db.RetrieveAPIKeyByHash("deleted-hash"); err != sql.ErrNoRows {
+		t.Errorf("Deleted user's key still found: %v", err)
+	}
+	if invites, _ := db.ListInvites("alice"); len(invites) == 0 || invites[len(invites)-1].GetId() != invite.GetId() ||
+		invites[len(invites)-1].GetUsedBy() != "(deleted)" {
+		t.Errorf("Deleted user still named by their invite: %v", invites)
+	}
+	if _, err := db.ClaimInvite("deleted-invite", "dave"); err != sql.ErrNoRows {
+		t.Errorf("Expected the deleted user's invite to stay used, got %v", err)
+	}
+	if err := db.DeleteUser("carol"); err != sql.ErrNoRows {
+		t.Errorf("Expected no rows deleting an unknown user, got %v", err)
+	}
+}
+
+// testSessionCacheConformance checks a connected cache. The usernames are
+// unique to each run, so that a shared cache needn't be emptied first
+func testSessionCacheConformance(t *testing.T, cache jutzo.UserSessionCache) {
+	username := "conformance-" + uuid.NewString()
+	userInfo := impl.NewUserInfo(username, username+"@example.com", nil, true, []string{"login"}, time.Now())
+	client := jutzo.ClientInfo{IP: "192.0.2.1", UserAgent: "Firefox"}
+
+	first, err := cache.CacheUserSession(userInfo, client)
+	if err != nil || first.GetId() == "" || first.GetRefreshToken() == "" {
+		t.Fatalf("Unable to cache a session: %v %v", first, err)
+	}
+	second, _ := cache.CacheUserSession(userInfo, jutzo.ClientInfo{IP: "192.0.2.2"})
+	if found, err := cache.GetUserSessionByID(first.GetId()); err != nil || found.GetUserInfo().GetUsername() != username ||
+		found.GetClientInfo().IP != client.IP || found.GetRefreshToken() != "" || found.GetLastSeen().IsZero() {
+		t.Errorf("Unexpected session: %+v %v", found, err)
+	}
+	// A session in use isn't written on every request
+	if again, err := cache.GetUserSessionByID(first.GetId()); err != nil || again.GetLastSeen().IsZero() {
+		t.Errorf("Unable to retrieve the session again: %v", err)
+	} else if found, _ := cache.GetUserSessionByID(first.GetId()); !found.GetLastSeen().Equal(again.GetLastSeen()) {
+		t.Errorf("Last seen time updated within the touch interval: %s %s", found.GetLastSeen(), again.GetLastSeen())
+	}
+	if _, err = cache.GetUserSessionByID(uuid.NewString()); err != jutzo.ErrSessionNotFound {
+		t.Errorf("Expected an unknown session not to be found, got %v", err)
+	}
+	if sessions, err := cache.ListUserSessions(username); err != nil || len(sessions) != 2 {
+		t.Errorf("Unexpected sessions: %v %v", sessions, err)
+	}
+
+	// Changes to the user and client reach the sessions
+	if err = cache.UpdateUserSessions(username, func(userSession jutzo.UserSession) jutzo.UserInfo {
+		updated := impl.NewUserInfo(username, username+"@example.com", nil, true, []string{"login", "blog"}, time.Now())
+		return updated
+	}); err != nil {
+		t.Errorf("Unable to update the sessions: %s", err.Error())
+	}
+	if found, _ := cache.GetUserSessionByID(second.GetId()); found == nil || !found.GetUserInfo().HasRights([]string{"blog"}) {
+		t.Errorf("Session not updated")
+	}
+	moved := jutzo.ClientInfo{IP: "198.51.100.1", UserAgent: "curl"}
+	if err = cache.RebindUserSession(first.GetId(), moved); err != nil {
+		t.Errorf("Unable to rebind the session: %s", err.Error())
+	}
+	if found, _ := cache.GetUserSessionByID(first.GetId()); found == nil || found.GetClientInfo().IP != moved.IP {
+		t.Errorf("Session not rebound")
+	}
+	if err = cache.RebindUserSession(uuid.NewString(), moved); err != jutzo.ErrInvalidRefreshToken {
+		t.Errorf("Expected an unknown session not to be rebound, got %v", err)
+	}
+
+	// Refresh tokens can only be used once; using one again revokes the session
+	refreshed, err := cache.RefreshUserSession(first.GetRefreshToken())
+	if err != nil || refreshed.GetId() != first.GetId() || refreshed.GetRefreshToken() == first.GetRefreshToken() {
+		t.Fatalf("Unable to refresh the session: %v %v", refreshed, err)
+	}
+	// The session ID isn't secret, so a token that was never issued mustn't end the session
+	if _, err = cache.RefreshUserSession(first.GetId() + ".forged"); err != jutzo.ErrInvalidRefreshToken {
+		t.Errorf("Expected a forged token to be invalid, got %v", err)
+	}
+	if _, err = cache.GetUserSessionByID(first.GetId()); err != nil {
+		t.Errorf("Session revoked by a forged token: %v", err)
+	}
+	if refreshed, err = cache.RefreshUserSession(refreshed.GetRefreshToken()); err != nil {
+		t.Fatalf("Unable to refresh the session again: %v", err)
+	}
+	if _, err = cache.RefreshUserSession(first.GetRefreshToken()); err != jutzo.ErrRefreshTokenReused {
+		t.Errorf("Expected reuse to be detected, got %v", err)
+	}
+	if _, err = cache.GetUserSessionByID(first.GetId()); err != jutzo.ErrSessionNotFound {
+		t.Errorf("Session not revoked after reuse: %v", err)
+	}
+	if _, err = cache.RefreshUserSession("not-a-token"); err != jutzo.ErrInvalidRefreshToken {
+		t.Errorf("Expected an invalid token, got %v", err)
+	}
+
+	// Sessions are removed one at a time or all together
+	third, _ := cache.CacheUserSession(userInfo, client)
+	if err = cache.InvalidateUserSessions(username, third.GetId()); err != nil {
+		t.Errorf("Unable to invalidate the sessions: %s", err.Error())
+	}
+	if sessions, _ := cache.ListUserSessions(username); len(sessions) != 1 || sessions[0].GetId() != third.GetId() {
+		t.Errorf("Unexpected sessions after invalidating: %v", sessions)
+	}
+	if err = cache.InvalidateUserSession(third.GetId()); err != nil {
+		t.Errorf("Unable to invalidate the session: %s", err.Error())
+	}
+	if sessions, _ := cache.ListUserSessions(username); len(sessions) != 0 {
+		t.Errorf("Unexpected sessions after invalidating: %v", sessions)
+	}
+
+	// Transient values are only taken once, and expire
+	if err = cache.StoreTransient(username, []byte("state"), time.Minute); err != nil {
+		t.Fatalf("Unable to store a transient value: %s", err.Error())
+	}
+	if ttl, err := cache.GetTransientTimeToLive(username); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Unexpected time to live: %s %v", ttl, err)
+	}
+	if value, err := cache.TakeTransient(username); err != nil || string(value) != "state" {
+		t.Errorf("Unexpected transient value: %s %v", value, err)
+	}
+	if value, err := cache.TakeTransient(username); err != nil || value != nil {
+		t.Errorf("Transient value taken twice: %s %v", value, err)
+	}
+	if ttl, err := cache.GetTransientTimeToLive(username); err != nil || ttl != 0 {
+		t.Errorf("Expected no time to live for a missing value, got %s %v", ttl, err)
+	}
+	_ = cache.StoreTransient(username, []byte("state"), 100*time.Millisecond)
+
+	// Counters count up until deleted or they expire
+	for expected := int64(1); expected <= 2; expected++ {
+		if count, err := cache.IncrementCounter(username, time.Second); err != nil || count != expected {
+			t.Errorf("Expected count %d, got %d %v", expected, count, err)
+		}
+	}
+	if err = cache.DeleteCounter(username); err != nil {
+		t.Errorf("Unable to delete the counter: %s", err.Error())
+	}
+	_, _ = cache.IncrementCounter(username, time.Second)
+	time.Sleep(1200 * time.Millisecond)
+	if count, _ := cache.IncrementCounter(username, time.Second); count != 1 {
+		t.Errorf("Counter did not expire: %d", count)
+	}
+	if value, _ := cache.TakeTransient(username); value != nil {
+		t.Errorf("Transient value did not expire")
+	}
+	_ = cache.DeleteCounter(username)
+}
+
+// testSessionExpiryConformance checks a cache created with shortSessionTimeouts:
+// sessions last a second without being used, and three seconds however much
+// they are used
+func testSessionExpiryConformance(t *testing.T, cache jutzo.UserSessionCache) {
+	username := "conformance-" + uuid.NewString()
+	userInfo := impl.NewUserInfo(username, username+"@example.com", nil, true, []string{"login"}, time.Now())
+	idle, _ := cache.CacheUserSession(userInfo, jutzo.ClientInfo{})
+	busy, err := cache.CacheUserSession(userInfo, jutzo.ClientInfo{})
+	if err != nil {
+		t.Fatalf("Unable to cache a session: %s", err.Error())
+	}
+	use := func(userSession jutzo.UserSession) error {
+		_, err := cache.GetUserSessionByID(userSession.GetId())
+		return err
+	}
+
+	// Using a session slides its idle timeout forward
+	for i := 0; i < 2; i++ {
+		time.Sleep(600 * time.Millisecond)
+		if use(idle) != nil || use(busy) != nil {
+			t.Fatalf("Session expired while in use")
+		}
+	}
+
+	// Until it is left idle
+	for i := 0; i < 2; i++ {
+		time.Sleep(600 * time.Millisecond)
+		if err = use(busy); err != nil {
+			t.Fatalf("Session expired while in use: %s", err.Error())
+		}
+	}
+	if err = use(idle); err != jutzo.ErrSessionNotFound {
+		t.Errorf("Expected the idle session to expire, got %v", err)
+	}
+	if _, err = cache.RefreshUserSession(idle.GetRefreshToken()); err != jutzo.ErrInvalidRefreshToken {
+		t.Errorf("Expected the idle session's refresh token to expire, got %v", err)
+	}
+
+	// Or it reaches the end of its lifetime
+	time.Sleep(700 * time.Millisecond)
+	if err = use(busy); err != jutzo.ErrSessionNotFound {
+		t.Errorf("Expected the session to expire at the end of its lifetime, got %v", err)
+	}
+	if sessions, err := cache.ListUserSessions(username); err != nil || len(sessions) != 0 {
+		t.Errorf("Expired sessions still listed: %v %v", sessions, err)
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"database/sql"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slices"
 	"os"
 	"services/jutzo"
 	"services/jutzo/impl"
 	"strconv"
 	"testing"
+	"time"
 )
 
 type TestConfig struct {
@@ -49,6 +51,52 @@ func (c TestConfig) GetConfigurationInt(name string) (int, bool) {
 	return 0, false
 }
 
+// withSettings is the configuration given with the settings added to it
+func withSettings(vars map[string]string, settings map[string]string) TestConfig {
+	config := TestConfig{map[string]string{}}
+	for name, value := range vars {
+		config.vars[name] = value
+	}
+	for name, value := range settings {
+		config.vars[name] = value
+	}
+	return config
+}
+
+// newTestEngine creates an engine on the in-memory database and session cache,
+// with bob as its administrator, so that the engine itself can be tested without
+// any servers. The settings given are added to the configuration
+func newTestEngine(t *testing.T, settings map[string]string) *impl.EngineImpl {
+	config := withSettings(map[string]string{
+		"JUTZO_ADMIN_EMAIL": "bob@hablutzel.com",
+		"JUTZO_ADMIN_PASS":  "test-pass",
+		"JUTZO_ADMIN_USER":  "bob",
+		"JUTZO_HASH_COST":   "4",
+	}, settings)
+	cache, err := impl.NewMemoryCache(config)
+	if err != nil {
+		t.Fatalf("Unable to create cache: %s", err.Error())
+	}
+	engine, err := impl.NewJutzoEngine(config, impl.NewMemoryConnection(config), cache)
+	if err != nil {
+		t.Fatalf("Unable to create engine: %s", err.Error())
+	}
+	return engine.(*impl.EngineImpl)
+}
+
+// registerTestUser registers a user with a validated email, who can log in
+// with the password "test-pass"
+func registerTestUser(t *testing.T, engine *impl.EngineImpl, username string) jutzo.UserInfo {
+	if status, _, err := engine.RegisterUser(username, "test-pass", username+"@example.com"); err != nil || status != jutzo.Success {
+		t.Fatalf("Unable to register %s: %d %v", username, status, err)
+	}
+	if err := engine.GetDatabase().MarkEmailValidated(username); err != nil {
+		t.Fatalf("Unable to validate %s: %s", username, err.Error())
+	}
+	userInfo, _ := engine.GetUser(username)
+	return userInfo
+}
+
 func TestDBConnection(t *testing.T) {
 	configuration := TestConfig{NormalConfig}
 	_ = impl.NewPostgresConnection(configuration)
@@ -63,6 +111,9 @@ func TestMissingDBURL(t *testing.T) {
 }
 
 func TestUserCache(t *testing.T) {
+	if RedisURL == "" {
+		t.Skip("TestRedisURL is not set")
+	}
 	configuration := TestConfig{NormalConfig}
 	if _, err := impl.NewRedisCache(configuration); err != nil {
 		t.Errorf("Test creating cache failed: %s", err.Error())
@@ -72,8 +123,28 @@ func TestUserCache(t *testing.T) {
 
 func deleteTables(directConnect *sql.DB, t *testing.T) {
 	tablesToDelete := []string{
+		"drop view if exists jutzo_effective_permission cascade",
+		"drop table if exists jutzo_api_key cascade",
+		"drop table if exists jutzo_audit_event cascade",
+		"drop function if exists jutzo_audit_event_immutable cascade",
+		"drop function if exists jutzo_pseudonymize_audit_events cascade",
+		"drop table if exists jutzo_counter cascade",
 		"drop table if exists jutzo_database_info cascade",
+		"drop table if exists jutzo_deletion_request cascade",
+		"drop table if exists jutzo_external_identity cascade",
+		"drop table if exists jutzo_invite cascade",
+		"drop table if exists jutzo_oauth_client cascade",
 		"drop table if exists jutzo_pending_validation cascade",
+		"drop table if exists jutzo_permission cascade",
+		"drop table if exists jutzo_role cascade",
+		"drop table if exists jutzo_role_inheritance cascade",
+		"drop table if exists jutzo_role_permission cascade",
+		"drop table if exists jutzo_scim_token cascade",
+		"drop table if exists jutzo_session cascade",
+		"drop table if exists jutzo_setting cascade",
+		"drop table if exists jutzo_transient cascade",
+		"drop table if exists jutzo_user_permission cascade",
+		"drop table if exists jutzo_user_role cascade",
 		"drop table if exists jutzo_registered_user cascade "}
 	for _, statement := range tablesToDelete {
 		if _, err := directConnect.Exec(statement); err != nil {
@@ -99,6 +170,9 @@ func connectAndWipe(t *testing.T) *sql.DB {
 }
 
 func TestConnectingToEmptyDB(t *testing.T) {
+	if PostgresURL == "" {
+		t.Skip("TestPostgresURL is not set")
+	}
 	configuration := TestConfig{NormalConfig}
 
 	// Directly connect to the remote server; blow away
@@ -129,15 +203,96 @@ func TestConnectingToEmptyDB(t *testing.T) {
 
 		// Define the expected results
 		expectedResults := []map[string]string{
+			{"table_name": "jutzo_api_key", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_api_key", "column_name": "expiration_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_api_key", "column_name": "key_hash", "data_type": "character varying"},
+			{"table_name": "jutzo_api_key", "column_name": "last_used", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_api_key", "column_name": "name", "data_type": "character varying"},
+			{"table_name": "jutzo_api_key", "column_name": "rights", "data_type": "text"},
+			{"table_name": "jutzo_api_key", "column_name": "unique_id", "data_type": "uuid"},
+			{"table_name": "jutzo_api_key", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_audit_event", "column_name": "actor", "data_type": "character varying"},
+			{"table_name": "jutzo_audit_event", "column_name": "detail", "data_type": "text"},
+			{"table_name": "jutzo_audit_event", "column_name": "event_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_audit_event", "column_name": "event_type", "data_type": "character varying"},
+			{"table_name": "jutzo_audit_event", "column_name": "id", "data_type": "bigint"},
+			{"table_name": "jutzo_audit_event", "column_name": "ip", "data_type": "character varying"},
+			{"table_name": "jutzo_audit_event", "column_name": "target", "data_type": "character varying"},
+			{"table_name": "jutzo_audit_event", "column_name": "user_agent", "data_type": "text"},
+			{"table_name": "jutzo_counter", "column_name": "count", "data_type": "bigint"},
+			{"table_name": "jutzo_counter", "column_name": "expiration", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_counter", "column_name": "key", "data_type": "character varying"},
 			{"table_name": "jutzo_database_info", "column_name": "schema_ordinal", "data_type": "integer"},
+			{"table_name": "jutzo_deletion_request", "column_name": "anonymize", "data_type": "boolean"},
+			{"table_name": "jutzo_deletion_request", "column_name": "due_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_deletion_request", "column_name": "request_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_deletion_request", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_effective_permission", "column_name": "permission", "data_type": "character varying"},
+			{"table_name": "jutzo_effective_permission", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_external_identity", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_external_identity", "column_name": "provider", "data_type": "character varying"},
+			{"table_name": "jutzo_external_identity", "column_name": "subject", "data_type": "character varying"},
+			{"table_name": "jutzo_external_identity", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_invite", "column_name": "code_hash", "data_type": "character varying"},
+			{"table_name": "jutzo_invite", "column_name": "created_by", "data_type": "character varying"},
+			{"table_name": "jutzo_invite", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_invite", "column_name": "expiration_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_invite", "column_name": "rights", "data_type": "text"},
+			{"table_name": "jutzo_invite", "column_name": "unique_id", "data_type": "uuid"},
+			{"table_name": "jutzo_invite", "column_name": "used_by", "data_type": "character varying"},
+			{"table_name": "jutzo_invite", "column_name": "used_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_oauth_client", "column_name": "client_id", "data_type": "character varying"},
+			{"table_name": "jutzo_oauth_client", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_oauth_client", "column_name": "name", "data_type": "character varying"},
+			{"table_name": "jutzo_oauth_client", "column_name": "redirect_uris", "data_type": "text"},
+			{"table_name": "jutzo_oauth_client", "column_name": "secret_hash", "data_type": "character varying"},
 			{"table_name": "jutzo_pending_validation", "column_name": "unique_id", "data_type": "uuid"},
 			{"table_name": "jutzo_pending_validation", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_permission", "column_name": "description", "data_type": "text"},
+			{"table_name": "jutzo_permission", "column_name": "name", "data_type": "character varying"},
+			{"table_name": "jutzo_registered_user", "column_name": "auth_source", "data_type": "character varying"},
+			{"table_name": "jutzo_registered_user", "column_name": "avatar_url", "data_type": "character varying"},
+			{"table_name": "jutzo_registered_user", "column_name": "bio", "data_type": "text"},
 			{"table_name": "jutzo_registered_user", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_registered_user", "column_name": "disabled", "data_type": "boolean"},
+			{"table_name": "jutzo_registered_user", "column_name": "display_name", "data_type": "character varying"},
 			{"table_name": "jutzo_registered_user", "column_name": "email", "data_type": "character varying"},
+			{"table_name": "jutzo_registered_user", "column_name": "email_key", "data_type": "character varying"},
 			{"table_name": "jutzo_registered_user", "column_name": "email_validated", "data_type": "boolean"},
+			{"table_name": "jutzo_registered_user", "column_name": "locale", "data_type": "character varying"},
+			{"table_name": "jutzo_registered_user", "column_name": "notifications", "data_type": "jsonb"},
 			{"table_name": "jutzo_registered_user", "column_name": "password_hash", "data_type": "bytea"},
-			{"table_name": "jutzo_registered_user", "column_name": "rights", "data_type": "text"},
+			{"table_name": "jutzo_registered_user", "column_name": "timezone", "data_type": "character varying"},
 			{"table_name": "jutzo_registered_user", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_registered_user", "column_name": "username_key", "data_type": "character varying"},
+			{"table_name": "jutzo_role", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_role", "column_name": "description", "data_type": "text"},
+			{"table_name": "jutzo_role", "column_name": "name", "data_type": "character varying"},
+			{"table_name": "jutzo_role_inheritance", "column_name": "parent_role", "data_type": "character varying"},
+			{"table_name": "jutzo_role_inheritance", "column_name": "role", "data_type": "character varying"},
+			{"table_name": "jutzo_role_permission", "column_name": "permission", "data_type": "character varying"},
+			{"table_name": "jutzo_role_permission", "column_name": "role", "data_type": "character varying"},
+			{"table_name": "jutzo_scim_token", "column_name": "created_by", "data_type": "character varying"},
+			{"table_name": "jutzo_scim_token", "column_name": "creation_time", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_scim_token", "column_name": "last_used", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_scim_token", "column_name": "name", "data_type": "character varying"},
+			{"table_name": "jutzo_scim_token", "column_name": "token_hash", "data_type": "character varying"},
+			{"table_name": "jutzo_scim_token", "column_name": "unique_id", "data_type": "uuid"},
+			{"table_name": "jutzo_session", "column_name": "expiration", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_session", "column_name": "id", "data_type": "character varying"},
+			{"table_name": "jutzo_session", "column_name": "last_seen", "data_type": "bigint"},
+			{"table_name": "jutzo_session", "column_name": "lifetime_end", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_session", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_session", "column_name": "value", "data_type": "bytea"},
+			{"table_name": "jutzo_setting", "column_name": "name", "data_type": "character varying"},
+			{"table_name": "jutzo_setting", "column_name": "value", "data_type": "text"},
+			{"table_name": "jutzo_transient", "column_name": "expiration", "data_type": "timestamp without time zone"},
+			{"table_name": "jutzo_transient", "column_name": "key", "data_type": "character varying"},
+			{"table_name": "jutzo_transient", "column_name": "value", "data_type": "bytea"},
+			{"table_name": "jutzo_user_permission", "column_name": "permission", "data_type": "character varying"},
+			{"table_name": "jutzo_user_permission", "column_name": "username", "data_type": "character varying"},
+			{"table_name": "jutzo_user_role", "column_name": "role", "data_type": "character varying"},
+			{"table_name": "jutzo_user_role", "column_name": "username", "data_type": "character varying"},
 		}
 
 		//  Loop through the actual results
@@ -180,6 +335,9 @@ func TestConnectingToEmptyDB(t *testing.T) {
 }
 
 func TestConnectingToNewEngineWithoutAdminConfig(t *testing.T) {
+	if PostgresURL == "" || RedisURL == "" {
+		t.Skip("TestPostgresURL and TestRedisURL are not set")
+	}
 
 	// Create an incomplete configuration. This doesn't have the
 	// admin config required
@@ -210,6 +368,9 @@ func TestConnectingToNewEngineWithoutAdminConfig(t *testing.T) {
 }
 
 func TestConnectingToNewEngine(t *testing.T) {
+	if PostgresURL == "" || RedisURL == "" {
+		t.Skip("TestPostgresURL and TestRedisURL are not set")
+	}
 	configuration := TestConfig{NormalConfig}
 
 	// Directly connect to the remote server; blow away
@@ -248,6 +409,48 @@ func TestConnectingToNewEngine(t *testing.T) {
 	}
 }
 
+func TestNewEngineOnMemoryBackends(t *testing.T) {
+
+	// Without an administrator, or the configuration to create one, there's no engine
+	config := TestConfig{map[string]string{}}
+	cache, _ := impl.NewMemoryCache(config)
+	if _, err := impl.NewJutzoEngine(config, impl.NewMemoryConnection(config), cache); err == nil {
+		t.Errorf("The engine didn't report the problem creating the admin")
+	}
+
+	// Otherwise the administrator is created, and can log in straight away
+	engine := newTestEngine(t, nil)
+	if count, err := engine.GetDatabase().GetAdminCount(); err != nil || count != 1 {
+		t.Errorf("Admin was not properly created: %d %v", count, err)
+	}
+	if _, err := engine.Login("bob", "test-pass", jutzo.ClientInfo{IP: "192.0.2.1"}); err != nil {
+		t.Errorf("Admin could not log in: %s", err.Error())
+	}
+
+	// New users log in once they have validated their email
+	status, userInfo, err := engine.RegisterUser("test", "test-pass", "test@test.com")
+	if err != nil || status != jutzo.Success || !slices.Equal(userInfo.GetAllRights(), []string{"blog", "login"}) ||
+		userInfo.IsEmailValidated() {
+		t.Fatalf("Unexpected registration: %d %+v %v", status, userInfo, err)
+	}
+	if _, err = engine.Login("test", "test-pass", jutzo.ClientInfo{}); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Unvalidated user logged in: %v", err)
+	}
+	uniqueID, email, err := engine.CreateUniqueValidationForUser("test")
+	if err != nil || email != "test@test.com" {
+		t.Fatalf("Unable to create a validation: %s %v", email, err)
+	}
+	if user, err := engine.ValidateEmail(uniqueID); err != nil || user != "test" {
+		t.Errorf("Unable to validate the email: %s %v", user, err)
+	}
+	if _, err = engine.Login("test", "test-pass", jutzo.ClientInfo{}); err != nil {
+		t.Errorf("Validated user could not log in: %v", err)
+	}
+	if status, _, _ = engine.RegisterUser("TEST", "test-pass", "other@test.com"); status != jutzo.DuplicateUsername {
+		t.Errorf("Expected a duplicate username, got %d", status)
+	}
+}
+
 func testValidateEmailFor(t *testing.T, db *sql.DB, engine jutzo.Engine, info jutzo.UserInfo) {
 
 	// Te user should exist, so attempt to get the validation link
@@ -278,7 +481,7 @@ func testValidateEmailFor(t *testing.T, db *sql.DB, engine jutzo.Engine, info ju
 			}
 
 			// Now validate the user
-			if err = engine.ValidateEmail(validationString); err != nil {
+			if _, err = engine.ValidateEmail(validationString); err != nil {
 				t.Errorf("Could not validate user %s, uniqueID = %s", info.GetUsername(), validationString)
 			} else {
 
@@ -319,9 +522,13 @@ func testRegisterUser(t *testing.T, db *sql.DB, engine jutzo.Engine, username st
 				return nil
 			}
 
-			// Direct validation
-			statement := `select username, email, password_hash, rights, email_validated
-                            from jutzo_registered_user 
+			// Direct validation. New users get their rights through the default role
+			statement := `select username, email, password_hash,
+                                 (select string_agg(permission, ',' order by permission)
+                                    from jutzo_effective_permission e
+                                   where e.username = u.username),
+                                 email_validated
+                            from jutzo_registered_user u
                            where username = $1`
 			row := db.QueryRow(statement, username)
 			var dbUsername, dbEmail, rights string
@@ -336,7 +543,7 @@ func testRegisterUser(t *testing.T, db *sql.DB, engine jutzo.Engine, username st
 				if email != dbEmail {
 					t.Errorf("Email does not match")
 				}
-				if rights != "blog,login" {
+				if rights != "blog,login" || !slices.Equal(userInfo.GetRoles(), []string{jutzo.DefaultUserRole}) {
 					t.Errorf("Rights is not what we expected")
 				}
 				if err = bcrypt.CompareHashAndPassword(userInfo.GetPasswordHash(), []byte(password)); err != nil {
@@ -352,3 +559,35 @@ func testRegisterUser(t *testing.T, db *sql.DB, engine jutzo.Engine, username st
 	}
 
 }
+
+func TestSessionTimeouts(t *testing.T) {
+
+	// With no configuration we should get the defaults
+	timeouts := impl.NewSessionTimeouts(TestConfig{map[string]string{}})
+	if timeouts.AccessDuration != impl.DefaultAccessTokenMinutes*time.Minute ||
+		timeouts.RefreshDuration != impl.DefaultRefreshTokenHours*time.Hour ||
+		timeouts.IdleTimeout != impl.DefaultIdleMinutes*time.Minute {
+		t.Errorf("Unexpected default timeouts: %v", timeouts)
+	}
+
+	// Configured values override the defaults; invalid ones are ignored
+	timeouts = impl.NewSessionTimeouts(TestConfig{map[string]string{
+		"JUTZO_ACCESS_TOKEN_MINUTES": "5",
+		"JUTZO_REFRESH_TOKEN_HOURS":  "24",
+		"JUTZO_SESSION_IDLE_MINUTES": "-1",
+	}})
+	if timeouts.AccessDuration != 5*time.Minute ||
+		timeouts.RefreshDuration != 24*time.Hour ||
+		timeouts.IdleTimeout != impl.DefaultIdleMinutes*time.Minute {
+		t.Errorf("Unexpected configured timeouts: %v", timeouts)
+	}
+
+	// Durations can be given more finely
+	timeouts = impl.NewSessionTimeouts(TestConfig{map[string]string{
+		"JUTZO_ACCESS_TOKEN_MINUTES": "90s",
+		"JUTZO_SESSION_IDLE_MINUTES": "soon",
+	}})
+	if timeouts.AccessDuration != 90*time.Second || timeouts.IdleTimeout != impl.DefaultIdleMinutes*time.Minute {
+		t.Errorf("Unexpected durations: %v", timeouts)
+	}
+}
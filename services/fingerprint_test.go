@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+)
+
+func TestSessionFingerprintPolicy(t *testing.T) {
+	created := jutzo.ClientInfo{IP: "192.0.2.1", UserAgent: "Firefox"}
+	check := func(config map[string]string, client jutzo.ClientInfo) error {
+		policy, err := impl.NewFingerprintPolicy(TestConfig{config})
+		if err != nil {
+			t.Fatalf("Unable to create policy: %s", err.Error())
+		}
+		userSession := testSession("interactive").(*impl.UserSessionImpl)
+		userSession.Client = created
+		return policy.Check(userSession, client)
+	}
+	reject := map[string]string{"JUTZO_SESSION_FINGERPRINT_POLICY": "reject"}
+
+	// Addresses can move within their network, but not the user agent
+	if err := check(reject, jutzo.ClientInfo{IP: "192.0.2.200", UserAgent: "Firefox"}); err != nil {
+		t.Errorf("Same network was refused: %v", err)
+	}
+	if err := check(reject, jutzo.ClientInfo{IP: "198.51.100.1", UserAgent: "Firefox"}); err != jutzo.ErrSessionClientChanged {
+		t.Errorf("Expected a new network to be refused, got %v", err)
+	}
+	if err := check(reject, jutzo.ClientInfo{IP: "192.0.2.1", UserAgent: "curl"}); err != jutzo.ErrSessionClientChanged {
+		t.Errorf("Expected a new user agent to be refused, got %v", err)
+	}
+
+	// Only the configured fields count, and only the reject and step up policies refuse requests
+	if err := check(map[string]string{"JUTZO_SESSION_FINGERPRINT_POLICY": "reject", "JUTZO_SESSION_FINGERPRINT": "ip"},
+		jutzo.ClientInfo{IP: "192.0.2.1", UserAgent: "curl"}); err != nil {
+		t.Errorf("User agent was checked: %v", err)
+	}
+	if err := check(map[string]string{}, jutzo.ClientInfo{IP: "198.51.100.1", UserAgent: "curl"}); err != nil {
+		t.Errorf("The default policy refused the request: %v", err)
+	}
+	if _, err := impl.NewFingerprintPolicy(TestConfig{map[string]string{"JUTZO_SESSION_FINGERPRINT_POLICY": "panic"}}); err == nil {
+		t.Errorf("Unknown policy was accepted")
+	}
+}
+
+func TestSessionStepUp(t *testing.T) {
+	engine := newTestEngine(t, map[string]string{"JUTZO_SESSION_FINGERPRINT_POLICY": "stepup"})
+	session, err := engine.Login("bob", "test-pass", jutzo.ClientInfo{IP: "192.0.2.1", UserAgent: "Firefox"})
+	if err != nil {
+		t.Fatalf("Unable to log in: %s", err.Error())
+	}
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	authenticated := router.Group("/v1", requireValidJWTToken(engine, tokenEngine))
+	authenticated.GET("/user/sessions", func(c *gin.Context) { c.String(http.StatusOK, "OK") })
+	authenticated.POST("/user/session/confirm", func(c *gin.Context) { handleConfirmSession(c, engine) })
+	send := func(method string, path string, body string, address string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.RemoteAddr = address + ":4321"
+		request.Header.Set("User-Agent", "Firefox")
+		request.Header.Set("Authorization", bearer(t, tokenEngine, session))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if recorder := send(http.MethodGet, "/v1/user/sessions", "", "192.0.2.1"); recorder.Code != http.StatusOK {
+		t.Errorf("Session refused from its own client: %d", recorder.Code)
+	}
+
+	// From elsewhere the session has to be confirmed before it can be used again
+	recorder := send(http.MethodGet, "/v1/user/sessions", "", "198.51.100.1")
+	if recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Body.String(), "step_up_required") {
+		t.Errorf("Expected step up, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder = send(http.MethodPost, SessionConfirmPath, `{"pass": "guess"}`, "198.51.100.1"); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong password confirmed the session: %d", recorder.Code)
+	}
+	if recorder = send(http.MethodPost, SessionConfirmPath, `{"pass": "test-pass"}`, "198.51.100.1"); recorder.Code != http.StatusOK {
+		t.Errorf("Confirmation failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder = send(http.MethodGet, "/v1/user/sessions", "", "198.51.100.1"); recorder.Code != http.StatusOK {
+		t.Errorf("Confirmed session was refused: %d", recorder.Code)
+	}
+	if confirmed, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditSessionConfirmed}}); len(confirmed) != 1 ||
+		confirmed[0].Target != "bob" || confirmed[0].IP != "198.51.100.1" {
+		t.Errorf("Expected the confirmation to be audited: %+v", confirmed)
+	}
+}
+
+func TestSessionFingerprintBehindCloudflare(t *testing.T) {
+	engine := newTestEngine(t, map[string]string{"JUTZO_SESSION_FINGERPRINT_POLICY": "reject"})
+	session, err := engine.Login("bob", "test-pass", jutzo.ClientInfo{IP: "203.0.113.1", UserAgent: "Firefox"})
+	if err != nil {
+		t.Fatalf("Unable to log in: %s", err.Error())
+	}
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if err = configureClientIP(router, withSettings(map[string]string{"JUTZO_TRUSTED_PLATFORM": "cloudflare"}, nil)); err != nil {
+		t.Fatalf("Unable to configure the client IP: %s", err.Error())
+	}
+	authenticated := router.Group("/v1", requireValidJWTToken(engine, tokenEngine))
+	authenticated.GET("/user/sessions", func(c *gin.Context) { c.String(http.StatusOK, "OK") })
+	send := func(edge string, clientIP string) int {
+		request := httptest.NewRequest(http.MethodGet, "/v1/user/sessions", nil)
+		request.RemoteAddr = edge + ":4321"
+		request.Header.Set("CF-Connecting-IP", clientIP)
+		request.Header.Set("User-Agent", "Firefox")
+		request.Header.Set("Authorization", bearer(t, tokenEngine, session))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// The session is checked against the client Cloudflare reports, whichever edge the request comes through
+	if code := send("172.64.0.1", "203.0.113.1"); code != http.StatusOK {
+		t.Errorf("Session refused from its own client: %d", code)
+	}
+	if code := send("104.16.0.1", "203.0.113.1"); code != http.StatusOK {
+		t.Errorf("Session refused through another edge: %d", code)
+	}
+	if code := send("172.64.0.1", "198.51.100.1"); code != http.StatusUnauthorized {
+		t.Errorf("Expected another client to be refused, got %d", code)
+	}
+}
+
+func TestSessionsAreConfirmedByTheirOwnAuthSource(t *testing.T) {
+	engine := directoryTestEngine(t, "carol", "dave")
+	client := jutzo.ClientInfo{IP: "192.0.2.1", UserAgent: "Firefox"}
+	elsewhere := jutzo.ClientInfo{IP: "198.51.100.1", UserAgent: "Firefox"}
+
+	// A directory user confirms with the directory's password, a local user with their own
+	carol, err := engine.Login("carol", "directory-pass", client)
+	if err != nil {
+		t.Fatalf("Unable to log in as a directory user: %s", err.Error())
+	}
+	if _, err = engine.ConfirmSession(carol.GetId(), "directory-pass", elsewhere); err != nil {
+		t.Errorf("Unable to confirm a directory user's session: %s", err.Error())
+	}
+	bob, _ := engine.Login("bob", "test-pass", client)
+	if _, err = engine.ConfirmSession(bob.GetId(), "test-pass", elsewhere); err != nil {
+		t.Errorf("Unable to confirm a local user's session: %s", err.Error())
+	}
+
+	// A user from an identity provider has no password, even one the directory
+	// would accept for the same name
+	dave, err := engine.LoginExternalIdentity(jutzo.ExternalIdentity{Provider: "idp", Subject: "dave-subject",
+		Email: "dave@example.com", EmailVerified: true, PreferredUsername: "dave"}, client)
+	if err != nil {
+		t.Fatalf("Unable to log in with an external identity: %s", err.Error())
+	}
+	if _, err = engine.ConfirmSession(dave.GetId(), "directory-pass", elsewhere); err != jutzo.ErrNoLocalPassword {
+		t.Errorf("Expected the external user's session not to be confirmed, got %v", err)
+	}
+	if session, _ := engine.LoadUserSession(dave.GetId()); session == nil || session.GetClientInfo().IP != client.IP {
+		t.Errorf("External user's session was rebound: %+v", session)
+	}
+}
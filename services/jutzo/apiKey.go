@@ -0,0 +1,46 @@
+package jutzo
+
+import (
+	"errors"
+	"time"
+)
+
+// APIKeyPrefix starts every API key we issue, so that they can be told
+// apart from JWT access tokens when presented as a bearer token
+const APIKeyPrefix = "jutzo_"
+
+// ErrInvalidAPIKey is returned when an API key is unknown, expired, or
+// belongs to a user that can no longer log in
+var ErrInvalidAPIKey = errors.New("invalid or expired API key")
+
+// ErrRightNotHeld is returned when an API key is requested with
+// a right that the owner doesn't have
+var ErrRightNotHeld = errors.New("an API key cannot have rights the owner does not hold")
+
+// APIKey describes a long-lived key that a user has created so that
+// scripts can call the API on their behalf. Only a hash of the key
+// itself is stored
+type APIKey interface {
+
+	// GetId of the key, used to list and revoke it
+	GetId() string
+
+	// GetUsername of the user that owns the key
+	GetUsername() string
+
+	// GetName the user gave the key
+	GetName() string
+
+	// GetRights the key is restricted to. These are always a subset
+	// of the rights of the owner
+	GetRights() []string
+
+	// GetCreationTime of the key
+	GetCreationTime() time.Time
+
+	// GetExpirationTime of the key; the zero time if it never expires
+	GetExpirationTime() time.Time
+
+	// GetLastUsed time of the key; the zero time if it has never been used
+	GetLastUsed() time.Time
+}
@@ -0,0 +1,68 @@
+package jutzo
+
+import (
+	"time"
+)
+
+// The types of event recorded in the audit log
+const (
+	AuditLoginSucceeded       = "login.succeeded"
+	AuditLoginFailed          = "login.failed"
+	AuditLogoff               = "logoff"
+	AuditSessionClientChanged = "session.client_changed"
+	AuditSessionConfirmed     = "session.confirmed"
+	AuditUserRegistered       = "user.registered"
+	AuditEmailValidated       = "email.validated"
+	AuditRightGranted         = "right.granted"
+	AuditRightRevoked         = "right.revoked"
+	AuditRoleDefined          = "role.defined"
+	AuditRoleDeleted          = "role.deleted"
+	AuditRoleAssigned         = "role.assigned"
+	AuditRoleUnassigned       = "role.unassigned"
+	AuditLoginEnabled         = "login.enabled"
+	AuditLoginDisabled        = "login.disabled"
+	AuditUserUnlocked         = "user.unlocked"
+	AuditUserDeleted          = "user.deleted"
+	AuditUserAnonymized       = "user.anonymized"
+	AuditPasswordChanged      = "password.changed"
+	AuditPasswordResetIssued  = "password.reset_issued"
+	AuditPasswordReset        = "password.reset"
+	AuditDeletionRequested    = "deletion.requested"
+	AuditDeletionCancelled    = "deletion.cancelled"
+	AuditSettingsChanged      = "settings.changed"
+	AuditProfileUpdated       = "profile.updated"
+	AuditEmailChanged         = "email.changed"
+	AuditSCIMTokenIssued      = "scim_token.issued"
+	AuditSCIMTokenRevoked     = "scim_token.revoked"
+)
+
+// AuditEvent records who did what to whom, from where. The actor is empty
+// for events that no logged-in user caused (e.g. a failed login, or an account
+// deletion coming due), and the target is whatever the event was done to
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Detail    string    `json:"detail"`
+}
+
+// AuditQuery selects audit events. Empty fields don't restrict the events
+// selected. Events are returned newest first; to page through them, pass the
+// ID of the last event returned as Before
+type AuditQuery struct {
+	Types  []string
+	Actor  string
+	Target string
+
+	// User selects the events where the user is either the actor or the target
+	User   string
+	IP     string
+	Since  time.Time
+	Until  time.Time
+	Before int64
+	Limit  int
+}
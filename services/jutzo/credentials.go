@@ -0,0 +1,38 @@
+package jutzo
+
+import (
+	"errors"
+)
+
+// Errors returned by a CredentialVerifier
+var (
+	ErrUnknownDirectoryUser = errors.New("user is not in the directory")
+	ErrInvalidCredentials   = errors.New("invalid username or password")
+)
+
+// DirectoryUser is a user whose credentials have been verified
+// by an external directory (e.g. LDAP)
+type DirectoryUser struct {
+
+	// Username the user logged in with
+	Username string
+
+	// Email of the user, as recorded in the directory
+	Email string
+
+	// Rights the directory grants the user, out of the ManagedRights
+	// it is responsible for. Rights outside ManagedRights are left
+	// as they are on the local user
+	Rights        []string
+	ManagedRights []string
+}
+
+// CredentialVerifier checks a user's password against an external
+// directory, as an alternative to the password hash of a local account
+type CredentialVerifier interface {
+
+	// VerifyCredentials of the user. Returns ErrUnknownDirectoryUser if
+	// the directory doesn't know the user, or ErrInvalidCredentials if
+	// the password is wrong
+	VerifyCredentials(user string, password string) (*DirectoryUser, error)
+}
@@ -2,6 +2,7 @@ package jutzo
 
 import (
 	_ "github.com/lib/pq"
+	"time"
 )
 
 type DatabaseConnection interface {
@@ -20,17 +21,29 @@ type DatabaseConnection interface {
 	// same username or email twice
 	CheckForUsernameOrEmail(username string, email string) (userExists bool, emailExists bool, err error)
 
-	// StoreUser in the database with the given username, email and password hash
-	StoreUser(username string, email string, passwordHash []byte) (UserInfo, error)
+	// StoreUser in the database with the given username, email and password hash,
+	// and the source the user authenticates with (e.g. AuthSourceLocal)
+	StoreUser(username string, email string, passwordHash []byte, authSource string) (UserInfo, error)
 
-	// UpdateUserInfo that has changed with what is stored in the database
+	// UpdateUserInfo that has changed with what is stored in the database.
+	// Returns ErrEmailInUse if another user has the email, or ErrLastAdmin,
+	// changing nothing, if this would leave no enabled administrator
 	UpdateUserInfo(userInfo UserInfo) error
 
 	// RetrieveUserInformation for the specified username so that the user credentials can
 	// be validated
 	RetrieveUserInformation(username string) (userInfo UserInfo, err error)
 
-	// GetAdminCount returns the number of administrator users
+	// UpdatePasswordHash stored for the user, e.g. after rehashing their
+	// password with stronger settings
+	UpdatePasswordHash(username string, passwordHash []byte) error
+
+	// DeleteUser and everything that belongs to them (API keys, linked identities,
+	// rights and roles). Returns sql.ErrNoRows if there is no such user, or
+	// ErrLastAdmin if they are the last enabled administrator
+	DeleteUser(username string) error
+
+	// GetAdminCount returns the number of administrator users whose login is enabled
 	GetAdminCount() (int, error)
 
 	// CreateValidationFor the user specified, so that the user can
@@ -40,13 +53,158 @@ type DatabaseConnection interface {
 	CreateValidationFor(username string) (uniqueID string, email string, err error)
 
 	// CompleteValidationFor the uniqueID created with the
-	// CreateValidationFor method
-	CompleteValidationFor(uniqueID string) error
-
-	// ListUsers in the database, starting with the specified user, until maxUsers are returned.
-	// If the starting user is specified as "", then the list will start at the beginning of the
-	// users in the database; otherwise it can be used for pagination through the set of users.
-	// The first user returned will be the first user AFTER the one specified, so duplicate records
-	// will not occur. If no more users can be found, a nil slice will be returned with no error
-	ListUsers(startingAt string, maxUsers int) ([]UserInfo, error)
+	// CreateValidationFor method, returning the username of the user
+	// validated. Returns sql.ErrNoRows if there is no such validation
+	CompleteValidationFor(uniqueID string) (username string, err error)
+
+	// ListUsers selected by the query, in the order it asks for, along with the total
+	// number selected. The users returned have no password hash. A limit of zero
+	// returns all the remaining users. Returns ErrInvalidUserQuery if the
+	// cursor or sort isn't valid
+	ListUsers(query UserQuery) (UserPage, error)
+
+	// CountKeyCollisions returns the number of users whose username or email
+	// collided with another user's when the keys they are compared by were added
+	CountKeyCollisions() (KeyCollisions, error)
+
+	// StoreAPIKey for the given user. Only the hash of the key is stored; the
+	// expiration time may be the zero time for a key that never expires
+	StoreAPIKey(username string, name string, keyHash string, rights []string, expirationTime time.Time) (APIKey, error)
+
+	// RetrieveAPIKeyByHash finds the API key with the given hash, returning
+	// sql.ErrNoRows if there is no such key
+	RetrieveAPIKeyByHash(keyHash string) (APIKey, error)
+
+	// ListAPIKeys that belong to the given user, oldest first
+	ListAPIKeys(username string) ([]APIKey, error)
+
+	// DeleteAPIKey belonging to the given user. Returns sql.ErrNoRows if the
+	// user has no key with that ID
+	DeleteAPIKey(username string, uniqueID string) error
+
+	// TouchAPIKey records that the key has just been used
+	TouchAPIKey(uniqueID string) error
+
+	// RetrieveSetting with the given name, returning sql.ErrNoRows if it hasn't been set
+	RetrieveSetting(name string) (string, error)
+
+	// StoreSetting with the given name, replacing any value it already has
+	StoreSetting(name string, value string) error
+
+	// StoreInvite created by the given user. Only the hash of the code is stored;
+	// the expiration time may be the zero time for an invite that never expires
+	StoreInvite(createdBy string, codeHash string, rights []string, expirationTime time.Time) (Invite, error)
+
+	// ClaimInvite with the given hash for the user registering with it. Returns
+	// sql.ErrNoRows if there's no such invite, or it has been used or has expired
+	ClaimInvite(codeHash string, username string) (Invite, error)
+
+	// ReleaseInvite that was claimed, so that it can be used again
+	ReleaseInvite(codeHash string) error
+
+	// ListInvites created by the given user, oldest first
+	ListInvites(createdBy string) ([]Invite, error)
+
+	// DeleteInvite created by the given user. Returns sql.ErrNoRows if the
+	// user has no invite with that ID
+	DeleteInvite(createdBy string, uniqueID string) error
+
+	// RetrieveUserByEmail finds the user registered with the given email,
+	// returning sql.ErrNoRows if there is no such user
+	RetrieveUserByEmail(email string) (UserInfo, error)
+
+	// MarkEmailValidated for the user without going through the validation
+	// process (e.g. because an identity provider has verified it)
+	MarkEmailValidated(username string) error
+
+	// StoreExternalIdentity links the identity the provider knows by subject
+	// to the given local user
+	StoreExternalIdentity(provider string, subject string, username string) error
+
+	// RetrieveExternalIdentity returns the username of the local user linked
+	// to the provider's subject, or sql.ErrNoRows if it isn't linked
+	RetrieveExternalIdentity(provider string, subject string) (string, error)
+
+	// ListExternalIdentities linked to the given user, oldest first
+	ListExternalIdentities(username string) ([]LinkedIdentity, error)
+
+	// StoreDeletionRequest for the given user, replacing any request they have already made
+	StoreDeletionRequest(username string, anonymize bool, dueTime time.Time) (DeletionRequest, error)
+
+	// RetrieveDeletionRequest for the given user, or sql.ErrNoRows if they haven't made one
+	RetrieveDeletionRequest(username string) (DeletionRequest, error)
+
+	// DeleteDeletionRequest for the given user, returning sql.ErrNoRows if they haven't made one
+	DeleteDeletionRequest(username string) error
+
+	// ListDueDeletions returns the deletion requests that are due at the time given
+	ListDueDeletions(dueBy time.Time) ([]DeletionRequest, error)
+
+	// AnonymizeUser renames the user and replaces their email, clears their profile,
+	// and removes their password, rights, roles, keys, linked identities, invites and
+	// deletion request. The account is disabled. Returns sql.ErrNoRows if there is no such user,
+	// or ErrLastAdmin if they are the last enabled administrator
+	AnonymizeUser(username string, anonymousName string, anonymousEmail string) error
+
+	// StoreOAuthClient registers an application that can sign users in. The
+	// secret hash is empty for public clients
+	StoreOAuthClient(clientID string, name string, redirectURIs []string, secretHash string) (OAuthClient, error)
+
+	// RetrieveOAuthClient with the given ID, or sql.ErrNoRows if there is no such client
+	RetrieveOAuthClient(clientID string) (OAuthClient, error)
+
+	// ListOAuthClients that are registered, in order of registration
+	ListOAuthClients() ([]OAuthClient, error)
+
+	// DeleteOAuthClient with the given ID, returning sql.ErrNoRows if there is no such client
+	DeleteOAuthClient(clientID string) error
+
+	// StoreRole with the rights it bundles and the roles it inherits from,
+	// replacing the role if it already exists. Returns ErrLastAdmin, changing
+	// nothing, if this would leave no enabled administrator
+	StoreRole(name string, description string, rights []string, inherits []string) error
+
+	// RetrieveRole with the given name, or sql.ErrNoRows if there is no such role
+	RetrieveRole(name string) (Role, error)
+
+	// ListRoles that are defined, in name order
+	ListRoles() ([]Role, error)
+
+	// ListRoleMembers returns the usernames of the users who hold the role, whether
+	// it is assigned to them or inherited by one of the roles they are assigned
+	ListRoleMembers(name string) ([]string, error)
+
+	// StoreAuditEvent in the audit log. Events can't be changed once stored
+	StoreAuditEvent(event AuditEvent) error
+
+	// PseudonymizeAuditEvents replaces the username with the pseudonym wherever an
+	// audit event names them, and removes the addresses and user agents of the
+	// events they caused (or that were about them, with no one logged in). It's
+	// the only change that can be made to stored events
+	PseudonymizeAuditEvents(username string, pseudonym string) error
+
+	// ListAuditEvents selected by the query, newest first. A limit of zero
+	// or less returns all the events selected
+	ListAuditEvents(query AuditQuery) ([]AuditEvent, error)
+
+	// DeleteRole with the given name, returning sql.ErrNoRows if there is no such role.
+	// The role is removed from any users and roles that have it. Returns
+	// ErrLastAdmin if this would leave no enabled administrator
+	DeleteRole(name string) error
+
+	// StoreSCIMToken created by the given user. Only the hash of the token is stored
+	StoreSCIMToken(createdBy string, name string, tokenHash string) (SCIMToken, error)
+
+	// RetrieveSCIMTokenByHash finds the SCIM token with the given hash, returning
+	// sql.ErrNoRows if there is no such token
+	RetrieveSCIMTokenByHash(tokenHash string) (SCIMToken, error)
+
+	// TouchSCIMToken records that the token with the given ID has just been used
+	TouchSCIMToken(uniqueID string) error
+
+	// ListSCIMTokens that have been issued, oldest first
+	ListSCIMTokens() ([]SCIMToken, error)
+
+	// DeleteSCIMToken with the given ID, returning sql.ErrNoRows if there is no such token
+	DeleteSCIMToken(uniqueID string) error
 }
@@ -3,6 +3,10 @@
 
 package jutzo
 
+import (
+	"time"
+)
+
 const (
 	Success           = 0
 	DuplicateEmail    = 1
@@ -18,38 +22,274 @@ type Engine interface {
 	// Shutdown ensures the engine has a chance to close all it's internal connections
 	Shutdown()
 
-	Login(user string, password string) (UserSession, error)
+	// Login the user, creating a new session for the client given. Repeated
+	// failures for the user, or from the client's IP address, back off
+	// exponentially; while backing off a *LoginThrottledError is returned
+	Login(user string, password string, client ClientInfo) (UserSession, error)
+
+	// UnlockUser clears the failed login attempts recorded for the user,
+	// lifting any lockout
+	UnlockUser(user string) error
 
 	// RegisterUser sets up a new user in the user management system. This will return
 	// one of (Success, DuplicateEmail, DuplicateUsername) depending on whether the
 	// username and email are unique, or whether one of the email or username is duplicated.
 	// If both the username and email are duplicated the DuplicateUsername will be
-	// returned.
+	// returned. A password that fails the password policy returns a *PasswordPolicyError
 	RegisterUser(user string, password string, email string) (result int, userInfo UserInfo, err error)
 
+	// SignUp registers a user who is signing themselves up, as allowed by the
+	// registration settings. Returns ErrRegistrationClosed, ErrInviteRequired,
+	// ErrEmailDomainNotAllowed or ErrInvalidInvite if the user can't register.
+	// An invite code gives the user the rights the invite carries
+	SignUp(user string, password string, email string, inviteCode string) (result int, userInfo UserInfo, err error)
+
+	// GetRegistrationSettings currently in force
+	GetRegistrationSettings() (RegistrationSettings, error)
+
+	// SetRegistrationSettings, which take effect immediately. Returns
+	// ErrInvalidRegistration if the mode or domains aren't valid
+	SetRegistrationSettings(settings RegistrationSettings) (RegistrationSettings, error)
+
+	// CreateInvite from the user, giving the rights listed (which must all be
+	// held by the user). The code is only returned here. An expiresIn of zero
+	// creates an invite that never expires
+	CreateInvite(user string, rights []string, expiresIn time.Duration) (code string, invite Invite, err error)
+
+	// ListInvites created by the user
+	ListInvites(user string) ([]Invite, error)
+
+	// RevokeInvite created by the user, returning sql.ErrNoRows if the user
+	// has no invite with that ID
+	RevokeInvite(user string, uniqueID string) error
+
+	// ChangePassword of the user, who has to give their current password. Returns
+	// ErrInvalidCredentials if that is wrong, a *LoginThrottledError if the client
+	// has to wait before trying again, or a *PasswordPolicyError if the new
+	// password fails the password policy
+	ChangePassword(user string, currentPassword string, newPassword string, client ClientInfo) error
+
+	// CreatePasswordReset for the user, returning a single use token that
+	// can be given to ResetPassword within the next hour
+	CreatePasswordReset(user string) (token string, err error)
+
+	// ResetPassword of the user the token was created for, ending all their
+	// sessions and lifting any login lockout. Returns ErrInvalidResetToken
+	// if the token isn't valid, or a *PasswordPolicyError. Returns the user
+	// whose password was reset
+	ResetPassword(token string, newPassword string) (user string, err error)
+
 	// CreateUniqueValidationForUser creates a new validation request record
 	// that can be satisfied by a call to ValidateEmail
 	CreateUniqueValidationForUser(user string) (uniqueID string, email string, err error)
 
 	// ValidateEmail is called when a user responds to an email to the given
-	// email address that contains the unique ID created by CreateUniqueValidationForUser
-	ValidateEmail(uniqueID string) error
+	// email address that contains the unique ID created by CreateUniqueValidationForUser.
+	// Returns the user whose email was validated
+	ValidateEmail(uniqueID string) (user string, err error)
 
 	// DestroyUserSession kills an active user session
 	DestroyUserSession(uniqueID string) error
 
+	// ListUserSessions returns the active sessions for the given user,
+	// most recently used first
+	ListUserSessions(user string) ([]UserSession, error)
+
+	// DestroyUserSessions kills all the active sessions for the given user
+	// other than the session identified by except ("" to kill them all)
+	DestroyUserSessions(user string, except string) error
+
 	// LoadUserSession returns the UserSession instance associated with the
 	// given unique identifier.
 	LoadUserSession(uniqueID string) (UserSession, error)
 
-	// ListUsers can be called by an admin to list users. This call will
-	// return up to maxUsers users at a time; if you want to retrieve the
-	// remaining users call ListUsers again passing in the username from the
-	// last record returned. If no more users can be found, an empty slice
-	// will be returned with no errors.
-	// If you want to start at the beginning of the user list, pass in an
-	// empty string as startingAt
-	ListUsers(startingAt string, maxUsers int) ([]UserInfo, error)
+	// RefreshUserSession exchanges a refresh token issued at login (or by a
+	// previous refresh) for a new one, extending the session idle timeout.
+	// Each refresh token can only be used once
+	RefreshUserSession(refreshToken string) (UserSession, error)
+
+	// VerifySessionClient checks the client using a session against the client
+	// the session was created from, as the fingerprint policy says. Returns
+	// ErrSessionClientChanged or ErrStepUpRequired if the request is refused
+	VerifySessionClient(userSession UserSession, client ClientInfo) error
+
+	// ConfirmSession with the password of the session's user, binding it to
+	// the client now using it. Returns ErrInvalidCredentials if the password is
+	// wrong, or ErrNoLocalPassword if the user has to log in again instead
+	ConfirmSession(uniqueID string, password string, client ClientInfo) (UserSession, error)
+
+	// GetSessionTimeouts returns the configured access token, refresh token
+	// and idle timeout durations
+	GetSessionTimeouts() SessionTimeouts
+
+	// ListUsers can be called by an admin to find users. A page of the users
+	// selected by the query is returned, along with the total number selected;
+	// pass the page's NextCursor in the query to get the next page. Returns
+	// ErrInvalidUserQuery if the cursor or sort isn't valid
+	ListUsers(query UserQuery) (UserPage, error)
+
+	// GetKeyCollisions returns the number of users whose username or email
+	// collided with another user's, ignoring case, when the database was upgraded
+	GetKeyCollisions() (KeyCollisions, error)
+
+	// CreateAPIKey for the user, restricted to the rights given (which must all
+	// be held by the user). The key itself is only returned here and cannot be
+	// retrieved again. An expiresIn of zero creates a key that never expires
+	CreateAPIKey(user string, name string, rights []string, expiresIn time.Duration) (key string, apiKey APIKey, err error)
+
+	// ListAPIKeys that belong to the user
+	ListAPIKeys(user string) ([]APIKey, error)
+
+	// RevokeAPIKey belonging to the user
+	RevokeAPIKey(user string, uniqueID string) error
+
+	// LoadAPIKeySession authenticates an API key, returning a session for the
+	// owner that is restricted to the rights of the key. These sessions are
+	// created for each request and never cached
+	LoadAPIKeySession(key string) (UserSession, error)
+
+	// LoginExternalIdentity logs in the local user linked to an identity asserted
+	// by an external identity provider. The first time an identity is seen it is
+	// linked to the user with the same (provider verified) email, or a new user
+	// is created for it if the registration settings allow (returning
+	// ErrRegistrationClosed, ErrInviteRequired or ErrEmailDomainNotAllowed if not)
+	LoginExternalIdentity(identity ExternalIdentity, client ClientInfo) (UserSession, error)
+
+	// StoreTransient keeps a short-lived value, such as the state of a login in
+	// progress, until it is taken or the time to live has passed
+	StoreTransient(key string, value []byte, ttl time.Duration) error
+
+	// TakeTransient retrieves and removes a value stored with StoreTransient, so
+	// that it can only be used once. Returns nil if there is no such value
+	TakeTransient(key string) ([]byte, error)
+
+	// RegisterOAuthClient for an application that signs users in with their
+	// Jutzo accounts. Confidential clients are given a secret, which is only
+	// returned here and cannot be retrieved again
+	RegisterOAuthClient(name string, redirectURIs []string, confidential bool) (secret string, client OAuthClient, err error)
+
+	// GetOAuthClient with the given ID, returning ErrInvalidOAuthClient if there is no such client
+	GetOAuthClient(clientID string) (OAuthClient, error)
+
+	// AuthenticateOAuthClient checks the credentials a client presented. Confidential
+	// clients must present their secret; public clients must not present one
+	AuthenticateOAuthClient(clientID string, secret string) (OAuthClient, error)
+
+	// ValidateOAuthRedirectURI makes sure the redirect URI is registered for the client
+	ValidateOAuthRedirectURI(client OAuthClient, redirectURI string) bool
+
+	// ListOAuthClients that are registered
+	ListOAuthClients() ([]OAuthClient, error)
+
+	// DeleteOAuthClient with the given ID
+	DeleteOAuthClient(clientID string) error
+
+	// CreateDelegatedSession creates a session for the user on behalf of the client
+	// application in the client info. The session only carries the rights that
+	// were granted to the client as scopes, and that the user holds
+	CreateDelegatedSession(user string, client ClientInfo) (UserSession, error)
+
+	// DefineRole with the rights it bundles and the roles it inherits from,
+	// replacing the role if it already exists. Returns ErrRoleCycle if the
+	// role would end up inheriting from itself, ErrBuiltInRole for the
+	// built-in roles, and ErrLastAdmin if this would leave no enabled
+	// administrator
+	DefineRole(name string, description string, rights []string, inherits []string) (Role, error)
+
+	// ListRoles that are defined
+	ListRoles() ([]Role, error)
+
+	// DeleteRole with the given name. The built-in roles can't be deleted, and
+	// deleting a role that would leave no enabled administrator returns ErrLastAdmin
+	DeleteRole(name string) error
+
+	// AssignRole to the user, returning the updated user
+	AssignRole(user string, role string) (UserInfo, error)
+
+	// UnassignRole from the user, returning the updated user
+	UnassignRole(user string, role string) (UserInfo, error)
+
+	// GrantRight to the user directly, returning the updated user
+	GrantRight(user string, right string) (UserInfo, error)
+
+	// RevokeRight that was granted to the user directly, returning the updated user.
+	// Returns ErrLastAdmin if this would leave no enabled administrator
+	RevokeRight(user string, right string) (UserInfo, error)
+
+	// SetLoginEnabled for the user, returning the updated user. Disabling the
+	// last enabled administrator returns ErrLastAdmin
+	SetLoginEnabled(user string, enabled bool) (UserInfo, error)
+
+	// ForceEmailValidation marks the user's email as validated without them
+	// following a validation link, returning the updated user
+	ForceEmailValidation(user string) (UserInfo, error)
+
+	// DeleteUser along with their sessions, API keys, linked identities and
+	// rights, returning the pseudonym the audit log names them by from then on.
+	// Deleting the last enabled administrator returns ErrLastAdmin
+	DeleteUser(user string) (string, error)
+
+	// UpdateProfile of the user with the fields present in the patch, returning
+	// the updated user. An invalid field returns an *InvalidProfileError
+	UpdateProfile(user string, patch ProfilePatch) (UserInfo, error)
+
+	// ExportUserData collects everything held about the user, for them to download
+	ExportUserData(user string) (*UserDataExport, error)
+
+	// RequestAccountDeletion schedules the user's account to be deleted (or
+	// anonymized) once the grace period has passed. The last enabled
+	// administrator can't ask to be deleted, and gets ErrLastAdmin
+	RequestAccountDeletion(user string, anonymize bool) (DeletionRequest, error)
+
+	// CancelAccountDeletion requested by the user, returning sql.ErrNoRows
+	// if there is no deletion pending
+	CancelAccountDeletion(user string) error
+
+	// PurgeAccountDeletions deletes or anonymizes the accounts whose deletion
+	// is due, returning how many were processed
+	PurgeAccountDeletions() (int, error)
+
+	// RecordAuditEvent in the audit log. The time is filled in if it isn't set
+	RecordAuditEvent(event AuditEvent) error
+
+	// ListAuditEvents selected by the query, newest first. The number of events
+	// returned is capped, whatever the limit in the query
+	ListAuditEvents(query AuditQuery) ([]AuditEvent, error)
+
+	// GetUser with the given username, returning sql.ErrNoRows if there is no such user
+	GetUser(user string) (UserInfo, error)
+
+	// GetUserByEmail finds the user registered with the email, returning
+	// sql.ErrNoRows if there is no such user
+	GetUserByEmail(email string) (UserInfo, error)
+
+	// ListRoleMembers returns the usernames of the users the role is assigned to
+	ListRoleMembers(role string) ([]string, error)
+
+	// ProvisionUser creates a user on behalf of an identity management system,
+	// returning the same results as RegisterUser. The email is taken as validated.
+	// A user provisioned without a password can only log in through an external
+	// identity provider or directory
+	ProvisionUser(user string, password string, email string) (result int, userInfo UserInfo, err error)
+
+	// ChangeEmail of the user to one an administrator or identity management
+	// system vouches for, returning the updated user. Returns ErrEmailInUse if
+	// another user has registered the email
+	ChangeEmail(user string, email string) (UserInfo, error)
+
+	// CreateSCIMToken for an identity management system to provision users
+	// with. The token is only returned here and cannot be retrieved again
+	CreateSCIMToken(createdBy string, name string) (token string, scimToken SCIMToken, err error)
+
+	// AuthenticateSCIMToken presented to the SCIM endpoints, returning
+	// ErrInvalidSCIMToken if it isn't one we issued
+	AuthenticateSCIMToken(token string) (SCIMToken, error)
+
+	// ListSCIMTokens that have been issued
+	ListSCIMTokens() ([]SCIMToken, error)
+
+	// RevokeSCIMToken with the given ID, returning sql.ErrNoRows if there is no such token
+	RevokeSCIMToken(uniqueID string) error
 
 	// GetConfigProvider that was used to create the engine
 	GetConfigProvider() ConfigurationProvider
@@ -0,0 +1,34 @@
+package jutzo
+
+import (
+	"errors"
+)
+
+// ErrExternalEmailConflict is returned when an external identity carries
+// an email that is already registered to a user it can't be linked to. We
+// only link accounts on a verified email, from a provider allowed to link
+// them, and never to an administrator
+var ErrExternalEmailConflict = errors.New("email is registered to another account that this identity can't be linked to")
+
+// ErrExternalEmailUnverified is returned when a new user would be created
+// for an external identity whose email the provider hasn't verified
+var ErrExternalEmailUnverified = errors.New("the identity provider has not verified the email")
+
+// ExternalIdentity is a user identity asserted by an external
+// identity provider (e.g. through OpenID Connect)
+type ExternalIdentity struct {
+
+	// Provider is the name we have configured the identity provider under
+	Provider string
+
+	// Subject is the provider's stable, unique identifier for the user
+	Subject string
+
+	// Email of the user, and whether the provider has verified it
+	Email         string
+	EmailVerified bool
+
+	// PreferredUsername is used as the basis of the username
+	// when a new local user has to be created
+	PreferredUsername string
+}
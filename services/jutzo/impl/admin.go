@@ -0,0 +1,56 @@
+package impl
+
+import (
+	"github.com/google/uuid"
+	"services/jutzo"
+)
+
+// GrantRight to the user directly, returning the updated user
+func (engine *EngineImpl) GrantRight(user string, right string) (jutzo.UserInfo, error) {
+	if !validRoleName(right) {
+		return nil, jutzo.ErrInvalidRole
+	}
+	return engine.updateUser(user, func(userInfo jutzo.UserInfo) { userInfo.GrantRight(right) })
+}
+
+// RevokeRight that was granted to the user directly, returning the updated
+// user. The user keeps the right if one of their roles includes it
+func (engine *EngineImpl) RevokeRight(user string, right string) (jutzo.UserInfo, error) {
+	return engine.updateUser(user, func(userInfo jutzo.UserInfo) { userInfo.RevokeRight(right) })
+}
+
+// SetLoginEnabled for the user, returning the updated user. Disabling a
+// user ends all their sessions
+func (engine *EngineImpl) SetLoginEnabled(user string, enabled bool) (jutzo.UserInfo, error) {
+	return engine.updateUser(user, func(userInfo jutzo.UserInfo) { userInfo.SetDisabled(!enabled) })
+}
+
+// ForceEmailValidation marks the user's email as validated without them
+// following a validation link, returning the updated user
+func (engine *EngineImpl) ForceEmailValidation(user string) (jutzo.UserInfo, error) {
+	if err := engine.db.MarkEmailValidated(user); err != nil {
+		return nil, err
+	}
+	if err := engine.refreshUserSessions(user); err != nil {
+		return nil, err
+	}
+	return engine.db.RetrieveUserInformation(user)
+}
+
+// DeleteUser along with everything that belongs to them, returning the
+// pseudonym the audit log names them by from then on. The last enabled
+// administrator can't be deleted
+func (engine *EngineImpl) DeleteUser(user string) (string, error) {
+	userInfo, err := engine.db.RetrieveUserInformation(user)
+	if err != nil {
+		return "", err
+	}
+	if err = engine.db.DeleteUser(userInfo.GetUsername()); err != nil {
+		return "", err
+	}
+	pseudonym := "deleted-" + uuid.NewString()
+	if err = engine.db.PseudonymizeAuditEvents(userInfo.GetUsername(), pseudonym); err != nil {
+		return "", err
+	}
+	return pseudonym, engine.cache.InvalidateUserSessions(userInfo.GetUsername(), "")
+}
@@ -0,0 +1,55 @@
+package impl
+
+import (
+	"time"
+)
+
+type APIKeyImpl struct {
+	ID             string    `json:"id"`
+	Username       string    `json:"username"`
+	Name           string    `json:"name"`
+	Rights         []string  `json:"rights"`
+	CreationTime   time.Time `json:"creationTime"`
+	ExpirationTime time.Time `json:"expirationTime,omitempty"`
+	LastUsed       time.Time `json:"lastUsed,omitempty"`
+}
+
+// GetId of the key, used to list and revoke it
+func (apiKey *APIKeyImpl) GetId() string {
+	return apiKey.ID
+}
+
+// GetUsername of the user that owns the key
+func (apiKey *APIKeyImpl) GetUsername() string {
+	return apiKey.Username
+}
+
+// GetName the user gave the key
+func (apiKey *APIKeyImpl) GetName() string {
+	return apiKey.Name
+}
+
+// GetRights the key is restricted to
+func (apiKey *APIKeyImpl) GetRights() []string {
+	return apiKey.Rights
+}
+
+// GetCreationTime of the key
+func (apiKey *APIKeyImpl) GetCreationTime() time.Time {
+	return apiKey.CreationTime
+}
+
+// GetExpirationTime of the key; the zero time if it never expires
+func (apiKey *APIKeyImpl) GetExpirationTime() time.Time {
+	return apiKey.ExpirationTime
+}
+
+// GetLastUsed time of the key; the zero time if it has never been used
+func (apiKey *APIKeyImpl) GetLastUsed() time.Time {
+	return apiKey.LastUsed
+}
+
+// isExpired determines if the key can no longer be used
+func (apiKey *APIKeyImpl) isExpired() bool {
+	return !apiKey.ExpirationTime.IsZero() && time.Now().After(apiKey.ExpirationTime)
+}
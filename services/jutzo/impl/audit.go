@@ -0,0 +1,55 @@
+package impl
+
+import (
+	"golang.org/x/exp/slices"
+	"log"
+	"services/jutzo"
+	"time"
+)
+
+// Limits on the number of audit events returned by a query
+const (
+	DefaultAuditQueryLimit = 100
+	MaxAuditQueryLimit     = 1000
+)
+
+// RecordAuditEvent in the audit log. The time is filled in if it isn't set
+func (engine *EngineImpl) RecordAuditEvent(event jutzo.AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	return engine.db.StoreAuditEvent(event)
+}
+
+// recordRightChanges made to the user by the actor, as one event for each
+// right granted or revoked directly. A failure to record is logged rather than undoing
+// the change, as it is for the changes made through the handlers
+func (engine *EngineImpl) recordRightChanges(actor string, user string, before []string, after []string) {
+	record := func(eventType string, right string) {
+		event := jutzo.AuditEvent{Type: eventType, Actor: actor, Target: user, Detail: right}
+		if err := engine.RecordAuditEvent(event); err != nil {
+			log.Printf("Unable to record %s event for %s: %s", eventType, user, err.Error())
+		}
+	}
+	for _, right := range after {
+		if !slices.Contains(before, right) {
+			record(jutzo.AuditRightGranted, right)
+		}
+	}
+	for _, right := range before {
+		if !slices.Contains(after, right) {
+			record(jutzo.AuditRightRevoked, right)
+		}
+	}
+}
+
+// ListAuditEvents selected by the query, newest first. Without a limit
+// the default number of events is returned
+func (engine *EngineImpl) ListAuditEvents(query jutzo.AuditQuery) ([]jutzo.AuditEvent, error) {
+	if query.Limit <= 0 {
+		query.Limit = DefaultAuditQueryLimit
+	} else if query.Limit > MaxAuditQueryLimit {
+		query.Limit = MaxAuditQueryLimit
+	}
+	return engine.db.ListAuditEvents(query)
+}
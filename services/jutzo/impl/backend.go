@@ -0,0 +1,58 @@
+package impl
+
+import (
+	"fmt"
+	"services/jutzo"
+)
+
+// The backends that the database and the session cache can be kept in
+const (
+	PostgresBackend = "postgres"
+	SQLiteBackend   = "sqlite"
+	RedisBackend    = "redis"
+	MemoryBackend   = "memory"
+)
+
+// Defaults for the backends, used when the configuration does not provide one
+const (
+	DefaultDatabaseBackend     = PostgresBackend
+	DefaultSessionStoreBackend = RedisBackend
+)
+
+// NewDatabaseConnection creates a connection to the database backend the
+// configuration asks for with JUTZO_DATABASE. The connection isn't made yet
+func NewDatabaseConnection(config jutzo.ConfigurationProvider) (jutzo.DatabaseConnection, error) {
+	backend, isPresent := config.GetConfigurationString("JUTZO_DATABASE")
+	if !isPresent || backend == "" {
+		backend = DefaultDatabaseBackend
+	}
+	switch backend {
+	case PostgresBackend:
+		return NewPostgresConnection(config), nil
+	case SQLiteBackend:
+		return NewSQLiteConnection(config), nil
+	case MemoryBackend:
+		return NewMemoryConnection(config), nil
+	default:
+		return nil, fmt.Errorf("unsupported JUTZO_DATABASE %s", backend)
+	}
+}
+
+// NewUserSessionCache creates the session cache the configuration asks for
+// with JUTZO_SESSION_STORE, connected
+func NewUserSessionCache(config jutzo.ConfigurationProvider) (jutzo.UserSessionCache, error) {
+	backend, isPresent := config.GetConfigurationString("JUTZO_SESSION_STORE")
+	if !isPresent || backend == "" {
+		backend = DefaultSessionStoreBackend
+	}
+	switch backend {
+	case RedisBackend:
+		return NewRedisCache(config)
+	case PostgresBackend:
+		return NewPostgresCache(config)
+	case MemoryBackend:
+		return NewMemoryCache(config)
+	default:
+		return nil, fmt.Errorf("unsupported JUTZO_SESSION_STORE %s", backend)
+	}
+}
@@ -0,0 +1,1083 @@
+package impl
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"log"
+	"services/jutzo"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors the in-memory database returns where Postgres would report a
+// constraint violation
+var (
+	errDuplicateKey     = errors.New("duplicate key value violates unique constraint")
+	errMissingReference = errors.New("referenced record does not exist")
+)
+
+// MemoryConnection keeps everything in memory, for development and tests.
+// It behaves as PostgresConnection does (including the errors returned for
+// missing records), but nothing survives the process ending. All access is
+// serialized by a single lock
+type MemoryConnection struct {
+	config jutzo.ConfigurationProvider
+	mutex  sync.Mutex
+
+	// Nothing is set up until the first connect
+	connected bool
+
+	users       map[string]*memoryUser
+	validations map[string]string
+	apiKeys     map[string]*memoryAPIKey
+	settings    map[string]string
+	invites     map[string]*memoryInvite
+	identities  map[memoryIdentityKey]*memoryIdentity
+	deletions   map[string]jutzo.DeletionRequest
+	clients     map[string]OAuthClientImpl
+	roles       map[string]*memoryRole
+	auditEvents []jutzo.AuditEvent
+	scimTokens  map[string]*memorySCIMToken
+}
+
+// memoryUser is a registered user along with the keys the username and email are compared by
+type memoryUser struct {
+	info        UserInfoImpl
+	usernameKey string
+	emailKey    string
+}
+
+// memoryAPIKey is an API key along with the hash it is found by
+type memoryAPIKey struct {
+	APIKeyImpl
+	keyHash string
+}
+
+// memoryInvite is an invite along with the hash of its code and when it was used
+type memoryInvite struct {
+	InviteImpl
+	codeHash string
+	usedTime time.Time
+}
+
+// memoryIdentityKey is how the provider knows a linked identity
+type memoryIdentityKey struct {
+	provider, subject string
+}
+
+// memoryIdentity is the local user linked to an external identity
+type memoryIdentity struct {
+	username     string
+	creationTime time.Time
+}
+
+// memoryRole is a role along with when it was created
+type memoryRole struct {
+	RoleImpl
+	creationTime time.Time
+}
+
+// memorySCIMToken is a SCIM token along with its hash
+type memorySCIMToken struct {
+	jutzo.SCIMToken
+	tokenHash string
+}
+
+// NewMemoryConnection creates an empty in-memory database
+func NewMemoryConnection(configurationProvider jutzo.ConfigurationProvider) *MemoryConnection {
+	result := new(MemoryConnection)
+	result.config = configurationProvider
+	return result
+}
+
+// Connect to the database. The first connect sets up the built-in roles and
+// rights, as the Postgres schema does. Reconnecting after a shutdown keeps
+// what was stored
+func (connection *MemoryConnection) Connect() error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if connection.connected {
+		return nil
+	}
+	connection.connected = true
+	if connection.users == nil {
+		log.Printf("Using an in-memory database; nothing will be kept when the server stops")
+		connection.users = make(map[string]*memoryUser)
+		connection.validations = make(map[string]string)
+		connection.apiKeys = make(map[string]*memoryAPIKey)
+		connection.settings = make(map[string]string)
+		connection.invites = make(map[string]*memoryInvite)
+		connection.identities = make(map[memoryIdentityKey]*memoryIdentity)
+		connection.deletions = make(map[string]jutzo.DeletionRequest)
+		connection.clients = make(map[string]OAuthClientImpl)
+		connection.scimTokens = make(map[string]*memorySCIMToken)
+		now := time.Now()
+		connection.roles = map[string]*memoryRole{
+			jutzo.DefaultUserRole: {RoleImpl: RoleImpl{Name: jutzo.DefaultUserRole, Description: "Given to all new users",
+				Rights: []string{"blog", "login"}, InheritedRoles: []string{}}, creationTime: now},
+			jutzo.AdministratorRole: {RoleImpl: RoleImpl{Name: jutzo.AdministratorRole, Description: "Administers the service",
+				Rights: []string{"admin"}, InheritedRoles: []string{jutzo.DefaultUserRole}}, creationTime: now},
+		}
+	}
+	return nil
+}
+
+// Shutdown the database. What was stored is kept, in case it is connected again
+func (connection *MemoryConnection) Shutdown() error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.connected = false
+	return nil
+}
+
+// CheckForUsernameOrEmail in the database so that we don't use the
+// same username or email twice
+func (connection *MemoryConnection) CheckForUsernameOrEmail(username string, email string) (bool, bool, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.findUser(username) != nil, connection.findUserByEmail(email) != nil, nil
+}
+
+// StoreUser with the given username, email, password hash and authentication
+// source, giving them the default role. Returns an error if the username or
+// email is in use
+func (connection *MemoryConnection) StoreUser(username string, email string, passwordHash []byte, authSource string) (jutzo.UserInfo, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	user := &memoryUser{usernameKey: UsernameKey(username), emailKey: EmailKey(email)}
+	for _, existing := range connection.users {
+		if existing.info.Username == username || existing.usernameKey == user.usernameKey ||
+			existing.info.Email == email || existing.emailKey == user.emailKey {
+			return nil, errDuplicateKey
+		}
+	}
+
+	user.info = UserInfoImpl{Username: username, Email: email, PasswordHash: append([]byte{}, passwordHash...),
+		AuthSource: authSource, GrantedRights: []string{}, Roles: []string{jutzo.DefaultUserRole}, CreationTime: time.Now()}
+	user.info.Profile.Notifications = jutzo.DefaultNotificationPreferences
+	connection.users[username] = user
+	return connection.userInfo(user), nil
+}
+
+// UpdateUserInfo that has changed: the email, whether the login is disabled,
+// the profile, the rights granted directly to the user and the user's roles.
+// Returns ErrLastAdmin, changing nothing, if this would leave no enabled administrator
+func (connection *MemoryConnection) UpdateUserInfo(userInfo jutzo.UserInfo) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	user, ok := connection.users[userInfo.GetUsername()]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	// The email stays unique, and the roles have to exist
+	emailKey := EmailKey(userInfo.GetEmail())
+	for _, existing := range connection.users {
+		if existing != user && (existing.info.Email == userInfo.GetEmail() || existing.emailKey == emailKey) {
+			return jutzo.ErrEmailInUse
+		}
+	}
+	for _, role := range userInfo.GetRoles() {
+		if _, ok := connection.roles[role]; !ok {
+			return errMissingReference
+		}
+	}
+
+	return connection.keepAnAdmin(func() func() {
+		previous, previousKey := user.info, user.emailKey
+		user.emailKey = emailKey
+		user.info.Email = userInfo.GetEmail()
+		user.info.Disabled = userInfo.IsDisabled()
+		user.info.Profile = userInfo.GetProfile()
+		user.info.GrantedRights = uniqueRights(userInfo.GetGrantedRights())
+		user.info.Roles = uniqueRights(userInfo.GetRoles())
+		return func() { user.info, user.emailKey = previous, previousKey }
+	})
+}
+
+// RetrieveUserInformation for the specified username (compared normalized and
+// case folded), returning sql.ErrNoRows if there is no such user
+func (connection *MemoryConnection) RetrieveUserInformation(username string) (jutzo.UserInfo, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if user := connection.findUser(username); user != nil {
+		return connection.userInfo(user), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// UpdatePasswordHash stored for the user
+func (connection *MemoryConnection) UpdatePasswordHash(username string, passwordHash []byte) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if user, ok := connection.users[username]; ok {
+		user.info.PasswordHash = append([]byte{}, passwordHash...)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// DeleteUser and everything that belongs to them. Returns sql.ErrNoRows if there is
+// no such user, or ErrLastAdmin if they are the last enabled administrator. The
+// invites they registered with no longer record their name
+func (connection *MemoryConnection) DeleteUser(username string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if user, ok := connection.users[username]; !ok {
+		return sql.ErrNoRows
+	} else if connection.isLastAdmin(user) {
+		return jutzo.ErrLastAdmin
+	}
+	delete(connection.users, username)
+	connection.removeBelongingTo(username)
+	for id, token := range connection.scimTokens {
+		if token.CreatedBy == username {
+			delete(connection.scimTokens, id)
+		}
+	}
+	for _, invite := range connection.invites {
+		if invite.UsedBy == username {
+			invite.UsedBy = deletedInviteUser
+		}
+	}
+	return nil
+}
+
+// GetAdminCount returns the number of administrator users whose login is enabled
+func (connection *MemoryConnection) GetAdminCount() (int, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.adminCount(), nil
+}
+
+// adminCount is the number of administrator users whose login is enabled.
+// The lock must be held
+func (connection *MemoryConnection) adminCount() int {
+	count := 0
+	for _, user := range connection.users {
+		if !user.info.Disabled && slices.Contains(connection.effectiveRights(user), "admin") {
+			count++
+		}
+	}
+	return count
+}
+
+// isLastAdmin determines if the user is the only enabled administrator. The lock must be held
+func (connection *MemoryConnection) isLastAdmin(user *memoryUser) bool {
+	return !user.info.Disabled && slices.Contains(connection.effectiveRights(user), "admin") && connection.adminCount() == 1
+}
+
+// keepAnAdmin makes the change, undoing it and returning ErrLastAdmin if it
+// leaves no enabled administrator where there was one. The change returns
+// how to undo it. The lock must be held
+func (connection *MemoryConnection) keepAnAdmin(change func() (undo func())) error {
+	before := connection.adminCount()
+	undo := change()
+	if before > 0 && connection.adminCount() == 0 {
+		undo()
+		return jutzo.ErrLastAdmin
+	}
+	return nil
+}
+
+// CreateValidationFor the user specified, replacing any validation already pending
+func (connection *MemoryConnection) CreateValidationFor(username string) (string, string, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	user, ok := connection.users[username]
+	if !ok {
+		return "", "", errMissingReference
+	}
+	for id, validating := range connection.validations {
+		if validating == username {
+			delete(connection.validations, id)
+		}
+	}
+	uniqueID := uuid.NewString()
+	connection.validations[uniqueID] = username
+	return uniqueID, user.info.Email, nil
+}
+
+// CompleteValidationFor the uniqueID created with CreateValidationFor, returning
+// the username of the user validated
+func (connection *MemoryConnection) CompleteValidationFor(uniqueID string) (string, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	username, ok := connection.validations[uniqueID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	delete(connection.validations, uniqueID)
+	if user, ok := connection.users[username]; ok {
+		user.info.EmailValidated = true
+	}
+	return username, nil
+}
+
+// CountKeyCollisions returns the number of users without a username or email
+// key. Users stored in memory always have their keys, so there are none
+func (connection *MemoryConnection) CountKeyCollisions() (jutzo.KeyCollisions, error) {
+	return jutzo.KeyCollisions{}, nil
+}
+
+// ListUsers selected by the query, in the order it asks for, along with the total number selected
+func (connection *MemoryConnection) ListUsers(query jutzo.UserQuery) (jutzo.UserPage, error) {
+	var page jutzo.UserPage
+	sort, err := userSort(query)
+	if err != nil {
+		return page, err
+	}
+	cursor, err := decodeUserCursor(query, sort)
+	if err != nil {
+		return page, err
+	}
+
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var selected []*UserInfoImpl
+	for _, user := range connection.users {
+		userInfo := connection.userInfo(user)
+		if (query.EmailContains == "" || strings.Contains(strings.ToLower(userInfo.Email), strings.ToLower(query.EmailContains))) &&
+			(query.Right == "" || slices.Contains(userInfo.Rights, query.Right)) &&
+			(query.Role == "" || slices.Contains(userInfo.Roles, query.Role)) &&
+			(query.Validated == nil || userInfo.EmailValidated == *query.Validated) &&
+			(query.CreatedSince.IsZero() || !userInfo.CreationTime.Before(query.CreatedSince)) &&
+			(query.CreatedUntil.IsZero() || userInfo.CreationTime.Before(query.CreatedUntil)) {
+			selected = append(selected, userInfo)
+		}
+	}
+	page.Total = len(selected)
+
+	// Users with the same creation time are ordered by username, so every user has a place in the order
+	before := func(a *UserInfoImpl, creationTime time.Time, username string) bool {
+		if sort == jutzo.UserSortCreated && !a.CreationTime.Equal(creationTime) {
+			return a.CreationTime.Before(creationTime) != query.Descending
+		}
+		return a.Username != username && (a.Username < username) != query.Descending
+	}
+	slices.SortFunc(selected, func(a, b *UserInfoImpl) bool { return before(a, b.CreationTime, b.Username) })
+	for _, userInfo := range selected {
+		if cursor == nil || before(&UserInfoImpl{CreationTime: cursor.CreationTime, Username: cursor.Username},
+			userInfo.CreationTime, userInfo.Username) {
+			// Password hashes never leave the database in a listing
+			userInfo.PasswordHash = []byte{}
+			page.Users = append(page.Users, userInfo)
+		}
+	}
+	if query.Limit > 0 && len(page.Users) > query.Limit {
+		page.Users = page.Users[:query.Limit]
+		page.NextCursor = encodeUserCursor(query, sort, page.Users[query.Limit-1])
+	}
+	return page, nil
+}
+
+// StoreAPIKey for the given user. Only the hash of the key is stored
+func (connection *MemoryConnection) StoreAPIKey(username string, name string, keyHash string, rights []string, expirationTime time.Time) (jutzo.APIKey, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.users[username]; !ok {
+		return nil, errMissingReference
+	}
+	for _, existing := range connection.apiKeys {
+		if existing.keyHash == keyHash {
+			return nil, errDuplicateKey
+		}
+	}
+	apiKey := &memoryAPIKey{APIKeyImpl: APIKeyImpl{ID: uuid.NewString(), Username: username, Name: name,
+		Rights: append([]string{}, rights...), CreationTime: time.Now(), ExpirationTime: expirationTime}, keyHash: keyHash}
+	connection.apiKeys[apiKey.ID] = apiKey
+	result := apiKey.APIKeyImpl
+	return &result, nil
+}
+
+// RetrieveAPIKeyByHash finds the API key with the given hash, returning
+// sql.ErrNoRows if there is no such key
+func (connection *MemoryConnection) RetrieveAPIKeyByHash(keyHash string) (jutzo.APIKey, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	for _, apiKey := range connection.apiKeys {
+		if apiKey.keyHash == keyHash {
+			result := apiKey.APIKeyImpl
+			return &result, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ListAPIKeys that belong to the given user, oldest first
+func (connection *MemoryConnection) ListAPIKeys(username string) ([]jutzo.APIKey, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var keys []*APIKeyImpl
+	for _, apiKey := range connection.apiKeys {
+		if apiKey.Username == username {
+			result := apiKey.APIKeyImpl
+			keys = append(keys, &result)
+		}
+	}
+	slices.SortFunc(keys, func(a, b *APIKeyImpl) bool { return a.CreationTime.Before(b.CreationTime) })
+	var result []jutzo.APIKey
+	for _, apiKey := range keys {
+		result = append(result, apiKey)
+	}
+	return result, nil
+}
+
+// DeleteAPIKey belonging to the given user. Returns sql.ErrNoRows if the
+// user has no key with that ID
+func (connection *MemoryConnection) DeleteAPIKey(username string, uniqueID string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if apiKey, ok := connection.apiKeys[uniqueID]; ok && apiKey.Username == username {
+		delete(connection.apiKeys, uniqueID)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// TouchAPIKey records that the key has just been used
+func (connection *MemoryConnection) TouchAPIKey(uniqueID string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if apiKey, ok := connection.apiKeys[uniqueID]; ok {
+		apiKey.LastUsed = time.Now()
+	}
+	return nil
+}
+
+// RetrieveSetting with the given name, returning sql.ErrNoRows if it hasn't been set
+func (connection *MemoryConnection) RetrieveSetting(name string) (string, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if value, ok := connection.settings[name]; ok {
+		return value, nil
+	}
+	return "", sql.ErrNoRows
+}
+
+// StoreSetting with the given name, replacing any value it already has
+func (connection *MemoryConnection) StoreSetting(name string, value string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	connection.settings[name] = value
+	return nil
+}
+
+// StoreInvite created by the given user. Only the hash of the code is stored
+func (connection *MemoryConnection) StoreInvite(createdBy string, codeHash string, rights []string, expirationTime time.Time) (jutzo.Invite, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.users[createdBy]; !ok {
+		return nil, errMissingReference
+	}
+	if connection.findInvite(codeHash) != nil {
+		return nil, errDuplicateKey
+	}
+	invite := &memoryInvite{InviteImpl: InviteImpl{ID: uuid.NewString(), CreatedBy: createdBy,
+		Rights: append([]string{}, rights...), CreationTime: time.Now(), ExpirationTime: expirationTime}, codeHash: codeHash}
+	connection.invites[invite.ID] = invite
+	result := invite.InviteImpl
+	return &result, nil
+}
+
+// ClaimInvite with the given hash for the user registering with it. Returns
+// sql.ErrNoRows if there's no such invite, or it has been used or has expired
+func (connection *MemoryConnection) ClaimInvite(codeHash string, username string) (jutzo.Invite, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	invite := connection.findInvite(codeHash)
+	if invite == nil || invite.UsedBy != "" ||
+		(!invite.ExpirationTime.IsZero() && !invite.ExpirationTime.After(time.Now())) {
+		return nil, sql.ErrNoRows
+	}
+	invite.UsedBy, invite.usedTime = username, time.Now()
+	result := invite.InviteImpl
+	return &result, nil
+}
+
+// ReleaseInvite that was claimed, so that it can be used again
+func (connection *MemoryConnection) ReleaseInvite(codeHash string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if invite := connection.findInvite(codeHash); invite != nil {
+		invite.UsedBy, invite.usedTime = "", time.Time{}
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// ListInvites created by the given user, oldest first
+func (connection *MemoryConnection) ListInvites(createdBy string) ([]jutzo.Invite, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var invites []*InviteImpl
+	for _, invite := range connection.invites {
+		if invite.CreatedBy == createdBy {
+			result := invite.InviteImpl
+			invites = append(invites, &result)
+		}
+	}
+	slices.SortFunc(invites, func(a, b *InviteImpl) bool { return a.CreationTime.Before(b.CreationTime) })
+	var result []jutzo.Invite
+	for _, invite := range invites {
+		result = append(result, invite)
+	}
+	return result, nil
+}
+
+// DeleteInvite created by the given user. Returns sql.ErrNoRows if the
+// user has no invite with that ID
+func (connection *MemoryConnection) DeleteInvite(createdBy string, uniqueID string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if invite, ok := connection.invites[uniqueID]; ok && invite.CreatedBy == createdBy {
+		delete(connection.invites, uniqueID)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// RetrieveUserByEmail finds the user registered with the given email (compared
+// normalized and case folded), returning sql.ErrNoRows if there is no such user
+func (connection *MemoryConnection) RetrieveUserByEmail(email string) (jutzo.UserInfo, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if user := connection.findUserByEmail(email); user != nil {
+		return connection.userInfo(user), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// MarkEmailValidated for the user without going through the validation process
+func (connection *MemoryConnection) MarkEmailValidated(username string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if user, ok := connection.users[username]; ok {
+		user.info.EmailValidated = true
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// StoreExternalIdentity links the identity the provider knows by subject
+// to the given local user
+func (connection *MemoryConnection) StoreExternalIdentity(provider string, subject string, username string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	key := memoryIdentityKey{provider: provider, subject: subject}
+	if _, ok := connection.users[username]; !ok {
+		return errMissingReference
+	} else if _, exists := connection.identities[key]; exists {
+		return errDuplicateKey
+	}
+	connection.identities[key] = &memoryIdentity{username: username, creationTime: time.Now()}
+	return nil
+}
+
+// RetrieveExternalIdentity returns the username of the local user linked
+// to the provider's subject, or sql.ErrNoRows if it isn't linked
+func (connection *MemoryConnection) RetrieveExternalIdentity(provider string, subject string) (string, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if identity, ok := connection.identities[memoryIdentityKey{provider: provider, subject: subject}]; ok {
+		return identity.username, nil
+	}
+	return "", sql.ErrNoRows
+}
+
+// ListExternalIdentities linked to the given user, oldest first
+func (connection *MemoryConnection) ListExternalIdentities(username string) ([]jutzo.LinkedIdentity, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var result []jutzo.LinkedIdentity
+	for key, identity := range connection.identities {
+		if identity.username == username {
+			result = append(result, jutzo.LinkedIdentity{Provider: key.provider, Subject: key.subject,
+				CreationTime: identity.creationTime})
+		}
+	}
+	slices.SortFunc(result, func(a, b jutzo.LinkedIdentity) bool { return a.CreationTime.Before(b.CreationTime) })
+	return result, nil
+}
+
+// StoreDeletionRequest for the given user, replacing any request they have already made
+func (connection *MemoryConnection) StoreDeletionRequest(username string, anonymize bool, dueTime time.Time) (jutzo.DeletionRequest, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.users[username]; !ok {
+		return jutzo.DeletionRequest{}, errMissingReference
+	}
+	request := jutzo.DeletionRequest{Username: username, Anonymize: anonymize, RequestTime: time.Now(), DueTime: dueTime}
+	connection.deletions[username] = request
+	return request, nil
+}
+
+// RetrieveDeletionRequest for the given user, or sql.ErrNoRows if they haven't made one
+func (connection *MemoryConnection) RetrieveDeletionRequest(username string) (jutzo.DeletionRequest, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if request, ok := connection.deletions[username]; ok {
+		return request, nil
+	}
+	return jutzo.DeletionRequest{}, sql.ErrNoRows
+}
+
+// DeleteDeletionRequest for the given user, returning sql.ErrNoRows if they haven't made one
+func (connection *MemoryConnection) DeleteDeletionRequest(username string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.deletions[username]; ok {
+		delete(connection.deletions, username)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// ListDueDeletions returns the deletion requests that are due at the time given
+func (connection *MemoryConnection) ListDueDeletions(dueBy time.Time) ([]jutzo.DeletionRequest, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var result []jutzo.DeletionRequest
+	for _, request := range connection.deletions {
+		if !request.DueTime.After(dueBy) {
+			result = append(result, request)
+		}
+	}
+	slices.SortFunc(result, func(a, b jutzo.DeletionRequest) bool { return a.DueTime.Before(b.DueTime) })
+	return result, nil
+}
+
+// AnonymizeUser renames the user and replaces their email, and removes everything
+// else that could identify them. What is left refers to the new name, as the
+// rename cascades in Postgres. Returns ErrLastAdmin if they are the last enabled administrator
+func (connection *MemoryConnection) AnonymizeUser(username string, anonymousName string, anonymousEmail string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	user, ok := connection.users[username]
+	if !ok {
+		return sql.ErrNoRows
+	} else if connection.isLastAdmin(user) {
+		return jutzo.ErrLastAdmin
+	}
+
+	delete(connection.users, username)
+	user.info = UserInfoImpl{Username: anonymousName, Email: anonymousEmail, PasswordHash: []byte{},
+		AuthSource: jutzo.AuthSourceLocal, Disabled: true, GrantedRights: []string{}, Roles: []string{},
+		CreationTime: user.info.CreationTime}
+	user.info.Profile.Notifications = jutzo.DefaultNotificationPreferences
+	user.usernameKey, user.emailKey = UsernameKey(anonymousName), EmailKey(anonymousEmail)
+	connection.users[anonymousName] = user
+	connection.removeBelongingTo(username)
+	for _, token := range connection.scimTokens {
+		if token.CreatedBy == username {
+			token.CreatedBy = anonymousName
+		}
+	}
+
+	// Invites only record the name of the user that used them
+	for _, invite := range connection.invites {
+		if invite.UsedBy == username {
+			invite.UsedBy = anonymousName
+		}
+	}
+	return nil
+}
+
+// StoreOAuthClient registers an application that can sign users in. The
+// secret hash is empty for public clients
+func (connection *MemoryConnection) StoreOAuthClient(clientID string, name string, redirectURIs []string, secretHash string) (jutzo.OAuthClient, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, exists := connection.clients[clientID]; exists {
+		return nil, errDuplicateKey
+	}
+	client := OAuthClientImpl{ClientID: clientID, Name: name, RedirectURIs: append([]string{}, redirectURIs...),
+		Confidential: secretHash != "", CreationTime: time.Now(), SecretHash: secretHash}
+	connection.clients[clientID] = client
+	return &client, nil
+}
+
+// RetrieveOAuthClient with the given ID, or sql.ErrNoRows if there is no such client
+func (connection *MemoryConnection) RetrieveOAuthClient(clientID string) (jutzo.OAuthClient, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if client, ok := connection.clients[clientID]; ok {
+		return &client, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ListOAuthClients that are registered, in order of registration
+func (connection *MemoryConnection) ListOAuthClients() ([]jutzo.OAuthClient, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	clients := make([]OAuthClientImpl, 0, len(connection.clients))
+	for _, client := range connection.clients {
+		clients = append(clients, client)
+	}
+	slices.SortFunc(clients, func(a, b OAuthClientImpl) bool { return a.CreationTime.Before(b.CreationTime) })
+	var result []jutzo.OAuthClient
+	for index := range clients {
+		result = append(result, &clients[index])
+	}
+	return result, nil
+}
+
+// DeleteOAuthClient with the given ID, returning sql.ErrNoRows if there is no such client
+func (connection *MemoryConnection) DeleteOAuthClient(clientID string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.clients[clientID]; ok {
+		delete(connection.clients, clientID)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// StoreRole with the rights it bundles and the roles it inherits from,
+// replacing the role if it already exists
+func (connection *MemoryConnection) StoreRole(name string, description string, rights []string, inherits []string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	for _, parent := range inherits {
+		if parent == name {
+			return fmt.Errorf("role %s cannot inherit from itself", name)
+		} else if _, ok := connection.roles[parent]; !ok {
+			return errMissingReference
+		}
+	}
+
+	return connection.keepAnAdmin(func() func() {
+		previous, existed := connection.roles[name]
+		role := &memoryRole{RoleImpl: RoleImpl{Name: name}, creationTime: time.Now()}
+		if existed {
+			role.creationTime = previous.creationTime
+		}
+		role.Description = description
+		role.Rights = sortedRights(rights)
+		role.InheritedRoles = sortedRights(inherits)
+		connection.roles[name] = role
+		return func() {
+			if existed {
+				connection.roles[name] = previous
+			} else {
+				delete(connection.roles, name)
+			}
+		}
+	})
+}
+
+// RetrieveRole with the given name, or sql.ErrNoRows if there is no such role
+func (connection *MemoryConnection) RetrieveRole(name string) (jutzo.Role, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if role, ok := connection.roles[name]; ok {
+		return role.copy(), nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ListRoles that are defined, in name order
+func (connection *MemoryConnection) ListRoles() ([]jutzo.Role, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	names := make([]string, 0, len(connection.roles))
+	for name := range connection.roles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var result []jutzo.Role
+	for _, name := range names {
+		result = append(result, connection.roles[name].copy())
+	}
+	return result, nil
+}
+
+// ListRoleMembers returns the usernames of the users who hold the role, whether
+// it is assigned to them or inherited by one of the roles they are assigned
+func (connection *MemoryConnection) ListRoleMembers(name string) ([]string, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var result []string
+	for username, user := range connection.users {
+		if slices.Contains(connection.roleClosure(user.info.Roles), name) {
+			result = append(result, username)
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// StoreAuditEvent in the audit log
+func (connection *MemoryConnection) StoreAuditEvent(event jutzo.AuditEvent) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	event.ID = int64(len(connection.auditEvents) + 1)
+	connection.auditEvents = append(connection.auditEvents, event)
+	return nil
+}
+
+// PseudonymizeAuditEvents replaces the username with the pseudonym wherever
+// an audit event names them, and removes the addresses and user agents of
+// the events they caused
+func (connection *MemoryConnection) PseudonymizeAuditEvents(username string, pseudonym string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	for index := range connection.auditEvents {
+		event := &connection.auditEvents[index]
+		if event.Actor == username || (event.Actor == "" && event.Target == username) {
+			event.IP = ""
+			event.UserAgent = ""
+		}
+		if event.Actor == username {
+			event.Actor = pseudonym
+		}
+		if event.Target == username {
+			event.Target = pseudonym
+		}
+	}
+	return nil
+}
+
+// ListAuditEvents selected by the query, newest first
+func (connection *MemoryConnection) ListAuditEvents(query jutzo.AuditQuery) ([]jutzo.AuditEvent, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var result []jutzo.AuditEvent
+	for index := len(connection.auditEvents) - 1; index >= 0; index-- {
+		if query.Limit > 0 && len(result) == query.Limit {
+			break
+		}
+		event := connection.auditEvents[index]
+		if (len(query.Types) == 0 || slices.Contains(query.Types, event.Type)) &&
+			(query.Actor == "" || event.Actor == query.Actor) &&
+			(query.Target == "" || event.Target == query.Target) &&
+			(query.User == "" || event.Actor == query.User || event.Target == query.User) &&
+			(query.IP == "" || event.IP == query.IP) &&
+			(query.Since.IsZero() || !event.Time.Before(query.Since)) &&
+			(query.Until.IsZero() || event.Time.Before(query.Until)) &&
+			(query.Before <= 0 || event.ID < query.Before) {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+// DeleteRole with the given name, returning sql.ErrNoRows if there is no such role,
+// or ErrLastAdmin if this would leave no enabled administrator. The role is removed
+// from any users and roles that have it
+func (connection *MemoryConnection) DeleteRole(name string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	removed, ok := connection.roles[name]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	return connection.keepAnAdmin(func() func() {
+		inherited := make(map[*memoryRole][]string)
+		assigned := make(map[*memoryUser][]string)
+		delete(connection.roles, name)
+		for _, role := range connection.roles {
+			inherited[role] = role.InheritedRoles
+			role.InheritedRoles = removeString(role.InheritedRoles, name)
+		}
+		for _, user := range connection.users {
+			assigned[user] = user.info.Roles
+			user.info.Roles = removeString(user.info.Roles, name)
+		}
+		return func() {
+			connection.roles[name] = removed
+			for role, roles := range inherited {
+				role.InheritedRoles = roles
+			}
+			for user, roles := range assigned {
+				user.info.Roles = roles
+			}
+		}
+	})
+}
+
+// StoreSCIMToken created by the given user. Only the hash of the token is stored
+func (connection *MemoryConnection) StoreSCIMToken(createdBy string, name string, tokenHash string) (jutzo.SCIMToken, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.users[createdBy]; !ok {
+		return jutzo.SCIMToken{}, errMissingReference
+	}
+	for _, existing := range connection.scimTokens {
+		if existing.tokenHash == tokenHash {
+			return jutzo.SCIMToken{}, errDuplicateKey
+		}
+	}
+	token := &memorySCIMToken{SCIMToken: jutzo.SCIMToken{ID: uuid.NewString(), Name: name, CreatedBy: createdBy,
+		CreationTime: time.Now()}, tokenHash: tokenHash}
+	connection.scimTokens[token.ID] = token
+	return token.SCIMToken, nil
+}
+
+// RetrieveSCIMTokenByHash finds the SCIM token with the given hash, returning
+// sql.ErrNoRows if there is no such token
+func (connection *MemoryConnection) RetrieveSCIMTokenByHash(tokenHash string) (jutzo.SCIMToken, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	for _, token := range connection.scimTokens {
+		if token.tokenHash == tokenHash {
+			return token.SCIMToken, nil
+		}
+	}
+	return jutzo.SCIMToken{}, sql.ErrNoRows
+}
+
+// TouchSCIMToken records that the token with the given ID has just been used
+func (connection *MemoryConnection) TouchSCIMToken(uniqueID string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if token, ok := connection.scimTokens[uniqueID]; ok {
+		token.LastUsed = time.Now()
+	}
+	return nil
+}
+
+// ListSCIMTokens that have been issued, oldest first
+func (connection *MemoryConnection) ListSCIMTokens() ([]jutzo.SCIMToken, error) {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	var result []jutzo.SCIMToken
+	for _, token := range connection.scimTokens {
+		result = append(result, token.SCIMToken)
+	}
+	slices.SortFunc(result, func(a, b jutzo.SCIMToken) bool { return a.CreationTime.Before(b.CreationTime) })
+	return result, nil
+}
+
+// DeleteSCIMToken with the given ID, returning sql.ErrNoRows if there is no such token
+func (connection *MemoryConnection) DeleteSCIMToken(uniqueID string) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	if _, ok := connection.scimTokens[uniqueID]; ok {
+		delete(connection.scimTokens, uniqueID)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// findUser with the exact username given, or failing that the username's
+// key. Returns nil if there is no such user. The lock must be held
+func (connection *MemoryConnection) findUser(username string) *memoryUser {
+	if user, ok := connection.users[username]; ok {
+		return user
+	}
+	key := UsernameKey(username)
+	for _, user := range connection.users {
+		if user.usernameKey == key {
+			return user
+		}
+	}
+	return nil
+}
+
+// findUserByEmail with the exact email given, or failing that the email's
+// key. Returns nil if there is no such user. The lock must be held
+func (connection *MemoryConnection) findUserByEmail(email string) *memoryUser {
+	key := EmailKey(email)
+	var found *memoryUser
+	for _, user := range connection.users {
+		if user.info.Email == email {
+			return user
+		} else if user.emailKey == key {
+			found = user
+		}
+	}
+	return found
+}
+
+// findInvite with the code hash given, or nil if there is none. The lock must be held
+func (connection *MemoryConnection) findInvite(codeHash string) *memoryInvite {
+	for _, invite := range connection.invites {
+		if invite.codeHash == codeHash {
+			return invite
+		}
+	}
+	return nil
+}
+
+// userInfo is a copy of the user, with their rights worked out as
+// scanUser would find them. The lock must be held
+func (connection *MemoryConnection) userInfo(user *memoryUser) *UserInfoImpl {
+	userInfo := user.info
+	userInfo.PasswordHash = append([]byte{}, user.info.PasswordHash...)
+	userInfo.GrantedRights = sortedRights(user.info.GrantedRights)
+	userInfo.Roles = sortedRights(user.info.Roles)
+	userInfo.Rights = connection.effectiveRights(user)
+	return &userInfo
+}
+
+// effectiveRights of the user: those granted directly and those of their
+// roles, including the roles those inherit from. The lock must be held
+func (connection *MemoryConnection) effectiveRights(user *memoryUser) []string {
+	rights := append([]string{}, user.info.GrantedRights...)
+	for _, name := range connection.roleClosure(user.info.Roles) {
+		rights = append(rights, connection.roles[name].Rights...)
+	}
+	return sortedRights(rights)
+}
+
+// roleClosure is the roles given along with all the roles they inherit
+// from, directly or indirectly. The lock must be held
+func (connection *MemoryConnection) roleClosure(roles []string) []string {
+	var result []string
+	pending := append([]string{}, roles...)
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if role, ok := connection.roles[name]; ok && !slices.Contains(result, name) {
+			result = append(result, name)
+			pending = append(pending, role.InheritedRoles...)
+		}
+	}
+	return result
+}
+
+// removeBelongingTo the user the records that would cascade from the user
+// being deleted, other than SCIM tokens. The lock must be held
+func (connection *MemoryConnection) removeBelongingTo(username string) {
+	for id, validating := range connection.validations {
+		if validating == username {
+			delete(connection.validations, id)
+		}
+	}
+	for id, apiKey := range connection.apiKeys {
+		if apiKey.Username == username {
+			delete(connection.apiKeys, id)
+		}
+	}
+	for id, invite := range connection.invites {
+		if invite.CreatedBy == username {
+			delete(connection.invites, id)
+		}
+	}
+	for key, identity := range connection.identities {
+		if identity.username == username {
+			delete(connection.identities, key)
+		}
+	}
+	delete(connection.deletions, username)
+}
+
+// copy of the role, so that changes to it don't change what is stored
+func (role *memoryRole) copy() *RoleImpl {
+	return &RoleImpl{Name: role.Name, Description: role.Description,
+		Rights: append([]string{}, role.Rights...), InheritedRoles: append([]string{}, role.InheritedRoles...)}
+}
+
+// sortedRights is a sorted copy of the rights (or roles) without duplicates,
+// as they are aggregated from the Postgres tables
+func sortedRights(rights []string) []string {
+	result := uniqueRights(rights)
+	slices.Sort(result)
+	return result
+}
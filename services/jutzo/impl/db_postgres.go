@@ -2,11 +2,11 @@ package impl
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"log"
-	"math"
 	"services/jutzo"
 	"strings"
 	"time"
@@ -23,7 +23,7 @@ func NewPostgresConnection(configurationProvider jutzo.ConfigurationProvider) *P
 	return result
 }
 
-const SupportedSchema = 1
+const SupportedSchema = 15
 
 var UpgradeStatements = [...][]string{
 
@@ -63,8 +63,405 @@ var UpgradeStatements = [...][]string{
 		`alter table jutzo_database_info owner to jutzo`,
 		`insert into jutzo_database_info (schema_ordinal) values (1)`,
 	},
+
+	// Upgrade from schema 1 to schema 2: API keys
+	{
+		`create table if not exists jutzo_api_key
+			(
+			unique_id       uuid      default gen_random_uuid() not null
+				constraint api_key_key
+				primary key,
+			username        varchar(256)                        not null
+				constraint api_key_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			name            varchar(256)                        not null,
+			key_hash        varchar(64)                         not null,
+			rights          text                                not null,
+			creation_time   timestamp default now()             not null,
+			expiration_time timestamp,
+			last_used       timestamp
+			)`,
+		`alter table jutzo_api_key owner to jutzo`,
+		`create unique index if not exists api_key_hash_idx on jutzo_api_key (key_hash)`,
+		`update jutzo_database_info set schema_ordinal = 2`,
+	},
+
+	// Upgrade from schema 2 to schema 3: identities from external providers, and
+	// how each user authenticates. Every user until now has a local password
+	{
+		`create table if not exists jutzo_external_identity
+			(
+			provider      varchar(64)             not null,
+			subject       varchar(256)            not null,
+			username      varchar(256)            not null
+				constraint external_identity_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			creation_time timestamp default now() not null,
+			constraint external_identity_key
+				primary key (provider, subject)
+			)`,
+		`alter table jutzo_external_identity owner to jutzo`,
+		`alter table jutzo_registered_user add column if not exists auth_source varchar(16) default 'local' not null`,
+		`update jutzo_database_info set schema_ordinal = 3`,
+	},
+
+	// Upgrade from schema 3 to schema 4: applications that sign users in through us
+	{
+		`create table if not exists jutzo_oauth_client
+			(
+			client_id     varchar(64)             not null
+				constraint oauth_client_key
+				primary key,
+			name          varchar(256)            not null,
+			redirect_uris text                    not null,
+			secret_hash   varchar(64),
+			creation_time timestamp default now() not null
+			)`,
+		`alter table jutzo_oauth_client owner to jutzo`,
+		`update jutzo_database_info set schema_ordinal = 4`,
+	},
+
+	// Upgrade from schema 4 to schema 5: rights become permissions that are granted
+	// to users directly or bundled into roles, replacing the comma separated column
+	{
+		`create table if not exists jutzo_permission
+			(
+			name        varchar(64)        not null
+				constraint permission_key
+				primary key,
+			description text default ''    not null
+			)`,
+		`alter table jutzo_permission owner to jutzo`,
+		`create table if not exists jutzo_role
+			(
+			name          varchar(64)             not null
+				constraint role_key
+				primary key,
+			description   text      default ''    not null,
+			creation_time timestamp default now() not null
+			)`,
+		`alter table jutzo_role owner to jutzo`,
+		`create table if not exists jutzo_role_permission
+			(
+			role       varchar(64) not null
+				constraint role_permission_role_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			permission varchar(64) not null
+				constraint role_permission_permission_key
+				references jutzo_permission
+				on update cascade on delete cascade,
+			constraint role_permission_key
+				primary key (role, permission)
+			)`,
+		`alter table jutzo_role_permission owner to jutzo`,
+		`create table if not exists jutzo_role_inheritance
+			(
+			role        varchar(64) not null
+				constraint role_inheritance_role_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			parent_role varchar(64) not null
+				constraint role_inheritance_parent_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			constraint role_inheritance_key
+				primary key (role, parent_role),
+			constraint role_inheritance_self_check
+				check (role <> parent_role)
+			)`,
+		`alter table jutzo_role_inheritance owner to jutzo`,
+		`create table if not exists jutzo_user_permission
+			(
+			username   varchar(256) not null
+				constraint user_permission_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			permission varchar(64)  not null
+				constraint user_permission_permission_key
+				references jutzo_permission
+				on update cascade on delete cascade,
+			constraint user_permission_key
+				primary key (username, permission)
+			)`,
+		`alter table jutzo_user_permission owner to jutzo`,
+		`create table if not exists jutzo_user_role
+			(
+			username varchar(256) not null
+				constraint user_role_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			role     varchar(64)  not null
+				constraint user_role_role_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			constraint user_role_key
+				primary key (username, role)
+			)`,
+		`alter table jutzo_user_role owner to jutzo`,
+
+		// Carry the existing rights over as direct grants, so nobody's rights change
+		`insert into jutzo_permission (name)
+			select distinct trim(right_name)
+			  from jutzo_registered_user, unnest(string_to_array(rights, ',')) as right_name
+			 where trim(right_name) <> ''
+			on conflict do nothing`,
+		`insert into jutzo_user_permission (username, permission)
+			select distinct username, trim(right_name)
+			  from jutzo_registered_user, unnest(string_to_array(rights, ',')) as right_name
+			 where trim(right_name) <> ''`,
+		`alter table jutzo_registered_user drop column rights`,
+
+		// The built-in roles. New users get the user role, which has the rights
+		// the old column defaulted to; administrators get everything users do
+		`insert into jutzo_permission (name, description) values
+			('login', 'Log in to the service'),
+			('blog', 'Write blog entries'),
+			('admin', 'Administer the service')
+			on conflict (name) do update set description = excluded.description`,
+		`insert into jutzo_role (name, description) values
+			('user', 'Given to all new users'),
+			('administrator', 'Administers the service')`,
+		`insert into jutzo_role_permission (role, permission) values
+			('user', 'login'), ('user', 'blog'), ('administrator', 'admin')`,
+		`insert into jutzo_role_inheritance (role, parent_role) values ('administrator', 'user')`,
+
+		// The effective permissions of each user: those granted directly and those
+		// of their roles, including the roles those inherit from
+		`create or replace view jutzo_effective_permission as
+			with recursive user_roles(username, role) as (
+				select username, role from jutzo_user_role
+				union
+				select user_roles.username, inheritance.parent_role
+				  from user_roles
+				  join jutzo_role_inheritance inheritance on inheritance.role = user_roles.role
+			)
+			select username, permission from jutzo_user_permission
+			union
+			select user_roles.username, role_permission.permission
+			  from user_roles
+			  join jutzo_role_permission role_permission on role_permission.role = user_roles.role`,
+		`alter view jutzo_effective_permission owner to jutzo`,
+		`update jutzo_database_info set schema_ordinal = 5`,
+	},
+
+	// Upgrade from schema 5 to schema 6: administrators can disable a user's login
+	{
+		`alter table jutzo_registered_user add column if not exists disabled boolean default false not null`,
+		`update jutzo_database_info set schema_ordinal = 6`,
+	},
+
+	// Upgrade from schema 6 to schema 7: settings that can be changed at runtime, and invites
+	{
+		`create table if not exists jutzo_setting
+			(
+			name  varchar(64) not null
+				constraint setting_key
+				primary key,
+			value text        not null
+			)`,
+		`alter table jutzo_setting owner to jutzo`,
+		`create table if not exists jutzo_invite
+			(
+			unique_id       uuid      default gen_random_uuid() not null
+				constraint invite_key
+				primary key,
+			created_by      varchar(256)                        not null
+				constraint invite_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			code_hash       varchar(64)                         not null,
+			rights          text                                not null,
+			creation_time   timestamp default now()             not null,
+			expiration_time timestamp,
+			used_by         varchar(256),
+			used_time       timestamp
+			)`,
+		`alter table jutzo_invite owner to jutzo`,
+		`create unique index if not exists invite_hash_idx on jutzo_invite (code_hash)`,
+		`insert into jutzo_permission (name, description) values ('invite', 'Invite new users')
+			on conflict (name) do update set description = excluded.description`,
+		`update jutzo_database_info set schema_ordinal = 7`,
+	},
+
+	// Upgrade from schema 7 to schema 8: users asking for their account to be deleted
+	{
+		`create table if not exists jutzo_deletion_request
+			(
+			username     varchar(256)            not null
+				constraint deletion_request_key
+				primary key
+				constraint deletion_request_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			anonymize    boolean default false   not null,
+			request_time timestamp default now() not null,
+			due_time     timestamp               not null
+			)`,
+		`alter table jutzo_deletion_request owner to jutzo`,
+		`update jutzo_database_info set schema_ordinal = 8`,
+	},
+
+	// Upgrade from schema 8 to schema 9: the audit log, which can only be appended
+	// to. Erasing a user pseudonymizes the events that identify them, which can only
+	// be done by jutzo_pseudonymize_audit_events, and then only who and where from
+	{
+		`create table if not exists jutzo_audit_event
+			(
+			id         bigserial                     not null
+				constraint audit_event_key
+				primary key,
+			event_time timestamp default now()       not null,
+			event_type varchar(64)                   not null,
+			actor      varchar(256) default ''       not null,
+			target     varchar(256) default ''       not null,
+			ip         varchar(64)  default ''       not null,
+			user_agent text         default ''       not null,
+			detail     text         default ''       not null
+			)`,
+		`alter table jutzo_audit_event owner to jutzo`,
+		`create index if not exists audit_event_time_idx on jutzo_audit_event (event_time)`,
+		`create index if not exists audit_event_actor_idx on jutzo_audit_event (actor)`,
+		`create index if not exists audit_event_target_idx on jutzo_audit_event (target)`,
+		`create or replace function jutzo_audit_event_immutable() returns trigger as $$
+			begin
+				if tg_op = 'UPDATE' and current_setting('jutzo.audit_pseudonymize', true) = 'on'
+				   and new.id = old.id and new.event_time = old.event_time
+				   and new.event_type = old.event_type and new.detail = old.detail then
+					return new;
+				end if;
+				raise exception 'audit events cannot be changed or deleted';
+			end
+			$$ language plpgsql`,
+		`create trigger audit_event_immutable before update or delete on jutzo_audit_event
+			for each row execute procedure jutzo_audit_event_immutable()`,
+		`create or replace function jutzo_pseudonymize_audit_events(username varchar, pseudonym varchar) returns void as $$
+			begin
+				perform set_config('jutzo.audit_pseudonymize', 'on', true);
+				update jutzo_audit_event
+				   set ip = '', user_agent = ''
+				 where actor = username or (actor = '' and target = username);
+				update jutzo_audit_event set actor = pseudonym where actor = username;
+				update jutzo_audit_event set target = pseudonym where target = username;
+				perform set_config('jutzo.audit_pseudonymize', 'off', true);
+			end
+			$$ language plpgsql`,
+		`update jutzo_database_info set schema_ordinal = 9`,
+	},
+
+	// Upgrade from schema 9 to schema 10: what users tell us about themselves
+	{
+		`alter table jutzo_registered_user add column if not exists display_name varchar(128) default '' not null`,
+		`alter table jutzo_registered_user add column if not exists bio text default '' not null`,
+		`alter table jutzo_registered_user add column if not exists avatar_url varchar(1024) default '' not null`,
+		`alter table jutzo_registered_user add column if not exists timezone varchar(64) default '' not null`,
+		`alter table jutzo_registered_user add column if not exists locale varchar(35) default '' not null`,
+		`alter table jutzo_registered_user add column if not exists notifications jsonb default '{}' not null`,
+		`update jutzo_database_info set schema_ordinal = 10`,
+	},
+
+	// Upgrade from schema 10 to schema 11: administrators list users by when they registered
+	{
+		`create index if not exists registered_user_creation_idx on jutzo_registered_user (creation_time, username)`,
+		`update jutzo_database_info set schema_ordinal = 11`,
+	},
+
+	// Upgrade from schema 11 to schema 12: tokens for SCIM provisioning
+	{
+		`create table if not exists jutzo_scim_token
+			(
+			unique_id     uuid      default gen_random_uuid() not null
+				constraint scim_token_key
+				primary key,
+			name          varchar(128)                        not null,
+			created_by    varchar(256)                        not null
+				constraint scim_token_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			token_hash    varchar(64)                         not null,
+			creation_time timestamp default now()             not null,
+			last_used     timestamp
+			)`,
+		`alter table jutzo_scim_token owner to jutzo`,
+		`create unique index if not exists scim_token_hash_idx on jutzo_scim_token (token_hash)`,
+		`update jutzo_database_info set schema_ordinal = 12`,
+	},
+
+	// Upgrade from schema 12 to schema 13: usernames and emails are compared
+	// normalized and case folded. The keys are filled in by normalizeUserKeys
+	{
+		`alter table jutzo_registered_user add column if not exists username_key varchar(256)`,
+		`alter table jutzo_registered_user add column if not exists email_key varchar(256)`,
+		`update jutzo_database_info set schema_ordinal = 13`,
+	},
+
+	// Upgrade from schema 13 to schema 14: the keys are unique, as the usernames and emails are
+	{
+		`create unique index if not exists username_key_idx on jutzo_registered_user (username_key)`,
+		`create unique index if not exists email_key_idx on jutzo_registered_user (email_key)`,
+		`update jutzo_database_info set schema_ordinal = 14`,
+	},
+
+	// Upgrade from schema 14 to schema 15: the tables the Postgres session store
+	// keeps its entries in. Sessions record when they were last seen in whole
+	// seconds, as the Redis index does, and can't outlive their absolute lifetime
+	{
+		`create table if not exists jutzo_session
+			(
+			id           varchar(64)  not null
+				constraint session_key
+				primary key,
+			username     varchar(256) not null,
+			value        bytea        not null,
+			last_seen    bigint       not null,
+			lifetime_end timestamp    not null,
+			expiration   timestamp    not null
+			)`,
+		`alter table jutzo_session owner to jutzo`,
+		`create index if not exists session_username_idx on jutzo_session (username)`,
+		`create index if not exists session_expiration_idx on jutzo_session (expiration)`,
+		`create table if not exists jutzo_transient
+			(
+			key        varchar(512) not null
+				constraint transient_key
+				primary key,
+			value      bytea        not null,
+			expiration timestamp
+			)`,
+		`alter table jutzo_transient owner to jutzo`,
+		`create table if not exists jutzo_counter
+			(
+			key        varchar(512) not null
+				constraint counter_key
+				primary key,
+			count      bigint       not null,
+			expiration timestamp
+			)`,
+		`alter table jutzo_counter owner to jutzo`,
+		`update jutzo_database_info set schema_ordinal = 15`,
+	},
 }
 
+// upgradeRoutines do the parts of a schema upgrade that can't be done in SQL,
+// keyed by the schema they upgrade to. Each runs after the statements for
+// that schema, in the same transaction
+var upgradeRoutines = map[int]func(tx *sql.Tx) error{
+	13: normalizeUserKeys,
+}
+
+// userColumns are selected by the routines that retrieve users (from the
+// registered user table aliased as u), and decoded by scanUser
+const userColumns = `u.username, u.email, u.email_validated, u.disabled, u.creation_time, u.password_hash, u.auth_source,
+       u.display_name, u.bio, u.avatar_url, u.timezone, u.locale, u.notifications,
+       coalesce((select string_agg(p.permission, ',' order by p.permission)
+                   from jutzo_user_permission p where p.username = u.username), ''),
+       coalesce((select string_agg(r.role, ',' order by r.role)
+                   from jutzo_user_role r where r.username = u.username), ''),
+       coalesce((select string_agg(e.permission, ',' order by e.permission)
+                   from jutzo_effective_permission e where e.username = u.username), '')`
+
 // Connect to the database. This should also do all structural
 // validations and forced updates required in order for other
 // routines to work successfully, including making sure there
@@ -169,18 +566,82 @@ func (connection *PostgresConnection) doesInfoTableExist() bool {
 // database into the version required for this version of the server
 func (connection *PostgresConnection) upgradeFrom(version int) error {
 
-	db := connection.db
 	log.Printf("Upgrading database, please wait...")
-	for targetVersion, statements := range UpgradeStatements[version:] {
+	for index, statements := range UpgradeStatements[version:] {
 
-		// Execute all the statements in that upgrade set
-		for _, statement := range statements {
-			_, err := db.Exec(statement)
-			if err != nil {
-				return err
+		// Execute all the statements in that upgrade set, along with any
+		// routine for it, so that a failed upgrade can be run again
+		schema := version + index + 1
+		if err := connection.inTransaction(func(tx *sql.Tx) error {
+			for _, statement := range statements {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
 			}
+			if routine, ok := upgradeRoutines[schema]; ok {
+				return routine(tx)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		log.Printf("Upgraded to version %d", schema)
+	}
+	return nil
+}
+
+// normalizeUserKeys fills in the normalized, case folded keys usernames and
+// emails are compared by. Users registered before normalization may collide,
+// e.g. "Bob" and "bob"; the first to register keeps the key, and each later
+// one is logged so that an administrator can resolve it. Until then the later
+// users can still be found by their exact username or email
+func normalizeUserKeys(tx *sql.Tx) error {
+	type userKeys struct {
+		username, email, usernameKey, emailKey string
+	}
+
+	// Read all the users before updating any of them
+	rows, err := tx.Query(`select username, email from jutzo_registered_user order by creation_time, username`)
+	if err != nil {
+		return err
+	}
+	var users []userKeys
+	for rows.Next() {
+		var user userKeys
+		if err = rows.Scan(&user.username, &user.email); err != nil {
+			closeRows(rows)
+			return err
+		}
+		user.usernameKey, user.emailKey = UsernameKey(user.username), EmailKey(user.email)
+		users = append(users, user)
+	}
+	closeRows(rows)
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	usernameOwners := make(map[string]string)
+	emailOwners := make(map[string]string)
+	statement := `update jutzo_registered_user set username_key = $2, email_key = $3 where username = $1`
+	for _, user := range users {
+		var usernameKey, emailKey sql.NullString
+		if owner, collides := usernameOwners[user.usernameKey]; collides {
+			log.Printf("Username %q collides with %q once normalized; it can only be found by its exact name",
+				user.username, owner)
+		} else {
+			usernameOwners[user.usernameKey] = user.username
+			usernameKey = sql.NullString{String: user.usernameKey, Valid: true}
+		}
+		if owner, collides := emailOwners[user.emailKey]; collides {
+			log.Printf("Email %q of user %q collides with the email of %q once normalized; it can only be found exactly",
+				user.email, user.username, owner)
+		} else {
+			emailOwners[user.emailKey] = user.username
+			emailKey = sql.NullString{String: user.emailKey, Valid: true}
+		}
+		if _, err = tx.Exec(statement, user.username, usernameKey, emailKey); err != nil {
+			return err
 		}
-		log.Printf("Upgraded to version %d", targetVersion+1)
 	}
 	return nil
 }
@@ -193,13 +654,14 @@ func (connection *PostgresConnection) CheckForUsernameOrEmail(username string, e
 	query := `select userQuery.userCount, emailQuery.emailCount from
     			(select count(*) userCount 
     			   from jutzo_registered_user j1 
-    			  where j1.username = $1) as userQuery,
+    			  where j1.username_key = $1 or j1.username = $2) as userQuery,
     			(select count(*) emailCount 
     			   from jutzo_registered_user j2 
-    			  where j2.email = $2) as emailQuery`
+    			  where j2.email_key = $3 or j2.email = $4) as emailQuery`
 
-	// Execute the query
-	row := connection.db.QueryRow(query, username, email)
+	// Execute the query, comparing the normalized keys as well as the exact
+	// values (which users whose keys collided are only known by)
+	row := connection.db.QueryRow(query, UsernameKey(username), username, EmailKey(email), email)
 	var userCount int
 	var emailCount int
 	if err := row.Scan(&userCount, &emailCount); err == nil {
@@ -209,60 +671,205 @@ func (connection *PostgresConnection) CheckForUsernameOrEmail(username string, e
 	}
 }
 
-// StoreUser in the database with the given username, email and password hash. This
-// routine will return an error if either the email or username are already in the
-// database, so checking first with CheckForUsernameOrEmail is a good idea
-func (connection *PostgresConnection) StoreUser(username string, email string, passwordHash []byte) (jutzo.UserInfo, error) {
+// StoreUser in the database with the given username, email, password hash and
+// authentication source. This routine will return an error if either the email or
+// username are already in the database, so checking first with CheckForUsernameOrEmail
+// is a good idea
+func (connection *PostgresConnection) StoreUser(username string, email string, passwordHash []byte, authSource string) (jutzo.UserInfo, error) {
 	statement := `insert into jutzo_registered_user
-                              (username, email,password_hash)
-                       values ($1, $2, $3)
-                     returning rights, creation_time`
+                              (username, email, password_hash, username_key, email_key, auth_source)
+                       values ($1, $2, $3, $4, $5, $6)`
+	roleStatement := `insert into jutzo_user_role (username, role) values ($1, $2)`
 
-	row := connection.db.QueryRow(statement, username, email, passwordHash)
-	var rightsString string
-	var creationTime time.Time
-	if err := row.Scan(&rightsString, &creationTime); err == nil {
-		return NewUserInfo(username, email, passwordHash, false, strings.Split(rightsString, ","), creationTime), err
+	// New users get the default role along with their record
+	err := connection.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(statement, username, email, passwordHash, UsernameKey(username), EmailKey(email),
+			authSource); err != nil {
+			return err
+		}
+		_, err := tx.Exec(roleStatement, username, jutzo.DefaultUserRole)
+		return err
+	})
+	if err == nil {
+		return connection.RetrieveUserInformation(username)
 	} else {
 		return nil, err
 	}
 }
 
-// UpdateUserInfo that has changed with what is stored in the database
+// UpdateUserInfo that has changed with what is stored in the database: the
+// email, whether the login is disabled, the rights granted directly to the
+// user and the user's roles. Returns ErrLastAdmin, changing nothing, if this
+// would leave no enabled administrator
 func (connection *PostgresConnection) UpdateUserInfo(userInfo jutzo.UserInfo) error {
 
-	statement := `update jutzo_registered_user set rights = $1 where username = $2`
+	username := userInfo.GetUsername()
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		profile := userInfo.GetProfile()
+		notifications, err := json.Marshal(profile.Notifications)
+		if err != nil {
+			return err
+		}
+		updateStatement := `update jutzo_registered_user
+                               set email = $1, disabled = $2, display_name = $3, bio = $4, avatar_url = $5,
+                                   timezone = $6, locale = $7, notifications = $8,
+                                   email_key = case when email = $1 then email_key else $10 end
+                             where username = $9`
+		if err := expectRowsAffected(tx.Exec(updateStatement, userInfo.GetEmail(), userInfo.IsDisabled(), profile.DisplayName,
+			profile.Bio, profile.AvatarURL, profile.Timezone, profile.Locale, notifications, username,
+			EmailKey(userInfo.GetEmail()))); err != nil {
+			return emailInUse(err)
+		}
 
-	// TODO - anything more than rights
-	rightsString := ""
-	separator := ""
-	for _, right := range userInfo.GetAllRights() {
-		rightsString = fmt.Sprintf("%s%s%s", rightsString, separator, right)
-		separator = ","
-	}
-	_, err := connection.db.Exec(statement, rightsString, userInfo.GetUsername())
-	return err
+		// Replace the direct grants
+		if _, err := tx.Exec(`delete from jutzo_user_permission where username = $1`, username); err != nil {
+			return err
+		}
+		if err := ensurePermissions(tx, userInfo.GetGrantedRights()); err != nil {
+			return err
+		}
+		for _, right := range userInfo.GetGrantedRights() {
+			if _, err := tx.Exec(`insert into jutzo_user_permission (username, permission) values ($1, $2)`,
+				username, right); err != nil {
+				return err
+			}
+		}
+
+		// Replace the roles
+		if _, err := tx.Exec(`delete from jutzo_user_role where username = $1`, username); err != nil {
+			return err
+		}
+		for _, role := range userInfo.GetRoles() {
+			if _, err := tx.Exec(`insert into jutzo_user_role (username, role) values ($1, $2)`,
+				username, role); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // RetrieveUserInformation for the specified username so that the user credentials can
-// be validated
+// be validated. The username is compared normalized and case folded, so "Bob" finds bob
 func (connection *PostgresConnection) RetrieveUserInformation(username string) (jutzo.UserInfo, error) {
-	statement := `SELECT email, email_validated, creation_time, 
-                            password_hash, email_validated, rights 
-                       from jutzo_registered_user
-                      where username = $1`
-	row := connection.db.QueryRow(statement, username)
-
-	var email string
-	var emailValidated bool
-	var creationTime time.Time
-	var passwordHash []byte
-	var rightsString string
-	if err := row.Scan(&email, &emailValidated, &creationTime, &passwordHash, &emailValidated, &rightsString); err != nil {
+	return connection.retrieveUser("username", username, UsernameKey(username))
+}
+
+// UpdatePasswordHash stored for the user, e.g. after rehashing their
+// password with stronger settings
+func (connection *PostgresConnection) UpdatePasswordHash(username string, passwordHash []byte) error {
+	statement := `update jutzo_registered_user set password_hash = $1 where username = $2`
+	return expectRowsAffected(connection.db.Exec(statement, passwordHash, username))
+}
+
+// DeleteUser and everything that belongs to them, which the foreign keys
+// cascade to. Returns sql.ErrNoRows if there is no such user, or ErrLastAdmin
+// if they are the last enabled administrator. The invites they registered
+// with no longer record their name
+func (connection *PostgresConnection) DeleteUser(username string) error {
+	statement := `delete from jutzo_registered_user where username = $1`
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		if err := expectRowsAffected(tx.Exec(statement, username)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`update jutzo_invite set used_by = $2 where used_by = $1`, username, deletedInviteUser)
+		return err
+	})
+}
+
+// RetrieveUserByEmail finds the user registered with the given email (compared
+// normalized and case folded), returning sql.ErrNoRows if there is no such user
+func (connection *PostgresConnection) RetrieveUserByEmail(email string) (jutzo.UserInfo, error) {
+	return connection.retrieveUser("email", email, EmailKey(email))
+}
+
+// retrieveUser finds the user with the given value in the (unique) column
+// specified, or the given key in the column's key. A user whose key collided
+// when the keys were introduced can only be found by the exact value, which
+// is preferred over the key
+func (connection *PostgresConnection) retrieveUser(column string, value string, key string) (jutzo.UserInfo, error) {
+	statement := fmt.Sprintf(`SELECT %s
+                                    from jutzo_registered_user u
+                                   where u.%[2]s_key = $2 or u.%[2]s = $1
+                                order by u.%[2]s = $1 desc
+                                   limit 1`, userColumns, column)
+
+	// Return a nil interface (rather than a nil *UserInfoImpl) if there's no such user
+	if userInfo, err := scanUser(connection.db.QueryRow(statement, value, key)); err == nil {
+		return userInfo, nil
+	} else {
 		return nil, err
+	}
+}
+
+// scanUser decodes a user from a row selected with userColumns
+func scanUser(row rowScanner) (*UserInfoImpl, error) {
+	userInfo := new(UserInfoImpl)
+	var grantedRights, roles, rights string
+	var notifications []byte
+	profile := &userInfo.Profile
+	if err := row.Scan(&userInfo.Username, &userInfo.Email, &userInfo.EmailValidated, &userInfo.Disabled, &userInfo.CreationTime,
+		&userInfo.PasswordHash, &userInfo.AuthSource, &profile.DisplayName, &profile.Bio, &profile.AvatarURL, &profile.Timezone, &profile.Locale,
+		&notifications, &grantedRights, &roles, &rights); err != nil {
+		return nil, err
+	} else {
+
+		// Preferences the user hasn't chosen keep their defaults
+		profile.Notifications = jutzo.DefaultNotificationPreferences
+		if err = json.Unmarshal(notifications, &profile.Notifications); err != nil {
+			return nil, err
+		}
+		userInfo.GrantedRights = splitRights(grantedRights)
+		userInfo.Roles = splitRights(roles)
+		userInfo.Rights = splitRights(rights)
+		return userInfo, nil
+	}
+}
+
+// MarkEmailValidated for the user without going through the validation
+// process (e.g. because an identity provider has verified it)
+func (connection *PostgresConnection) MarkEmailValidated(username string) error {
+	statement := `update jutzo_registered_user set email_validated = true where username = $1`
+	return expectRowsAffected(connection.db.Exec(statement, username))
+}
+
+// StoreExternalIdentity links the identity the provider knows by subject
+// to the given local user
+func (connection *PostgresConnection) StoreExternalIdentity(provider string, subject string, username string) error {
+	statement := `insert into jutzo_external_identity (provider, subject, username) values ($1, $2, $3)`
+	_, err := connection.db.Exec(statement, provider, subject, username)
+	return err
+}
+
+// RetrieveExternalIdentity returns the username of the local user linked
+// to the provider's subject, or sql.ErrNoRows if it isn't linked
+func (connection *PostgresConnection) RetrieveExternalIdentity(provider string, subject string) (username string, err error) {
+	statement := `select username from jutzo_external_identity where provider = $1 and subject = $2`
+	err = connection.db.QueryRow(statement, provider, subject).Scan(&username)
+	return
+}
+
+// ListExternalIdentities linked to the given user, oldest first
+func (connection *PostgresConnection) ListExternalIdentities(username string) ([]jutzo.LinkedIdentity, error) {
+	statement := `select provider, subject, creation_time
+                    from jutzo_external_identity
+                   where username = $1
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement, username); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.LinkedIdentity
+		for rows.Next() {
+			var identity jutzo.LinkedIdentity
+			if err = rows.Scan(&identity.Provider, &identity.Subject, &identity.CreationTime); err == nil {
+				result = append(result, identity)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
 	} else {
-		// Build and return the user info
-		return NewUserInfo(username, email, passwordHash, emailValidated, strings.Split(rightsString, ","), creationTime), nil
+		return nil, err
 	}
 }
 
@@ -295,83 +902,861 @@ func (connection *PostgresConnection) CreateValidationFor(username string) (uniq
 }
 
 // CompleteValidationFor the uniqueID created with the
-// CreateValidationFor method
-func (connection *PostgresConnection) CompleteValidationFor(uniqueID string) error {
+// CreateValidationFor method, returning the username of the user validated
+func (connection *PostgresConnection) CompleteValidationFor(uniqueID string) (username string, err error) {
 
 	db := connection.db
-	updateStatement := `update jutzo_registered_user set email_validated = true where username = 
-                               (select username from jutzo_pending_validation where unique_id = $1)`
+	selectStatement := `select username from jutzo_pending_validation where unique_id = $1`
+	updateStatement := `update jutzo_registered_user set email_validated = true where username = $1`
 	deleteStatement := `delete from jutzo_pending_validation where unique_id = $1`
 
-	// Mark the user's email as valid based on the unique ID provided
-	if _, err := db.Exec(updateStatement, uniqueID); err == nil {
+	// Find the user the validation is for, and mark their email as valid
+	if err = db.QueryRow(selectStatement, uniqueID).Scan(&username); err == nil {
+		if _, err = db.Exec(updateStatement, username); err == nil {
 
-		// Delete the pending validation record
-		_, err = db.Exec(deleteStatement, uniqueID)
-		return err
+			// Delete the pending validation record
+			_, err = db.Exec(deleteStatement, uniqueID)
+		}
+	}
+	return
+
+}
+
+// CountKeyCollisions returns the number of users whose username or email
+// collided with another user's when the keys were added, which left their key empty
+func (connection *PostgresConnection) CountKeyCollisions() (jutzo.KeyCollisions, error) {
+	var collisions jutzo.KeyCollisions
+	row := connection.db.QueryRow(`select coalesce(sum(case when username_key is null then 1 else 0 end), 0),
+	                                      coalesce(sum(case when email_key is null then 1 else 0 end), 0)
+	                                 from jutzo_registered_user`)
+	err := row.Scan(&collisions.Usernames, &collisions.Emails)
+	return collisions, err
+}
+
+// ListUsers selected by the query, in the order it asks for, along with the total number selected
+func (connection *PostgresConnection) ListUsers(query jutzo.UserQuery) (jutzo.UserPage, error) {
+	var page jutzo.UserPage
+	sort, err := userSort(query)
+	if err != nil {
+		return page, err
+	}
+	cursor, err := decodeUserCursor(query, sort)
+	if err != nil {
+		return page, err
+	}
+
+	var conditions []string
+	var args []any
+	condition := func(format string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if query.EmailContains != "" {
+		condition("position(lower($%d) in lower(u.email)) > 0", query.EmailContains)
+	}
+	if query.Right != "" {
+		condition(`exists (select 1 from jutzo_effective_permission e
+                            where e.username = u.username and e.permission = $%d)`, query.Right)
+	}
+	if query.Role != "" {
+		condition(`exists (select 1 from jutzo_user_role r where r.username = u.username and r.role = $%d)`, query.Role)
+	}
+	if query.Validated != nil {
+		condition("u.email_validated = $%d", *query.Validated)
+	}
+	if !query.CreatedSince.IsZero() {
+		condition("u.creation_time >= $%d", query.CreatedSince.UTC())
+	}
+	if !query.CreatedUntil.IsZero() {
+		condition("u.creation_time < $%d", query.CreatedUntil.UTC())
+	}
+	where := func() string {
+		if len(conditions) > 0 {
+			return " where " + strings.Join(conditions, " and ")
+		}
+		return ""
+	}
+
+	// The total doesn't depend on the page
+	if err = connection.db.QueryRow(`select count(*) from jutzo_registered_user u`+where(), args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	// Users with the same creation time are ordered by username, so every user has a place in the order
+	comparison, direction := ">", "asc"
+	if query.Descending {
+		comparison, direction = "<", "desc"
+	}
+	order := fmt.Sprintf("u.username %s", direction)
+	if sort == jutzo.UserSortCreated {
+		order = fmt.Sprintf("u.creation_time %s, u.username %s", direction, direction)
+		if cursor != nil {
+			args = append(args, cursor.CreationTime.UTC(), cursor.Username)
+			conditions = append(conditions, fmt.Sprintf("(u.creation_time, u.username) %s ($%d, $%d)",
+				comparison, len(args)-1, len(args)))
+		}
+	} else if cursor != nil {
+		condition("u.username "+comparison+" $%d", cursor.Username)
+	}
+	statement := `select ` + userColumns + ` from jutzo_registered_user u` + where() + " order by " + order
+
+	// One more user than asked for tells us whether there is another page
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" limit %d", query.Limit+1)
+	}
+
+	if rows, err := connection.db.Query(statement, args...); err == nil {
+		defer closeRows(rows)
+		for rows.Next() {
+			if userInfo, err := scanUser(rows); err != nil {
+				return page, err
+			} else {
+				// Password hashes never leave the database in a listing
+				userInfo.PasswordHash = []byte{}
+				page.Users = append(page.Users, userInfo)
+			}
+		}
+		if query.Limit > 0 && len(page.Users) > query.Limit {
+			page.Users = page.Users[:query.Limit]
+			page.NextCursor = encodeUserCursor(query, sort, page.Users[query.Limit-1])
+		}
+		return page, rows.Err()
 	} else {
+		return page, err
+	}
+}
+
+// adminCountQuery counts the administrator users whose login is enabled
+const adminCountQuery = `select count(distinct e.username)
+                           from jutzo_effective_permission e
+                           join jutzo_registered_user u on u.username = e.username
+                          where e.permission = 'admin' and not u.disabled`
+
+// adminLockKey is the advisory lock held by the transactions that can change
+// who is an administrator, so that two of them can't each remove a different
+// administrator believing the other is still there
+const adminLockKey = 0x6a75747a6f
+
+// GetAdminCount returns the number of administrator users whose login is enabled
+func (connection *PostgresConnection) GetAdminCount() (count int, err error) {
+
+	// Count the admins
+	row := connection.db.QueryRow(adminCountQuery)
+	err = row.Scan(&count)
+	return
+}
+
+// inAdminTransaction runs work that can change who is an administrator in a
+// transaction, rolling it back with ErrLastAdmin if it leaves none
+func (connection *PostgresConnection) inAdminTransaction(work func(tx *sql.Tx) error) error {
+	return connection.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`select pg_advisory_xact_lock($1)`, adminLockKey); err != nil {
+			return err
+		}
+		return keepAnAdmin(tx, work)
+	})
+}
+
+// keepAnAdmin does the work in the transaction, returning ErrLastAdmin (so
+// that the transaction is rolled back) if it leaves no enabled administrator
+// where there was one. The transaction must hold off other changes to the
+// administrators until it ends
+func keepAnAdmin(tx *sql.Tx, work func(tx *sql.Tx) error) error {
+	var before, after int
+	if err := tx.QueryRow(adminCountQuery).Scan(&before); err != nil {
+		return err
+	}
+	if err := work(tx); err != nil {
 		return err
 	}
+	if err := tx.QueryRow(adminCountQuery).Scan(&after); err != nil {
+		return err
+	} else if before > 0 && after == 0 {
+		return jutzo.ErrLastAdmin
+	}
+	return nil
+}
+
+// StoreAPIKey for the given user. Only the hash of the key is stored; the
+// expiration time may be the zero time for a key that never expires
+func (connection *PostgresConnection) StoreAPIKey(username string, name string, keyHash string, rights []string, expirationTime time.Time) (jutzo.APIKey, error) {
+	statement := `insert into jutzo_api_key (username, name, key_hash, rights, expiration_time)
+                       values ($1, $2, $3, $4, $5)
+                    returning unique_id, creation_time`
+
+	expiration := sql.NullTime{Time: expirationTime, Valid: !expirationTime.IsZero()}
+	row := connection.db.QueryRow(statement, username, name, keyHash, strings.Join(rights, ","), expiration)
+	apiKey := &APIKeyImpl{Username: username, Name: name, Rights: rights, ExpirationTime: expirationTime}
+	if err := row.Scan(&apiKey.ID, &apiKey.CreationTime); err == nil {
+		return apiKey, nil
+	} else {
+		return nil, err
+	}
+}
+
+// RetrieveAPIKeyByHash finds the API key with the given hash, returning
+// sql.ErrNoRows if there is no such key
+func (connection *PostgresConnection) RetrieveAPIKeyByHash(keyHash string) (jutzo.APIKey, error) {
+	statement := `select unique_id, username, name, rights, creation_time, expiration_time, last_used
+                    from jutzo_api_key
+                   where key_hash = $1`
+	return scanAPIKey(connection.db.QueryRow(statement, keyHash))
+}
+
+// ListAPIKeys that belong to the given user, oldest first
+func (connection *PostgresConnection) ListAPIKeys(username string) ([]jutzo.APIKey, error) {
+	statement := `select unique_id, username, name, rights, creation_time, expiration_time, last_used
+                    from jutzo_api_key
+                   where username = $1
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement, username); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.APIKey
+		for rows.Next() {
+			if apiKey, err := scanAPIKey(rows); err == nil {
+				result = append(result, apiKey)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteAPIKey belonging to the given user. Returns sql.ErrNoRows if the
+// user has no key with that ID
+func (connection *PostgresConnection) DeleteAPIKey(username string, uniqueID string) error {
+	statement := `delete from jutzo_api_key where username = $1 and unique_id::text = $2`
+	return expectRowsAffected(connection.db.Exec(statement, username, uniqueID))
+}
+
+// TouchAPIKey records that the key has just been used
+func (connection *PostgresConnection) TouchAPIKey(uniqueID string) error {
+	statement := `update jutzo_api_key set last_used = now() where unique_id = $1`
+	_, err := connection.db.Exec(statement, uniqueID)
+	return err
+}
+
+// RetrieveSetting with the given name, returning sql.ErrNoRows if it hasn't been set
+func (connection *PostgresConnection) RetrieveSetting(name string) (value string, err error) {
+	statement := `select value from jutzo_setting where name = $1`
+	err = connection.db.QueryRow(statement, name).Scan(&value)
+	return
+}
+
+// StoreSetting with the given name, replacing any value it already has
+func (connection *PostgresConnection) StoreSetting(name string, value string) error {
+	statement := `insert into jutzo_setting (name, value) values ($1, $2)
+                  on conflict (name) do update set value = excluded.value`
+	_, err := connection.db.Exec(statement, name, value)
+	return err
+}
+
+// StoreInvite created by the given user. Only the hash of the code is stored;
+// the expiration time may be the zero time for an invite that never expires
+func (connection *PostgresConnection) StoreInvite(createdBy string, codeHash string, rights []string, expirationTime time.Time) (jutzo.Invite, error) {
+	statement := `insert into jutzo_invite (created_by, code_hash, rights, expiration_time)
+                       values ($1, $2, $3, $4)
+                    returning unique_id, creation_time`
+
+	expiration := sql.NullTime{Time: expirationTime, Valid: !expirationTime.IsZero()}
+	row := connection.db.QueryRow(statement, createdBy, codeHash, strings.Join(rights, ","), expiration)
+	invite := &InviteImpl{CreatedBy: createdBy, Rights: rights, ExpirationTime: expirationTime}
+	if err := row.Scan(&invite.ID, &invite.CreationTime); err == nil {
+		return invite, nil
+	} else {
+		return nil, err
+	}
+}
+
+// ClaimInvite with the given hash for the user registering with it. Returns
+// sql.ErrNoRows if there's no such invite, or it has been used or has expired
+func (connection *PostgresConnection) ClaimInvite(codeHash string, username string) (jutzo.Invite, error) {
+	statement := `update jutzo_invite set used_by = $2, used_time = now()
+                   where code_hash = $1 and used_by is null
+                     and (expiration_time is null or expiration_time > now())
+               returning ` + inviteColumns
+	return scanInvite(connection.db.QueryRow(statement, codeHash, username))
+}
+
+// ReleaseInvite that was claimed, so that it can be used again (e.g. because
+// the registration it was claimed for failed)
+func (connection *PostgresConnection) ReleaseInvite(codeHash string) error {
+	statement := `update jutzo_invite set used_by = null, used_time = null where code_hash = $1`
+	return expectRowsAffected(connection.db.Exec(statement, codeHash))
+}
+
+// ListInvites created by the given user, oldest first
+func (connection *PostgresConnection) ListInvites(createdBy string) ([]jutzo.Invite, error) {
+	statement := `select ` + inviteColumns + `
+                    from jutzo_invite
+                   where created_by = $1
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement, createdBy); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.Invite
+		for rows.Next() {
+			if invite, err := scanInvite(rows); err == nil {
+				result = append(result, invite)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteInvite created by the given user. Returns sql.ErrNoRows if the
+// user has no invite with that ID
+func (connection *PostgresConnection) DeleteInvite(createdBy string, uniqueID string) error {
+	statement := `delete from jutzo_invite where created_by = $1 and unique_id::text = $2`
+	return expectRowsAffected(connection.db.Exec(statement, createdBy, uniqueID))
+}
+
+// StoreDeletionRequest for the given user, replacing any request they have already made
+func (connection *PostgresConnection) StoreDeletionRequest(username string, anonymize bool, dueTime time.Time) (jutzo.DeletionRequest, error) {
+	statement := `insert into jutzo_deletion_request (username, anonymize, due_time)
+                       values ($1, $2, $3)
+                  on conflict (username) do update
+                          set anonymize = excluded.anonymize, request_time = now(), due_time = excluded.due_time
+                    returning ` + deletionRequestColumns
+
+	return scanDeletionRequest(connection.db.QueryRow(statement, username, anonymize, dueTime))
+}
+
+// RetrieveDeletionRequest for the given user, or sql.ErrNoRows if they haven't made one
+func (connection *PostgresConnection) RetrieveDeletionRequest(username string) (jutzo.DeletionRequest, error) {
+	statement := `select ` + deletionRequestColumns + ` from jutzo_deletion_request where username = $1`
+	return scanDeletionRequest(connection.db.QueryRow(statement, username))
+}
 
+// DeleteDeletionRequest for the given user, returning sql.ErrNoRows if they haven't made one
+func (connection *PostgresConnection) DeleteDeletionRequest(username string) error {
+	statement := `delete from jutzo_deletion_request where username = $1`
+	return expectRowsAffected(connection.db.Exec(statement, username))
 }
 
-// ListUsers in the database, starting with the specified user, until maxUsers are returned.
-// If the starting user is specified as "", then the list will start at the beginning of the
-// users in the database; otherwise it can be used for pagination through the set of users.
-// The first user returned will be the first user AFTER the one specified, so duplicate records
-// will not occur. If no more users can be found, a nil slice will be returned with no error
-func (connection *PostgresConnection) ListUsers(startingAt string, maxUsers int) ([]jutzo.UserInfo, error) {
-	sqlStatement := `SELECT username, email, email_validated, creation_time, email_validated, rights
-                       from jutzo_registered_user
-                       where username > $1
-                       order by username
-                       limit $2`
+// ListDueDeletions returns the deletion requests that are due at the time given
+func (connection *PostgresConnection) ListDueDeletions(dueBy time.Time) ([]jutzo.DeletionRequest, error) {
+	statement := `select ` + deletionRequestColumns + `
+                    from jutzo_deletion_request
+                   where due_time <= $1
+                   order by due_time`
 
-	// Get the max users to return - or MaxInt if the user specifies an invalid one
-	if maxUsers <= 0 {
-		maxUsers = math.MaxInt32
+	if rows, err := connection.db.Query(statement, dueBy); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.DeletionRequest
+		for rows.Next() {
+			if request, err := scanDeletionRequest(rows); err == nil {
+				result = append(result, request)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
 	}
+}
 
-	if rows, err := connection.db.Query(sqlStatement, startingAt, maxUsers); err == nil {
+// AnonymizeUser renames the user and replaces their email, and removes everything
+// else that could identify them. The rename cascades to the tables that reference
+// the user, so what is left (e.g. the invites they used) refers to the new name.
+// Returns ErrLastAdmin if they are the last enabled administrator
+func (connection *PostgresConnection) AnonymizeUser(username string, anonymousName string, anonymousEmail string) error {
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		renameStatement := `update jutzo_registered_user
+                               set username = $2, email = $3, password_hash = '', auth_source = 'local',
+                                   email_validated = false, disabled = true,
+                                   username_key = $4, email_key = $5,
+                                   display_name = '', bio = '', avatar_url = '', timezone = '', locale = '',
+                                   notifications = '{}'
+                             where username = $1`
+		if err := expectRowsAffected(tx.Exec(renameStatement, username, anonymousName, anonymousEmail,
+			UsernameKey(anonymousName), EmailKey(anonymousEmail))); err != nil {
+			return err
+		}
 
-		defer func(rows *sql.Rows) {
-			if err := rows.Close(); err != nil {
-				log.Printf("Error closing row: %s", err.Error())
+		for _, statement := range []string{
+			`delete from jutzo_user_permission where username = $1`,
+			`delete from jutzo_user_role where username = $1`,
+			`delete from jutzo_api_key where username = $1`,
+			`delete from jutzo_external_identity where username = $1`,
+			`delete from jutzo_pending_validation where username = $1`,
+			`delete from jutzo_invite where created_by = $1`,
+			`delete from jutzo_deletion_request where username = $1`,
+		} {
+			if _, err := tx.Exec(statement, anonymousName); err != nil {
+				return err
 			}
-		}(rows)
-		var username string
-		var result []jutzo.UserInfo
+		}
+
+		// Invites only record the name of the user that used them
+		_, err := tx.Exec(`update jutzo_invite set used_by = $2 where used_by = $1`, username, anonymousName)
+		return err
+	})
+}
+
+// StoreAuditEvent in the audit log
+func (connection *PostgresConnection) StoreAuditEvent(event jutzo.AuditEvent) error {
+	statement := `insert into jutzo_audit_event (event_time, event_type, actor, target, ip, user_agent, detail)
+                       values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := connection.db.Exec(statement, event.Time, event.Type, event.Actor, event.Target,
+		event.IP, event.UserAgent, event.Detail)
+	return err
+}
+
+// PseudonymizeAuditEvents replaces the username with the pseudonym wherever
+// an audit event names them, and removes the addresses and user agents of
+// the events they caused
+func (connection *PostgresConnection) PseudonymizeAuditEvents(username string, pseudonym string) error {
+	_, err := connection.db.Exec(`select jutzo_pseudonymize_audit_events($1, $2)`, username, pseudonym)
+	return err
+}
+
+// ListAuditEvents selected by the query, newest first
+func (connection *PostgresConnection) ListAuditEvents(query jutzo.AuditQuery) ([]jutzo.AuditEvent, error) {
+	var conditions []string
+	var args []any
+	condition := func(format string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if len(query.Types) > 0 {
+		placeholders := make([]string, 0, len(query.Types))
+		for _, eventType := range query.Types {
+			args = append(args, eventType)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		conditions = append(conditions, "event_type in ("+strings.Join(placeholders, ", ")+")")
+	}
+	if query.Actor != "" {
+		condition("actor = $%d", query.Actor)
+	}
+	if query.Target != "" {
+		condition("target = $%d", query.Target)
+	}
+	if query.User != "" {
+		args = append(args, query.User)
+		conditions = append(conditions, fmt.Sprintf("(actor = $%d or target = $%d)", len(args), len(args)))
+	}
+	if query.IP != "" {
+		condition("ip = $%d", query.IP)
+	}
+	if !query.Since.IsZero() {
+		condition("event_time >= $%d", query.Since)
+	}
+	if !query.Until.IsZero() {
+		condition("event_time < $%d", query.Until)
+	}
+	if query.Before > 0 {
+		condition("id < $%d", query.Before)
+	}
+
+	statement := `select id, event_time, event_type, actor, target, ip, user_agent, detail from jutzo_audit_event`
+	if len(conditions) > 0 {
+		statement += " where " + strings.Join(conditions, " and ")
+	}
+	statement += " order by id desc"
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" limit %d", query.Limit)
+	}
+
+	if rows, err := connection.db.Query(statement, args...); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.AuditEvent
 		for rows.Next() {
-			var email string
-			var emailValidated bool
-			var creationTime time.Time
-			var rightsString string
+			var event jutzo.AuditEvent
+			if err = rows.Scan(&event.ID, &event.Time, &event.Type, &event.Actor, &event.Target,
+				&event.IP, &event.UserAgent, &event.Detail); err == nil {
+				result = append(result, event)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// deletionRequestColumns are selected by the routines that retrieve deletion
+// requests, and decoded by scanDeletionRequest
+const deletionRequestColumns = `username, anonymize, request_time, due_time`
+
+// scanDeletionRequest decodes a deletion request from a row selected with deletionRequestColumns
+func scanDeletionRequest(row rowScanner) (jutzo.DeletionRequest, error) {
+	var request jutzo.DeletionRequest
+	err := row.Scan(&request.Username, &request.Anonymize, &request.RequestTime, &request.DueTime)
+	return request, err
+}
+
+// inviteColumns are selected by the routines that retrieve invites, and decoded by scanInvite
+const inviteColumns = `unique_id, created_by, rights, creation_time, expiration_time, coalesce(used_by, '')`
+
+// scanInvite decodes an invite from a row selected with inviteColumns
+func scanInvite(row rowScanner) (jutzo.Invite, error) {
+	invite := new(InviteImpl)
+	var rightsString string
+	var expirationTime sql.NullTime
+	if err := row.Scan(&invite.ID, &invite.CreatedBy, &rightsString, &invite.CreationTime,
+		&expirationTime, &invite.UsedBy); err == nil {
+		invite.Rights = splitRights(rightsString)
+		invite.ExpirationTime = expirationTime.Time
+		return invite, nil
+	} else {
+		return nil, err
+	}
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows, so that the
+// same routine can decode a record from either
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanAPIKey decodes an API key from a row selected with the columns
+// unique_id, username, name, rights, creation_time, expiration_time, last_used
+func scanAPIKey(row rowScanner) (jutzo.APIKey, error) {
+	apiKey := new(APIKeyImpl)
+	var rightsString string
+	var expirationTime, lastUsed sql.NullTime
+	if err := row.Scan(&apiKey.ID, &apiKey.Username, &apiKey.Name, &rightsString,
+		&apiKey.CreationTime, &expirationTime, &lastUsed); err == nil {
+		apiKey.Rights = splitRights(rightsString)
+		apiKey.ExpirationTime = expirationTime.Time
+		apiKey.LastUsed = lastUsed.Time
+		return apiKey, nil
+	} else {
+		return nil, err
+	}
+}
+
+// splitRights converts a comma separated list of rights into a slice,
+// treating the empty string as no rights at all
+func splitRights(rightsString string) []string {
+	if rightsString == "" {
+		return []string{}
+	} else {
+		return strings.Split(rightsString, ",")
+	}
+}
+
+// closeRows is deferred by routines that iterate over a query result
+func closeRows(rows *sql.Rows) {
+	if err := rows.Close(); err != nil {
+		log.Printf("Error closing row: %s", err.Error())
+	}
+}
+
+// emailInUse returns ErrEmailInUse for an error that says another user
+// already has the email (or one that differs only in case), or the error
+func emailInUse(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" &&
+		(pqErr.Constraint == "email_idx" || pqErr.Constraint == "email_key_idx") {
+		return jutzo.ErrEmailInUse
+	}
+	return err
+}
+
+// expectRowsAffected converts the result of an update or delete that
+// touched no rows into sql.ErrNoRows
+func expectRowsAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	} else if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return sql.ErrNoRows
+	} else {
+		return nil
+	}
+}
+
+// StoreOAuthClient registers an application that can sign users in. The
+// secret hash is empty for public clients
+func (connection *PostgresConnection) StoreOAuthClient(clientID string, name string, redirectURIs []string, secretHash string) (jutzo.OAuthClient, error) {
+	statement := `insert into jutzo_oauth_client (client_id, name, redirect_uris, secret_hash)
+                       values ($1, $2, $3, $4)
+                    returning creation_time`
 
-			if err := rows.Scan(&username, &email, &emailValidated, &creationTime, &emailValidated, &rightsString); err != nil {
+	client := &OAuthClientImpl{ClientID: clientID, Name: name, RedirectURIs: redirectURIs,
+		Confidential: secretHash != "", SecretHash: secretHash}
+	secret := sql.NullString{String: secretHash, Valid: secretHash != ""}
+	row := connection.db.QueryRow(statement, clientID, name, strings.Join(redirectURIs, " "), secret)
+	if err := row.Scan(&client.CreationTime); err == nil {
+		return client, nil
+	} else {
+		return nil, err
+	}
+}
+
+// RetrieveOAuthClient with the given ID, or sql.ErrNoRows if there is no such client
+func (connection *PostgresConnection) RetrieveOAuthClient(clientID string) (jutzo.OAuthClient, error) {
+	statement := `select client_id, name, redirect_uris, secret_hash, creation_time
+                    from jutzo_oauth_client
+                   where client_id = $1`
+	return scanOAuthClient(connection.db.QueryRow(statement, clientID))
+}
+
+// ListOAuthClients that are registered, in order of registration
+func (connection *PostgresConnection) ListOAuthClients() ([]jutzo.OAuthClient, error) {
+	statement := `select client_id, name, redirect_uris, secret_hash, creation_time
+                    from jutzo_oauth_client
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.OAuthClient
+		for rows.Next() {
+			if client, err := scanOAuthClient(rows); err == nil {
+				result = append(result, client)
+			} else {
 				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteOAuthClient with the given ID, returning sql.ErrNoRows if there is no such client
+func (connection *PostgresConnection) DeleteOAuthClient(clientID string) error {
+	statement := `delete from jutzo_oauth_client where client_id = $1`
+	return expectRowsAffected(connection.db.Exec(statement, clientID))
+}
+
+// scanOAuthClient decodes a client from a row selected with the columns
+// client_id, name, redirect_uris, secret_hash, creation_time
+func scanOAuthClient(row rowScanner) (jutzo.OAuthClient, error) {
+	client := new(OAuthClientImpl)
+	var redirectURIs string
+	var secretHash sql.NullString
+	if err := row.Scan(&client.ClientID, &client.Name, &redirectURIs, &secretHash, &client.CreationTime); err == nil {
+		client.RedirectURIs = strings.Fields(redirectURIs)
+		client.SecretHash = secretHash.String
+		client.Confidential = secretHash.Valid
+		return client, nil
+	} else {
+		return nil, err
+	}
+}
+
+// StoreRole with the rights it bundles and the roles it inherits from,
+// replacing the role if it already exists. Returns ErrLastAdmin if this
+// would leave no enabled administrator
+func (connection *PostgresConnection) StoreRole(name string, description string, rights []string, inherits []string) error {
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`insert into jutzo_role (name, description) values ($1, $2)
+                                  on conflict (name) do update set description = excluded.description`,
+			name, description); err != nil {
+			return err
+		}
+
+		// Replace the rights and inheritance of the role
+		if _, err := tx.Exec(`delete from jutzo_role_permission where role = $1`, name); err != nil {
+			return err
+		}
+		if err := ensurePermissions(tx, rights); err != nil {
+			return err
+		}
+		for _, right := range rights {
+			if _, err := tx.Exec(`insert into jutzo_role_permission (role, permission) values ($1, $2)`,
+				name, right); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`delete from jutzo_role_inheritance where role = $1`, name); err != nil {
+			return err
+		}
+		for _, parent := range inherits {
+			if _, err := tx.Exec(`insert into jutzo_role_inheritance (role, parent_role) values ($1, $2)`,
+				name, parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RetrieveRole with the given name, or sql.ErrNoRows if there is no such role
+func (connection *PostgresConnection) RetrieveRole(name string) (jutzo.Role, error) {
+	statement := `select ` + roleColumns + ` from jutzo_role r where r.name = $1`
+	return scanRole(connection.db.QueryRow(statement, name))
+}
+
+// ListRoles that are defined, in name order
+func (connection *PostgresConnection) ListRoles() ([]jutzo.Role, error) {
+	statement := `select ` + roleColumns + ` from jutzo_role r order by r.name`
+
+	if rows, err := connection.db.Query(statement); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.Role
+		for rows.Next() {
+			if role, err := scanRole(rows); err == nil {
+				result = append(result, role)
 			} else {
-				result = append(result, NewUserInfo(username, email, []byte{},
-					emailValidated, strings.Split(rightsString, ","), creationTime))
+				return nil, err
 			}
 		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
 
-		if len(result) < maxUsers {
-			return result, nil
-		} else {
-			return result, nil
+// ListRoleMembers returns the usernames of the users who hold the role, whether
+// it is assigned to them or inherited by one of the roles they are assigned
+func (connection *PostgresConnection) ListRoleMembers(name string) ([]string, error) {
+	statement := `with recursive holding_roles(role) as (
+                      select $1::varchar
+                      union
+                      select inheritance.role
+                        from holding_roles
+                        join jutzo_role_inheritance inheritance on inheritance.parent_role = holding_roles.role
+                  )
+                  select distinct user_role.username
+                    from jutzo_user_role user_role
+                    join holding_roles on holding_roles.role = user_role.role
+                   order by user_role.username`
+
+	if rows, err := connection.db.Query(statement, name); err == nil {
+		defer closeRows(rows)
+		var result []string
+		for rows.Next() {
+			var username string
+			if err = rows.Scan(&username); err != nil {
+				return nil, err
+			}
+			result = append(result, username)
 		}
+		return result, rows.Err()
 	} else {
 		return nil, err
 	}
+}
 
+// DeleteRole with the given name, returning sql.ErrNoRows if there is no such
+// role, or ErrLastAdmin if this would leave no enabled administrator
+func (connection *PostgresConnection) DeleteRole(name string) error {
+	statement := `delete from jutzo_role where name = $1`
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		return expectRowsAffected(tx.Exec(statement, name))
+	})
 }
 
-// GetAdminCount returns the number of administrator users
-func (connection *PostgresConnection) GetAdminCount() (count int, err error) {
-	query := `select count(*) from jutzo_registered_user where rights like '%admin%'`
+// roleColumns are selected by the routines that retrieve roles (from
+// the role table aliased as r), and decoded by scanRole
+const roleColumns = `r.name, r.description,
+       coalesce((select string_agg(p.permission, ',' order by p.permission)
+                   from jutzo_role_permission p where p.role = r.name), ''),
+       coalesce((select string_agg(i.parent_role, ',' order by i.parent_role)
+                   from jutzo_role_inheritance i where i.role = r.name), '')`
 
-	// Count the admins
-	row := connection.db.QueryRow(query)
-	err = row.Scan(&count)
-	return
+// scanRole decodes a role from a row selected with roleColumns
+func scanRole(row rowScanner) (jutzo.Role, error) {
+	role := new(RoleImpl)
+	var rights, inherits string
+	if err := row.Scan(&role.Name, &role.Description, &rights, &inherits); err == nil {
+		role.Rights = splitRights(rights)
+		role.InheritedRoles = splitRights(inherits)
+		return role, nil
+	} else {
+		return nil, err
+	}
+}
+
+// ensurePermissions makes sure the permissions exist, so that they
+// can be granted to users and roles
+func ensurePermissions(tx *sql.Tx, rights []string) error {
+	for _, right := range rights {
+		if _, err := tx.Exec(`insert into jutzo_permission (name) values ($1) on conflict do nothing`, right); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTransaction runs the work given in a transaction, committing it if
+// the work succeeds and rolling it back otherwise
+func (connection *PostgresConnection) inTransaction(work func(tx *sql.Tx) error) error {
+	if tx, err := connection.db.Begin(); err == nil {
+		if err = work(tx); err == nil {
+			return tx.Commit()
+		} else {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Error rolling back transaction: %s", rollbackErr.Error())
+			}
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// scimTokenColumns are selected by the routines that retrieve SCIM tokens,
+// and decoded by scanSCIMToken
+const scimTokenColumns = `unique_id, name, created_by, creation_time, last_used`
+
+// scanSCIMToken from a row holding the scimTokenColumns
+func scanSCIMToken(row rowScanner) (jutzo.SCIMToken, error) {
+	var token jutzo.SCIMToken
+	var lastUsed sql.NullTime
+	err := row.Scan(&token.ID, &token.Name, &token.CreatedBy, &token.CreationTime, &lastUsed)
+	token.LastUsed = lastUsed.Time
+	return token, err
+}
+
+// StoreSCIMToken created by the given user. Only the hash of the token is stored
+func (connection *PostgresConnection) StoreSCIMToken(createdBy string, name string, tokenHash string) (jutzo.SCIMToken, error) {
+	statement := `insert into jutzo_scim_token (name, created_by, token_hash)
+                       values ($1, $2, $3)
+                    returning ` + scimTokenColumns
+	return scanSCIMToken(connection.db.QueryRow(statement, name, createdBy, tokenHash))
+}
+
+// RetrieveSCIMTokenByHash finds the SCIM token with the given hash, returning
+// sql.ErrNoRows if there is no such token
+func (connection *PostgresConnection) RetrieveSCIMTokenByHash(tokenHash string) (jutzo.SCIMToken, error) {
+	statement := `select ` + scimTokenColumns + ` from jutzo_scim_token where token_hash = $1`
+	return scanSCIMToken(connection.db.QueryRow(statement, tokenHash))
+}
+
+// TouchSCIMToken records that the token with the given ID has just been used
+func (connection *PostgresConnection) TouchSCIMToken(uniqueID string) error {
+	_, err := connection.db.Exec(`update jutzo_scim_token set last_used = now() where unique_id::text = $1`, uniqueID)
+	return err
+}
+
+// ListSCIMTokens that have been issued, oldest first
+func (connection *PostgresConnection) ListSCIMTokens() ([]jutzo.SCIMToken, error) {
+	statement := `select ` + scimTokenColumns + ` from jutzo_scim_token order by creation_time`
+
+	if rows, err := connection.db.Query(statement); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.SCIMToken
+		for rows.Next() {
+			if token, err := scanSCIMToken(rows); err == nil {
+				result = append(result, token)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteSCIMToken with the given ID, returning sql.ErrNoRows if there is no such token
+func (connection *PostgresConnection) DeleteSCIMToken(uniqueID string) error {
+	statement := `delete from jutzo_scim_token where unique_id::text = $1`
+	return expectRowsAffected(connection.db.Exec(statement, uniqueID))
 }
@@ -0,0 +1,1415 @@
+package impl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"services/jutzo"
+	"strings"
+	"time"
+
+	// The pure Go SQLite driver, so that no C toolchain is needed
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteConnection keeps everything in a single SQLite file, for small
+// deployments and demos that shouldn't need a Postgres server. It behaves
+// as PostgresConnection does, at the same schema version
+type SQLiteConnection struct {
+	config jutzo.ConfigurationProvider
+	db     *sql.DB
+}
+
+func NewSQLiteConnection(configurationProvider jutzo.ConfigurationProvider) *SQLiteConnection {
+	result := new(SQLiteConnection)
+	result.config = configurationProvider
+	return result
+}
+
+// SQLiteUpgradeStatements are the equivalent of UpgradeStatements for SQLite,
+// upgrading to the same schema versions (so there must be SupportedSchema of
+// them). SQLite has no UUID generation, so the unique IDs are made by the
+// connection; times are always stored in UTC, so that they compare as text
+var SQLiteUpgradeStatements = [...][]string{
+
+	// Upgrade from schema 0 (non-existent) to schema 1
+	{
+		`drop table if exists jutzo_database_info`,
+		`drop table if exists jutzo_pending_validation`,
+		`drop table if exists jutzo_registered_user`,
+		`create table if not exists jutzo_registered_user
+			(
+			username        varchar(256)                        not null
+				constraint username_key
+				primary key,
+			email           varchar(256)                        not null,
+			email_validated boolean   default false             not null,
+			creation_time   timestamp default current_timestamp not null,
+			password_hash   blob                                not null,
+			rights          text      default 'blog,login'
+			)`,
+		`create table if not exists jutzo_pending_validation
+			(
+			unique_id varchar(36)  not null
+				constraint uuid_key
+				primary key,
+			username  varchar(256) not null
+				constraint foreign_key_name
+				references jutzo_registered_user
+				on update cascade on delete cascade
+			)`,
+		`create unique index if not exists email_idx on jutzo_registered_user (email)`,
+		`create table jutzo_database_info
+			(
+				schema_ordinal integer default 1
+			)`,
+		`insert into jutzo_database_info (schema_ordinal) values (1)`,
+	},
+
+	// Upgrade from schema 1 to schema 2: API keys
+	{
+		`create table if not exists jutzo_api_key
+			(
+			unique_id       varchar(36)                         not null
+				constraint api_key_key
+				primary key,
+			username        varchar(256)                        not null
+				constraint api_key_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			name            varchar(256)                        not null,
+			key_hash        varchar(64)                         not null,
+			rights          text                                not null,
+			creation_time   timestamp default current_timestamp not null,
+			expiration_time timestamp,
+			last_used       timestamp
+			)`,
+		`create unique index if not exists api_key_hash_idx on jutzo_api_key (key_hash)`,
+		`update jutzo_database_info set schema_ordinal = 2`,
+	},
+
+	// Upgrade from schema 2 to schema 3: identities from external providers, and
+	// how each user authenticates. Every user until now has a local password
+	{
+		`create table if not exists jutzo_external_identity
+			(
+			provider      varchar(64)                         not null,
+			subject       varchar(256)                        not null,
+			username      varchar(256)                        not null
+				constraint external_identity_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			creation_time timestamp default current_timestamp not null,
+			constraint external_identity_key
+				primary key (provider, subject)
+			)`,
+		`alter table jutzo_registered_user add column auth_source varchar(16) default 'local' not null`,
+		`update jutzo_database_info set schema_ordinal = 3`,
+	},
+
+	// Upgrade from schema 3 to schema 4: applications that sign users in through us
+	{
+		`create table if not exists jutzo_oauth_client
+			(
+			client_id     varchar(64)                         not null
+				constraint oauth_client_key
+				primary key,
+			name          varchar(256)                        not null,
+			redirect_uris text                                not null,
+			secret_hash   varchar(64),
+			creation_time timestamp default current_timestamp not null
+			)`,
+		`update jutzo_database_info set schema_ordinal = 4`,
+	},
+
+	// Upgrade from schema 4 to schema 5: rights become permissions that are granted
+	// to users directly or bundled into roles, replacing the comma separated column
+	{
+		`create table if not exists jutzo_permission
+			(
+			name        varchar(64)     not null
+				constraint permission_key
+				primary key,
+			description text default '' not null
+			)`,
+		`create table if not exists jutzo_role
+			(
+			name          varchar(64)                         not null
+				constraint role_key
+				primary key,
+			description   text      default ''                not null,
+			creation_time timestamp default current_timestamp not null
+			)`,
+		`create table if not exists jutzo_role_permission
+			(
+			role       varchar(64) not null
+				constraint role_permission_role_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			permission varchar(64) not null
+				constraint role_permission_permission_key
+				references jutzo_permission
+				on update cascade on delete cascade,
+			constraint role_permission_key
+				primary key (role, permission)
+			)`,
+		`create table if not exists jutzo_role_inheritance
+			(
+			role        varchar(64) not null
+				constraint role_inheritance_role_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			parent_role varchar(64) not null
+				constraint role_inheritance_parent_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			constraint role_inheritance_key
+				primary key (role, parent_role),
+			constraint role_inheritance_self_check
+				check (role <> parent_role)
+			)`,
+		`create table if not exists jutzo_user_permission
+			(
+			username   varchar(256) not null
+				constraint user_permission_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			permission varchar(64)  not null
+				constraint user_permission_permission_key
+				references jutzo_permission
+				on update cascade on delete cascade,
+			constraint user_permission_key
+				primary key (username, permission)
+			)`,
+		`create table if not exists jutzo_user_role
+			(
+			username varchar(256) not null
+				constraint user_role_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			role     varchar(64)  not null
+				constraint user_role_role_key
+				references jutzo_role
+				on update cascade on delete cascade,
+			constraint user_role_key
+				primary key (username, role)
+			)`,
+
+		// Carry the existing rights over as direct grants, so nobody's rights change.
+		// SQLite can't split a string into rows, so the lists are split recursively
+		`with recursive split(username, right_name, rest) as (
+				select username, '', rights || ',' from jutzo_registered_user where rights is not null
+				union all
+				select username, trim(substr(rest, 1, instr(rest, ',') - 1)), substr(rest, instr(rest, ',') + 1)
+				  from split
+				 where rest <> ''
+			)
+			insert or ignore into jutzo_permission (name)
+			select distinct right_name from split where right_name <> ''`,
+		`with recursive split(username, right_name, rest) as (
+				select username, '', rights || ',' from jutzo_registered_user where rights is not null
+				union all
+				select username, trim(substr(rest, 1, instr(rest, ',') - 1)), substr(rest, instr(rest, ',') + 1)
+				  from split
+				 where rest <> ''
+			)
+			insert or ignore into jutzo_user_permission (username, permission)
+			select distinct username, right_name from split where right_name <> ''`,
+		`alter table jutzo_registered_user drop column rights`,
+
+		// The built-in roles. New users get the user role, which has the rights
+		// the old column defaulted to; administrators get everything users do
+		`insert into jutzo_permission (name, description) values
+			('login', 'Log in to the service'),
+			('blog', 'Write blog entries'),
+			('admin', 'Administer the service')
+			on conflict (name) do update set description = excluded.description`,
+		`insert into jutzo_role (name, description) values
+			('user', 'Given to all new users'),
+			('administrator', 'Administers the service')`,
+		`insert into jutzo_role_permission (role, permission) values
+			('user', 'login'), ('user', 'blog'), ('administrator', 'admin')`,
+		`insert into jutzo_role_inheritance (role, parent_role) values ('administrator', 'user')`,
+
+		// The effective permissions of each user: those granted directly and those
+		// of their roles, including the roles those inherit from
+		`create view if not exists jutzo_effective_permission as
+			with recursive user_roles(username, role) as (
+				select username, role from jutzo_user_role
+				union
+				select user_roles.username, inheritance.parent_role
+				  from user_roles
+				  join jutzo_role_inheritance inheritance on inheritance.role = user_roles.role
+			)
+			select username, permission from jutzo_user_permission
+			union
+			select user_roles.username, role_permission.permission
+			  from user_roles
+			  join jutzo_role_permission role_permission on role_permission.role = user_roles.role`,
+		`update jutzo_database_info set schema_ordinal = 5`,
+	},
+
+	// Upgrade from schema 5 to schema 6: administrators can disable a user's login
+	{
+		`alter table jutzo_registered_user add column disabled boolean default false not null`,
+		`update jutzo_database_info set schema_ordinal = 6`,
+	},
+
+	// Upgrade from schema 6 to schema 7: settings that can be changed at runtime, and invites
+	{
+		`create table if not exists jutzo_setting
+			(
+			name  varchar(64) not null
+				constraint setting_key
+				primary key,
+			value text        not null
+			)`,
+		`create table if not exists jutzo_invite
+			(
+			unique_id       varchar(36)                         not null
+				constraint invite_key
+				primary key,
+			created_by      varchar(256)                        not null
+				constraint invite_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			code_hash       varchar(64)                         not null,
+			rights          text                                not null,
+			creation_time   timestamp default current_timestamp not null,
+			expiration_time timestamp,
+			used_by         varchar(256),
+			used_time       timestamp
+			)`,
+		`create unique index if not exists invite_hash_idx on jutzo_invite (code_hash)`,
+		`insert into jutzo_permission (name, description) values ('invite', 'Invite new users')
+			on conflict (name) do update set description = excluded.description`,
+		`update jutzo_database_info set schema_ordinal = 7`,
+	},
+
+	// Upgrade from schema 7 to schema 8: users asking for their account to be deleted
+	{
+		`create table if not exists jutzo_deletion_request
+			(
+			username     varchar(256)                        not null
+				constraint deletion_request_key
+				primary key
+				constraint deletion_request_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			anonymize    boolean   default false             not null,
+			request_time timestamp default current_timestamp not null,
+			due_time     timestamp                           not null
+			)`,
+		`update jutzo_database_info set schema_ordinal = 8`,
+	},
+
+	// Upgrade from schema 8 to schema 9: the audit log, which can only be appended
+	// to. Erasing a user pseudonymizes the events that identify them, which can only
+	// be done while the unlock table has a row, and then only who and where from
+	{
+		`create table if not exists jutzo_audit_event
+			(
+			id         integer                             not null
+				constraint audit_event_key
+				primary key autoincrement,
+			event_time timestamp default current_timestamp not null,
+			event_type varchar(64)                         not null,
+			actor      varchar(256) default ''             not null,
+			target     varchar(256) default ''             not null,
+			ip         varchar(64)  default ''             not null,
+			user_agent text         default ''             not null,
+			detail     text         default ''             not null
+			)`,
+		`create index if not exists audit_event_time_idx on jutzo_audit_event (event_time)`,
+		`create index if not exists audit_event_actor_idx on jutzo_audit_event (actor)`,
+		`create index if not exists audit_event_target_idx on jutzo_audit_event (target)`,
+		`create table if not exists jutzo_audit_unlock (unlocked integer not null)`,
+		`create trigger if not exists audit_event_immutable_update before update on jutzo_audit_event
+			when not exists (select 1 from jutzo_audit_unlock)
+			  or new.id is not old.id or new.event_time is not old.event_time
+			  or new.event_type is not old.event_type or new.detail is not old.detail
+			begin
+				select raise(abort, 'audit events cannot be changed or deleted');
+			end`,
+		`create trigger if not exists audit_event_immutable_delete before delete on jutzo_audit_event
+			begin
+				select raise(abort, 'audit events cannot be changed or deleted');
+			end`,
+		`update jutzo_database_info set schema_ordinal = 9`,
+	},
+
+	// Upgrade from schema 9 to schema 10: what users tell us about themselves
+	{
+		`alter table jutzo_registered_user add column display_name varchar(128) default '' not null`,
+		`alter table jutzo_registered_user add column bio text default '' not null`,
+		`alter table jutzo_registered_user add column avatar_url varchar(1024) default '' not null`,
+		`alter table jutzo_registered_user add column timezone varchar(64) default '' not null`,
+		`alter table jutzo_registered_user add column locale varchar(35) default '' not null`,
+		`alter table jutzo_registered_user add column notifications text default '{}' not null`,
+		`update jutzo_database_info set schema_ordinal = 10`,
+	},
+
+	// Upgrade from schema 10 to schema 11: administrators list users by when they registered
+	{
+		`create index if not exists registered_user_creation_idx on jutzo_registered_user (creation_time, username)`,
+		`update jutzo_database_info set schema_ordinal = 11`,
+	},
+
+	// Upgrade from schema 11 to schema 12: tokens for SCIM provisioning
+	{
+		`create table if not exists jutzo_scim_token
+			(
+			unique_id     varchar(36)                         not null
+				constraint scim_token_key
+				primary key,
+			name          varchar(128)                        not null,
+			created_by    varchar(256)                        not null
+				constraint scim_token_user_key
+				references jutzo_registered_user
+				on update cascade on delete cascade,
+			token_hash    varchar(64)                         not null,
+			creation_time timestamp default current_timestamp not null,
+			last_used     timestamp
+			)`,
+		`create unique index if not exists scim_token_hash_idx on jutzo_scim_token (token_hash)`,
+		`update jutzo_database_info set schema_ordinal = 12`,
+	},
+
+	// Upgrade from schema 12 to schema 13: usernames and emails are compared
+	// normalized and case folded. The keys are filled in by normalizeUserKeys
+	{
+		`alter table jutzo_registered_user add column username_key varchar(256)`,
+		`alter table jutzo_registered_user add column email_key varchar(256)`,
+		`update jutzo_database_info set schema_ordinal = 13`,
+	},
+
+	// Upgrade from schema 13 to schema 14: the keys are unique, as the usernames and emails are
+	{
+		`create unique index if not exists username_key_idx on jutzo_registered_user (username_key)`,
+		`create unique index if not exists email_key_idx on jutzo_registered_user (email_key)`,
+		`update jutzo_database_info set schema_ordinal = 14`,
+	},
+
+	// Upgrade from schema 14 to schema 15: the Postgres session store's tables,
+	// which SQLite has no use for
+	{
+		`update jutzo_database_info set schema_ordinal = 15`,
+	},
+}
+
+// sqliteEmailInUse is the equivalent of emailInUse. The driver only says
+// which constraint failed in the error's message
+func sqliteEmailInUse(err error) error {
+	if strings.Contains(err.Error(), "UNIQUE constraint failed: jutzo_registered_user.email") {
+		return jutzo.ErrEmailInUse
+	}
+	return err
+}
+
+// sqliteUserColumns are the equivalent of userColumns. SQLite's group_concat
+// can't be ordered, so it concatenates from ordered subqueries instead
+const sqliteUserColumns = `u.username, u.email, u.email_validated, u.disabled, u.creation_time, u.password_hash, u.auth_source,
+       u.display_name, u.bio, u.avatar_url, u.timezone, u.locale, u.notifications,
+       coalesce((select group_concat(permission, ',')
+                   from (select p.permission from jutzo_user_permission p
+                          where p.username = u.username order by p.permission)), ''),
+       coalesce((select group_concat(role, ',')
+                   from (select r.role from jutzo_user_role r
+                          where r.username = u.username order by r.role)), ''),
+       coalesce((select group_concat(permission, ',')
+                   from (select distinct e.permission from jutzo_effective_permission e
+                          where e.username = u.username order by e.permission)), '')`
+
+// sqliteRoleColumns are the equivalent of roleColumns
+const sqliteRoleColumns = `r.name, r.description,
+       coalesce((select group_concat(permission, ',')
+                   from (select p.permission from jutzo_role_permission p
+                          where p.role = r.name order by p.permission)), ''),
+       coalesce((select group_concat(parent_role, ',')
+                   from (select i.parent_role from jutzo_role_inheritance i
+                          where i.role = r.name order by i.parent_role)), '')`
+
+// Connect to the database file, creating it if it doesn't exist, and
+// upgrade it to the schema this version of the system needs
+func (connection *SQLiteConnection) Connect() error {
+
+	// Do nothing if we are already connected
+	if connection.db != nil {
+		return nil
+	}
+
+	path, isPresent := connection.config.GetConfigurationString("JUTZO_SQLITE_PATH")
+	if !isPresent || path == "" {
+		return errors.New("required database file JUTZO_SQLITE_PATH is missing")
+	}
+
+	// Foreign keys are off in SQLite unless asked for, and times are written in
+	// the format SQLite's own date functions understand
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return err
+	}
+
+	// SQLite allows a single writer; sharing one connection avoids busy errors
+	// (and keeps a :memory: database from being a different one per connection)
+	db.SetMaxOpenConns(1)
+	connection.db = db
+	log.Printf("Connected to database: %s", path)
+
+	if version, err := connection.getEffectiveSchemaVersion(); err != nil {
+		return err
+	} else if version < SupportedSchema {
+		return connection.upgradeFrom(version)
+	}
+	return nil
+}
+
+// Shutdown the database and clean up any resources used
+func (connection *SQLiteConnection) Shutdown() error {
+	db := connection.db
+	if db != nil {
+		connection.db = nil
+		return db.Close()
+	} else {
+		return nil
+	}
+}
+
+// getEffectiveSchemaVersion will return the version in the information table,
+// or zero if there is no information table (so no schema exists yet)
+func (connection *SQLiteConnection) getEffectiveSchemaVersion() (int, error) {
+	var dataType string
+	row := connection.db.QueryRow(`select type from pragma_table_info('jutzo_database_info') where name = 'schema_ordinal'`)
+	switch err := row.Scan(&dataType); err {
+	case nil:
+	case sql.ErrNoRows:
+		return 0, nil
+	default:
+		return 0, err
+	}
+	if !strings.EqualFold(dataType, "integer") {
+		return 0, errors.New("database version could not be retrieved")
+	}
+
+	var schemaOrdinal int
+	if err := connection.db.QueryRow("select schema_ordinal from jutzo_database_info").Scan(&schemaOrdinal); err != nil {
+		return 0, errors.New("database version could not be retrieved")
+	}
+	return schemaOrdinal, nil
+}
+
+// upgradeFrom the reported version to the current version of the schema,
+// running each set of statements (and any routine for it) in a transaction
+func (connection *SQLiteConnection) upgradeFrom(version int) error {
+
+	log.Printf("Upgrading database, please wait...")
+	for index, statements := range SQLiteUpgradeStatements[version:] {
+		schema := version + index + 1
+		if err := connection.inTransaction(func(tx *sql.Tx) error {
+			for _, statement := range statements {
+				if _, err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+			if routine, ok := upgradeRoutines[schema]; ok {
+				return routine(tx)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		log.Printf("Upgraded to version %d", schema)
+	}
+	return nil
+}
+
+// CheckForUsernameOrEmail in the database so that we don't use the
+// same username or email twice
+func (connection *SQLiteConnection) CheckForUsernameOrEmail(username string, email string) (bool, bool, error) {
+	query := `select (select count(*) from jutzo_registered_user where username_key = $1 or username = $2),
+	                 (select count(*) from jutzo_registered_user where email_key = $3 or email = $4)`
+
+	var userCount, emailCount int
+	row := connection.db.QueryRow(query, UsernameKey(username), username, EmailKey(email), email)
+	if err := row.Scan(&userCount, &emailCount); err == nil {
+		return userCount > 0, emailCount > 0, nil
+	} else {
+		return false, false, err
+	}
+}
+
+// StoreUser in the database with the given username, email, password hash and
+// authentication source, along with the default role. Returns an error if either
+// the username or email is already in use
+func (connection *SQLiteConnection) StoreUser(username string, email string, passwordHash []byte, authSource string) (jutzo.UserInfo, error) {
+	statement := `insert into jutzo_registered_user
+                              (username, email, password_hash, username_key, email_key, creation_time, auth_source)
+                       values ($1, $2, $3, $4, $5, $6, $7)`
+	roleStatement := `insert into jutzo_user_role (username, role) values ($1, $2)`
+
+	err := connection.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(statement, username, email, passwordHash, UsernameKey(username), EmailKey(email),
+			time.Now().UTC(), authSource); err != nil {
+			return err
+		}
+		_, err := tx.Exec(roleStatement, username, jutzo.DefaultUserRole)
+		return err
+	})
+	if err == nil {
+		return connection.RetrieveUserInformation(username)
+	} else {
+		return nil, err
+	}
+}
+
+// UpdateUserInfo that has changed with what is stored in the database: the
+// email, whether the login is disabled, the profile, the rights granted
+// directly to the user and the user's roles. Returns ErrLastAdmin, changing
+// nothing, if this would leave no enabled administrator
+func (connection *SQLiteConnection) UpdateUserInfo(userInfo jutzo.UserInfo) error {
+
+	username := userInfo.GetUsername()
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		profile := userInfo.GetProfile()
+		notifications, err := json.Marshal(profile.Notifications)
+		if err != nil {
+			return err
+		}
+		updateStatement := `update jutzo_registered_user
+                               set email = $1, disabled = $2, display_name = $3, bio = $4, avatar_url = $5,
+                                   timezone = $6, locale = $7, notifications = $8,
+                                   email_key = case when email = $1 then email_key else $10 end
+                             where username = $9`
+		if err := expectRowsAffected(tx.Exec(updateStatement, userInfo.GetEmail(), userInfo.IsDisabled(), profile.DisplayName,
+			profile.Bio, profile.AvatarURL, profile.Timezone, profile.Locale, string(notifications), username,
+			EmailKey(userInfo.GetEmail()))); err != nil {
+			return sqliteEmailInUse(err)
+		}
+
+		// Replace the direct grants
+		if _, err := tx.Exec(`delete from jutzo_user_permission where username = $1`, username); err != nil {
+			return err
+		}
+		if err := ensurePermissions(tx, userInfo.GetGrantedRights()); err != nil {
+			return err
+		}
+		for _, right := range userInfo.GetGrantedRights() {
+			if _, err := tx.Exec(`insert into jutzo_user_permission (username, permission) values ($1, $2)`,
+				username, right); err != nil {
+				return err
+			}
+		}
+
+		// Replace the roles
+		if _, err := tx.Exec(`delete from jutzo_user_role where username = $1`, username); err != nil {
+			return err
+		}
+		for _, role := range userInfo.GetRoles() {
+			if _, err := tx.Exec(`insert into jutzo_user_role (username, role) values ($1, $2)`,
+				username, role); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RetrieveUserInformation for the specified username, compared normalized and case folded
+func (connection *SQLiteConnection) RetrieveUserInformation(username string) (jutzo.UserInfo, error) {
+	return connection.retrieveUser("username", username, UsernameKey(username))
+}
+
+// UpdatePasswordHash stored for the user
+func (connection *SQLiteConnection) UpdatePasswordHash(username string, passwordHash []byte) error {
+	statement := `update jutzo_registered_user set password_hash = $1 where username = $2`
+	return expectRowsAffected(connection.db.Exec(statement, passwordHash, username))
+}
+
+// DeleteUser and everything that belongs to them, which the foreign keys
+// cascade to. Returns sql.ErrNoRows if there is no such user, or ErrLastAdmin
+// if they are the last enabled administrator. The invites they registered
+// with no longer record their name
+func (connection *SQLiteConnection) DeleteUser(username string) error {
+	statement := `delete from jutzo_registered_user where username = $1`
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		if err := expectRowsAffected(tx.Exec(statement, username)); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`update jutzo_invite set used_by = $2 where used_by = $1`, username, deletedInviteUser)
+		return err
+	})
+}
+
+// RetrieveUserByEmail finds the user registered with the given email (compared
+// normalized and case folded), returning sql.ErrNoRows if there is no such user
+func (connection *SQLiteConnection) RetrieveUserByEmail(email string) (jutzo.UserInfo, error) {
+	return connection.retrieveUser("email", email, EmailKey(email))
+}
+
+// retrieveUser finds the user with the given value in the (unique) column
+// specified, or the given key in the column's key, preferring the exact value
+func (connection *SQLiteConnection) retrieveUser(column string, value string, key string) (jutzo.UserInfo, error) {
+	statement := fmt.Sprintf(`select %s
+                                    from jutzo_registered_user u
+                                   where u.%[2]s_key = $2 or u.%[2]s = $1
+                                order by u.%[2]s = $1 desc
+                                   limit 1`, sqliteUserColumns, column)
+
+	// Return a nil interface (rather than a nil *UserInfoImpl) if there's no such user
+	if userInfo, err := scanUser(connection.db.QueryRow(statement, value, key)); err == nil {
+		return userInfo, nil
+	} else {
+		return nil, err
+	}
+}
+
+// MarkEmailValidated for the user without going through the validation process
+func (connection *SQLiteConnection) MarkEmailValidated(username string) error {
+	statement := `update jutzo_registered_user set email_validated = true where username = $1`
+	return expectRowsAffected(connection.db.Exec(statement, username))
+}
+
+// StoreExternalIdentity links the identity the provider knows by subject
+// to the given local user
+func (connection *SQLiteConnection) StoreExternalIdentity(provider string, subject string, username string) error {
+	statement := `insert into jutzo_external_identity (provider, subject, username, creation_time) values ($1, $2, $3, $4)`
+	_, err := connection.db.Exec(statement, provider, subject, username, time.Now().UTC())
+	return err
+}
+
+// RetrieveExternalIdentity returns the username of the local user linked
+// to the provider's subject, or sql.ErrNoRows if it isn't linked
+func (connection *SQLiteConnection) RetrieveExternalIdentity(provider string, subject string) (username string, err error) {
+	statement := `select username from jutzo_external_identity where provider = $1 and subject = $2`
+	err = connection.db.QueryRow(statement, provider, subject).Scan(&username)
+	return
+}
+
+// ListExternalIdentities linked to the given user, oldest first
+func (connection *SQLiteConnection) ListExternalIdentities(username string) ([]jutzo.LinkedIdentity, error) {
+	statement := `select provider, subject, creation_time
+                    from jutzo_external_identity
+                   where username = $1
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement, username); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.LinkedIdentity
+		for rows.Next() {
+			var identity jutzo.LinkedIdentity
+			if err = rows.Scan(&identity.Provider, &identity.Subject, &identity.CreationTime); err == nil {
+				result = append(result, identity)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// CreateValidationFor the user specified, replacing any validation already pending
+func (connection *SQLiteConnection) CreateValidationFor(username string) (uniqueID string, email string, err error) {
+	uniqueID = uuid.NewString()
+	err = connection.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`delete from jutzo_pending_validation where username = $1`, username); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`insert into jutzo_pending_validation (unique_id, username) values ($1, $2)`,
+			uniqueID, username); err != nil {
+			return err
+		}
+		return tx.QueryRow(`select email from jutzo_registered_user where username = $1`, username).Scan(&email)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return
+}
+
+// CompleteValidationFor the uniqueID created with the
+// CreateValidationFor method, returning the username of the user validated
+func (connection *SQLiteConnection) CompleteValidationFor(uniqueID string) (username string, err error) {
+	err = connection.inTransaction(func(tx *sql.Tx) error {
+		if err := tx.QueryRow(`select username from jutzo_pending_validation where unique_id = $1`,
+			uniqueID).Scan(&username); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`update jutzo_registered_user set email_validated = true where username = $1`,
+			username); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`delete from jutzo_pending_validation where unique_id = $1`, uniqueID)
+		return err
+	})
+	return
+}
+
+// CountKeyCollisions returns the number of users whose username or email
+// collided with another user's when the keys were added, which left their key empty
+func (connection *SQLiteConnection) CountKeyCollisions() (jutzo.KeyCollisions, error) {
+	var collisions jutzo.KeyCollisions
+	row := connection.db.QueryRow(`select coalesce(sum(case when username_key is null then 1 else 0 end), 0),
+	                                      coalesce(sum(case when email_key is null then 1 else 0 end), 0)
+	                                 from jutzo_registered_user`)
+	err := row.Scan(&collisions.Usernames, &collisions.Emails)
+	return collisions, err
+}
+
+// ListUsers selected by the query, in the order it asks for, along with the total number selected
+func (connection *SQLiteConnection) ListUsers(query jutzo.UserQuery) (jutzo.UserPage, error) {
+	var page jutzo.UserPage
+	sort, err := userSort(query)
+	if err != nil {
+		return page, err
+	}
+	cursor, err := decodeUserCursor(query, sort)
+	if err != nil {
+		return page, err
+	}
+
+	var conditions []string
+	var args []any
+	condition := func(format string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if query.EmailContains != "" {
+		condition("instr(lower(u.email), lower($%d)) > 0", query.EmailContains)
+	}
+	if query.Right != "" {
+		condition(`exists (select 1 from jutzo_effective_permission e
+                            where e.username = u.username and e.permission = $%d)`, query.Right)
+	}
+	if query.Role != "" {
+		condition(`exists (select 1 from jutzo_user_role r where r.username = u.username and r.role = $%d)`, query.Role)
+	}
+	if query.Validated != nil {
+		condition("u.email_validated = $%d", *query.Validated)
+	}
+	if !query.CreatedSince.IsZero() {
+		condition("u.creation_time >= $%d", query.CreatedSince.UTC())
+	}
+	if !query.CreatedUntil.IsZero() {
+		condition("u.creation_time < $%d", query.CreatedUntil.UTC())
+	}
+	where := func() string {
+		if len(conditions) > 0 {
+			return " where " + strings.Join(conditions, " and ")
+		}
+		return ""
+	}
+
+	// The total doesn't depend on the page
+	if err = connection.db.QueryRow(`select count(*) from jutzo_registered_user u`+where(), args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	// Users with the same creation time are ordered by username, so every user has a place in the order
+	comparison, direction := ">", "asc"
+	if query.Descending {
+		comparison, direction = "<", "desc"
+	}
+	order := fmt.Sprintf("u.username %s", direction)
+	if sort == jutzo.UserSortCreated {
+		order = fmt.Sprintf("u.creation_time %s, u.username %s", direction, direction)
+		if cursor != nil {
+			args = append(args, cursor.CreationTime.UTC(), cursor.Username)
+			conditions = append(conditions, fmt.Sprintf("(u.creation_time, u.username) %s ($%d, $%d)",
+				comparison, len(args)-1, len(args)))
+		}
+	} else if cursor != nil {
+		condition("u.username "+comparison+" $%d", cursor.Username)
+	}
+	statement := `select ` + sqliteUserColumns + ` from jutzo_registered_user u` + where() + " order by " + order
+
+	// One more user than asked for tells us whether there is another page
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" limit %d", query.Limit+1)
+	}
+
+	if rows, err := connection.db.Query(statement, args...); err == nil {
+		defer closeRows(rows)
+		for rows.Next() {
+			if userInfo, err := scanUser(rows); err != nil {
+				return page, err
+			} else {
+				// Password hashes never leave the database in a listing
+				userInfo.PasswordHash = []byte{}
+				page.Users = append(page.Users, userInfo)
+			}
+		}
+		if query.Limit > 0 && len(page.Users) > query.Limit {
+			page.Users = page.Users[:query.Limit]
+			page.NextCursor = encodeUserCursor(query, sort, page.Users[query.Limit-1])
+		}
+		return page, rows.Err()
+	} else {
+		return page, err
+	}
+}
+
+// GetAdminCount returns the number of administrator users whose login is enabled
+func (connection *SQLiteConnection) GetAdminCount() (count int, err error) {
+	err = connection.db.QueryRow(adminCountQuery).Scan(&count)
+	return
+}
+
+// inAdminTransaction runs work that can change who is an administrator in a
+// transaction, rolling it back with ErrLastAdmin if it leaves none. There is
+// only the one connection, so nothing else can change in the meantime
+func (connection *SQLiteConnection) inAdminTransaction(work func(tx *sql.Tx) error) error {
+	return connection.inTransaction(func(tx *sql.Tx) error {
+		return keepAnAdmin(tx, work)
+	})
+}
+
+// StoreAPIKey for the given user. Only the hash of the key is stored; the
+// expiration time may be the zero time for a key that never expires
+func (connection *SQLiteConnection) StoreAPIKey(username string, name string, keyHash string, rights []string, expirationTime time.Time) (jutzo.APIKey, error) {
+	statement := `insert into jutzo_api_key (unique_id, username, name, key_hash, rights, creation_time, expiration_time)
+                       values ($1, $2, $3, $4, $5, $6, $7)`
+
+	apiKey := &APIKeyImpl{ID: uuid.NewString(), Username: username, Name: name, Rights: rights,
+		CreationTime: time.Now().UTC(), ExpirationTime: expirationTime}
+	expiration := sql.NullTime{Time: expirationTime.UTC(), Valid: !expirationTime.IsZero()}
+	if _, err := connection.db.Exec(statement, apiKey.ID, username, name, keyHash, strings.Join(rights, ","),
+		apiKey.CreationTime, expiration); err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// RetrieveAPIKeyByHash finds the API key with the given hash, returning
+// sql.ErrNoRows if there is no such key
+func (connection *SQLiteConnection) RetrieveAPIKeyByHash(keyHash string) (jutzo.APIKey, error) {
+	statement := `select unique_id, username, name, rights, creation_time, expiration_time, last_used
+                    from jutzo_api_key
+                   where key_hash = $1`
+	return scanAPIKey(connection.db.QueryRow(statement, keyHash))
+}
+
+// ListAPIKeys that belong to the given user, oldest first
+func (connection *SQLiteConnection) ListAPIKeys(username string) ([]jutzo.APIKey, error) {
+	statement := `select unique_id, username, name, rights, creation_time, expiration_time, last_used
+                    from jutzo_api_key
+                   where username = $1
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement, username); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.APIKey
+		for rows.Next() {
+			if apiKey, err := scanAPIKey(rows); err == nil {
+				result = append(result, apiKey)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteAPIKey belonging to the given user. Returns sql.ErrNoRows if the
+// user has no key with that ID
+func (connection *SQLiteConnection) DeleteAPIKey(username string, uniqueID string) error {
+	statement := `delete from jutzo_api_key where username = $1 and unique_id = $2`
+	return expectRowsAffected(connection.db.Exec(statement, username, uniqueID))
+}
+
+// TouchAPIKey records that the key has just been used
+func (connection *SQLiteConnection) TouchAPIKey(uniqueID string) error {
+	statement := `update jutzo_api_key set last_used = $2 where unique_id = $1`
+	_, err := connection.db.Exec(statement, uniqueID, time.Now().UTC())
+	return err
+}
+
+// RetrieveSetting with the given name, returning sql.ErrNoRows if it hasn't been set
+func (connection *SQLiteConnection) RetrieveSetting(name string) (value string, err error) {
+	statement := `select value from jutzo_setting where name = $1`
+	err = connection.db.QueryRow(statement, name).Scan(&value)
+	return
+}
+
+// StoreSetting with the given name, replacing any value it already has
+func (connection *SQLiteConnection) StoreSetting(name string, value string) error {
+	statement := `insert into jutzo_setting (name, value) values ($1, $2)
+                  on conflict (name) do update set value = excluded.value`
+	_, err := connection.db.Exec(statement, name, value)
+	return err
+}
+
+// StoreInvite created by the given user. Only the hash of the code is stored;
+// the expiration time may be the zero time for an invite that never expires
+func (connection *SQLiteConnection) StoreInvite(createdBy string, codeHash string, rights []string, expirationTime time.Time) (jutzo.Invite, error) {
+	statement := `insert into jutzo_invite (unique_id, created_by, code_hash, rights, creation_time, expiration_time)
+                       values ($1, $2, $3, $4, $5, $6)`
+
+	invite := &InviteImpl{ID: uuid.NewString(), CreatedBy: createdBy, Rights: rights,
+		CreationTime: time.Now().UTC(), ExpirationTime: expirationTime}
+	expiration := sql.NullTime{Time: expirationTime.UTC(), Valid: !expirationTime.IsZero()}
+	if _, err := connection.db.Exec(statement, invite.ID, createdBy, codeHash, strings.Join(rights, ","),
+		invite.CreationTime, expiration); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// ClaimInvite with the given hash for the user registering with it. Returns
+// sql.ErrNoRows if there's no such invite, or it has been used or has expired
+func (connection *SQLiteConnection) ClaimInvite(codeHash string, username string) (jutzo.Invite, error) {
+	statement := `update jutzo_invite set used_by = $2, used_time = $3
+                   where code_hash = $1 and used_by is null
+                     and (expiration_time is null or expiration_time > $3)
+               returning ` + inviteColumns
+	return scanInvite(connection.db.QueryRow(statement, codeHash, username, time.Now().UTC()))
+}
+
+// ReleaseInvite that was claimed, so that it can be used again
+func (connection *SQLiteConnection) ReleaseInvite(codeHash string) error {
+	statement := `update jutzo_invite set used_by = null, used_time = null where code_hash = $1`
+	return expectRowsAffected(connection.db.Exec(statement, codeHash))
+}
+
+// ListInvites created by the given user, oldest first
+func (connection *SQLiteConnection) ListInvites(createdBy string) ([]jutzo.Invite, error) {
+	statement := `select ` + inviteColumns + `
+                    from jutzo_invite
+                   where created_by = $1
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement, createdBy); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.Invite
+		for rows.Next() {
+			if invite, err := scanInvite(rows); err == nil {
+				result = append(result, invite)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteInvite created by the given user. Returns sql.ErrNoRows if the
+// user has no invite with that ID
+func (connection *SQLiteConnection) DeleteInvite(createdBy string, uniqueID string) error {
+	statement := `delete from jutzo_invite where created_by = $1 and unique_id = $2`
+	return expectRowsAffected(connection.db.Exec(statement, createdBy, uniqueID))
+}
+
+// StoreDeletionRequest for the given user, replacing any request they have already made
+func (connection *SQLiteConnection) StoreDeletionRequest(username string, anonymize bool, dueTime time.Time) (jutzo.DeletionRequest, error) {
+	statement := `insert into jutzo_deletion_request (username, anonymize, request_time, due_time)
+                       values ($1, $2, $3, $4)
+                  on conflict (username) do update
+                          set anonymize = excluded.anonymize, request_time = excluded.request_time,
+                              due_time = excluded.due_time
+                    returning ` + deletionRequestColumns
+
+	return scanDeletionRequest(connection.db.QueryRow(statement, username, anonymize, time.Now().UTC(), dueTime.UTC()))
+}
+
+// RetrieveDeletionRequest for the given user, or sql.ErrNoRows if they haven't made one
+func (connection *SQLiteConnection) RetrieveDeletionRequest(username string) (jutzo.DeletionRequest, error) {
+	statement := `select ` + deletionRequestColumns + ` from jutzo_deletion_request where username = $1`
+	return scanDeletionRequest(connection.db.QueryRow(statement, username))
+}
+
+// DeleteDeletionRequest for the given user, returning sql.ErrNoRows if they haven't made one
+func (connection *SQLiteConnection) DeleteDeletionRequest(username string) error {
+	statement := `delete from jutzo_deletion_request where username = $1`
+	return expectRowsAffected(connection.db.Exec(statement, username))
+}
+
+// ListDueDeletions returns the deletion requests that are due at the time given
+func (connection *SQLiteConnection) ListDueDeletions(dueBy time.Time) ([]jutzo.DeletionRequest, error) {
+	statement := `select ` + deletionRequestColumns + `
+                    from jutzo_deletion_request
+                   where due_time <= $1
+                   order by due_time`
+
+	if rows, err := connection.db.Query(statement, dueBy.UTC()); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.DeletionRequest
+		for rows.Next() {
+			if request, err := scanDeletionRequest(rows); err == nil {
+				result = append(result, request)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// AnonymizeUser renames the user and replaces their email, and removes everything
+// else that could identify them. The rename cascades to the tables that reference
+// the user, so what is left (e.g. the invites they used) refers to the new name.
+// Returns ErrLastAdmin if they are the last enabled administrator
+func (connection *SQLiteConnection) AnonymizeUser(username string, anonymousName string, anonymousEmail string) error {
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		renameStatement := `update jutzo_registered_user
+                               set username = $2, email = $3, password_hash = x'', auth_source = 'local',
+                                   email_validated = false, disabled = true,
+                                   username_key = $4, email_key = $5,
+                                   display_name = '', bio = '', avatar_url = '', timezone = '', locale = '',
+                                   notifications = '{}'
+                             where username = $1`
+		if err := expectRowsAffected(tx.Exec(renameStatement, username, anonymousName, anonymousEmail,
+			UsernameKey(anonymousName), EmailKey(anonymousEmail))); err != nil {
+			return err
+		}
+
+		for _, statement := range []string{
+			`delete from jutzo_user_permission where username = $1`,
+			`delete from jutzo_user_role where username = $1`,
+			`delete from jutzo_api_key where username = $1`,
+			`delete from jutzo_external_identity where username = $1`,
+			`delete from jutzo_pending_validation where username = $1`,
+			`delete from jutzo_invite where created_by = $1`,
+			`delete from jutzo_deletion_request where username = $1`,
+		} {
+			if _, err := tx.Exec(statement, anonymousName); err != nil {
+				return err
+			}
+		}
+
+		// Invites only record the name of the user that used them
+		_, err := tx.Exec(`update jutzo_invite set used_by = $2 where used_by = $1`, username, anonymousName)
+		return err
+	})
+}
+
+// StoreAuditEvent in the audit log
+func (connection *SQLiteConnection) StoreAuditEvent(event jutzo.AuditEvent) error {
+	statement := `insert into jutzo_audit_event (event_time, event_type, actor, target, ip, user_agent, detail)
+                       values ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := connection.db.Exec(statement, event.Time.UTC(), event.Type, event.Actor, event.Target,
+		event.IP, event.UserAgent, event.Detail)
+	return err
+}
+
+// PseudonymizeAuditEvents replaces the username with the pseudonym wherever
+// an audit event names them, and removes the addresses and user agents of
+// the events they caused
+func (connection *SQLiteConnection) PseudonymizeAuditEvents(username string, pseudonym string) error {
+	return connection.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`insert into jutzo_audit_unlock (unlocked) values (1)`); err != nil {
+			return err
+		}
+		clearStatement := `update jutzo_audit_event
+		                      set ip = '', user_agent = ''
+		                    where actor = $1 or (actor = '' and target = $1)`
+		if _, err := tx.Exec(clearStatement, username); err != nil {
+			return err
+		}
+		for _, statement := range []string{
+			`update jutzo_audit_event set actor = $2 where actor = $1`,
+			`update jutzo_audit_event set target = $2 where target = $1`,
+		} {
+			if _, err := tx.Exec(statement, username, pseudonym); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`delete from jutzo_audit_unlock`)
+		return err
+	})
+}
+
+// ListAuditEvents selected by the query, newest first
+func (connection *SQLiteConnection) ListAuditEvents(query jutzo.AuditQuery) ([]jutzo.AuditEvent, error) {
+	var conditions []string
+	var args []any
+	condition := func(format string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(format, len(args)))
+	}
+	if len(query.Types) > 0 {
+		placeholders := make([]string, 0, len(query.Types))
+		for _, eventType := range query.Types {
+			args = append(args, eventType)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		conditions = append(conditions, "event_type in ("+strings.Join(placeholders, ", ")+")")
+	}
+	if query.Actor != "" {
+		condition("actor = $%d", query.Actor)
+	}
+	if query.Target != "" {
+		condition("target = $%d", query.Target)
+	}
+	if query.User != "" {
+		args = append(args, query.User)
+		conditions = append(conditions, fmt.Sprintf("(actor = $%d or target = $%d)", len(args), len(args)))
+	}
+	if query.IP != "" {
+		condition("ip = $%d", query.IP)
+	}
+	if !query.Since.IsZero() {
+		condition("event_time >= $%d", query.Since.UTC())
+	}
+	if !query.Until.IsZero() {
+		condition("event_time < $%d", query.Until.UTC())
+	}
+	if query.Before > 0 {
+		condition("id < $%d", query.Before)
+	}
+
+	statement := `select id, event_time, event_type, actor, target, ip, user_agent, detail from jutzo_audit_event`
+	if len(conditions) > 0 {
+		statement += " where " + strings.Join(conditions, " and ")
+	}
+	statement += " order by id desc"
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" limit %d", query.Limit)
+	}
+
+	if rows, err := connection.db.Query(statement, args...); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.AuditEvent
+		for rows.Next() {
+			var event jutzo.AuditEvent
+			if err = rows.Scan(&event.ID, &event.Time, &event.Type, &event.Actor, &event.Target,
+				&event.IP, &event.UserAgent, &event.Detail); err == nil {
+				result = append(result, event)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// StoreOAuthClient registers an application that can sign users in. The
+// secret hash is empty for public clients
+func (connection *SQLiteConnection) StoreOAuthClient(clientID string, name string, redirectURIs []string, secretHash string) (jutzo.OAuthClient, error) {
+	statement := `insert into jutzo_oauth_client (client_id, name, redirect_uris, secret_hash, creation_time)
+                       values ($1, $2, $3, $4, $5)`
+
+	client := &OAuthClientImpl{ClientID: clientID, Name: name, RedirectURIs: redirectURIs,
+		Confidential: secretHash != "", SecretHash: secretHash, CreationTime: time.Now().UTC()}
+	secret := sql.NullString{String: secretHash, Valid: secretHash != ""}
+	if _, err := connection.db.Exec(statement, clientID, name, strings.Join(redirectURIs, " "), secret,
+		client.CreationTime); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// RetrieveOAuthClient with the given ID, or sql.ErrNoRows if there is no such client
+func (connection *SQLiteConnection) RetrieveOAuthClient(clientID string) (jutzo.OAuthClient, error) {
+	statement := `select client_id, name, redirect_uris, secret_hash, creation_time
+                    from jutzo_oauth_client
+                   where client_id = $1`
+	return scanOAuthClient(connection.db.QueryRow(statement, clientID))
+}
+
+// ListOAuthClients that are registered, in order of registration
+func (connection *SQLiteConnection) ListOAuthClients() ([]jutzo.OAuthClient, error) {
+	statement := `select client_id, name, redirect_uris, secret_hash, creation_time
+                    from jutzo_oauth_client
+                   order by creation_time`
+
+	if rows, err := connection.db.Query(statement); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.OAuthClient
+		for rows.Next() {
+			if client, err := scanOAuthClient(rows); err == nil {
+				result = append(result, client)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteOAuthClient with the given ID, returning sql.ErrNoRows if there is no such client
+func (connection *SQLiteConnection) DeleteOAuthClient(clientID string) error {
+	statement := `delete from jutzo_oauth_client where client_id = $1`
+	return expectRowsAffected(connection.db.Exec(statement, clientID))
+}
+
+// StoreRole with the rights it bundles and the roles it inherits from,
+// replacing the role if it already exists. Returns ErrLastAdmin if this
+// would leave no enabled administrator
+func (connection *SQLiteConnection) StoreRole(name string, description string, rights []string, inherits []string) error {
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`insert into jutzo_role (name, description, creation_time) values ($1, $2, $3)
+                                  on conflict (name) do update set description = excluded.description`,
+			name, description, time.Now().UTC()); err != nil {
+			return err
+		}
+
+		// Replace the rights and inheritance of the role
+		if _, err := tx.Exec(`delete from jutzo_role_permission where role = $1`, name); err != nil {
+			return err
+		}
+		if err := ensurePermissions(tx, rights); err != nil {
+			return err
+		}
+		for _, right := range rights {
+			if _, err := tx.Exec(`insert into jutzo_role_permission (role, permission) values ($1, $2)`,
+				name, right); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`delete from jutzo_role_inheritance where role = $1`, name); err != nil {
+			return err
+		}
+		for _, parent := range inherits {
+			if _, err := tx.Exec(`insert into jutzo_role_inheritance (role, parent_role) values ($1, $2)`,
+				name, parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RetrieveRole with the given name, or sql.ErrNoRows if there is no such role
+func (connection *SQLiteConnection) RetrieveRole(name string) (jutzo.Role, error) {
+	statement := `select ` + sqliteRoleColumns + ` from jutzo_role r where r.name = $1`
+	return scanRole(connection.db.QueryRow(statement, name))
+}
+
+// ListRoles that are defined, in name order
+func (connection *SQLiteConnection) ListRoles() ([]jutzo.Role, error) {
+	statement := `select ` + sqliteRoleColumns + ` from jutzo_role r order by r.name`
+
+	if rows, err := connection.db.Query(statement); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.Role
+		for rows.Next() {
+			if role, err := scanRole(rows); err == nil {
+				result = append(result, role)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// ListRoleMembers returns the usernames of the users who hold the role, whether
+// it is assigned to them or inherited by one of the roles they are assigned
+func (connection *SQLiteConnection) ListRoleMembers(name string) ([]string, error) {
+	statement := `with recursive holding_roles(role) as (
+                      select $1
+                      union
+                      select inheritance.role
+                        from holding_roles
+                        join jutzo_role_inheritance inheritance on inheritance.parent_role = holding_roles.role
+                  )
+                  select distinct user_role.username
+                    from jutzo_user_role user_role
+                    join holding_roles on holding_roles.role = user_role.role
+                   order by user_role.username`
+
+	if rows, err := connection.db.Query(statement, name); err == nil {
+		defer closeRows(rows)
+		var result []string
+		for rows.Next() {
+			var username string
+			if err = rows.Scan(&username); err != nil {
+				return nil, err
+			}
+			result = append(result, username)
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteRole with the given name, returning sql.ErrNoRows if there is no such
+// role, or ErrLastAdmin if this would leave no enabled administrator
+func (connection *SQLiteConnection) DeleteRole(name string) error {
+	statement := `delete from jutzo_role where name = $1`
+	return connection.inAdminTransaction(func(tx *sql.Tx) error {
+		return expectRowsAffected(tx.Exec(statement, name))
+	})
+}
+
+// inTransaction runs the work given in a transaction, committing it if
+// the work succeeds and rolling it back otherwise
+func (connection *SQLiteConnection) inTransaction(work func(tx *sql.Tx) error) error {
+	if tx, err := connection.db.Begin(); err == nil {
+		if err = work(tx); err == nil {
+			return tx.Commit()
+		} else {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Error rolling back transaction: %s", rollbackErr.Error())
+			}
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// StoreSCIMToken created by the given user. Only the hash of the token is stored
+func (connection *SQLiteConnection) StoreSCIMToken(createdBy string, name string, tokenHash string) (jutzo.SCIMToken, error) {
+	statement := `insert into jutzo_scim_token (unique_id, name, created_by, token_hash, creation_time)
+                       values ($1, $2, $3, $4, $5)
+                    returning ` + scimTokenColumns
+	return scanSCIMToken(connection.db.QueryRow(statement, uuid.NewString(), name, createdBy, tokenHash, time.Now().UTC()))
+}
+
+// RetrieveSCIMTokenByHash finds the SCIM token with the given hash, returning
+// sql.ErrNoRows if there is no such token
+func (connection *SQLiteConnection) RetrieveSCIMTokenByHash(tokenHash string) (jutzo.SCIMToken, error) {
+	statement := `select ` + scimTokenColumns + ` from jutzo_scim_token where token_hash = $1`
+	return scanSCIMToken(connection.db.QueryRow(statement, tokenHash))
+}
+
+// TouchSCIMToken records that the token with the given ID has just been used
+func (connection *SQLiteConnection) TouchSCIMToken(uniqueID string) error {
+	_, err := connection.db.Exec(`update jutzo_scim_token set last_used = $2 where unique_id = $1`, uniqueID, time.Now().UTC())
+	return err
+}
+
+// ListSCIMTokens that have been issued, oldest first
+func (connection *SQLiteConnection) ListSCIMTokens() ([]jutzo.SCIMToken, error) {
+	statement := `select ` + scimTokenColumns + ` from jutzo_scim_token order by creation_time`
+
+	if rows, err := connection.db.Query(statement); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.SCIMToken
+		for rows.Next() {
+			if token, err := scanSCIMToken(rows); err == nil {
+				result = append(result, token)
+			} else {
+				return nil, err
+			}
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// DeleteSCIMToken with the given ID, returning sql.ErrNoRows if there is no such token
+func (connection *SQLiteConnection) DeleteSCIMToken(uniqueID string) error {
+	statement := `delete from jutzo_scim_token where unique_id = $1`
+	return expectRowsAffected(connection.db.Exec(statement, uniqueID))
+}
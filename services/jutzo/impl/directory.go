@@ -0,0 +1,82 @@
+package impl
+
+import (
+	"errors"
+	"golang.org/x/exp/slices"
+	"log"
+	"services/jutzo"
+)
+
+// directoryActor is recorded in the audit log as making the changes the
+// directory asks for
+const directoryActor = "directory"
+
+// loginDirectoryUser checks the user's credentials against the directory. The
+// first time a directory user logs in a local user (with no password) is created
+// for them; after that the local user is kept in step with the directory's email
+// and the rights the directory manages. Only users the directory created are
+// ever adopted; anyone else with the same name isn't the directory's to manage
+func (engine *EngineImpl) loginDirectoryUser(user string, password string, userInfo jutzo.UserInfo) (jutzo.UserInfo, error) {
+	if userInfo != nil && userInfo.GetAuthSource() != jutzo.AuthSourceDirectory {
+		return nil, jutzo.ErrInvalidCredentials
+	}
+
+	directoryUser, err := engine.verifier.VerifyCredentials(user, password)
+	if err != nil {
+		return nil, err
+	} else if directoryUser.Email == "" {
+		return nil, errors.New("the directory has no email address for the user")
+	}
+
+	if userInfo == nil {
+		if userInfo, err = engine.storeUser(user, directoryUser.Email, []byte{}, jutzo.AuthSourceDirectory); errors.Is(err, jutzo.ErrInvalidUsername) {
+			log.Printf("Directory user %q can't be registered, as the name isn't a valid username", user)
+			return nil, jutzo.ErrInvalidCredentials
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	// The directory decides which of the rights it manages are granted directly;
+	// other grants, and the user's roles, are left alone
+	updated := *userInfo.(*UserInfoImpl)
+	updated.Email = directoryUser.Email
+	for _, right := range directoryUser.ManagedRights {
+		updated.RevokeRight(right)
+	}
+	for _, right := range directoryUser.Rights {
+		updated.GrantRight(right)
+	}
+
+	// Only write to the database if something has changed
+	if updated.GetEmail() != userInfo.GetEmail() || !sameRights(updated.GetGrantedRights(), userInfo.GetGrantedRights()) {
+		if err = engine.db.UpdateUserInfo(&updated); err != nil {
+			return nil, err
+		}
+		engine.recordRightChanges(directoryActor, userInfo.GetUsername(), userInfo.GetGrantedRights(), updated.GetGrantedRights())
+		if err = engine.refreshUserSessions(user); err != nil {
+			return nil, err
+		}
+	}
+
+	// We take the directory's word for the email
+	if !userInfo.IsEmailValidated() {
+		if err = engine.db.MarkEmailValidated(userInfo.GetUsername()); err != nil {
+			return nil, err
+		}
+	}
+	return engine.db.RetrieveUserInformation(userInfo.GetUsername())
+}
+
+// sameRights determines if two sets of rights are the same, regardless of order
+func sameRights(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, right := range a {
+		if !slices.Contains(b, right) {
+			return false
+		}
+	}
+	return true
+}
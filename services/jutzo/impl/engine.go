@@ -1,19 +1,35 @@
 package impl
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
-	"golang.org/x/crypto/bcrypt"
 	"log"
 	"services/jutzo"
+	"sync"
+	"time"
 )
 
 // EngineImpl provides the implementation structure for the
 // implementation of a Jutzo engine
 type EngineImpl struct {
-	config jutzo.ConfigurationProvider
-	db     jutzo.DatabaseConnection
-	cache  jutzo.UserSessionCache
+	config   jutzo.ConfigurationProvider
+	db       jutzo.DatabaseConnection
+	cache    jutzo.UserSessionCache
+	timeouts jutzo.SessionTimeouts
+
+	// The directory that users without a local password are checked
+	// against (nil if there isn't one)
+	verifier jutzo.CredentialVerifier
+
+	// How passwords are hashed, failed login tracking, and the hash that passwords
+	// for unknown users are checked against (so that they take as long as known users)
+	hasher        *PasswordHasher
+	policy        *PasswordPolicy
+	throttle      *loginThrottle
+	fingerprint   *FingerprintPolicy
+	dummyHash     []byte
+	dummyHashOnce sync.Once
 }
 
 // NewJutzoEngine sets up the Jutzo environment with the configuration information provided.
@@ -26,6 +42,30 @@ func NewJutzoEngine(config jutzo.ConfigurationProvider, connection jutzo.Databas
 	engine.config = config
 	engine.db = connection
 	engine.cache = cache
+	engine.timeouts = NewSessionTimeouts(config)
+	engine.throttle = newLoginThrottle(config, cache)
+	if hasher, err := NewPasswordHasher(config); err == nil {
+		engine.hasher = hasher
+	} else {
+		return nil, err
+	}
+	if policy, err := NewPasswordPolicy(config); err == nil {
+		engine.policy = policy
+	} else {
+		return nil, err
+	}
+	if fingerprint, err := NewFingerprintPolicy(config); err == nil {
+		engine.fingerprint = fingerprint
+	} else {
+		return nil, err
+	}
+
+	// Set up the directory, if there is one
+	if verifier, err := NewLDAPVerifier(config); err != nil {
+		return nil, err
+	} else if verifier != nil {
+		engine.verifier = verifier
+	}
 
 	// Connect to the database. Note this is should be a no-op if already connected.
 	if err := connection.Connect(); err != nil {
@@ -37,6 +77,15 @@ func NewJutzoEngine(config jutzo.ConfigurationProvider, connection jutzo.Databas
 		return nil, err
 	}
 
+	// Users whose keys collided when the database was upgraded need an
+	// administrator to resolve them, so they are pointed out each time
+	if collisions, err := connection.CountKeyCollisions(); err != nil {
+		return nil, err
+	} else if collisions.Usernames > 0 || collisions.Emails > 0 {
+		log.Printf("Warning: %d usernames and %d emails are the same as another user's ignoring case, "+
+			"so can only be found exactly; see /v1/user/collisions", collisions.Usernames, collisions.Emails)
+	}
+
 	// Ensure that there is an administrative user registered
 	if count, err := connection.GetAdminCount(); err != nil {
 		return nil, err
@@ -55,9 +104,9 @@ func NewJutzoEngine(config jutzo.ConfigurationProvider, connection jutzo.Databas
 						return nil, errors.New("unable to find or register admin account due to conflict")
 					} else {
 
-						// Force update the rights for that user. This will also allow them
+						// Make that user an administrator. This will also allow them
 						// to log in with an email that hasn't been validated.
-						userInfo.GrantRight("admin")
+						userInfo.AssignRole(jutzo.AdministratorRole)
 						if err := connection.UpdateUserInfo(userInfo); err != nil {
 
 							log.Printf("Update of grants failed")
@@ -79,6 +128,10 @@ func (engine *EngineImpl) GetConfigProvider() jutzo.ConfigurationProvider {
 	return engine.config
 }
 
+func (engine *EngineImpl) GetSessionTimeouts() jutzo.SessionTimeouts {
+	return engine.timeouts
+}
+
 func (engine *EngineImpl) GetDatabase() jutzo.DatabaseConnection {
 	return engine.db
 }
@@ -95,34 +148,133 @@ func (engine *EngineImpl) Shutdown() {
 	}
 }
 
-func (engine *EngineImpl) Login(user string, password string) (jutzo.UserSession, error) {
+func (engine *EngineImpl) Login(user string, password string, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	if userInfo, err := engine.checkPassword(user, password, client); err == nil {
+		return engine.cache.CacheUserSession(userInfo, client)
+	} else {
+		return nil, err
+	}
+}
+
+// checkPassword of the user, subject to the login throttle
+func (engine *EngineImpl) checkPassword(user string, password string, client jutzo.ClientInfo) (jutzo.UserInfo, error) {
 
-	if userInfo, err := engine.db.RetrieveUserInformation(user); err != nil {
+	// While the user (or the client's address) is locked out the attempt is refused
+	// straight away, without spending any time on the password
+	if retryAfter, err := engine.throttle.check(user, client); err != nil {
 		return nil, err
-	} else {
+	} else if retryAfter > 0 {
+		return nil, &jutzo.LoginThrottledError{RetryAfter: retryAfter}
+	}
+
+	userInfo, err := engine.authenticate(user, password)
+	if err == jutzo.ErrInvalidCredentials {
+		if err := engine.throttle.recordFailure(user, client); err != nil {
+			log.Printf("Unable to record failed login for %s: %s", user, err.Error())
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
 
-		// Make sure that the user is allowed to log in
-		admin := userInfo.HasRights([]string{"admin"})
-		canLogin := userInfo.HasRights([]string{"login"})
-		if (userInfo.IsEmailValidated() && canLogin) || admin {
+	if err = engine.throttle.recordSuccess(user); err != nil {
+		log.Printf("Unable to clear failed logins for %s: %s", user, err.Error())
+	}
+	return userInfo, nil
+}
 
-			// User is able to log in, compare the password hash. We do this second because it's
-			// a more expensive operation than just the testing done above
-			if err = bcrypt.CompareHashAndPassword(userInfo.GetPasswordHash(), []byte(password)); err == nil {
+// authenticate the user with their password. Returns ErrInvalidCredentials if
+// the user doesn't exist, the password is wrong or the user isn't allowed to log
+// in; a password is checked in each case, so that responses for unknown users
+// can't be told apart from those for known users
+func (engine *EngineImpl) authenticate(user string, password string) (jutzo.UserInfo, error) {
 
-				// Successful login, create a user session
-				return engine.cache.CacheUserSession(userInfo)
-			} else {
-				return nil, err
-			}
-		} else {
-			return nil, errors.New(fmt.Sprintf("User %s is not active - unvalidated or no login rights", user))
+	userInfo, err := engine.db.RetrieveUserInformation(user)
+
+	// Directory users are checked against the directory, if there is one, and
+	// users it knows are created the first time they log in. Users who log in
+	// some other way are never sent there, so whoever controls a directory entry
+	// can't log in as them
+	if engine.verifier != nil && (err == sql.ErrNoRows || (err == nil && userInfo.GetAuthSource() == jutzo.AuthSourceDirectory)) {
+		if userInfo, err = engine.loginDirectoryUser(user, password, userInfo); err == jutzo.ErrUnknownDirectoryUser {
+			return nil, jutzo.ErrInvalidCredentials
+		} else if err != nil {
+			return nil, err
+		} else if !canLogin(userInfo) {
+			log.Printf("User %s is not active - no login rights", user)
+			return nil, jutzo.ErrInvalidCredentials
+		}
+		return userInfo, nil
+	}
+
+	// Only local users have a password we can check
+	if err == sql.ErrNoRows || (err == nil && (userInfo.GetAuthSource() != jutzo.AuthSourceLocal ||
+		len(userInfo.GetPasswordHash()) == 0)) {
+		engine.hasher.Verify(engine.dummyPasswordHash(), password)
+		return nil, jutzo.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Check the password before whether the user can log in, so that the time
+	// taken doesn't give away that the user exists
+	if !engine.hasher.Verify(userInfo.GetPasswordHash(), password) {
+		return nil, jutzo.ErrInvalidCredentials
+	} else if !canLogin(userInfo) {
+		log.Printf("User %s is not active - unvalidated or no login rights", user)
+		return nil, jutzo.ErrInvalidCredentials
+	}
+
+	// Now that we have the password, bring a weaker hash up to the current settings
+	if engine.hasher.NeedsRehash(userInfo.GetPasswordHash()) {
+		if passwordHash, err := engine.hasher.Hash(password); err != nil {
+			log.Printf("Unable to rehash password for %s: %s", user, err.Error())
+		} else if err = engine.db.UpdatePasswordHash(userInfo.GetUsername(), passwordHash); err != nil {
+			log.Printf("Unable to store rehashed password for %s: %s", user, err.Error())
+		}
+	}
+	return userInfo, nil
+}
+
+// dummyPasswordHash is checked against when there's no password hash for the
+// user, created on first use with the same settings as real hashes
+func (engine *EngineImpl) dummyPasswordHash() []byte {
+	engine.dummyHashOnce.Do(func() {
+		var err error
+		if engine.dummyHash, err = engine.hasher.Hash("no such user"); err != nil {
+			log.Printf("Unable to create dummy password hash: %s", err.Error())
 		}
+	})
+	return engine.dummyHash
+}
+
+// UnlockUser clears the failed login attempts recorded for the user,
+// lifting any lockout
+func (engine *EngineImpl) UnlockUser(user string) error {
+	return engine.throttle.unlock(user)
+}
+
+// storeUser with the username and email normalized, once the username is
+// known to follow the rules. Every user is created through here, however
+// they come to be registered
+func (engine *EngineImpl) storeUser(user string, email string, passwordHash []byte, authSource string) (jutzo.UserInfo, error) {
+	user, email, err := normalizeNewUser(user, email)
+	if err != nil {
+		return nil, err
 	}
+	return engine.db.StoreUser(user, email, passwordHash, authSource)
 }
 
 func (engine *EngineImpl) RegisterUser(user string, password string, email string) (int, jutzo.UserInfo, error) {
 
+	user, email, err := normalizeNewUser(user, email)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := engine.policy.Check(password, user, email); err != nil {
+		return 0, nil, err
+	}
+
 	// See if the username or email already exists
 	if usernameExists, emailExists, err := engine.db.CheckForUsernameOrEmail(user, email); err == nil {
 
@@ -131,21 +283,13 @@ func (engine *EngineImpl) RegisterUser(user string, password string, email strin
 		} else if emailExists {
 			return jutzo.DuplicateEmail, nil, nil
 		} else {
-			// Get the cost for creating the password. This cost can be
-			// set as an environment variable or defaulted, and it will
-			// be stored with the password for validation later
-			passwordCost, isPresent := engine.config.GetConfigurationInt("JUTZO_HASH_COST")
-			if !isPresent {
-				passwordCost = 15
-			}
-
 			// Encrypt the password provided
-			if passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost); err != nil {
+			if passwordHash, err := engine.hasher.Hash(password); err != nil {
 				return 0, nil, err
 			} else {
 
 				// Store the user
-				if userInfo, err := engine.db.StoreUser(user, email, passwordHash); err != nil {
+				if userInfo, err := engine.storeUser(user, email, passwordHash, jutzo.AuthSourceLocal); err != nil {
 					return 0, nil, err
 				} else {
 					return jutzo.Success, userInfo, nil
@@ -161,7 +305,7 @@ func (engine *EngineImpl) CreateUniqueValidationForUser(user string) (string, st
 	return engine.db.CreateValidationFor(user)
 }
 
-func (engine *EngineImpl) ValidateEmail(uniqueID string) error {
+func (engine *EngineImpl) ValidateEmail(uniqueID string) (string, error) {
 	return engine.db.CompleteValidationFor(uniqueID)
 }
 
@@ -169,17 +313,136 @@ func (engine *EngineImpl) LoadUserSession(uniqueID string) (jutzo.UserSession, e
 	return engine.cache.GetUserSessionByID(uniqueID)
 }
 
+func (engine *EngineImpl) RefreshUserSession(refreshToken string) (jutzo.UserSession, error) {
+	return engine.cache.RefreshUserSession(refreshToken)
+}
+
+func (engine *EngineImpl) StoreTransient(key string, value []byte, ttl time.Duration) error {
+	return engine.cache.StoreTransient(key, value, ttl)
+}
+
+func (engine *EngineImpl) TakeTransient(key string) ([]byte, error) {
+	return engine.cache.TakeTransient(key)
+}
+
 func (engine *EngineImpl) DestroyUserSession(uniqueID string) error {
 	return engine.cache.InvalidateUserSession(uniqueID)
 }
 
-// ListUsers can be called by an admin to list users. This call will
-// return up to maxUsers users at a time; if you want to retrieve the
-// remaining users call ListUsers again passing in the username from the
-// last record returned. If no more users can be found, an empty slice
-// will be returned with no errors.
-// If you want to start at the beginning of the user list, pass in an
-// empty string as startingAt
-func (engine *EngineImpl) ListUsers(startingAt string, maxUsers int) ([]jutzo.UserInfo, error) {
-	return engine.db.ListUsers(startingAt, maxUsers)
+func (engine *EngineImpl) ListUserSessions(user string) ([]jutzo.UserSession, error) {
+	return engine.cache.ListUserSessions(user)
+}
+
+func (engine *EngineImpl) DestroyUserSessions(user string, except string) error {
+	return engine.cache.InvalidateUserSessions(user, except)
+}
+
+// refreshUserSessions brings the user's live sessions up to date after the
+// user has changed. Each session holds a copy of the user, so without this the
+// user would keep the rights they logged in with until the session ended. A
+// user who can no longer log in (or no longer exists) loses their sessions
+func (engine *EngineImpl) refreshUserSessions(user string) error {
+	userInfo, err := engine.db.RetrieveUserInformation(user)
+	if err == sql.ErrNoRows || (err == nil && !canLogin(userInfo)) {
+		return engine.cache.InvalidateUserSessions(user, "")
+	} else if err != nil {
+		return err
+	}
+
+	return engine.cache.UpdateUserSessions(user, func(userSession jutzo.UserSession) jutzo.UserInfo {
+		if client := userSession.GetClientInfo(); client.ClientID != "" {
+			return delegatedUserInfo(userInfo, client.Scope)
+		}
+		return userInfo
+	})
+}
+
+// canLogin determines if the user is allowed to log in (or use their API
+// keys): they need a validated email and the login right, or to be an admin.
+// Nobody can log in once their login has been disabled
+func canLogin(userInfo jutzo.UserInfo) bool {
+	admin := userInfo.HasRights([]string{"admin"})
+	canLogin := userInfo.HasRights([]string{"login"})
+	return !userInfo.IsDisabled() && ((userInfo.IsEmailValidated() && canLogin) || admin)
+}
+
+// CreateAPIKey for the user, restricted to the rights given (which must all
+// be held by the user). The key itself is only returned here and cannot be
+// retrieved again. An expiresIn of zero creates a key that never expires
+func (engine *EngineImpl) CreateAPIKey(user string, name string, rights []string, expiresIn time.Duration) (string, jutzo.APIKey, error) {
+
+	if userInfo, err := engine.db.RetrieveUserInformation(user); err != nil {
+		return "", nil, err
+	} else if !userInfo.HasRights(rights) {
+		return "", nil, jutzo.ErrRightNotHeld
+	} else {
+
+		// Generate the key; we only keep the hash of it
+		if secret, err := newSecretToken(); err == nil {
+			key := fmt.Sprintf("%s%s", jutzo.APIKeyPrefix, secret)
+			var expirationTime time.Time
+			if expiresIn > 0 {
+				expirationTime = time.Now().Add(expiresIn)
+			}
+			if apiKey, err := engine.db.StoreAPIKey(user, name, hashToken(key), rights, expirationTime); err == nil {
+				return key, apiKey, nil
+			} else {
+				return "", nil, err
+			}
+		} else {
+			return "", nil, err
+		}
+	}
+}
+
+// ListAPIKeys that belong to the user
+func (engine *EngineImpl) ListAPIKeys(user string) ([]jutzo.APIKey, error) {
+	return engine.db.ListAPIKeys(user)
+}
+
+// RevokeAPIKey belonging to the user
+func (engine *EngineImpl) RevokeAPIKey(user string, uniqueID string) error {
+	return engine.db.DeleteAPIKey(user, uniqueID)
+}
+
+// LoadAPIKeySession authenticates an API key, returning a session for the
+// owner that is restricted to the rights of the key
+func (engine *EngineImpl) LoadAPIKeySession(key string) (jutzo.UserSession, error) {
+
+	if apiKey, err := engine.db.RetrieveAPIKeyByHash(hashToken(key)); err == nil {
+		if apiKey.(*APIKeyImpl).isExpired() {
+			return nil, jutzo.ErrInvalidAPIKey
+		}
+
+		// The owner has to still be allowed to log in
+		if userInfo, err := engine.db.RetrieveUserInformation(apiKey.GetUsername()); err == nil && canLogin(userInfo) {
+
+			// The key only carries the rights that both it and the owner still hold, so
+			// rights revoked from the owner are revoked from their keys too
+			var rights []string
+			for _, right := range apiKey.GetRights() {
+				if userInfo.HasRights([]string{right}) {
+					rights = append(rights, right)
+				}
+			}
+
+			if err = engine.db.TouchAPIKey(apiKey.GetId()); err != nil {
+				log.Printf("Unable to record use of API key %s: %s", apiKey.GetId(), err.Error())
+			}
+
+			userSession := new(UserSessionImpl)
+			userSession.ID = apiKey.GetId()
+			userSession.Info = NewUserInfo(userInfo.GetUsername(), userInfo.GetEmail(), []byte{},
+				userInfo.IsEmailValidated(), rights, userInfo.GetCreationTime()).(*UserInfoImpl)
+			userSession.CreationTime = time.Now()
+			userSession.LastSeen = userSession.CreationTime
+			return userSession, nil
+		} else {
+			return nil, jutzo.ErrInvalidAPIKey
+		}
+	} else if err == sql.ErrNoRows {
+		return nil, jutzo.ErrInvalidAPIKey
+	} else {
+		return nil, err
+	}
 }
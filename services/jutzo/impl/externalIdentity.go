@@ -0,0 +1,143 @@
+package impl
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"services/jutzo"
+	"strconv"
+	"strings"
+)
+
+// LoginExternalIdentity logs in the local user linked to an identity
+// asserted by an external identity provider, creating or linking the
+// local user the first time the identity is seen
+func (engine *EngineImpl) LoginExternalIdentity(identity jutzo.ExternalIdentity, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	if userInfo, err := engine.findOrProvisionExternalUser(identity); err == nil {
+		if canLogin(userInfo) {
+			return engine.cache.CacheUserSession(userInfo, client)
+		} else {
+			return nil, errors.New(fmt.Sprintf("User %s is not active - unvalidated or no login rights", userInfo.GetUsername()))
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// findOrProvisionExternalUser maps the external identity to a local user. An identity
+// we've seen before is already linked; otherwise we link it to the user with the same
+// email (but only if the provider has verified that email), or create a new user
+func (engine *EngineImpl) findOrProvisionExternalUser(identity jutzo.ExternalIdentity) (jutzo.UserInfo, error) {
+
+	// See if we already know this identity
+	if username, err := engine.db.RetrieveExternalIdentity(identity.Provider, identity.Subject); err == nil {
+		return engine.db.RetrieveUserInformation(username)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	// We need an email to either link or create the user
+	if identity.Email == "" {
+		return nil, errors.New("the identity provider did not supply an email address")
+	}
+
+	userInfo, err := engine.db.RetrieveUserByEmail(identity.Email)
+	if err == nil {
+
+		// Only link to an existing account if the provider vouches for the email,
+		// otherwise anyone could take over an account by claiming its email. Even
+		// then the provider has to be trusted to link accounts, and administrators
+		// are never handed to a provider
+		if !identity.EmailVerified || !engine.externalLinkingAllowed(identity) || isActiveAdmin(userInfo) {
+			return nil, jutzo.ErrExternalEmailConflict
+		}
+	} else if err == sql.ErrNoRows {
+
+		// A brand new user, who can only register as the registration settings
+		// allow, and with an email the provider has verified (the user couldn't
+		// verify it with us, having no way to log in until it is). They get no
+		// password (so can only log in through the provider) and the default rights
+		if err = engine.externalRegistrationAllowed(identity); err != nil {
+			return nil, err
+		} else if !identity.EmailVerified {
+			return nil, jutzo.ErrExternalEmailUnverified
+		}
+		if username, err := engine.uniqueUsernameFor(identity); err == nil {
+			if userInfo, err = engine.storeUser(username, identity.Email, []byte{}, jutzo.AuthSourceExternal); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+
+	// Link the identity, and take the provider's word on the email
+	if err = engine.db.StoreExternalIdentity(identity.Provider, identity.Subject, userInfo.GetUsername()); err != nil {
+		return nil, err
+	}
+	if identity.EmailVerified && !userInfo.IsEmailValidated() {
+		if err = engine.db.MarkEmailValidated(userInfo.GetUsername()); err != nil {
+			return nil, err
+		}
+	}
+	return engine.db.RetrieveUserInformation(userInfo.GetUsername())
+}
+
+// externalRegistrationAllowed for a new user from an external identity provider,
+// by the registration settings, unless the provider is exempt from them (with
+// JUTZO_OIDC_NAME_REGISTRATION_EXEMPT). An email the provider hasn't verified
+// is never in an allowed domain
+func (engine *EngineImpl) externalRegistrationAllowed(identity jutzo.ExternalIdentity) error {
+	exemptSetting := fmt.Sprintf("JUTZO_OIDC_%s_REGISTRATION_EXEMPT", strings.ToUpper(identity.Provider))
+	if exempt, isPresent := engine.config.GetConfigurationString(exemptSetting); isPresent {
+		if isExempt, _ := strconv.ParseBool(exempt); isExempt {
+			return nil
+		}
+	}
+
+	settings, err := engine.GetRegistrationSettings()
+	if err != nil {
+		return err
+	} else if settings.Mode == jutzo.RegistrationDomain && !identity.EmailVerified {
+		return jutzo.ErrEmailDomainNotAllowed
+	}
+	return registrationAllowed(settings, identity.Email)
+}
+
+// externalLinkingAllowed for the identity's provider, if it is trusted to
+// link identities to the existing users with the same email (with
+// JUTZO_OIDC_NAME_LINK_ACCOUNTS)
+func (engine *EngineImpl) externalLinkingAllowed(identity jutzo.ExternalIdentity) bool {
+	linkSetting := fmt.Sprintf("JUTZO_OIDC_%s_LINK_ACCOUNTS", strings.ToUpper(identity.Provider))
+	if link, isPresent := engine.config.GetConfigurationString(linkSetting); isPresent {
+		allowed, _ := strconv.ParseBool(link)
+		return allowed
+	}
+	return false
+}
+
+// uniqueUsernameFor an external identity, based on the preferred username
+// or the email, with a numeric suffix added if that's already in use
+func (engine *EngineImpl) uniqueUsernameFor(identity jutzo.ExternalIdentity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	// Leave room for the suffix
+	base = usernameFrom(base, MaxUsernameLength-4)
+
+	candidate := base
+	for attempt := 0; attempt < 10; attempt++ {
+		if usernameExists, _, err := engine.db.CheckForUsernameOrEmail(candidate, ""); err != nil {
+			return "", err
+		} else if !usernameExists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%04d", base, rand.Intn(10000))
+	}
+	return "", errors.New("unable to find an unused username")
+}
@@ -0,0 +1,162 @@
+package impl
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"services/jutzo"
+	"strings"
+)
+
+// Defaults for the session fingerprint, used when the configuration does not provide a value
+const (
+	DefaultFingerprintPolicy = jutzo.FingerprintLog
+	DefaultFingerprintFields = "ip,userAgent"
+)
+
+// The size of the network an address can move around in without the
+// fingerprint changing, so that e.g. a mobile user on the same carrier
+// doesn't keep tripping the policy
+const (
+	fingerprintIPv4PrefixBits = 24
+	fingerprintIPv6PrefixBits = 64
+)
+
+// FingerprintPolicy decides what happens when a session is used from a
+// different client than the one it was created from. The fingerprint is
+// the client's network and/or user agent
+type FingerprintPolicy struct {
+	action         string
+	matchIP        bool
+	matchUserAgent bool
+}
+
+// NewFingerprintPolicy creates the policy from the configuration
+func NewFingerprintPolicy(config jutzo.ConfigurationProvider) (*FingerprintPolicy, error) {
+	policy := new(FingerprintPolicy)
+
+	action, isPresent := config.GetConfigurationString("JUTZO_SESSION_FINGERPRINT_POLICY")
+	if !isPresent || action == "" {
+		action = DefaultFingerprintPolicy
+	}
+	switch action {
+	case jutzo.FingerprintIgnore, jutzo.FingerprintLog, jutzo.FingerprintReject, jutzo.FingerprintStepUp:
+		policy.action = action
+	default:
+		return nil, fmt.Errorf("unknown session fingerprint policy: %s", action)
+	}
+
+	fields, isPresent := config.GetConfigurationString("JUTZO_SESSION_FINGERPRINT")
+	if !isPresent {
+		fields = DefaultFingerprintFields
+	}
+	for _, field := range strings.Split(fields, ",") {
+		switch strings.TrimSpace(field) {
+		case "ip":
+			policy.matchIP = true
+		case "userAgent":
+			policy.matchUserAgent = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown session fingerprint field: %s", field)
+		}
+	}
+	return policy, nil
+}
+
+// Check the client using the session against the one it was created from
+func (policy *FingerprintPolicy) Check(userSession jutzo.UserSession, client jutzo.ClientInfo) error {
+	if policy.action == jutzo.FingerprintIgnore {
+		return nil
+	}
+
+	recorded := userSession.GetClientInfo()
+	if (!policy.matchIP || sameNetwork(recorded.IP, client.IP)) &&
+		(!policy.matchUserAgent || recorded.UserAgent == client.UserAgent) {
+		return nil
+	}
+
+	log.Printf("Session %s for %s used from %s (%s), was created from %s (%s)", userSession.GetId(),
+		userSession.GetUserInfo().GetUsername(), client.IP, client.UserAgent, recorded.IP, recorded.UserAgent)
+	switch policy.action {
+	case jutzo.FingerprintReject:
+		return jutzo.ErrSessionClientChanged
+	case jutzo.FingerprintStepUp:
+
+		// Only the user can confirm a session, so one delegated to an application is refused
+		if recorded.ClientID != "" {
+			return jutzo.ErrSessionClientChanged
+		}
+		return jutzo.ErrStepUpRequired
+	default:
+		return nil
+	}
+}
+
+// sameNetwork determines if the addresses are in the same network. Sessions
+// that didn't record an address are taken to match
+func sameNetwork(recorded string, current string) bool {
+	if recorded == "" || recorded == current {
+		return true
+	}
+	recordedIP, currentIP := net.ParseIP(recorded), net.ParseIP(current)
+	if recordedIP == nil || currentIP == nil {
+		return false
+	}
+	if recordedIP.To4() != nil && currentIP.To4() != nil {
+		mask := net.CIDRMask(fingerprintIPv4PrefixBits, 32)
+		return recordedIP.To4().Mask(mask).Equal(currentIP.To4().Mask(mask))
+	} else if recordedIP.To4() == nil && currentIP.To4() == nil {
+		mask := net.CIDRMask(fingerprintIPv6PrefixBits, 128)
+		return recordedIP.Mask(mask).Equal(currentIP.Mask(mask))
+	}
+	return false
+}
+
+// VerifySessionClient checks the client using a session against the client
+// the session was created from, as the fingerprint policy says
+func (engine *EngineImpl) VerifySessionClient(userSession jutzo.UserSession, client jutzo.ClientInfo) error {
+	return engine.fingerprint.Check(userSession, client)
+}
+
+// ConfirmSession with the password of the session's user, binding it to the
+// client now using it. The password is only checked by whatever the user
+// authenticates with: their own password, or the directory for a directory
+// user. Wrong passwords count towards the login throttle
+func (engine *EngineImpl) ConfirmSession(uniqueID string, password string, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	userSession, err := engine.cache.GetUserSessionByID(uniqueID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The session's copy of the user may be out of date, so it's the stored
+	// user that says how they authenticate
+	user := userSession.GetUserInfo().GetUsername()
+	userInfo, err := engine.db.RetrieveUserInformation(user)
+	if err == sql.ErrNoRows {
+		return nil, jutzo.ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	switch userInfo.GetAuthSource() {
+	case jutzo.AuthSourceLocal:
+		if len(userInfo.GetPasswordHash()) == 0 {
+			return nil, jutzo.ErrNoLocalPassword
+		}
+	case jutzo.AuthSourceDirectory:
+		if engine.verifier == nil {
+			return nil, jutzo.ErrNoLocalPassword
+		}
+	default:
+		return nil, jutzo.ErrNoLocalPassword
+	}
+
+	if _, err = engine.checkPassword(user, password, client); err != nil {
+		return nil, err
+	}
+	if err = engine.cache.RebindUserSession(uniqueID, client); err != nil {
+		return nil, err
+	}
+	return engine.cache.GetUserSessionByID(uniqueID)
+}
@@ -0,0 +1,44 @@
+package impl
+
+import (
+	"time"
+)
+
+type InviteImpl struct {
+	ID             string    `json:"id"`
+	CreatedBy      string    `json:"createdBy"`
+	Rights         []string  `json:"rights"`
+	CreationTime   time.Time `json:"creationTime"`
+	ExpirationTime time.Time `json:"expirationTime,omitempty"`
+	UsedBy         string    `json:"usedBy,omitempty"`
+}
+
+// GetId of the invite, used to list and revoke it
+func (invite *InviteImpl) GetId() string {
+	return invite.ID
+}
+
+// GetCreatedBy is the username of the user that created the invite
+func (invite *InviteImpl) GetCreatedBy() string {
+	return invite.CreatedBy
+}
+
+// GetRights given to the user that registers with the invite
+func (invite *InviteImpl) GetRights() []string {
+	return invite.Rights
+}
+
+// GetCreationTime of the invite
+func (invite *InviteImpl) GetCreationTime() time.Time {
+	return invite.CreationTime
+}
+
+// GetExpirationTime of the invite; the zero time if it never expires
+func (invite *InviteImpl) GetExpirationTime() time.Time {
+	return invite.ExpirationTime
+}
+
+// GetUsedBy is the username of the user that registered with the invite
+func (invite *InviteImpl) GetUsedBy() string {
+	return invite.UsedBy
+}
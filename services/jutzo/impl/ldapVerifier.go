@@ -0,0 +1,172 @@
+package impl
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"net/url"
+	"services/jutzo"
+	"strconv"
+	"strings"
+)
+
+// Defaults for the LDAP settings, used when the configuration
+// does not provide a value
+const (
+	DefaultLDAPUserFilter     = "(uid=%s)"
+	DefaultLDAPEmailAttribute = "mail"
+	DefaultLDAPGroupAttribute = "memberOf"
+	DefaultLDAPDefaultRights  = "login"
+)
+
+// LDAPVerifier checks credentials by binding to an LDAP directory as the
+// user. The user's entry is found by searching below the base DN with the
+// user filter, and their rights are derived from the groups they are in
+type LDAPVerifier struct {
+	url            string
+	startTLS       bool
+	bindDN         string
+	bindPassword   string
+	baseDN         string
+	userFilter     string
+	emailAttribute string
+	groupAttribute string
+
+	// Rights granted to every directory user, and the rights granted
+	// by membership of each group (keyed by the lower-cased group DN)
+	defaultRights []string
+	groupRights   map[string][]string
+}
+
+// NewLDAPVerifier creates a verifier from the configuration, returning
+// nil if no directory is configured
+func NewLDAPVerifier(config jutzo.ConfigurationProvider) (*LDAPVerifier, error) {
+	ldapURL, isPresent := config.GetConfigurationString("JUTZO_LDAP_URL")
+	if !isPresent || ldapURL == "" {
+		return nil, nil
+	}
+
+	verifier := new(LDAPVerifier)
+	verifier.url = ldapURL
+	verifier.bindDN, _ = config.GetConfigurationString("JUTZO_LDAP_BIND_DN")
+	verifier.bindPassword, _ = config.GetConfigurationString("JUTZO_LDAP_BIND_PASSWORD")
+	if verifier.baseDN, isPresent = config.GetConfigurationString("JUTZO_LDAP_BASE_DN"); !isPresent {
+		return nil, errors.New("JUTZO_LDAP_BASE_DN is required when JUTZO_LDAP_URL is set")
+	}
+	if startTLS, isPresent := config.GetConfigurationString("JUTZO_LDAP_START_TLS"); isPresent {
+		verifier.startTLS, _ = strconv.ParseBool(startTLS)
+	}
+	if verifier.userFilter, isPresent = config.GetConfigurationString("JUTZO_LDAP_USER_FILTER"); !isPresent {
+		verifier.userFilter = DefaultLDAPUserFilter
+	}
+	if strings.Count(verifier.userFilter, "%s") != 1 {
+		return nil, errors.New("JUTZO_LDAP_USER_FILTER must contain %s exactly once, for the username")
+	}
+	if verifier.emailAttribute, isPresent = config.GetConfigurationString("JUTZO_LDAP_EMAIL_ATTRIBUTE"); !isPresent {
+		verifier.emailAttribute = DefaultLDAPEmailAttribute
+	}
+	if verifier.groupAttribute, isPresent = config.GetConfigurationString("JUTZO_LDAP_GROUP_ATTRIBUTE"); !isPresent {
+		verifier.groupAttribute = DefaultLDAPGroupAttribute
+	}
+	defaultRights, isPresent := config.GetConfigurationString("JUTZO_LDAP_DEFAULT_RIGHTS")
+	if !isPresent {
+		defaultRights = DefaultLDAPDefaultRights
+	}
+	verifier.defaultRights = splitRights(defaultRights)
+
+	// The group mapping is a semicolon separated list of right:group DN pairs,
+	// e.g. "admin:cn=admins,ou=groups,dc=example,dc=com;blog:cn=writers,ou=groups,dc=example,dc=com"
+	verifier.groupRights = make(map[string][]string)
+	if groupRights, isPresent := config.GetConfigurationString("JUTZO_LDAP_GROUP_RIGHTS"); isPresent {
+		for _, mapping := range strings.Split(groupRights, ";") {
+			if mapping = strings.TrimSpace(mapping); mapping != "" {
+				right, groupDN, found := strings.Cut(mapping, ":")
+				if right, groupDN = strings.TrimSpace(right), strings.TrimSpace(groupDN); !found || right == "" || groupDN == "" {
+					return nil, fmt.Errorf("invalid LDAP group mapping: %s", mapping)
+				}
+				key := strings.ToLower(groupDN)
+				verifier.groupRights[key] = append(verifier.groupRights[key], right)
+			}
+		}
+	}
+	return verifier, nil
+}
+
+// VerifyCredentials of the user by finding their entry in the directory
+// and binding as them with the password given
+func (verifier *LDAPVerifier) VerifyCredentials(user string, password string) (*jutzo.DirectoryUser, error) {
+
+	// An empty password would be an unauthenticated bind, which many
+	// directories accept for any DN
+	if password == "" {
+		return nil, jutzo.ErrInvalidCredentials
+	}
+
+	conn, err := verifier.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Find the user's entry, using the service account if there is one
+	if verifier.bindDN != "" {
+		if err = conn.Bind(verifier.bindDN, verifier.bindPassword); err != nil {
+			return nil, fmt.Errorf("unable to bind to the directory: %s", err.Error())
+		}
+	}
+	search := ldap.NewSearchRequest(verifier.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(verifier.userFilter, ldap.EscapeFilter(user)),
+		[]string{verifier.emailAttribute, verifier.groupAttribute}, nil)
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	} else if len(result.Entries) == 0 {
+		return nil, jutzo.ErrUnknownDirectoryUser
+	} else if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("more than one directory entry matches user %s", user)
+	}
+	entry := result.Entries[0]
+
+	// Now check the password by binding as the user
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, jutzo.ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	directoryUser := &jutzo.DirectoryUser{Username: user, Email: entry.GetAttributeValue(verifier.emailAttribute)}
+	directoryUser.Rights, directoryUser.ManagedRights = verifier.rightsFor(entry.GetAttributeValues(verifier.groupAttribute))
+	return directoryUser, nil
+}
+
+// rightsFor a user in the groups given, along with all the
+// rights that the directory is responsible for
+func (verifier *LDAPVerifier) rightsFor(groups []string) ([]string, []string) {
+	rights := append([]string{}, verifier.defaultRights...)
+	for _, group := range groups {
+		rights = append(rights, verifier.groupRights[strings.ToLower(group)]...)
+	}
+	managed := append([]string{}, verifier.defaultRights...)
+	for _, groupRights := range verifier.groupRights {
+		managed = append(managed, groupRights...)
+	}
+	return rights, managed
+}
+
+// connect to the directory, upgrading the connection to TLS if configured
+func (verifier *LDAPVerifier) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(verifier.url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the directory: %s", err.Error())
+	}
+	if verifier.startTLS {
+		parsed, _ := url.Parse(verifier.url)
+		if err = conn.StartTLS(&tls.Config{ServerName: parsed.Hostname()}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to start TLS with the directory: %s", err.Error())
+		}
+	}
+	return conn, nil
+}
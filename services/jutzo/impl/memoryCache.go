@@ -0,0 +1,460 @@
+package impl
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+	"log"
+	"services/jutzo"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryCacheSweepInterval is how often expired entries are cleared out of
+// the in-memory cache. Expired entries are never returned in the meantime
+const memoryCacheSweepInterval = time.Minute
+
+// MemoryCache keeps user sessions, transient values and counters in memory,
+// for development and tests, expiring them as Redis does. Sessions are kept
+// encoded, as in Redis, so that callers never share them
+type MemoryCache struct {
+	config    jutzo.ConfigurationProvider
+	timeouts  jutzo.SessionTimeouts
+	mutex     sync.Mutex
+	entries   map[string]*memoryCacheEntry
+	indexes   map[string]*memorySessionIndex
+	counters  map[string]*memoryCounter
+	lastSweep time.Time
+}
+
+// memoryCacheEntry is an encoded session or a transient value, along with when it expires
+type memoryCacheEntry struct {
+	value      []byte
+	expiration time.Time
+}
+
+// memorySessionIndex holds the IDs of a user's sessions with the time each was
+// last seen, as the sorted set does in Redis
+type memorySessionIndex struct {
+	lastSeen   map[string]time.Time
+	expiration time.Time
+}
+
+// memoryCounter is a counter along with when it expires
+type memoryCounter struct {
+	count      int64
+	expiration time.Time
+}
+
+// NewMemoryCache will create a new in-memory cache for the engine to use
+func NewMemoryCache(configurationProvider jutzo.ConfigurationProvider) (jutzo.UserSessionCache, error) {
+	result := new(MemoryCache)
+	result.config = configurationProvider
+	result.timeouts = NewSessionTimeouts(configurationProvider)
+	err := result.Connect()
+	return result, err
+}
+
+// Connect to the cache. Reconnecting keeps what was stored
+func (cache *MemoryCache) Connect() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.entries == nil {
+		log.Printf("Using an in-memory session cache; sessions will be lost when the server stops")
+		cache.entries = make(map[string]*memoryCacheEntry)
+		cache.indexes = make(map[string]*memorySessionIndex)
+		cache.counters = make(map[string]*memoryCounter)
+		cache.lastSweep = time.Now()
+	}
+	return nil
+}
+
+// Disconnect from the cache when we're done with it
+func (cache *MemoryCache) Disconnect() error {
+	return nil
+}
+
+// GetUserSessionByID will look for the ID in the cache and return it if it
+// exists and isn't expired, or ErrSessionNotFound if it doesn't. Retrieving a
+// session extends its idle timeout, at most once every sessionTouchInterval
+func (cache *MemoryCache) GetUserSessionByID(uniqueID string) (jutzo.UserSession, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if userSession, err := cache.loadUserSession(uniqueID); err != nil {
+		return nil, err
+	} else if userSession == nil {
+		return nil, jutzo.ErrSessionNotFound
+	} else {
+		// The session is in use, so slide the idle timeout forward, unless that
+		// was done recently enough that it can wait
+		if index := cache.liveIndex(userSession.Info.Username); index != nil {
+			userSession.LastSeen = index.lastSeen[uniqueID]
+		}
+		if time.Since(userSession.LastSeen) >= sessionTouchInterval(cache.timeouts) {
+			cache.entries[uniqueID].expiration = time.Now().Add(cache.slidingExpiration(userSession))
+			cache.touchUserSession(userSession)
+		}
+		return userSession, nil
+	}
+}
+
+// CacheUserSession so that it can be retrieved again by the unique ID
+func (cache *MemoryCache) CacheUserSession(userInfo jutzo.UserInfo, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	userSession := new(UserSessionImpl)
+	userSession.Info = userInfo.(*UserInfoImpl)
+	userSession.ID = uuid.NewString()
+	userSession.Duration = cache.timeouts.RefreshDuration
+	userSession.CreationTime = time.Now()
+	userSession.Client = client
+	if err := rotateRefreshToken(userSession); err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if err := cache.storeUserSession(userSession, cache.slidingExpiration(userSession)); err != nil {
+		return nil, err
+	}
+	cache.touchUserSession(userSession)
+	return userSession, nil
+}
+
+// RefreshUserSession exchanges a refresh token for a new one, rotating
+// the token held by the session. Presenting a token that has already been
+// exchanged destroys the session and returns ErrRefreshTokenReused; any other
+// token returns ErrInvalidRefreshToken and leaves the session alone
+func (cache *MemoryCache) RefreshUserSession(refreshToken string) (jutzo.UserSession, error) {
+	uniqueID, _, found := strings.Cut(refreshToken, ".")
+	if !found {
+		return nil, jutzo.ErrInvalidRefreshToken
+	}
+
+	// The lock is held throughout, so two refreshes with the same token can't both succeed
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	userSession, err := cache.loadUserSession(uniqueID)
+	if err != nil {
+		return nil, err
+	} else if userSession == nil {
+		return nil, jutzo.ErrInvalidRefreshToken
+	}
+	if err = checkRefreshToken(userSession, refreshToken); err == jutzo.ErrRefreshTokenReused {
+		cache.removeUserSession(userSession.Info.Username, uniqueID)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = rotateRefreshToken(userSession); err != nil {
+		return nil, err
+	}
+	expiration := cache.slidingExpiration(userSession)
+	if expiration <= 0 {
+		return nil, jutzo.ErrInvalidRefreshToken
+	}
+	if err = cache.storeUserSession(userSession, expiration); err != nil {
+		return nil, err
+	}
+	cache.touchUserSession(userSession)
+	return userSession, nil
+}
+
+// InvalidateUserSession by removing the session from the cache
+func (cache *MemoryCache) InvalidateUserSession(uniqueID string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if userSession, err := cache.loadUserSession(uniqueID); err != nil {
+		return err
+	} else if userSession != nil {
+		cache.removeUserSession(userSession.Info.Username, uniqueID)
+	}
+	return nil
+}
+
+// ListUserSessions returns all the live sessions for the given user,
+// most recently used first
+func (cache *MemoryCache) ListUserSessions(username string) ([]jutzo.UserSession, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	var sessions []*UserSessionImpl
+	if index := cache.liveIndex(username); index != nil {
+		for uniqueID, lastSeen := range index.lastSeen {
+			if userSession, err := cache.loadUserSession(uniqueID); err != nil {
+				return nil, err
+			} else if userSession == nil {
+				// The session has expired; prune it from the index
+				delete(index.lastSeen, uniqueID)
+			} else {
+				userSession.LastSeen = lastSeen
+				sessions = append(sessions, userSession)
+			}
+		}
+	}
+
+	// Sessions seen in the same second are ordered by ID, as in a Redis sorted set
+	slices.SortFunc(sessions, func(a, b *UserSessionImpl) bool {
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+		return a.ID > b.ID
+	})
+	var result []jutzo.UserSession
+	for _, userSession := range sessions {
+		result = append(result, userSession)
+	}
+	return result, nil
+}
+
+// InvalidateUserSessions removes all the sessions for the given user,
+// except for the session with the ID given in except (which may be "")
+func (cache *MemoryCache) InvalidateUserSessions(username string, except string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if index := cache.liveIndex(username); index != nil {
+		for uniqueID := range index.lastSeen {
+			if uniqueID != except {
+				cache.removeUserSession(username, uniqueID)
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateUserSessions replaces the user information held by each of the
+// user's live sessions with what update returns for that session
+func (cache *MemoryCache) UpdateUserSessions(username string, update func(userSession jutzo.UserSession) jutzo.UserInfo) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if index := cache.liveIndex(username); index != nil {
+		for uniqueID := range index.lastSeen {
+			if err := cache.updateUserSession(uniqueID, func(userSession *UserSessionImpl) {
+				userSession.Info = update(userSession).(*UserInfoImpl)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RebindUserSession to the client given, keeping the session's expiration
+func (cache *MemoryCache) RebindUserSession(uniqueID string, client jutzo.ClientInfo) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if userSession, err := cache.loadUserSession(uniqueID); err != nil {
+		return err
+	} else if userSession == nil {
+		return jutzo.ErrInvalidRefreshToken
+	}
+	return cache.updateUserSession(uniqueID, func(userSession *UserSessionImpl) {
+		// The client ID and scope of a delegated session stay as they were granted
+		userSession.Client.IP, userSession.Client.UserAgent = client.IP, client.UserAgent
+	})
+}
+
+// StoreTransient keeps a short-lived value, such as the state of a login
+// in progress, until it is taken or the time to live has passed
+func (cache *MemoryCache) StoreTransient(key string, value []byte, ttl time.Duration) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.sweep()
+	cache.entries[transientKey(key)] = &memoryCacheEntry{value: append([]byte{}, value...), expiration: expiresAfter(ttl)}
+	return nil
+}
+
+// TakeTransient retrieves and removes a value stored with StoreTransient,
+// so that it can only be used once. Returns nil if there is no such value
+func (cache *MemoryCache) TakeTransient(key string) ([]byte, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if entry := cache.liveEntry(transientKey(key)); entry != nil {
+		delete(cache.entries, transientKey(key))
+		return entry.value, nil
+	}
+	return nil, nil
+}
+
+// GetTransientTimeToLive returns how long the transient value has left
+// before it expires, or zero if there is no such value
+func (cache *MemoryCache) GetTransientTimeToLive(key string) (time.Duration, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if entry := cache.liveEntry(transientKey(key)); entry != nil && !entry.expiration.IsZero() {
+		return time.Until(entry.expiration), nil
+	}
+	return 0, nil
+}
+
+// IncrementCounter adds one to the counter with the given key, returning the
+// new count. The counter is discarded once ttl passes without an increment
+func (cache *MemoryCache) IncrementCounter(key string, ttl time.Duration) (int64, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.sweep()
+	counter, ok := cache.counters[counterKey(key)]
+	if !ok || counter.expired(time.Now()) {
+		counter = new(memoryCounter)
+		cache.counters[counterKey(key)] = counter
+	}
+	counter.count++
+	counter.expiration = expiresAfter(ttl)
+	return counter.count, nil
+}
+
+// DeleteCounter with the given key, resetting it to zero
+func (cache *MemoryCache) DeleteCounter(key string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.counters, counterKey(key))
+	return nil
+}
+
+// loadUserSession decodes the session, or returns nil if there is no such
+// session or it has expired. The lock must be held
+func (cache *MemoryCache) loadUserSession(uniqueID string) (*UserSessionImpl, error) {
+	if entry := cache.liveEntry(uniqueID); entry != nil {
+		userSession := new(UserSessionImpl)
+		if err := json.Unmarshal(entry.value, userSession); err != nil {
+			return nil, err
+		}
+		return userSession, nil
+	}
+	return nil, nil
+}
+
+// storeUserSession encodes the session and keeps it for the expiration
+// given. The lock must be held
+func (cache *MemoryCache) storeUserSession(userSession *UserSessionImpl, expiration time.Duration) error {
+	if expiration <= 0 {
+		return jutzo.ErrInvalidRefreshToken
+	}
+	if marshalledSession, err := json.Marshal(userSession); err == nil {
+		cache.sweep()
+		cache.entries[userSession.ID] = &memoryCacheEntry{value: marshalledSession, expiration: time.Now().Add(expiration)}
+		return nil
+	} else {
+		return fmt.Errorf("could not marshal the userSession: %s", err.Error())
+	}
+}
+
+// updateUserSession applies the update to one session, keeping its
+// expiration. Sessions that have expired are left alone. The lock must be held
+func (cache *MemoryCache) updateUserSession(uniqueID string, update func(userSession *UserSessionImpl)) error {
+	userSession, err := cache.loadUserSession(uniqueID)
+	if err != nil || userSession == nil {
+		return err
+	}
+	update(userSession)
+	if marshalledSession, err := json.Marshal(userSession); err == nil {
+		cache.entries[uniqueID].value = marshalledSession
+		return nil
+	} else {
+		return err
+	}
+}
+
+// touchUserSession records that the session was just used in the user's
+// session index. Like the Redis index, it only records whole seconds. The
+// lock must be held
+func (cache *MemoryCache) touchUserSession(userSession *UserSessionImpl) {
+	now := time.Now()
+	userSession.LastSeen = now.Truncate(time.Second)
+	index := cache.liveIndex(userSession.Info.Username)
+	if index == nil {
+		index = &memorySessionIndex{lastSeen: make(map[string]time.Time)}
+		cache.indexes[userSession.Info.Username] = index
+	}
+	index.lastSeen[userSession.ID] = userSession.LastSeen
+	index.expiration = now.Add(cache.timeouts.RefreshDuration)
+}
+
+// removeUserSession deletes the session and removes it from the user's
+// index. The lock must be held
+func (cache *MemoryCache) removeUserSession(username string, uniqueID string) {
+	delete(cache.entries, uniqueID)
+	if index, ok := cache.indexes[username]; ok {
+		delete(index.lastSeen, uniqueID)
+	}
+}
+
+// liveEntry with the given key, or nil if there is none or it has expired.
+// The lock must be held
+func (cache *MemoryCache) liveEntry(key string) *memoryCacheEntry {
+	if entry, ok := cache.entries[key]; ok {
+		if !entry.expired(time.Now()) {
+			return entry
+		}
+		delete(cache.entries, key)
+	}
+	return nil
+}
+
+// liveIndex of the user's sessions, or nil if there is none or it has expired.
+// The lock must be held
+func (cache *MemoryCache) liveIndex(username string) *memorySessionIndex {
+	if index, ok := cache.indexes[username]; ok {
+		if index.expiration.After(time.Now()) {
+			return index
+		}
+		delete(cache.indexes, username)
+	}
+	return nil
+}
+
+// sweep clears out the entries that have expired, if it has been a while
+// since the last sweep. The lock must be held
+func (cache *MemoryCache) sweep() {
+	now := time.Now()
+	if now.Sub(cache.lastSweep) < memoryCacheSweepInterval {
+		return
+	}
+	cache.lastSweep = now
+	for key, entry := range cache.entries {
+		if entry.expired(now) {
+			delete(cache.entries, key)
+		}
+	}
+	for key, counter := range cache.counters {
+		if counter.expired(now) {
+			delete(cache.counters, key)
+		}
+	}
+	for username, index := range cache.indexes {
+		if !index.expiration.After(now) {
+			delete(cache.indexes, username)
+		}
+	}
+}
+
+// slidingExpiration determines how long the session should be kept
+// from now: the idle timeout, but never past the absolute session lifetime
+func (cache *MemoryCache) slidingExpiration(userSession *UserSessionImpl) time.Duration {
+	remaining := time.Until(userSession.getExpirationTime())
+	if remaining < cache.timeouts.IdleTimeout {
+		return remaining
+	} else {
+		return cache.timeouts.IdleTimeout
+	}
+}
+
+// expired determines if the entry has expired by the time given. Entries
+// without an expiration never expire
+func (entry *memoryCacheEntry) expired(now time.Time) bool {
+	return !entry.expiration.IsZero() && !entry.expiration.After(now)
+}
+
+// expired determines if the counter has expired by the time given
+func (counter *memoryCounter) expired(now time.Time) bool {
+	return !counter.expiration.IsZero() && !counter.expiration.After(now)
+}
+
+// expiresAfter is the time an entry kept for the ttl expires. As in Redis,
+// an entry without a ttl doesn't expire
+func expiresAfter(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
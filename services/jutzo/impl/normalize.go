@@ -0,0 +1,93 @@
+package impl
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"services/jutzo"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxUsernameLength is the most characters a username can have
+const MaxUsernameLength = 64
+
+// NormalizeUsername puts the username in Unicode normalization form KC, so
+// that characters which look alike (e.g. full width and ordinary letters)
+// are stored the same way. The case is kept, so users see their name as
+// they chose it
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// NormalizeEmail puts the email in Unicode normalization form KC
+func NormalizeEmail(email string) string {
+	return norm.NFKC.String(strings.TrimSpace(email))
+}
+
+// UsernameKey is what usernames are compared by: normalized and case folded,
+// so that "Bob" and "bob" are the same user
+func UsernameKey(username string) string {
+	return foldKey(NormalizeUsername(username))
+}
+
+// EmailKey is what emails are compared by: normalized and case folded
+func EmailKey(email string) string {
+	return foldKey(NormalizeEmail(email))
+}
+
+// foldKey case folds the normalized text. Folding can leave text that
+// isn't normalized, so it is normalized again
+func foldKey(text string) string {
+	return norm.NFKC.String(cases.Fold().String(text))
+}
+
+// ValidateUsername checks a normalized username against the rules: up to
+// MaxUsernameLength letters, digits, combining marks, dots, underscores and
+// hyphens, starting with a letter or digit. Returns ErrInvalidUsername if
+// the username breaks them
+func ValidateUsername(username string) error {
+	if username == "" || utf8.RuneCountInString(username) > MaxUsernameLength {
+		return jutzo.ErrInvalidUsername
+	}
+	for index, r := range username {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+		case index > 0 && (unicode.IsMark(r) || r == '.' || r == '_' || r == '-'):
+		default:
+			return jutzo.ErrInvalidUsername
+		}
+	}
+	return nil
+}
+
+// normalizeNewUser normalizes the username and email of a user about to be
+// created, and checks the username follows the rules
+func normalizeNewUser(username string, email string) (string, string, error) {
+	username, email = NormalizeUsername(username), NormalizeEmail(email)
+	if err := ValidateUsername(username); err != nil {
+		return "", "", err
+	}
+	return username, email, nil
+}
+
+// usernameFrom makes a valid username of up to maxLength characters out of
+// text that may not be one, such as the name an identity provider prefers,
+// by dropping the characters the rules don't allow. Returns "user" if
+// nothing is left
+func usernameFrom(text string, maxLength int) string {
+	var username []rune
+	for _, r := range NormalizeUsername(text) {
+		switch {
+		case len(username) == maxLength:
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			username = append(username, r)
+		case len(username) > 0 && (unicode.IsMark(r) || r == '.' || r == '_' || r == '-'):
+			username = append(username, r)
+		}
+	}
+	if len(username) == 0 {
+		return "user"
+	}
+	return string(username)
+}
@@ -0,0 +1,124 @@
+package impl
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"services/jutzo"
+	"strings"
+)
+
+// RegisterOAuthClient for an application that signs users in with their
+// Jutzo accounts. Confidential clients are given a secret, which is only
+// returned here and cannot be retrieved again
+func (engine *EngineImpl) RegisterOAuthClient(name string, redirectURIs []string, confidential bool) (string, jutzo.OAuthClient, error) {
+
+	if len(redirectURIs) == 0 {
+		return "", nil, errors.New("at least one redirect URI is required")
+	}
+	for _, redirectURI := range redirectURIs {
+		if redirectURI == "" || strings.ContainsAny(redirectURI, " \t\n") {
+			return "", nil, fmt.Errorf("invalid redirect URI: %q", redirectURI)
+		}
+	}
+
+	clientID, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Generate the secret for confidential clients; we only keep the hash of it
+	var secret, secretHash string
+	if confidential {
+		if secret, err = newSecretToken(); err != nil {
+			return "", nil, err
+		}
+		secretHash = hashToken(secret)
+	}
+
+	if client, err := engine.db.StoreOAuthClient(clientID.String(), name, redirectURIs, secretHash); err == nil {
+		return secret, client, nil
+	} else {
+		return "", nil, err
+	}
+}
+
+// GetOAuthClient with the given ID, returning ErrInvalidOAuthClient if there is no such client
+func (engine *EngineImpl) GetOAuthClient(clientID string) (jutzo.OAuthClient, error) {
+	if client, err := engine.db.RetrieveOAuthClient(clientID); err == nil {
+		return client, nil
+	} else if err == sql.ErrNoRows {
+		return nil, jutzo.ErrInvalidOAuthClient
+	} else {
+		return nil, err
+	}
+}
+
+// AuthenticateOAuthClient checks the credentials a client presented. Confidential
+// clients must present their secret; public clients must not present one
+func (engine *EngineImpl) AuthenticateOAuthClient(clientID string, secret string) (jutzo.OAuthClient, error) {
+	if client, err := engine.GetOAuthClient(clientID); err == nil {
+		secretHash := client.(*OAuthClientImpl).SecretHash
+		if client.IsConfidential() {
+			if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(secretHash)) != 1 {
+				return nil, jutzo.ErrInvalidOAuthClient
+			}
+		} else if secret != "" {
+			return nil, jutzo.ErrInvalidOAuthClient
+		}
+		return client, nil
+	} else {
+		return nil, err
+	}
+}
+
+// ValidateOAuthRedirectURI makes sure the redirect URI is registered for the client
+func (engine *EngineImpl) ValidateOAuthRedirectURI(client jutzo.OAuthClient, redirectURI string) bool {
+	if clientImpl, ok := client.(*OAuthClientImpl); ok {
+		return clientImpl.allowsRedirectURI(redirectURI)
+	}
+	return false
+}
+
+// ListOAuthClients that are registered
+func (engine *EngineImpl) ListOAuthClients() ([]jutzo.OAuthClient, error) {
+	return engine.db.ListOAuthClients()
+}
+
+// DeleteOAuthClient with the given ID. Sessions already delegated to
+// the client remain until they expire or are revoked
+func (engine *EngineImpl) DeleteOAuthClient(clientID string) error {
+	return engine.db.DeleteOAuthClient(clientID)
+}
+
+// CreateDelegatedSession creates a session for the user on behalf of the client
+// application in the client info. The session only carries the rights that
+// were granted to the client as scopes, and that the user holds
+func (engine *EngineImpl) CreateDelegatedSession(user string, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	if userInfo, err := engine.db.RetrieveUserInformation(user); err != nil {
+		return nil, err
+	} else if !canLogin(userInfo) {
+		return nil, errors.New(fmt.Sprintf("User %s is not active - unvalidated or no login rights", user))
+	} else {
+		return engine.cache.CacheUserSession(delegatedUserInfo(userInfo, client.Scope), client)
+	}
+}
+
+// delegatedUserInfo is the user as seen by a client application: holding only
+// the rights that were granted to the client as scopes, and that the user holds
+func delegatedUserInfo(userInfo jutzo.UserInfo, scope []string) jutzo.UserInfo {
+	var rights []string
+	for _, scope := range scope {
+		if strings.HasPrefix(scope, jutzo.RightScopePrefix) {
+			if right := strings.TrimPrefix(scope, jutzo.RightScopePrefix); userInfo.HasRights([]string{right}) {
+				rights = append(rights, right)
+			}
+		}
+	}
+	delegated := NewUserInfo(userInfo.GetUsername(), userInfo.GetEmail(), []byte{},
+		userInfo.IsEmailValidated(), rights, userInfo.GetCreationTime())
+	delegated.SetProfile(userInfo.GetProfile())
+	return delegated
+}
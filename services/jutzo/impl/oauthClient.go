@@ -0,0 +1,48 @@
+package impl
+
+import (
+	"golang.org/x/exp/slices"
+	"time"
+)
+
+type OAuthClientImpl struct {
+	ClientID     string    `json:"clientId"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectURIs"`
+	Confidential bool      `json:"confidential"`
+	CreationTime time.Time `json:"creationTime"`
+
+	// Only the hash of the client secret is stored
+	SecretHash string `json:"-"`
+}
+
+// GetClientId the application identifies itself with
+func (client *OAuthClientImpl) GetClientId() string {
+	return client.ClientID
+}
+
+// GetName of the application, shown to users when they grant access
+func (client *OAuthClientImpl) GetName() string {
+	return client.Name
+}
+
+// GetRedirectURIs the application may receive authorization codes at
+func (client *OAuthClientImpl) GetRedirectURIs() []string {
+	return client.RedirectURIs
+}
+
+// IsConfidential if the application has a client secret
+func (client *OAuthClientImpl) IsConfidential() bool {
+	return client.Confidential
+}
+
+// GetCreationTime of the registration
+func (client *OAuthClientImpl) GetCreationTime() time.Time {
+	return client.CreationTime
+}
+
+// allowsRedirectURI determines if the URI is registered for the client. Redirect
+// URIs are compared exactly, as recommended for OAuth 2.0
+func (client *OAuthClientImpl) allowsRedirectURI(redirectURI string) bool {
+	return slices.Contains(client.RedirectURIs, redirectURI)
+}
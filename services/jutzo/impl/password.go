@@ -0,0 +1,163 @@
+package impl
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"services/jutzo"
+	"strings"
+)
+
+// The password hashing algorithms supported. Hashes are stored in their
+// standard string forms (the modular crypt format for bcrypt and the PHC
+// string format for Argon2id), so each hash records the algorithm and
+// parameters it was made with
+const (
+	BcryptAlgorithm   = "bcrypt"
+	Argon2idAlgorithm = "argon2id"
+)
+
+// Defaults for the password hashing settings, used when the configuration
+// does not provide a value
+const (
+	DefaultHashAlgorithm    = BcryptAlgorithm
+	DefaultHashCost         = 15
+	DefaultArgon2MemoryKB   = 64 * 1024
+	DefaultArgon2Iterations = 3
+	DefaultArgon2Threads    = 2
+)
+
+// Sizes of the Argon2id salt and key, in bytes
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// ErrUnknownPasswordHash is returned when a stored hash isn't in a format we recognize
+var ErrUnknownPasswordHash = errors.New("unrecognized password hash format")
+
+// PasswordHasher hashes new passwords with the configured algorithm and
+// parameters, and verifies passwords against hashes made with any of the
+// supported algorithms
+type PasswordHasher struct {
+	algorithm     string
+	bcryptCost    int
+	argon2Memory  uint32
+	argon2Time    uint32
+	argon2Threads uint8
+}
+
+// NewPasswordHasher creates a hasher from the configuration
+func NewPasswordHasher(config jutzo.ConfigurationProvider) (*PasswordHasher, error) {
+	hasher := new(PasswordHasher)
+
+	algorithm, isPresent := config.GetConfigurationString("JUTZO_HASH_ALGORITHM")
+	if !isPresent || algorithm == "" {
+		algorithm = DefaultHashAlgorithm
+	}
+	if algorithm != BcryptAlgorithm && algorithm != Argon2idAlgorithm {
+		return nil, fmt.Errorf("unsupported JUTZO_HASH_ALGORITHM %s", algorithm)
+	}
+	hasher.algorithm = algorithm
+
+	if hasher.bcryptCost, isPresent = config.GetConfigurationInt("JUTZO_HASH_COST"); !isPresent {
+		hasher.bcryptCost = DefaultHashCost
+	}
+	memory, isPresent := config.GetConfigurationInt("JUTZO_ARGON2_MEMORY_KB")
+	if !isPresent || memory <= 0 {
+		memory = DefaultArgon2MemoryKB
+	}
+	iterations, isPresent := config.GetConfigurationInt("JUTZO_ARGON2_ITERATIONS")
+	if !isPresent || iterations <= 0 {
+		iterations = DefaultArgon2Iterations
+	}
+	threads, isPresent := config.GetConfigurationInt("JUTZO_ARGON2_THREADS")
+	if !isPresent || threads <= 0 || threads > 255 {
+		threads = DefaultArgon2Threads
+	}
+	hasher.argon2Memory = uint32(memory)
+	hasher.argon2Time = uint32(iterations)
+	hasher.argon2Threads = uint8(threads)
+	return hasher, nil
+}
+
+// Hash the password with the configured algorithm and parameters
+func (hasher *PasswordHasher) Hash(password string) ([]byte, error) {
+	if hasher.algorithm == Argon2idAlgorithm {
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		key := argon2.IDKey([]byte(password), salt, hasher.argon2Time, hasher.argon2Memory, hasher.argon2Threads, argon2KeyLength)
+		return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			hasher.argon2Memory, hasher.argon2Time, hasher.argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), hasher.bcryptCost)
+}
+
+// Verify that the password matches the hash, whichever supported algorithm made it
+func (hasher *PasswordHasher) Verify(hash []byte, password string) bool {
+	if params, salt, key, err := parseArgon2idHash(hash); err == nil {
+		candidate := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(candidate, key) == 1
+	} else if err != ErrUnknownPasswordHash {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// NeedsRehash determines if the hash is weaker than one made now would be:
+// bcrypt when Argon2id is configured, or made with lower parameters than
+// those configured. Argon2id hashes are kept if bcrypt is configured
+func (hasher *PasswordHasher) NeedsRehash(hash []byte) bool {
+	if params, _, _, err := parseArgon2idHash(hash); err == nil {
+		return hasher.algorithm == Argon2idAlgorithm && (params.memory < hasher.argon2Memory ||
+			params.time < hasher.argon2Time || params.threads < hasher.argon2Threads)
+	} else if err != ErrUnknownPasswordHash {
+		return false
+	}
+
+	if cost, err := bcrypt.Cost(hash); err == nil {
+		return hasher.algorithm == Argon2idAlgorithm || cost < hasher.bcryptCost
+	}
+	return false
+}
+
+// argon2Parameters that an Argon2id hash was made with
+type argon2Parameters struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// parseArgon2idHash decodes a hash in the PHC string format, returning
+// ErrUnknownPasswordHash if the hash isn't an Argon2id hash at all
+func parseArgon2idHash(hash []byte) (argon2Parameters, []byte, []byte, error) {
+	var params argon2Parameters
+	fields := strings.Split(string(hash), "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != Argon2idAlgorithm {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported Argon2id version")
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errors.New("malformed Argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("malformed Argon2id hash")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,94 @@
+package impl
+
+import (
+	"fmt"
+	"services/jutzo"
+	"time"
+)
+
+// passwordResetDuration is how long a password reset token can be used for
+const passwordResetDuration = time.Hour
+
+// ChangePassword of the user, who has to give their current password. The
+// current password is checked as for a login from the client, so guesses at
+// it are throttled in the same way
+func (engine *EngineImpl) ChangePassword(user string, currentPassword string, newPassword string, client jutzo.ClientInfo) error {
+	if userInfo, err := engine.db.RetrieveUserInformation(user); err != nil {
+		return err
+	} else if userInfo.GetAuthSource() != jutzo.AuthSourceLocal || len(userInfo.GetPasswordHash()) == 0 {
+		return jutzo.ErrNoLocalPassword
+	}
+	if userInfo, err := engine.checkPassword(user, currentPassword, client); err == nil {
+		return engine.setPassword(userInfo, newPassword)
+	} else {
+		return err
+	}
+}
+
+// CreatePasswordReset for the user, returning a single use token. Only the
+// hash of the token is kept, so it can't be recovered from the cache
+func (engine *EngineImpl) CreatePasswordReset(user string) (string, error) {
+	if userInfo, err := engine.db.RetrieveUserInformation(user); err != nil {
+		return "", err
+	} else if userInfo.GetAuthSource() != jutzo.AuthSourceLocal {
+		return "", jutzo.ErrNoLocalPassword
+	}
+
+	if token, err := newSecretToken(); err == nil {
+		return token, engine.cache.StoreTransient(passwordResetKey(token), []byte(user), passwordResetDuration)
+	} else {
+		return "", err
+	}
+}
+
+// ResetPassword of the user the token was created for. A password that fails
+// the policy leaves the token in place, so the user can try another
+func (engine *EngineImpl) ResetPassword(token string, newPassword string) (string, error) {
+	key := passwordResetKey(token)
+	remaining, err := engine.cache.GetTransientTimeToLive(key)
+	if err != nil {
+		return "", err
+	}
+	user, err := engine.cache.TakeTransient(key)
+	if err != nil {
+		return "", err
+	} else if user == nil {
+		return "", jutzo.ErrInvalidResetToken
+	}
+
+	userInfo, err := engine.db.RetrieveUserInformation(string(user))
+	if err != nil {
+		return "", err
+	}
+	if err = engine.setPassword(userInfo, newPassword); err != nil {
+		if _, isPolicyError := err.(*jutzo.PasswordPolicyError); isPolicyError && remaining > 0 {
+			if err := engine.cache.StoreTransient(key, user, remaining); err != nil {
+				return "", err
+			}
+		}
+		return "", err
+	}
+
+	// Whoever had the old password is logged out, and the owner can log in again straight away
+	if err = engine.cache.InvalidateUserSessions(userInfo.GetUsername(), ""); err != nil {
+		return "", err
+	}
+	return userInfo.GetUsername(), engine.throttle.unlock(userInfo.GetUsername())
+}
+
+// setPassword of the user, if it meets the password policy
+func (engine *EngineImpl) setPassword(userInfo jutzo.UserInfo, password string) error {
+	if err := engine.policy.Check(password, userInfo.GetUsername(), userInfo.GetEmail()); err != nil {
+		return err
+	}
+	if passwordHash, err := engine.hasher.Hash(password); err == nil {
+		return engine.db.UpdatePasswordHash(userInfo.GetUsername(), passwordHash)
+	} else {
+		return err
+	}
+}
+
+// passwordResetKey is the transient that holds the user a reset token is for
+func passwordResetKey(token string) string {
+	return fmt.Sprintf("password-reset:%s", hashToken(token))
+}
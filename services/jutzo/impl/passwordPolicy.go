@@ -0,0 +1,252 @@
+package impl
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"services/jutzo"
+	"strings"
+	"unicode"
+)
+
+// Defaults for the password policy, used when the configuration does not provide a value
+const (
+	DefaultPasswordMinLength = 8
+	DefaultPasswordMaxLength = 128
+)
+
+// breachedLineLength is as much of a line of the breached password list as is
+// read to find its hash: the hash, and room for a count and the line ending
+const breachedLineLength = 64
+
+// PasswordPolicy decides whether a new password is acceptable: long enough,
+// with the required classes of character, not the user's username or email,
+// and not in the list of breached passwords
+type PasswordPolicy struct {
+	minLength        int
+	maxLength        int
+	requireLowercase bool
+	requireUppercase bool
+	requireDigit     bool
+	requireSymbol    bool
+
+	// The sorted list of the SHA-1 hashes of breached passwords, which is
+	// searched on disk. Nil if no list is configured
+	breached *breachedList
+}
+
+// breachedList is a file of SHA-1 password hashes in hex, one per line, sorted
+// by hash. Each hash can be followed by a colon and a count, as in the Pwned
+// Passwords downloads ordered by hash. The list is binary searched where it
+// is, so that it needn't fit in memory
+type breachedList struct {
+	file *os.File
+	size int64
+}
+
+// NewPasswordPolicy creates a policy from the configuration, loading the
+// breached password list if one is configured
+func NewPasswordPolicy(config jutzo.ConfigurationProvider) (*PasswordPolicy, error) {
+	policy := new(PasswordPolicy)
+	var isPresent bool
+	if policy.minLength, isPresent = config.GetConfigurationInt("JUTZO_PASSWORD_MIN_LENGTH"); !isPresent || policy.minLength < 1 {
+		policy.minLength = DefaultPasswordMinLength
+	}
+	if policy.maxLength, isPresent = config.GetConfigurationInt("JUTZO_PASSWORD_MAX_LENGTH"); !isPresent || policy.maxLength < 1 {
+		policy.maxLength = DefaultPasswordMaxLength
+	}
+	if policy.maxLength < policy.minLength {
+		return nil, fmt.Errorf("JUTZO_PASSWORD_MAX_LENGTH (%d) is less than JUTZO_PASSWORD_MIN_LENGTH (%d)",
+			policy.maxLength, policy.minLength)
+	}
+
+	// The required classes are a comma separated list, e.g. "lower,upper,digit"
+	if classes, isPresent := config.GetConfigurationString("JUTZO_PASSWORD_REQUIRED_CLASSES"); isPresent {
+		for _, class := range splitRights(classes) {
+			switch strings.TrimSpace(class) {
+			case "lower":
+				policy.requireLowercase = true
+			case "upper":
+				policy.requireUppercase = true
+			case "digit":
+				policy.requireDigit = true
+			case "symbol":
+				policy.requireSymbol = true
+			default:
+				return nil, fmt.Errorf("unknown character class in JUTZO_PASSWORD_REQUIRED_CLASSES: %s", class)
+			}
+		}
+	}
+
+	if file, isPresent := config.GetConfigurationString("JUTZO_PASSWORD_BREACHED_LIST"); isPresent && file != "" {
+		var err error
+		if policy.breached, err = openBreachedList(file); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// openBreachedList opens the breached password list, checking that it starts
+// with a hash. The file is kept open for the life of the server
+func openBreachedList(file string) (*breachedList, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open breached password list: %s", err.Error())
+	}
+	list := &breachedList{file: reader}
+	if info, err := reader.Stat(); err != nil {
+		_ = reader.Close()
+		return nil, fmt.Errorf("unable to read breached password list: %s", err.Error())
+	} else {
+		list.size = info.Size()
+	}
+	if hash, _, err := list.lineAt(0); err != nil || !validBreachedHash(hash) {
+		_ = reader.Close()
+		return nil, fmt.Errorf("the breached password list must start with a SHA-1 hash in hex")
+	}
+	return list, nil
+}
+
+// contains determines if the hash (in upper case hex) is in the list. Each
+// step looks at the first line starting at or after the middle of the part
+// of the file still to be searched
+func (list *breachedList) contains(hash string) (bool, error) {
+	low, high := int64(0), list.size
+	for low < high {
+		middle := low + (high-low)/2
+		start, err := list.lineStartFrom(middle, low)
+		if err != nil {
+			return false, err
+		} else if start >= high {
+			high = middle
+			continue
+		}
+
+		lineHash, next, err := list.lineAt(start)
+		if err != nil {
+			return false, err
+		}
+		switch strings.Compare(lineHash, hash) {
+		case 0:
+			return true, nil
+		case -1:
+			low = next
+		default:
+			high = middle
+		}
+	}
+	return false, nil
+}
+
+// lineStartFrom finds where the first line starting at or after the offset
+// begins, given that a line starts at low (which is no later than the offset)
+func (list *breachedList) lineStartFrom(offset int64, low int64) (int64, error) {
+	buffer := make([]byte, breachedLineLength)
+	for position := offset - 1; offset > low && position < list.size; position += int64(len(buffer)) {
+		count, err := list.file.ReadAt(buffer, position)
+		if newline := bytes.IndexByte(buffer[:count], '\n'); newline >= 0 {
+			return position + int64(newline) + 1, nil
+		} else if err == io.EOF {
+			return list.size, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// lineAt returns the hash on the line starting at the offset, in upper case,
+// and where the next line starts
+func (list *breachedList) lineAt(offset int64) (string, int64, error) {
+	buffer := make([]byte, breachedLineLength)
+	count, err := list.file.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	line := buffer[:count]
+	next := offset + int64(count)
+	if newline := bytes.IndexByte(line, '\n'); newline >= 0 {
+		line, next = line[:newline], offset+int64(newline)+1
+	} else if err == nil {
+		return "", 0, fmt.Errorf("line at %d of the breached password list is too long", offset)
+	}
+	hash, _, _ := strings.Cut(strings.TrimSpace(string(line)), ":")
+	return strings.ToUpper(hash), next, nil
+}
+
+// validBreachedHash determines if the hash is a SHA-1 hash in hex
+func validBreachedHash(hash string) bool {
+	_, err := hex.DecodeString(hash)
+	return err == nil && len(hash) == sha1.Size*2
+}
+
+// Check the password for the given user against the policy, returning
+// a *jutzo.PasswordPolicyError listing every rule that it breaks
+func (policy *PasswordPolicy) Check(password string, username string, email string) error {
+	var violations []jutzo.PasswordViolation
+	violate := func(code string, format string, args ...any) {
+		violations = append(violations, jutzo.PasswordViolation{Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if length := len([]rune(password)); length < policy.minLength {
+		violate(jutzo.PasswordTooShort, "must be at least %d characters", policy.minLength)
+	} else if length > policy.maxLength {
+		violate(jutzo.PasswordTooLong, "must be at most %d characters", policy.maxLength)
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	for _, character := range password {
+		switch {
+		case unicode.IsLower(character):
+			hasLower = true
+		case unicode.IsUpper(character):
+			hasUpper = true
+		case unicode.IsDigit(character):
+			hasDigit = true
+		case unicode.IsPunct(character) || unicode.IsSymbol(character) || unicode.IsSpace(character):
+			hasSymbol = true
+		}
+	}
+	if policy.requireLowercase && !hasLower {
+		violate(jutzo.PasswordMissingLowercase, "must contain a lowercase letter")
+	}
+	if policy.requireUppercase && !hasUpper {
+		violate(jutzo.PasswordMissingUppercase, "must contain an uppercase letter")
+	}
+	if policy.requireDigit && !hasDigit {
+		violate(jutzo.PasswordMissingDigit, "must contain a digit")
+	}
+	if policy.requireSymbol && !hasSymbol {
+		violate(jutzo.PasswordMissingSymbol, "must contain a symbol")
+	}
+
+	if username != "" && strings.EqualFold(password, username) {
+		violate(jutzo.PasswordMatchesUsername, "must not be the same as the username")
+	}
+	if email != "" && (strings.EqualFold(password, email) || strings.EqualFold(password, strings.Split(email, "@")[0])) {
+		violate(jutzo.PasswordMatchesEmail, "must not be the same as the email address")
+	}
+	if breached, err := policy.isBreached(password); err != nil {
+		return err
+	} else if breached {
+		violate(jutzo.PasswordBreached, "has appeared in a data breach and must not be used")
+	}
+
+	if len(violations) > 0 {
+		return &jutzo.PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// isBreached determines if the password is in the breached password list
+func (policy *PasswordPolicy) isBreached(password string) (bool, error) {
+	if policy.breached == nil {
+		return false, nil
+	}
+	sum := sha1.Sum([]byte(password))
+	return policy.breached.contains(strings.ToUpper(hex.EncodeToString(sum[:])))
+}
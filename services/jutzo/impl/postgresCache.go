@@ -0,0 +1,441 @@
+package impl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"services/jutzo"
+	"strings"
+	"time"
+)
+
+// DefaultSessionCleanupMinutes is how often expired sessions, transient
+// values and counters are deleted from Postgres, unless configured otherwise.
+// Expired rows are never returned in the meantime
+const DefaultSessionCleanupMinutes = 10
+
+// sessionStoreSchema is the first schema with the tables the Postgres cache
+// keeps its entries in
+const sessionStoreSchema = 15
+
+// PostgresCache keeps user sessions, transient values and counters in
+// Postgres tables, so that Jutzo can run without Redis. Entries expire as
+// they do in Redis, and are deleted periodically once they have
+type PostgresCache struct {
+	config   jutzo.ConfigurationProvider
+	db       *sql.DB
+	timeouts jutzo.SessionTimeouts
+	stop     chan struct{}
+}
+
+// NewPostgresCache will create a new Postgres cache for the engine to use
+func NewPostgresCache(configurationProvider jutzo.ConfigurationProvider) (jutzo.UserSessionCache, error) {
+	result := new(PostgresCache)
+	result.config = configurationProvider
+	result.timeouts = NewSessionTimeouts(configurationProvider)
+	if err := result.Connect(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Connect to the database given by JUTZO_DB_URL and start deleting expired
+// entries periodically. The tables the cache needs are created when the
+// Postgres database is upgraded, so it has to have been upgraded first
+func (cache *PostgresCache) Connect() error {
+	if cache.db != nil {
+		return nil
+	}
+
+	dbURL, isPresent := cache.config.GetConfigurationString("JUTZO_DB_URL")
+	if !isPresent {
+		return errors.New("required connection string for database JUTZO_DB_URL is missing")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return err
+	}
+	var schema int
+	if err = db.QueryRow(`select schema_ordinal from jutzo_database_info`).Scan(&schema); err == nil && schema < sessionStoreSchema {
+		err = fmt.Errorf("the Postgres session store needs the database at schema %d, not %d", sessionStoreSchema, schema)
+	}
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	cleanupMinutes, isPresent := cache.config.GetConfigurationInt("JUTZO_SESSION_CLEANUP_MINUTES")
+	if !isPresent || cleanupMinutes <= 0 {
+		cleanupMinutes = DefaultSessionCleanupMinutes
+	}
+	cache.db = db
+	cache.stop = make(chan struct{})
+	go cache.cleanUp(db, time.Duration(cleanupMinutes)*time.Minute, cache.stop)
+	return nil
+}
+
+// Disconnect from the database, stopping the periodic cleanup
+func (cache *PostgresCache) Disconnect() error {
+	db := cache.db
+	if db != nil {
+		cache.db = nil
+		close(cache.stop)
+		return db.Close()
+	} else {
+		return nil
+	}
+}
+
+// GetUserSessionByID will look for the ID in the cache and return it if it
+// exists and isn't expired, or ErrSessionNotFound if it doesn't. Retrieving a
+// session extends its idle timeout, at most once every sessionTouchInterval
+func (cache *PostgresCache) GetUserSessionByID(uniqueID string) (jutzo.UserSession, error) {
+	var marshalledSession []byte
+	var lastSeen int64
+	if err := cache.db.QueryRow(`select value, last_seen from jutzo_session where id = $1 and expiration > now()`,
+		uniqueID).Scan(&marshalledSession, &lastSeen); err == sql.ErrNoRows {
+		return nil, jutzo.ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	userSession := new(UserSessionImpl)
+	if err := json.Unmarshal(marshalledSession, userSession); err != nil {
+		return nil, err
+	}
+	userSession.LastSeen = time.Unix(lastSeen, 0)
+
+	// The session is in use, so slide the idle timeout forward, unless that
+	// was done recently enough that it can wait
+	if time.Since(userSession.LastSeen) >= sessionTouchInterval(cache.timeouts) {
+		statement := `update jutzo_session
+                         set expiration = least(now() + $2::interval, lifetime_end), last_seen = $3
+                       where id = $1 and expiration > now()`
+		now := time.Now()
+		if _, err := cache.db.Exec(statement, uniqueID, postgresInterval(cache.timeouts.IdleTimeout),
+			now.Unix()); err != nil {
+			return nil, err
+		}
+		userSession.LastSeen = now
+	}
+	return userSession, nil
+}
+
+// CacheUserSession so that it can be retrieved again by the unique ID
+func (cache *PostgresCache) CacheUserSession(userInfo jutzo.UserInfo, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	userSession := new(UserSessionImpl)
+	userSession.Info = userInfo.(*UserInfoImpl)
+	userSession.ID = uuid.NewString()
+	userSession.Duration = cache.timeouts.RefreshDuration
+	userSession.CreationTime = time.Now()
+	userSession.LastSeen = userSession.CreationTime
+	userSession.Client = client
+	if err := rotateRefreshToken(userSession); err != nil {
+		return nil, err
+	}
+
+	marshalledSession, err := json.Marshal(userSession)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal the userSession: %s", err.Error())
+	}
+	statement := `insert into jutzo_session (id, username, value, last_seen, lifetime_end, expiration)
+                       values ($1, $2, $3, $4, now() + $5::interval, now() + least($5::interval, $6::interval))`
+	if _, err = cache.db.Exec(statement, userSession.ID, userSession.Info.Username, marshalledSession,
+		userSession.LastSeen.Unix(), postgresInterval(cache.timeouts.RefreshDuration),
+		postgresInterval(cache.timeouts.IdleTimeout)); err != nil {
+		return nil, err
+	}
+	return userSession, nil
+}
+
+// RefreshUserSession exchanges a refresh token for a new one, rotating
+// the token held by the session. Presenting a token that has already been
+// exchanged destroys the session and returns ErrRefreshTokenReused; any other
+// token returns ErrInvalidRefreshToken and leaves the session alone
+func (cache *PostgresCache) RefreshUserSession(refreshToken string) (jutzo.UserSession, error) {
+	uniqueID, _, found := strings.Cut(refreshToken, ".")
+	if !found {
+		return nil, jutzo.ErrInvalidRefreshToken
+	}
+
+	// The session is locked while we rotate the token, so that two concurrent
+	// refreshes with the same token can't both succeed. A reused token is only
+	// reported once the session has been deleted
+	var refreshed *UserSessionImpl
+	reused := false
+	err := cache.inTransaction(func(tx *sql.Tx) error {
+		userSession, err := loadLockedUserSession(tx, uniqueID)
+		if err == sql.ErrNoRows {
+			return jutzo.ErrInvalidRefreshToken
+		} else if err != nil {
+			return err
+		}
+
+		if err = checkRefreshToken(userSession, refreshToken); err == jutzo.ErrRefreshTokenReused {
+			reused = true
+			_, err = tx.Exec(`delete from jutzo_session where id = $1`, uniqueID)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if err = rotateRefreshToken(userSession); err != nil {
+			return err
+		}
+		userSession.LastSeen = time.Now()
+		marshalledSession, err := json.Marshal(userSession)
+		if err != nil {
+			return err
+		}
+		statement := `update jutzo_session
+                         set value = $2, last_seen = $3, expiration = least(now() + $4::interval, lifetime_end)
+                       where id = $1`
+		if _, err = tx.Exec(statement, uniqueID, marshalledSession, userSession.LastSeen.Unix(),
+			postgresInterval(cache.timeouts.IdleTimeout)); err != nil {
+			return err
+		}
+		refreshed = userSession
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	} else if reused {
+		return nil, jutzo.ErrRefreshTokenReused
+	} else {
+		return refreshed, nil
+	}
+}
+
+// InvalidateUserSession by removing the session from the cache
+func (cache *PostgresCache) InvalidateUserSession(uniqueID string) error {
+	_, err := cache.db.Exec(`delete from jutzo_session where id = $1`, uniqueID)
+	return err
+}
+
+// ListUserSessions returns all the live sessions for the given user,
+// most recently used first
+func (cache *PostgresCache) ListUserSessions(username string) ([]jutzo.UserSession, error) {
+	statement := `select value, last_seen
+                    from jutzo_session
+                   where username = $1 and expiration > now()
+                   order by last_seen desc, id desc`
+
+	if rows, err := cache.db.Query(statement, username); err == nil {
+		defer closeRows(rows)
+		var result []jutzo.UserSession
+		for rows.Next() {
+			var marshalledSession []byte
+			var lastSeen int64
+			if err = rows.Scan(&marshalledSession, &lastSeen); err != nil {
+				return nil, err
+			}
+			userSession := new(UserSessionImpl)
+			if err = json.Unmarshal(marshalledSession, userSession); err != nil {
+				return nil, err
+			}
+			userSession.LastSeen = time.Unix(lastSeen, 0)
+			result = append(result, userSession)
+		}
+		return result, rows.Err()
+	} else {
+		return nil, err
+	}
+}
+
+// InvalidateUserSessions removes all the sessions for the given user,
+// except for the session with the ID given in except (which may be "")
+func (cache *PostgresCache) InvalidateUserSessions(username string, except string) error {
+	_, err := cache.db.Exec(`delete from jutzo_session where username = $1 and id <> $2`, username, except)
+	return err
+}
+
+// UpdateUserSessions replaces the user information held by each of the
+// user's live sessions with what update returns for that session
+func (cache *PostgresCache) UpdateUserSessions(username string, update func(userSession jutzo.UserSession) jutzo.UserInfo) error {
+	return cache.inTransaction(func(tx *sql.Tx) error {
+		statement := `select id from jutzo_session where username = $1 and expiration > now()`
+		rows, err := tx.Query(statement, username)
+		if err != nil {
+			return err
+		}
+		var uniqueIDs []string
+		for rows.Next() {
+			var uniqueID string
+			if err = rows.Scan(&uniqueID); err != nil {
+				closeRows(rows)
+				return err
+			}
+			uniqueIDs = append(uniqueIDs, uniqueID)
+		}
+		closeRows(rows)
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, uniqueID := range uniqueIDs {
+			if err = updateLockedUserSession(tx, uniqueID, func(userSession *UserSessionImpl) {
+				userSession.Info = update(userSession).(*UserInfoImpl)
+			}); err != nil && err != sql.ErrNoRows {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RebindUserSession to the client given, keeping the session's expiration
+func (cache *PostgresCache) RebindUserSession(uniqueID string, client jutzo.ClientInfo) error {
+	err := cache.inTransaction(func(tx *sql.Tx) error {
+		return updateLockedUserSession(tx, uniqueID, func(userSession *UserSessionImpl) {
+			// The client ID and scope of a delegated session stay as they were granted
+			userSession.Client.IP, userSession.Client.UserAgent = client.IP, client.UserAgent
+		})
+	})
+	if err == sql.ErrNoRows {
+		return jutzo.ErrInvalidRefreshToken
+	}
+	return err
+}
+
+// StoreTransient keeps a short-lived value, such as the state of a login
+// in progress, until it is taken or the time to live has passed
+func (cache *PostgresCache) StoreTransient(key string, value []byte, ttl time.Duration) error {
+	statement := `insert into jutzo_transient (key, value, expiration) values ($1, $2, now() + $3::interval)
+                  on conflict (key) do update set value = excluded.value, expiration = excluded.expiration`
+	_, err := cache.db.Exec(statement, key, value, postgresTimeToLive(ttl))
+	return err
+}
+
+// TakeTransient retrieves and removes a value stored with StoreTransient,
+// so that it can only be used once. Returns nil if there is no such value
+func (cache *PostgresCache) TakeTransient(key string) ([]byte, error) {
+	statement := `delete from jutzo_transient where key = $1
+               returning value, expiration is null or expiration > now()`
+
+	var value []byte
+	var live bool
+	if err := cache.db.QueryRow(statement, key).Scan(&value, &live); err == sql.ErrNoRows || (err == nil && !live) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// GetTransientTimeToLive returns how long the transient value has left
+// before it expires, or zero if there is no such value
+func (cache *PostgresCache) GetTransientTimeToLive(key string) (time.Duration, error) {
+	statement := `select extract(epoch from expiration - now())
+                    from jutzo_transient
+                   where key = $1 and expiration > now()`
+
+	var seconds float64
+	if err := cache.db.QueryRow(statement, key).Scan(&seconds); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// IncrementCounter adds one to the counter with the given key, returning the
+// new count. The counter is discarded once ttl passes without an increment
+func (cache *PostgresCache) IncrementCounter(key string, ttl time.Duration) (int64, error) {
+	statement := `insert into jutzo_counter (key, count, expiration) values ($1, 1, now() + $2::interval)
+                  on conflict (key) do update
+                          set count = case when jutzo_counter.expiration is null or jutzo_counter.expiration > now()
+                                           then jutzo_counter.count + 1 else 1 end,
+                              expiration = excluded.expiration
+                    returning count`
+
+	var count int64
+	err := cache.db.QueryRow(statement, key, postgresTimeToLive(ttl)).Scan(&count)
+	return count, err
+}
+
+// DeleteCounter with the given key, resetting it to zero
+func (cache *PostgresCache) DeleteCounter(key string) error {
+	_, err := cache.db.Exec(`delete from jutzo_counter where key = $1`, key)
+	return err
+}
+
+// cleanUp deletes the entries that have expired every interval, until stopped
+func (cache *PostgresCache) cleanUp(db *sql.DB, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, table := range []string{"jutzo_session", "jutzo_transient", "jutzo_counter"} {
+				if _, err := db.Exec(`delete from ` + table + ` where expiration <= now()`); err != nil {
+					log.Printf("Error deleting expired entries from %s: %s", table, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// inTransaction runs the work given in a transaction, committing it if
+// the work succeeds and rolling it back otherwise
+func (cache *PostgresCache) inTransaction(work func(tx *sql.Tx) error) error {
+	if tx, err := cache.db.Begin(); err == nil {
+		if err = work(tx); err == nil {
+			return tx.Commit()
+		} else {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				log.Printf("Error rolling back transaction: %s", rollbackErr.Error())
+			}
+			return err
+		}
+	} else {
+		return err
+	}
+}
+
+// loadLockedUserSession reads and decodes a live session, locking it until
+// the transaction ends. Returns sql.ErrNoRows if there is no such session
+func loadLockedUserSession(tx *sql.Tx, uniqueID string) (*UserSessionImpl, error) {
+	statement := `select value from jutzo_session where id = $1 and expiration > now() for update`
+
+	var marshalledSession []byte
+	if err := tx.QueryRow(statement, uniqueID).Scan(&marshalledSession); err != nil {
+		return nil, err
+	}
+	userSession := new(UserSessionImpl)
+	if err := json.Unmarshal(marshalledSession, userSession); err != nil {
+		return nil, err
+	}
+	return userSession, nil
+}
+
+// updateLockedUserSession applies the update to one live session, keeping its
+// expiration. Returns sql.ErrNoRows if there is no such session
+func updateLockedUserSession(tx *sql.Tx, uniqueID string, update func(userSession *UserSessionImpl)) error {
+	userSession, err := loadLockedUserSession(tx, uniqueID)
+	if err != nil {
+		return err
+	}
+	update(userSession)
+	if marshalledSession, err := json.Marshal(userSession); err == nil {
+		_, err = tx.Exec(`update jutzo_session set value = $2 where id = $1`, uniqueID, marshalledSession)
+		return err
+	} else {
+		return err
+	}
+}
+
+// postgresInterval formats the duration as a Postgres interval
+func postgresInterval(duration time.Duration) string {
+	return fmt.Sprintf("%d milliseconds", duration.Milliseconds())
+}
+
+// postgresTimeToLive is the interval an entry kept for the ttl expires after.
+// As in Redis, an entry without a ttl doesn't expire, so its expiration is null
+func postgresTimeToLive(ttl time.Duration) sql.NullString {
+	return sql.NullString{String: postgresInterval(ttl), Valid: ttl > 0}
+}
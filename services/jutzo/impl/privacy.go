@@ -0,0 +1,133 @@
+package impl
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"services/jutzo"
+	"time"
+)
+
+// DefaultDeletionGraceDays is how long an account is kept after the user asks
+// for it to be deleted, when the configuration does not provide a value
+const DefaultDeletionGraceDays = 30
+
+// deletionGrace is how long accounts are kept after their deletion is requested
+func deletionGrace(config jutzo.ConfigurationProvider) time.Duration {
+	days, isPresent := config.GetConfigurationInt("JUTZO_DELETION_GRACE_DAYS")
+	if !isPresent || days < 0 {
+		days = DefaultDeletionGraceDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// ExportUserData collects everything held about the user, for them to download
+func (engine *EngineImpl) ExportUserData(user string) (*jutzo.UserDataExport, error) {
+	export := &jutzo.UserDataExport{ExportTime: time.Now().UTC()}
+	var err error
+	if export.User, err = engine.db.RetrieveUserInformation(user); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = engine.cache.ListUserSessions(user); err != nil {
+		return nil, err
+	}
+	if export.APIKeys, err = engine.db.ListAPIKeys(user); err != nil {
+		return nil, err
+	}
+	if export.Identities, err = engine.db.ListExternalIdentities(user); err != nil {
+		return nil, err
+	}
+	if export.Invites, err = engine.db.ListInvites(user); err != nil {
+		return nil, err
+	}
+	if export.AuditEvents, err = engine.db.ListAuditEvents(jutzo.AuditQuery{User: user}); err != nil {
+		return nil, err
+	}
+	if deletion, err := engine.db.RetrieveDeletionRequest(user); err == nil {
+		export.Deletion = &deletion
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return export, nil
+}
+
+// RequestAccountDeletion schedules the user's account to be deleted (or
+// anonymized) once the grace period has passed. Asking again replaces the
+// earlier request, and starts the grace period again
+func (engine *EngineImpl) RequestAccountDeletion(user string, anonymize bool) (jutzo.DeletionRequest, error) {
+	userInfo, err := engine.db.RetrieveUserInformation(user)
+	if err != nil {
+		return jutzo.DeletionRequest{}, err
+	}
+	if err = engine.ensureNotLastAdmin(userInfo); err != nil {
+		return jutzo.DeletionRequest{}, err
+	}
+	return engine.db.StoreDeletionRequest(user, anonymize, time.Now().Add(deletionGrace(engine.config)))
+}
+
+// CancelAccountDeletion requested by the user
+func (engine *EngineImpl) CancelAccountDeletion(user string) error {
+	return engine.db.DeleteDeletionRequest(user)
+}
+
+// PurgeAccountDeletions deletes or anonymizes the accounts whose deletion is
+// due. An account that can't be processed (e.g. because its user has since
+// become the last administrator) is logged and left for the next purge
+func (engine *EngineImpl) PurgeAccountDeletions() (int, error) {
+	requests, err := engine.db.ListDueDeletions(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, request := range requests {
+		var pseudonym string
+		eventType := jutzo.AuditUserDeleted
+		if request.Anonymize {
+			eventType = jutzo.AuditUserAnonymized
+			pseudonym, err = engine.anonymizeUser(request.Username)
+		} else {
+			pseudonym, err = engine.DeleteUser(request.Username)
+		}
+		if err == nil {
+			purged++
+			event := jutzo.AuditEvent{Type: eventType, Target: pseudonym, Detail: "requested by the user"}
+			if err = engine.RecordAuditEvent(event); err != nil {
+				log.Printf("Unable to record the purge of %s: %s", request.Username, err.Error())
+			}
+		} else {
+			log.Printf("Unable to purge account %s: %s", request.Username, err.Error())
+		}
+	}
+	return purged, nil
+}
+
+// anonymizeUser replaces everything that identifies the user, keeping the
+// account (under a new name) so that what refers to it stays consistent.
+// Returns the new name, which the audit log names them by too
+func (engine *EngineImpl) anonymizeUser(user string) (string, error) {
+	anonymousID := uuid.NewString()
+	anonymousName := "deleted-" + anonymousID
+	if err := engine.db.AnonymizeUser(user, anonymousName, anonymousID+"@deleted.invalid"); err != nil {
+		return "", err
+	}
+	if err := engine.db.PseudonymizeAuditEvents(user, anonymousName); err != nil {
+		return "", err
+	}
+	return anonymousName, engine.cache.InvalidateUserSessions(user, "")
+}
+
+// ensureNotLastAdmin returns ErrLastAdmin if the user is the only enabled
+// administrator, so can't be removed. The database makes sure of this when
+// the user is removed; this is for refusing early, e.g. a deletion request
+func (engine *EngineImpl) ensureNotLastAdmin(userInfo jutzo.UserInfo) error {
+	if isActiveAdmin(userInfo) {
+		if count, err := engine.db.GetAdminCount(); err != nil {
+			return err
+		} else if count <= 1 {
+			return jutzo.ErrLastAdmin
+		}
+	}
+	return nil
+}
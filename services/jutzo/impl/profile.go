@@ -0,0 +1,76 @@
+package impl
+
+import (
+	"golang.org/x/exp/slices"
+	"golang.org/x/text/language"
+	"net/url"
+	"services/jutzo"
+	"time"
+	_ "time/tzdata" // so timezones can be checked wherever the service runs
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the length (in characters) of the fields of a profile
+const (
+	MaxDisplayNameLength = 128
+	MaxBioLength         = 2000
+	MaxAvatarURLLength   = 1024
+)
+
+// UpdateProfile of the user with the fields present in the patch, returning
+// the updated user. Nothing is changed if any of the fields isn't valid
+func (engine *EngineImpl) UpdateProfile(user string, patch jutzo.ProfilePatch) (jutzo.UserInfo, error) {
+	if err := validateProfilePatch(patch); err != nil {
+		return nil, err
+	}
+	return engine.updateUser(user, func(userInfo jutzo.UserInfo) {
+		userInfo.SetProfile(patch.Apply(userInfo.GetProfile()))
+	})
+}
+
+// validateProfilePatch checks each of the fields present in the patch
+func validateProfilePatch(patch jutzo.ProfilePatch) error {
+	invalid := func(field string, reason string) error {
+		return &jutzo.InvalidProfileError{Field: field, Reason: reason}
+	}
+
+	if name := patch.DisplayName; name != nil {
+		if utf8.RuneCountInString(*name) > MaxDisplayNameLength {
+			return invalid("displayName", "too long")
+		}
+		for _, r := range *name {
+			if unicode.IsControl(r) {
+				return invalid("displayName", "contains control characters")
+			}
+		}
+	}
+	if bio := patch.Bio; bio != nil && utf8.RuneCountInString(*bio) > MaxBioLength {
+		return invalid("bio", "too long")
+	}
+	if avatar := patch.AvatarURL; avatar != nil && *avatar != "" {
+		if utf8.RuneCountInString(*avatar) > MaxAvatarURLLength {
+			return invalid("avatarUrl", "too long")
+		}
+		if parsed, err := url.Parse(*avatar); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return invalid("avatarUrl", "must be an https URL")
+		}
+	}
+	if timezone := patch.Timezone; timezone != nil && *timezone != "" {
+		if _, err := time.LoadLocation(*timezone); err != nil || *timezone == "Local" {
+			return invalid("timezone", "unknown timezone")
+		}
+	}
+	if locale := patch.Locale; locale != nil && *locale != "" {
+		if _, err := language.Parse(*locale); err != nil {
+			return invalid("locale", "not a valid language tag")
+		}
+	}
+	if notifications := patch.Notifications; notifications != nil && notifications.Digest != nil {
+		digests := []string{jutzo.DigestNever, jutzo.DigestDaily, jutzo.DigestWeekly}
+		if !slices.Contains(digests, *notifications.Digest) {
+			return invalid("notifications.digest", "must be one of never, daily or weekly")
+		}
+	}
+	return nil
+}
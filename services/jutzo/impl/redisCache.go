@@ -2,6 +2,7 @@ package impl
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,18 +10,28 @@ import (
 	"github.com/google/uuid"
 	"net/url"
 	"services/jutzo"
+	"strings"
 	"time"
 )
 
+// maxSessionUpdateAttempts is how many times a session that keeps changing
+// while it is being rewritten is tried again, before giving up
+const maxSessionUpdateAttempts = 10
+
+// errSessionContended is returned when a session kept changing while it was being rewritten
+var errSessionContended = errors.New("the session kept changing while it was being updated")
+
 type RedisCache struct {
-	config jutzo.ConfigurationProvider
-	client *redis.Client
+	config   jutzo.ConfigurationProvider
+	client   *redis.Client
+	timeouts jutzo.SessionTimeouts
 }
 
 // NewRedisCache will create a new Redis cache for the engine to use
 func NewRedisCache(configurationProvider jutzo.ConfigurationProvider) (jutzo.UserSessionCache, error) {
 	result := new(RedisCache)
 	result.config = configurationProvider
+	result.timeouts = NewSessionTimeouts(configurationProvider)
 	err := result.Connect()
 	return result, err
 }
@@ -77,22 +88,43 @@ func (cache *RedisCache) Disconnect() error {
 }
 
 // GetUserSessionByID will look for the ID in the cache and return it
-// if it exists and isn't expired. It will return nil if the session
-// cannot be found, and an error if there is a problem communicating
-// with the cache
+// if it exists and isn't expired. It will return ErrSessionNotFound if the
+// session cannot be found, and another error if there is a problem
+// communicating with the cache. Retrieving a session extends its idle timeout,
+// at most once every sessionTouchInterval
 func (cache *RedisCache) GetUserSessionByID(uniqueID string) (jutzo.UserSession, error) {
 
 	// Get the actual user session from the Redis server
-	if marshalledUserSession, err := cache.client.Get(context.Background(), uniqueID).Result(); err == nil {
+	ctx := context.Background()
+	if userSession, err := cache.loadUserSession(ctx, cache.client, uniqueID); err == nil {
 
-		// Decode the user session. Note we need to have an allocated UserSession so that
-		// it doesn't go out of scope when this function ends
-		userSession := new(UserSessionImpl)
-		if err = json.Unmarshal([]byte(marshalledUserSession), userSession); err == nil {
-			return userSession, nil
+		// Redis keeps keys for whole seconds, so the session can outlast its
+		// absolute lifetime by a moment. It is over then, and can't be extended
+		if cache.slidingExpiration(userSession) <= 0 {
+			if err = cache.removeUserSession(ctx, userSession.Info.Username, uniqueID); err != nil {
+				return nil, err
+			}
+			return nil, jutzo.ErrSessionNotFound
+		}
+
+		// The session is in use, so slide the idle timeout forward, unless that
+		// was done recently enough that it can wait
+		indexKey := userSessionIndexKey(userSession.Info.Username)
+		if lastSeen, err := cache.client.ZScore(ctx, indexKey, uniqueID).Result(); err == nil {
+			userSession.LastSeen = time.Unix(int64(lastSeen), 0)
+			if time.Since(userSession.LastSeen) < sessionTouchInterval(cache.timeouts) {
+				return userSession, nil
+			}
+		} else if err != redis.Nil {
+			return nil, err
+		}
+		if err = cache.client.Expire(ctx, uniqueID, cache.slidingExpiration(userSession)).Err(); err == nil {
+			return userSession, cache.touchUserSession(ctx, userSession)
 		} else {
 			return nil, err
 		}
+	} else if err == redis.Nil {
+		return nil, jutzo.ErrSessionNotFound
 	} else {
 		return nil, err
 	}
@@ -100,23 +132,29 @@ func (cache *RedisCache) GetUserSessionByID(uniqueID string) (jutzo.UserSession,
 }
 
 // CacheUserSession so that it can be retrieved again by the unique ID
-func (cache *RedisCache) CacheUserSession(userInfo jutzo.UserInfo) (jutzo.UserSession, error) {
+func (cache *RedisCache) CacheUserSession(userInfo jutzo.UserInfo, client jutzo.ClientInfo) (jutzo.UserSession, error) {
 	// Create a new uuid to store that user session in the Redis cache with
 	if uniqueID, err := uuid.NewRandom(); err == nil {
 
-		// Get the new UUID as a string
-		id := uniqueID.String()
-
 		// Create a new user session
 		userSession := new(UserSessionImpl)
 		userSession.Info = userInfo.(*UserInfoImpl)
-		userSession.ID = id
-		userSession.Duration = time.Duration(8) * time.Hour
+		userSession.ID = uniqueID.String()
+		userSession.Duration = cache.timeouts.RefreshDuration
+		userSession.CreationTime = time.Now()
+		userSession.Client = client
 
-		if marshalledSession, err := json.Marshal(userSession); err == nil {
-			return userSession, cache.client.Set(context.Background(), id, marshalledSession, userSession.Duration).Err()
+		// Give the session its first refresh token
+		if err = rotateRefreshToken(userSession); err != nil {
+			return nil, err
+		}
+
+		// Store the session and add it to the user's session index
+		ctx := context.Background()
+		if err = cache.storeUserSession(ctx, cache.client, userSession); err == nil {
+			return userSession, cache.touchUserSession(ctx, userSession)
 		} else {
-			return nil, errors.New(fmt.Sprintf("could not marshal the userSession: %s", err.Error()))
+			return nil, err
 		}
 	} else {
 		return nil, errors.New("could not create unique Redis key")
@@ -124,7 +162,377 @@ func (cache *RedisCache) CacheUserSession(userInfo jutzo.UserInfo) (jutzo.UserSe
 
 }
 
+// RefreshUserSession exchanges a refresh token for a new one, rotating
+// the token held by the session. Presenting a token that has already been
+// exchanged destroys the session and returns ErrRefreshTokenReused; any other
+// token returns ErrInvalidRefreshToken and leaves the session alone
+func (cache *RedisCache) RefreshUserSession(refreshToken string) (jutzo.UserSession, error) {
+
+	// The refresh token carries the session ID it belongs to
+	uniqueID, _, found := strings.Cut(refreshToken, ".")
+	if !found {
+		return nil, jutzo.ErrInvalidRefreshToken
+	}
+
+	// Watch the session while we rotate the token, so that two concurrent
+	// refreshes with the same token can't both succeed
+	ctx := context.Background()
+	var refreshed *UserSessionImpl
+	err := cache.client.Watch(ctx, func(tx *redis.Tx) error {
+		userSession, err := cache.loadUserSession(ctx, tx, uniqueID)
+		if err == redis.Nil {
+			return jutzo.ErrInvalidRefreshToken
+		} else if err != nil {
+			return err
+		}
+
+		// A token that has been used already means the session is compromised
+		if err = checkRefreshToken(userSession, refreshToken); err == jutzo.ErrRefreshTokenReused {
+			if _, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, uniqueID)
+				pipe.ZRem(ctx, userSessionIndexKey(userSession.Info.Username), uniqueID)
+				return nil
+			}); err == nil {
+				err = jutzo.ErrRefreshTokenReused
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		// Rotate the token and store the session back
+		if err = rotateRefreshToken(userSession); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return cache.storeUserSession(ctx, pipe, userSession)
+		})
+		refreshed = userSession
+		return err
+	}, uniqueID)
+
+	if err == redis.TxFailedErr {
+		return nil, jutzo.ErrInvalidRefreshToken
+	} else if err != nil {
+		return nil, err
+	} else {
+		return refreshed, cache.touchUserSession(ctx, refreshed)
+	}
+}
+
 // InvalidateUserSession by removing the session from the cache
 func (cache *RedisCache) InvalidateUserSession(uniqueID string) error {
-	return cache.client.Del(context.Background(), uniqueID).Err()
+
+	// Load the session first so that we can find the user's session index
+	ctx := context.Background()
+	if userSession, err := cache.loadUserSession(ctx, cache.client, uniqueID); err == nil {
+		return cache.removeUserSession(ctx, userSession.Info.Username, uniqueID)
+	} else if err == redis.Nil {
+		return nil
+	} else {
+		return err
+	}
+}
+
+// ListUserSessions returns all the live sessions for the given user,
+// most recently used first
+func (cache *RedisCache) ListUserSessions(username string) ([]jutzo.UserSession, error) {
+
+	ctx := context.Background()
+	indexKey := userSessionIndexKey(username)
+	if entries, err := cache.client.ZRevRangeWithScores(ctx, indexKey, 0, -1).Result(); err == nil {
+
+		var result []jutzo.UserSession
+		for _, entry := range entries {
+			uniqueID := entry.Member.(string)
+			if userSession, err := cache.loadUserSession(ctx, cache.client, uniqueID); err == nil {
+				userSession.LastSeen = time.Unix(int64(entry.Score), 0)
+				result = append(result, userSession)
+			} else if err == redis.Nil {
+
+				// The session has expired; prune it from the index
+				if err = cache.client.ZRem(ctx, indexKey, uniqueID).Err(); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, err
+			}
+		}
+		return result, nil
+	} else {
+		return nil, err
+	}
+}
+
+// InvalidateUserSessions removes all the sessions for the given user,
+// except for the session with the ID given in except (which may be "")
+func (cache *RedisCache) InvalidateUserSessions(username string, except string) error {
+
+	ctx := context.Background()
+	if uniqueIDs, err := cache.client.ZRange(ctx, userSessionIndexKey(username), 0, -1).Result(); err == nil {
+		for _, uniqueID := range uniqueIDs {
+			if uniqueID != except {
+				if err = cache.removeUserSession(ctx, username, uniqueID); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+// UpdateUserSessions replaces the user information held by each of the
+// user's live sessions with what update returns for that session
+func (cache *RedisCache) UpdateUserSessions(username string, update func(userSession jutzo.UserSession) jutzo.UserInfo) error {
+
+	ctx := context.Background()
+	if uniqueIDs, err := cache.client.ZRange(ctx, userSessionIndexKey(username), 0, -1).Result(); err == nil {
+		for _, uniqueID := range uniqueIDs {
+			err = cache.updateUserSession(ctx, uniqueID, func(userSession *UserSessionImpl) {
+				userSession.Info = update(userSession).(*UserInfoImpl)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+// RebindUserSession to the client given, keeping the session's expiration
+func (cache *RedisCache) RebindUserSession(uniqueID string, client jutzo.ClientInfo) error {
+	ctx := context.Background()
+	if _, err := cache.loadUserSession(ctx, cache.client, uniqueID); err == redis.Nil {
+		return jutzo.ErrInvalidRefreshToken
+	} else if err != nil {
+		return err
+	}
+
+	return cache.updateUserSession(ctx, uniqueID, func(userSession *UserSessionImpl) {
+		// The client ID and scope of a delegated session stay as they were granted
+		userSession.Client.IP, userSession.Client.UserAgent = client.IP, client.UserAgent
+	})
+}
+
+// updateUserSession applies the update to one session, keeping its
+// expiration. A session that changes while we rewrite it (e.g. because it
+// was refreshed) is rewritten again, up to maxSessionUpdateAttempts times
+func (cache *RedisCache) updateUserSession(ctx context.Context, uniqueID string, update func(userSession *UserSessionImpl)) error {
+	for attempt := 0; attempt < maxSessionUpdateAttempts; attempt++ {
+		if err := cache.rewriteUserSession(ctx, uniqueID, update); err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errSessionContended
+}
+
+// rewriteUserSession applies the update to one session, keeping its expiration.
+// The session is watched while it is rewritten, returning redis.TxFailedErr if
+// it changed
+func (cache *RedisCache) rewriteUserSession(ctx context.Context, uniqueID string, update func(userSession *UserSessionImpl)) error {
+	return cache.client.Watch(ctx, func(tx *redis.Tx) error {
+		userSession, err := cache.loadUserSession(ctx, tx, uniqueID)
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		expiration, err := tx.TTL(ctx, uniqueID).Result()
+		if err != nil || expiration <= 0 {
+			return err
+		}
+
+		update(userSession)
+		if marshalledSession, err := json.Marshal(userSession); err == nil {
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, uniqueID, marshalledSession, expiration)
+				return nil
+			})
+			return err
+		} else {
+			return err
+		}
+	}, uniqueID)
+}
+
+// StoreTransient keeps a short-lived value, such as the state of a login
+// in progress, until it is taken or the time to live has passed
+func (cache *RedisCache) StoreTransient(key string, value []byte, ttl time.Duration) error {
+	return cache.client.Set(context.Background(), transientKey(key), value, ttl).Err()
+}
+
+// TakeTransient retrieves and removes a value stored with StoreTransient,
+// so that it can only be used once. Returns nil if there is no such value
+func (cache *RedisCache) TakeTransient(key string) ([]byte, error) {
+	ctx := context.Background()
+	var get *redis.StringCmd
+	_, err := cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, transientKey(key))
+		pipe.Del(ctx, transientKey(key))
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		return get.Bytes()
+	}
+}
+
+// GetTransientTimeToLive returns how long the transient value has left
+// before it expires, or zero if there is no such value
+func (cache *RedisCache) GetTransientTimeToLive(key string) (time.Duration, error) {
+	if ttl, err := cache.client.PTTL(context.Background(), transientKey(key)).Result(); err != nil {
+		return 0, err
+	} else if ttl < 0 {
+		// Redis uses negative values for keys that don't exist (or never expire)
+		return 0, nil
+	} else {
+		return ttl, nil
+	}
+}
+
+// IncrementCounter adds one to the counter with the given key, returning the
+// new count. The counter is discarded once ttl passes without an increment
+func (cache *RedisCache) IncrementCounter(key string, ttl time.Duration) (int64, error) {
+	ctx := context.Background()
+	var incr *redis.IntCmd
+	_, err := cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, counterKey(key))
+		pipe.Expire(ctx, counterKey(key), ttl)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// DeleteCounter with the given key, resetting it to zero
+func (cache *RedisCache) DeleteCounter(key string) error {
+	return cache.client.Del(context.Background(), counterKey(key)).Err()
+}
+
+// counterKey namespaces counters so they can't collide with sessions or transients
+func counterKey(key string) string {
+	return fmt.Sprintf("jutzo-counter:%s", key)
+}
+
+// transientKey namespaces transient values so they can't collide with sessions
+func transientKey(key string) string {
+	return fmt.Sprintf("jutzo-transient:%s", key)
+}
+
+// userSessionIndexKey is the key of the Redis sorted set that holds the IDs
+// of a user's sessions, scored by the time each session was last seen
+func userSessionIndexKey(username string) string {
+	return fmt.Sprintf("jutzo-user-sessions:%s", username)
+}
+
+// touchUserSession records that the session was just used by updating its
+// score in the user's session index
+func (cache *RedisCache) touchUserSession(ctx context.Context, userSession *UserSessionImpl) error {
+	now := time.Now()
+	userSession.LastSeen = now
+	indexKey := userSessionIndexKey(userSession.Info.Username)
+	_, err := cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, indexKey, &redis.Z{Score: float64(now.Unix()), Member: userSession.ID})
+		pipe.Expire(ctx, indexKey, cache.timeouts.RefreshDuration)
+		return nil
+	})
+	return err
+}
+
+// removeUserSession deletes the session and removes it from the user's index
+func (cache *RedisCache) removeUserSession(ctx context.Context, username string, uniqueID string) error {
+	_, err := cache.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, uniqueID)
+		pipe.ZRem(ctx, userSessionIndexKey(username), uniqueID)
+		return nil
+	})
+	return err
+}
+
+// loadUserSession reads and decodes a session from Redis
+func (cache *RedisCache) loadUserSession(ctx context.Context, client redis.Cmdable, uniqueID string) (*UserSessionImpl, error) {
+	if marshalledUserSession, err := client.Get(ctx, uniqueID).Result(); err == nil {
+
+		// Decode the user session. Note we need to have an allocated UserSession so that
+		// it doesn't go out of scope when this function ends
+		userSession := new(UserSessionImpl)
+		if err = json.Unmarshal([]byte(marshalledUserSession), userSession); err == nil {
+			return userSession, nil
+		} else {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// storeUserSession encodes a session and writes it to Redis with
+// the idle timeout as its expiration
+func (cache *RedisCache) storeUserSession(ctx context.Context, client redis.Cmdable, userSession *UserSessionImpl) error {
+	expiration := cache.slidingExpiration(userSession)
+	if expiration <= 0 {
+		return jutzo.ErrInvalidRefreshToken
+	}
+	if marshalledSession, err := json.Marshal(userSession); err == nil {
+		return client.Set(ctx, userSession.ID, marshalledSession, expiration).Err()
+	} else {
+		return errors.New(fmt.Sprintf("could not marshal the userSession: %s", err.Error()))
+	}
+}
+
+// slidingExpiration determines how long the session should be kept
+// from now: the idle timeout, but never past the absolute session lifetime
+func (cache *RedisCache) slidingExpiration(userSession *UserSessionImpl) time.Duration {
+	remaining := time.Until(userSession.getExpirationTime())
+	if remaining < cache.timeouts.IdleTimeout {
+		return remaining
+	} else {
+		return cache.timeouts.IdleTimeout
+	}
+}
+
+// rotateRefreshToken gives the session a new refresh token, keeping only
+// the hash of that token in the session itself. The token is prefixed with
+// the session ID so that we can find the session again on refresh. The hash
+// of the token being replaced is retired, so that its reuse can be detected
+func rotateRefreshToken(userSession *UserSessionImpl) error {
+	if secret, err := newSecretToken(); err == nil {
+		if userSession.RefreshHash != "" {
+			userSession.RetiredHashes = append(userSession.RetiredHashes, userSession.RefreshHash)
+			if len(userSession.RetiredHashes) > retiredRefreshTokens {
+				userSession.RetiredHashes = userSession.RetiredHashes[len(userSession.RetiredHashes)-retiredRefreshTokens:]
+			}
+		}
+		userSession.RefreshToken = fmt.Sprintf("%s.%s", userSession.ID, secret)
+		userSession.RefreshHash = hashToken(userSession.RefreshToken)
+		return nil
+	} else {
+		return err
+	}
+}
+
+// checkRefreshToken presented for the session. Returns ErrRefreshTokenReused
+// if it is one of the session's retired tokens, and ErrInvalidRefreshToken if
+// it was never issued for the session. The session ID in a token isn't secret,
+// so a token that was never issued mustn't end the session
+func checkRefreshToken(userSession *UserSessionImpl, refreshToken string) error {
+	presented := []byte(hashToken(refreshToken))
+	if subtle.ConstantTimeCompare(presented, []byte(userSession.RefreshHash)) == 1 {
+		return nil
+	}
+	for _, retired := range userSession.RetiredHashes {
+		if subtle.ConstantTimeCompare(presented, []byte(retired)) == 1 {
+			return jutzo.ErrRefreshTokenReused
+		}
+	}
+	return jutzo.ErrInvalidRefreshToken
 }
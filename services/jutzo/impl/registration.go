@@ -0,0 +1,203 @@
+package impl
+
+import (
+	"database/sql"
+	"services/jutzo"
+	"strings"
+	"time"
+)
+
+// deletedInviteUser is recorded as the user of an invite in place of the name
+// of a user who has been deleted. It can't be a username, and isn't empty, so
+// the invite stays used
+const deletedInviteUser = "(deleted)"
+
+// The names of the settings the registration settings are stored under
+const (
+	registrationModeSetting    = "registration_mode"
+	registrationDomainsSetting = "registration_domains"
+)
+
+// GetRegistrationSettings currently in force. Settings that haven't been
+// changed at runtime come from the configuration, and registration is open
+// if the configuration doesn't say otherwise
+func (engine *EngineImpl) GetRegistrationSettings() (jutzo.RegistrationSettings, error) {
+	var settings jutzo.RegistrationSettings
+
+	mode, err := engine.db.RetrieveSetting(registrationModeSetting)
+	if err == sql.ErrNoRows {
+		if mode, _ = engine.config.GetConfigurationString("JUTZO_REGISTRATION_MODE"); mode == "" {
+			mode = jutzo.RegistrationOpen
+		}
+	} else if err != nil {
+		return settings, err
+	}
+	domains, err := engine.db.RetrieveSetting(registrationDomainsSetting)
+	if err == sql.ErrNoRows {
+		domains, _ = engine.config.GetConfigurationString("JUTZO_REGISTRATION_DOMAINS")
+	} else if err != nil {
+		return settings, err
+	}
+
+	settings.Mode = mode
+	settings.AllowedDomains = normalizeDomains(splitRights(domains))
+	return settings, nil
+}
+
+// SetRegistrationSettings, which take effect immediately. The domain mode
+// needs at least one allowed domain
+func (engine *EngineImpl) SetRegistrationSettings(settings jutzo.RegistrationSettings) (jutzo.RegistrationSettings, error) {
+	settings.AllowedDomains = normalizeDomains(settings.AllowedDomains)
+	switch settings.Mode {
+	case jutzo.RegistrationOpen, jutzo.RegistrationClosed, jutzo.RegistrationInvitation:
+	case jutzo.RegistrationDomain:
+		if len(settings.AllowedDomains) == 0 {
+			return settings, jutzo.ErrInvalidRegistration
+		}
+	default:
+		return settings, jutzo.ErrInvalidRegistration
+	}
+	for _, domain := range settings.AllowedDomains {
+		if strings.ContainsAny(domain, ", @") {
+			return settings, jutzo.ErrInvalidRegistration
+		}
+	}
+
+	if err := engine.db.StoreSetting(registrationModeSetting, settings.Mode); err != nil {
+		return settings, err
+	}
+	if err := engine.db.StoreSetting(registrationDomainsSetting, strings.Join(settings.AllowedDomains, ",")); err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// SignUp registers a user who is signing themselves up, as allowed by the
+// registration settings. An invite code lets the user register when the
+// registration mode wouldn't otherwise allow it (unless registration is
+// closed), and gives them the rights the invite carries
+func (engine *EngineImpl) SignUp(user string, password string, email string, inviteCode string) (int, jutzo.UserInfo, error) {
+	user, email = NormalizeUsername(user), NormalizeEmail(email)
+	settings, err := engine.GetRegistrationSettings()
+	if err != nil {
+		return 0, nil, err
+	} else if settings.Mode == jutzo.RegistrationClosed {
+		return 0, nil, jutzo.ErrRegistrationClosed
+	}
+
+	if inviteCode == "" {
+		if err = registrationAllowed(settings, email); err != nil {
+			return 0, nil, err
+		}
+		return engine.RegisterUser(user, password, email)
+	}
+
+	// Claim the invite first, so that it can't be used twice at the same time,
+	// and give it back if the registration doesn't go through
+	codeHash := hashToken(inviteCode)
+	invite, err := engine.db.ClaimInvite(codeHash, user)
+	if err == sql.ErrNoRows {
+		return 0, nil, jutzo.ErrInvalidInvite
+	} else if err != nil {
+		return 0, nil, err
+	}
+	status, userInfo, err := engine.RegisterUser(user, password, email)
+	if err != nil || status != jutzo.Success {
+		if err := engine.db.ReleaseInvite(codeHash); err != nil {
+			return 0, nil, err
+		}
+		return status, userInfo, err
+	}
+
+	// The rights are recorded as granted by whoever created the invite
+	if len(invite.GetRights()) > 0 {
+		before := userInfo.GetGrantedRights()
+		if userInfo, err = engine.updateUser(user, func(userInfo jutzo.UserInfo) {
+			for _, right := range invite.GetRights() {
+				userInfo.GrantRight(right)
+			}
+		}); err != nil {
+			return status, nil, err
+		}
+		engine.recordRightChanges(invite.GetCreatedBy(), user, before, userInfo.GetGrantedRights())
+	}
+	return status, userInfo, nil
+}
+
+// CreateInvite from the user, giving the rights listed (which must all be held
+// by the user). The code itself is only returned here and cannot be retrieved
+// again. An expiresIn of zero creates an invite that never expires
+func (engine *EngineImpl) CreateInvite(user string, rights []string, expiresIn time.Duration) (string, jutzo.Invite, error) {
+	if userInfo, err := engine.db.RetrieveUserInformation(user); err != nil {
+		return "", nil, err
+	} else if !userInfo.HasRights(rights) {
+		return "", nil, jutzo.ErrRightNotHeld
+	}
+
+	if code, err := newSecretToken(); err == nil {
+		var expirationTime time.Time
+		if expiresIn > 0 {
+			expirationTime = time.Now().Add(expiresIn)
+		}
+		if invite, err := engine.db.StoreInvite(user, hashToken(code), uniqueRights(rights), expirationTime); err == nil {
+			return code, invite, nil
+		} else {
+			return "", nil, err
+		}
+	} else {
+		return "", nil, err
+	}
+}
+
+// ListInvites created by the user
+func (engine *EngineImpl) ListInvites(user string) ([]jutzo.Invite, error) {
+	return engine.db.ListInvites(user)
+}
+
+// RevokeInvite created by the user
+func (engine *EngineImpl) RevokeInvite(user string, uniqueID string) error {
+	return engine.db.DeleteInvite(user, uniqueID)
+}
+
+// registrationAllowed without an invite for a user with the email given, by
+// the registration settings. Returns ErrRegistrationClosed, ErrInviteRequired
+// or ErrEmailDomainNotAllowed if the user can't register
+func registrationAllowed(settings jutzo.RegistrationSettings, email string) error {
+	switch settings.Mode {
+	case jutzo.RegistrationClosed:
+		return jutzo.ErrRegistrationClosed
+	case jutzo.RegistrationInvitation:
+		return jutzo.ErrInviteRequired
+	case jutzo.RegistrationDomain:
+		if !domainAllowed(email, settings.AllowedDomains) {
+			return jutzo.ErrEmailDomainNotAllowed
+		}
+	}
+	return nil
+}
+
+// domainAllowed determines if the email is in one of the allowed domains
+func domainAllowed(email string, allowedDomains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range allowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomains lower-cases the domains, dropping empty ones
+func normalizeDomains(domains []string) []string {
+	result := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			result = append(result, domain)
+		}
+	}
+	return result
+}
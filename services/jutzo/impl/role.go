@@ -0,0 +1,28 @@
+package impl
+
+type RoleImpl struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Rights         []string `json:"rights"`
+	InheritedRoles []string `json:"inherits"`
+}
+
+// GetName of the role
+func (role *RoleImpl) GetName() string {
+	return role.Name
+}
+
+// GetDescription of what the role is for
+func (role *RoleImpl) GetDescription() string {
+	return role.Description
+}
+
+// GetRights bundled in the role itself
+func (role *RoleImpl) GetRights() []string {
+	return role.Rights
+}
+
+// GetInheritedRoles whose rights are included in this role
+func (role *RoleImpl) GetInheritedRoles() []string {
+	return role.InheritedRoles
+}
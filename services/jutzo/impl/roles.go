@@ -0,0 +1,139 @@
+package impl
+
+import (
+	"services/jutzo"
+	"strings"
+)
+
+// DefineRole with the rights it bundles and the roles it inherits from,
+// replacing the role if it already exists. The inherited roles must exist,
+// and can't (directly or indirectly) inherit from the role being defined.
+// The built-in roles can't be redefined
+func (engine *EngineImpl) DefineRole(name string, description string, rights []string, inherits []string) (jutzo.Role, error) {
+	if !validRoleName(name) {
+		return nil, jutzo.ErrInvalidRole
+	} else if name == jutzo.DefaultUserRole || name == jutzo.AdministratorRole {
+		return nil, jutzo.ErrBuiltInRole
+	}
+	for _, right := range rights {
+		if !validRoleName(right) {
+			return nil, jutzo.ErrInvalidRole
+		}
+	}
+
+	// Walk up from each inherited role; finding the role being defined is a cycle
+	visited := make(map[string]bool)
+	pending := uniqueRights(inherits)
+	for len(pending) > 0 {
+		parent := pending[0]
+		pending = pending[1:]
+		if parent == name {
+			return nil, jutzo.ErrRoleCycle
+		} else if !visited[parent] {
+			visited[parent] = true
+			if role, err := engine.db.RetrieveRole(parent); err == nil {
+				pending = append(pending, role.GetInheritedRoles()...)
+			} else {
+				return nil, err
+			}
+		}
+	}
+
+	if err := engine.db.StoreRole(name, description, uniqueRights(rights), uniqueRights(inherits)); err == nil {
+		if err = engine.refreshRoleMembers(name); err != nil {
+			return nil, err
+		}
+		return engine.db.RetrieveRole(name)
+	} else {
+		return nil, err
+	}
+}
+
+// ListRoles that are defined
+func (engine *EngineImpl) ListRoles() ([]jutzo.Role, error) {
+	return engine.db.ListRoles()
+}
+
+// DeleteRole with the given name. The built-in roles can't be deleted, nor
+// can a role whose loss would leave no enabled administrator
+func (engine *EngineImpl) DeleteRole(name string) error {
+	if name == jutzo.DefaultUserRole || name == jutzo.AdministratorRole {
+		return jutzo.ErrBuiltInRole
+	}
+
+	// Find who holds the role before it goes, so their sessions can lose its rights
+	members, err := engine.db.ListRoleMembers(name)
+	if err != nil {
+		return err
+	}
+	if err = engine.db.DeleteRole(name); err != nil {
+		return err
+	}
+	return engine.refreshSessionsOf(members)
+}
+
+// refreshRoleMembers brings the sessions of everyone holding the role up to date
+func (engine *EngineImpl) refreshRoleMembers(name string) error {
+	if members, err := engine.db.ListRoleMembers(name); err == nil {
+		return engine.refreshSessionsOf(members)
+	} else {
+		return err
+	}
+}
+
+// refreshSessionsOf each of the users given
+func (engine *EngineImpl) refreshSessionsOf(users []string) error {
+	for _, user := range users {
+		if err := engine.refreshUserSessions(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AssignRole to the user, returning sql.ErrNoRows if either doesn't exist
+func (engine *EngineImpl) AssignRole(user string, role string) (jutzo.UserInfo, error) {
+	if _, err := engine.db.RetrieveRole(role); err != nil {
+		return nil, err
+	}
+	return engine.updateUser(user, func(userInfo jutzo.UserInfo) { userInfo.AssignRole(role) })
+}
+
+// UnassignRole from the user
+func (engine *EngineImpl) UnassignRole(user string, role string) (jutzo.UserInfo, error) {
+	return engine.updateUser(user, func(userInfo jutzo.UserInfo) { userInfo.RemoveRole(role) })
+}
+
+// updateUser applies the change to the user and stores it, returning the
+// user as retrieved again (so that the effective rights are up to date). The
+// database refuses a change that leaves no enabled administrator with ErrLastAdmin.
+// The user's live sessions are brought up to date with the change
+func (engine *EngineImpl) updateUser(user string, change func(userInfo jutzo.UserInfo)) (jutzo.UserInfo, error) {
+	userInfo, err := engine.db.RetrieveUserInformation(user)
+	if err != nil {
+		return nil, err
+	}
+	change(userInfo)
+	if err = engine.db.UpdateUserInfo(userInfo); err != nil {
+		return nil, err
+	}
+	updated, err := engine.db.RetrieveUserInformation(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = engine.refreshUserSessions(updated.GetUsername()); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// isActiveAdmin determines if the user is an administrator who can log in
+func isActiveAdmin(userInfo jutzo.UserInfo) bool {
+	return !userInfo.IsDisabled() && userInfo.HasRights([]string{"admin"})
+}
+
+// validRoleName determines if the name can be used for a role (or right)
+func validRoleName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, ", \t\n")
+}
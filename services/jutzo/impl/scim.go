@@ -0,0 +1,117 @@
+package impl
+
+import (
+	"database/sql"
+	"log"
+	"services/jutzo"
+	"strings"
+)
+
+// GetUser with the given username
+func (engine *EngineImpl) GetUser(user string) (jutzo.UserInfo, error) {
+	return engine.db.RetrieveUserInformation(user)
+}
+
+// GetUserByEmail finds the user registered with the email
+func (engine *EngineImpl) GetUserByEmail(email string) (jutzo.UserInfo, error) {
+	return engine.db.RetrieveUserByEmail(email)
+}
+
+// ListRoleMembers returns the usernames of the users the role is assigned
+// to, leaving out those who only hold it through an inheriting role
+func (engine *EngineImpl) ListRoleMembers(role string) ([]string, error) {
+	if page, err := engine.db.ListUsers(jutzo.UserQuery{Role: role}); err == nil {
+		members := make([]string, 0, len(page.Users))
+		for _, userInfo := range page.Users {
+			members = append(members, userInfo.GetUsername())
+		}
+		return members, nil
+	} else {
+		return nil, err
+	}
+}
+
+// ProvisionUser creates a user on behalf of an identity management system.
+// A password, if there is one, has to pass the password policy
+func (engine *EngineImpl) ProvisionUser(user string, password string, email string) (int, jutzo.UserInfo, error) {
+	user, email, err := normalizeNewUser(user, email)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var result int
+	var userInfo jutzo.UserInfo
+	if password != "" {
+		if result, userInfo, err = engine.RegisterUser(user, password, email); err != nil || result != jutzo.Success {
+			return result, nil, err
+		}
+	} else if usernameExists, emailExists, err := engine.db.CheckForUsernameOrEmail(user, email); err != nil {
+		return 0, nil, err
+	} else if usernameExists {
+		return jutzo.DuplicateUsername, nil, nil
+	} else if emailExists {
+		return jutzo.DuplicateEmail, nil, nil
+	} else if userInfo, err = engine.storeUser(user, email, []byte{}, jutzo.AuthSourceExternal); err != nil {
+		return 0, nil, err
+	}
+
+	// The identity management system vouches for the email
+	if err = engine.db.MarkEmailValidated(userInfo.GetUsername()); err != nil {
+		return 0, nil, err
+	}
+	userInfo, err = engine.db.RetrieveUserInformation(userInfo.GetUsername())
+	return jutzo.Success, userInfo, err
+}
+
+// ChangeEmail of the user to one an administrator or identity management
+// system vouches for, so the new email is taken as validated. The database
+// refuses an email another user has, even one being changed at the same time
+func (engine *EngineImpl) ChangeEmail(user string, email string) (jutzo.UserInfo, error) {
+	email = NormalizeEmail(email)
+	if _, err := engine.updateUser(user, func(userInfo jutzo.UserInfo) { userInfo.SetEmail(email) }); err != nil {
+		return nil, err
+	}
+	return engine.ForceEmailValidation(user)
+}
+
+// CreateSCIMToken for an identity management system. Only the hash of the
+// token is stored
+func (engine *EngineImpl) CreateSCIMToken(createdBy string, name string) (string, jutzo.SCIMToken, error) {
+	if secret, err := newSecretToken(); err == nil {
+		token := jutzo.SCIMTokenPrefix + secret
+		scimToken, err := engine.db.StoreSCIMToken(createdBy, name, hashToken(token))
+		if err != nil {
+			return "", jutzo.SCIMToken{}, err
+		}
+		return token, scimToken, nil
+	} else {
+		return "", jutzo.SCIMToken{}, err
+	}
+}
+
+// AuthenticateSCIMToken presented to the SCIM endpoints
+func (engine *EngineImpl) AuthenticateSCIMToken(token string) (jutzo.SCIMToken, error) {
+	if !strings.HasPrefix(token, jutzo.SCIMTokenPrefix) {
+		return jutzo.SCIMToken{}, jutzo.ErrInvalidSCIMToken
+	}
+	if scimToken, err := engine.db.RetrieveSCIMTokenByHash(hashToken(token)); err == nil {
+		if err = engine.db.TouchSCIMToken(scimToken.ID); err != nil {
+			log.Printf("Unable to record use of SCIM token %s: %s", scimToken.ID, err.Error())
+		}
+		return scimToken, nil
+	} else if err == sql.ErrNoRows {
+		return jutzo.SCIMToken{}, jutzo.ErrInvalidSCIMToken
+	} else {
+		return jutzo.SCIMToken{}, err
+	}
+}
+
+// ListSCIMTokens that have been issued
+func (engine *EngineImpl) ListSCIMTokens() ([]jutzo.SCIMToken, error) {
+	return engine.db.ListSCIMTokens()
+}
+
+// RevokeSCIMToken with the given ID
+func (engine *EngineImpl) RevokeSCIMToken(uniqueID string) error {
+	return engine.db.DeleteSCIMToken(uniqueID)
+}
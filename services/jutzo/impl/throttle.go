@@ -0,0 +1,135 @@
+package impl
+
+import (
+	"fmt"
+	"services/jutzo"
+	"time"
+)
+
+// Defaults for login throttling, used when the configuration does not provide a value
+const (
+	DefaultLoginFreeAttempts         = 5
+	DefaultLoginFreeAttemptsPerIP    = 20
+	DefaultLoginMaxLockoutMinutes    = 15
+	DefaultLoginFailureWindowMinutes = 60
+)
+
+// loginThrottle slows down password guessing. Failed logins are counted per
+// username and per client IP address; once a count passes the number of free
+// attempts, each further failure locks out its username (or address) for twice
+// as long as the one before, starting at a second, up to the maximum lockout
+type loginThrottle struct {
+	cache             jutzo.UserSessionCache
+	freeAttempts      int64
+	freeAttemptsPerIP int64
+	maxLockout        time.Duration
+	failureWindow     time.Duration
+}
+
+// newLoginThrottle creates a throttle from the configuration
+func newLoginThrottle(config jutzo.ConfigurationProvider, cache jutzo.UserSessionCache) *loginThrottle {
+	throttle := new(loginThrottle)
+	throttle.cache = cache
+
+	freeAttempts, isPresent := config.GetConfigurationInt("JUTZO_LOGIN_FREE_ATTEMPTS")
+	if !isPresent || freeAttempts <= 0 {
+		freeAttempts = DefaultLoginFreeAttempts
+	}
+	freeAttemptsPerIP, isPresent := config.GetConfigurationInt("JUTZO_LOGIN_FREE_ATTEMPTS_PER_IP")
+	if !isPresent || freeAttemptsPerIP <= 0 {
+		freeAttemptsPerIP = DefaultLoginFreeAttemptsPerIP
+	}
+	maxLockoutMinutes, isPresent := config.GetConfigurationInt("JUTZO_LOGIN_MAX_LOCKOUT_MINUTES")
+	if !isPresent || maxLockoutMinutes <= 0 {
+		maxLockoutMinutes = DefaultLoginMaxLockoutMinutes
+	}
+	failureWindowMinutes, isPresent := config.GetConfigurationInt("JUTZO_LOGIN_FAILURE_WINDOW_MINUTES")
+	if !isPresent || failureWindowMinutes <= 0 {
+		failureWindowMinutes = DefaultLoginFailureWindowMinutes
+	}
+
+	throttle.freeAttempts = int64(freeAttempts)
+	throttle.freeAttemptsPerIP = int64(freeAttemptsPerIP)
+	throttle.maxLockout = time.Duration(maxLockoutMinutes) * time.Minute
+	throttle.failureWindow = time.Duration(failureWindowMinutes) * time.Minute
+	return throttle
+}
+
+// check whether the user, or the client's address, is locked out. Returns
+// how long the caller has to wait, or zero if the attempt can go ahead
+func (throttle *loginThrottle) check(user string, client jutzo.ClientInfo) (time.Duration, error) {
+	retryAfter, err := throttle.cache.GetTransientTimeToLive(lockKey(userThrottleKey(user)))
+	if err != nil || client.IP == "" {
+		return retryAfter, err
+	}
+	if ipRetryAfter, err := throttle.cache.GetTransientTimeToLive(lockKey(ipThrottleKey(client.IP))); err != nil {
+		return 0, err
+	} else if ipRetryAfter > retryAfter {
+		retryAfter = ipRetryAfter
+	}
+	return retryAfter, nil
+}
+
+// recordFailure of a login attempt for the user from the client
+func (throttle *loginThrottle) recordFailure(user string, client jutzo.ClientInfo) error {
+	if err := throttle.countFailure(userThrottleKey(user), throttle.freeAttempts); err != nil {
+		return err
+	}
+	if client.IP != "" {
+		return throttle.countFailure(ipThrottleKey(client.IP), throttle.freeAttemptsPerIP)
+	}
+	return nil
+}
+
+// recordSuccess of a login, which clears the failures counted for the username.
+// Failures counted against the address are left to expire, so that one account
+// the attacker controls can't be used to reset the count for their address
+func (throttle *loginThrottle) recordSuccess(user string) error {
+	return throttle.cache.DeleteCounter(userThrottleKey(user))
+}
+
+// unlock the user, clearing their failures and any lockout in place
+func (throttle *loginThrottle) unlock(user string) error {
+	if err := throttle.cache.DeleteCounter(userThrottleKey(user)); err != nil {
+		return err
+	}
+	_, err := throttle.cache.TakeTransient(lockKey(userThrottleKey(user)))
+	return err
+}
+
+// countFailure against the key, locking it out if it has run out of free attempts
+func (throttle *loginThrottle) countFailure(key string, freeAttempts int64) error {
+	if failures, err := throttle.cache.IncrementCounter(key, throttle.failureWindow); err != nil {
+		return err
+	} else if failures > freeAttempts {
+		return throttle.cache.StoreTransient(lockKey(key), []byte{}, throttle.lockoutFor(failures-freeAttempts))
+	}
+	return nil
+}
+
+// lockoutFor the given number of failures past the free attempts: a second
+// for the first, doubling with each one after that up to the maximum lockout
+func (throttle *loginThrottle) lockoutFor(excessFailures int64) time.Duration {
+	if excessFailures > 32 {
+		return throttle.maxLockout
+	}
+	if lockout := time.Second << (excessFailures - 1); lockout < throttle.maxLockout {
+		return lockout
+	}
+	return throttle.maxLockout
+}
+
+// userThrottleKey is the key failures are counted under for a username
+func userThrottleKey(user string) string {
+	return fmt.Sprintf("login-failures:user:%s", UsernameKey(user))
+}
+
+// ipThrottleKey is the key failures are counted under for a client address
+func ipThrottleKey(ip string) string {
+	return fmt.Sprintf("login-failures:ip:%s", ip)
+}
+
+// lockKey is the transient that marks the key as locked out
+func lockKey(key string) string {
+	return fmt.Sprintf("%s:locked", key)
+}
@@ -7,22 +7,33 @@ import (
 )
 
 type UserInfoImpl struct {
-	Username       string    `json:"username"`
-	Email          string    `json:"email"`
-	PasswordHash   []byte    `json:"passwordHash"`
-	EmailValidated bool      `json:"emailValidated"`
-	Rights         []string  `json:"rights"`
-	CreationTime   time.Time `json:"creationTime"`
+	Username       string            `json:"username"`
+	Email          string            `json:"email"`
+	PasswordHash   []byte            `json:"passwordHash"`
+	AuthSource     string            `json:"authSource"`
+	EmailValidated bool              `json:"emailValidated"`
+	Disabled       bool              `json:"disabled"`
+	Rights         []string          `json:"rights"`
+	GrantedRights  []string          `json:"grantedRights"`
+	Roles          []string          `json:"roles"`
+	CreationTime   time.Time         `json:"creationTime"`
+	Profile        jutzo.UserProfile `json:"profile"`
 }
 
+// NewUserInfo creates a user that holds the given rights directly,
+// with no roles
 func NewUserInfo(username string, email string, passwordHash []byte, emailValidated bool, rights []string, creationTime time.Time) jutzo.UserInfo {
 	result := new(UserInfoImpl)
 	result.Username = username
 	result.Email = email
 	result.PasswordHash = passwordHash
+	result.AuthSource = jutzo.AuthSourceLocal
 	result.EmailValidated = emailValidated
-	result.Rights = rights
+	result.GrantedRights = uniqueRights(rights)
+	result.Rights = append([]string{}, result.GrantedRights...)
+	result.Roles = []string{}
 	result.CreationTime = creationTime
+	result.Profile.Notifications = jutzo.DefaultNotificationPreferences
 	return result
 }
 
@@ -36,54 +47,135 @@ func (userInfo *UserInfoImpl) GetEmail() string {
 	return userInfo.Email
 }
 
+// SetEmail associated with this user
+func (userInfo *UserInfoImpl) SetEmail(email string) {
+	userInfo.Email = email
+}
+
 // GetPasswordHash associated with this user
 func (userInfo *UserInfoImpl) GetPasswordHash() []byte {
 	return userInfo.PasswordHash
 }
 
+// GetAuthSource tells how the user authenticates
+func (userInfo *UserInfoImpl) GetAuthSource() string {
+	return userInfo.AuthSource
+}
+
 // IsEmailValidated for this user
 func (userInfo *UserInfoImpl) IsEmailValidated() bool {
 	return userInfo.EmailValidated
 }
 
-// HasRights will return true if the user contains ALL the rights requested
+// IsDisabled determines if an administrator has disabled the user's login
+func (userInfo *UserInfoImpl) IsDisabled() bool {
+	return userInfo.Disabled
+}
+
+// SetDisabled enables or disables the user's login
+func (userInfo *UserInfoImpl) SetDisabled(disabled bool) {
+	userInfo.Disabled = disabled
+}
+
+// HasRights will return true if the user holds ALL the rights requested. Each
+// requested right is checked on its own, so duplicates (in the request or in
+// the user's rights) can't make up for a right the user doesn't hold
 func (userInfo *UserInfoImpl) HasRights(requested []string) bool {
-	rightCount := 0
 	for _, requestedRight := range requested {
-		for _, item := range userInfo.Rights {
-			if item == requestedRight {
-				rightCount++
-			}
+		if !slices.Contains(userInfo.Rights, requestedRight) {
+			return false
 		}
 	}
-	return rightCount == len(requested)
+	return true
 }
 
-// HasAnyRight will return true if the user has ANY of the rights requested
+// HasAnyRight will return true if the user holds ANY of the rights requested
 func (userInfo *UserInfoImpl) HasAnyRight(requested []string) bool {
 	for _, requestedRight := range requested {
-		for _, item := range userInfo.Rights {
-			if item == requestedRight {
-				return true
-			}
+		if slices.Contains(userInfo.Rights, requestedRight) {
+			return true
 		}
 	}
 	return false
 }
 
-// GetAllRights that the user has been granted as a string array
+// GetAllRights that the user holds, directly or through their roles
 func (userInfo *UserInfoImpl) GetAllRights() []string {
 	return userInfo.Rights
 }
 
-// GrantRight to the user. A no-op if the right is already in place
+// GetGrantedRights that were granted to the user directly
+func (userInfo *UserInfoImpl) GetGrantedRights() []string {
+	return userInfo.GrantedRights
+}
+
+// GetRoles that have been assigned to the user
+func (userInfo *UserInfoImpl) GetRoles() []string {
+	return userInfo.Roles
+}
+
+// GrantRight to the user directly. A no-op if the right is already in place
 func (userInfo *UserInfoImpl) GrantRight(right string) {
+	if !slices.Contains(userInfo.GrantedRights, right) {
+		userInfo.GrantedRights = append(userInfo.GrantedRights, right)
+	}
 	if !slices.Contains(userInfo.Rights, right) {
 		userInfo.Rights = append(userInfo.Rights, right)
 	}
 }
 
+// RevokeRight that was granted to the user directly. The effective rights
+// are recalculated when the user is next retrieved, as the right may also
+// come from one of the user's roles
+func (userInfo *UserInfoImpl) RevokeRight(right string) {
+	userInfo.GrantedRights = removeString(userInfo.GrantedRights, right)
+}
+
+// AssignRole to the user. A no-op if the role is already assigned
+func (userInfo *UserInfoImpl) AssignRole(role string) {
+	if !slices.Contains(userInfo.Roles, role) {
+		userInfo.Roles = append(userInfo.Roles, role)
+	}
+}
+
+// RemoveRole from the user
+func (userInfo *UserInfoImpl) RemoveRole(role string) {
+	userInfo.Roles = removeString(userInfo.Roles, role)
+}
+
 // GetCreationTime for the user
 func (userInfo *UserInfoImpl) GetCreationTime() time.Time {
 	return userInfo.CreationTime
 }
+
+// GetProfile the user has filled in about themselves
+func (userInfo *UserInfoImpl) GetProfile() jutzo.UserProfile {
+	return userInfo.Profile
+}
+
+// SetProfile of the user
+func (userInfo *UserInfoImpl) SetProfile(profile jutzo.UserProfile) {
+	userInfo.Profile = profile
+}
+
+// uniqueRights removes any duplicate (or empty) rights, keeping the order
+func uniqueRights(rights []string) []string {
+	result := make([]string, 0, len(rights))
+	for _, right := range rights {
+		if right != "" && !slices.Contains(result, right) {
+			result = append(result, right)
+		}
+	}
+	return result
+}
+
+// removeString returns the list without any occurrences of the value
+func removeString(list []string, value string) []string {
+	result := make([]string, 0, len(list))
+	for _, entry := range list {
+		if entry != value {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
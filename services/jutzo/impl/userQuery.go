@@ -0,0 +1,80 @@
+package impl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"services/jutzo"
+	"time"
+)
+
+// Limits on the number of users returned by a query
+const (
+	DefaultUserQueryLimit = 50
+	MaxUserQueryLimit     = 500
+)
+
+// ListUsers selected by the query. Without a limit the default number of
+// users is returned
+func (engine *EngineImpl) ListUsers(query jutzo.UserQuery) (jutzo.UserPage, error) {
+	if query.Limit <= 0 {
+		query.Limit = DefaultUserQueryLimit
+	} else if query.Limit > MaxUserQueryLimit {
+		query.Limit = MaxUserQueryLimit
+	}
+	return engine.db.ListUsers(query)
+}
+
+// GetKeyCollisions returns the number of users whose username or email
+// collided with another user's when the database was upgraded
+func (engine *EngineImpl) GetKeyCollisions() (jutzo.KeyCollisions, error) {
+	return engine.db.CountKeyCollisions()
+}
+
+// userCursor is the position of the last user of a page, in the order of
+// the query. It is handed out encoded, so callers can't depend on what it holds
+type userCursor struct {
+	Sort         string    `json:"s"`
+	Descending   bool      `json:"d,omitempty"`
+	CreationTime time.Time `json:"t,omitempty"`
+	Username     string    `json:"u"`
+}
+
+// userSort returns the order the query asks for, or ErrInvalidUserQuery
+// if it isn't known
+func userSort(query jutzo.UserQuery) (string, error) {
+	switch query.Sort {
+	case "", jutzo.UserSortUsername:
+		return jutzo.UserSortUsername, nil
+	case jutzo.UserSortCreated:
+		return jutzo.UserSortCreated, nil
+	default:
+		return "", jutzo.ErrInvalidUserQuery
+	}
+}
+
+// encodeUserCursor for the page ending with the user
+func encodeUserCursor(query jutzo.UserQuery, sort string, last jutzo.UserInfo) string {
+	cursor := userCursor{Sort: sort, Descending: query.Descending, Username: last.GetUsername()}
+	if sort == jutzo.UserSortCreated {
+		cursor.CreationTime = last.GetCreationTime()
+	}
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeUserCursor of the query, if it has one. Returns ErrInvalidUserQuery
+// if the cursor is malformed or was handed out for a different order
+func decodeUserCursor(query jutzo.UserQuery, sort string) (*userCursor, error) {
+	if query.Cursor == "" {
+		return nil, nil
+	}
+	cursor := new(userCursor)
+	if encoded, err := base64.RawURLEncoding.DecodeString(query.Cursor); err != nil {
+		return nil, jutzo.ErrInvalidUserQuery
+	} else if err = json.Unmarshal(encoded, cursor); err != nil {
+		return nil, jutzo.ErrInvalidUserQuery
+	} else if cursor.Sort != sort || cursor.Descending != query.Descending {
+		return nil, jutzo.ErrInvalidUserQuery
+	}
+	return cursor, nil
+}
@@ -5,13 +5,42 @@ import (
 	"time"
 )
 
+// Default session timeouts, used when the configuration does not
+// provide a value
+const (
+	DefaultAccessTokenMinutes = 15
+	DefaultRefreshTokenHours  = 7 * 24
+	DefaultIdleMinutes        = 8 * 60
+)
+
+// retiredRefreshTokens is how many of a session's rotated out refresh tokens
+// are remembered, so that presenting one of them again can be told apart from
+// presenting a token that was never issued
+const retiredRefreshTokens = 16
+
+// maxSessionTouchInterval is the longest a session in use goes without its
+// last seen time and idle timeout being updated
+const maxSessionTouchInterval = time.Minute
+
 // UserSessionImpl defines the structure of the user session information that we store in Redis. This
-// contains a unique ID, the username, and the rights. In a more secure environment we could
-// also include device or IP fingerprint information - we'll make that a TODO
+// contains a unique ID, the username, and the rights, along with the client (IP address and user agent)
+// the session was created from, which the fingerprint policy checks each request against
 type UserSessionImpl struct {
-	ID       string        `json:"ID"`
-	Info     *UserInfoImpl `json:"info"`
-	Duration time.Duration `json:"duration"`
+	ID            string           `json:"ID"`
+	Info          *UserInfoImpl    `json:"info"`
+	Duration      time.Duration    `json:"duration"`
+	CreationTime  time.Time        `json:"creationTime"`
+	RefreshHash   string           `json:"refreshHash"`
+	RetiredHashes []string         `json:"retiredHashes,omitempty"`
+	Client        jutzo.ClientInfo `json:"client"`
+
+	// The last seen time is tracked in the per-user session index
+	// rather than in the session itself
+	LastSeen time.Time `json:"-"`
+
+	// The clear refresh token is never stored; it is only handed back
+	// to the caller when the session is created or refreshed
+	RefreshToken string `json:"-"`
 }
 
 // GetId for the session itself
@@ -28,3 +57,66 @@ func (userSession *UserSessionImpl) GetUserInfo() jutzo.UserInfo {
 func (userSession *UserSessionImpl) GetDuration() time.Duration {
 	return userSession.Duration
 }
+
+// GetCreationTime of the session (i.e. when the user logged in)
+func (userSession *UserSessionImpl) GetCreationTime() time.Time {
+	return userSession.CreationTime
+}
+
+// GetLastSeen is the last time the session was used
+func (userSession *UserSessionImpl) GetLastSeen() time.Time {
+	return userSession.LastSeen
+}
+
+// GetClientInfo describing the client the session was created from
+func (userSession *UserSessionImpl) GetClientInfo() jutzo.ClientInfo {
+	return userSession.Client
+}
+
+// GetRefreshToken that can be exchanged for a new access token
+func (userSession *UserSessionImpl) GetRefreshToken() string {
+	return userSession.RefreshToken
+}
+
+// getExpirationTime is the absolute time at which the session ends,
+// regardless of how recently it was used
+func (userSession *UserSessionImpl) getExpirationTime() time.Time {
+	return userSession.CreationTime.Add(userSession.Duration)
+}
+
+// sessionTouchInterval is how long a session's last seen time and idle timeout
+// are left alone after being updated, so that a busy session isn't written on
+// every request. It is kept well inside the idle timeout, so that sessions in
+// use don't expire
+func sessionTouchInterval(timeouts jutzo.SessionTimeouts) time.Duration {
+	if interval := timeouts.IdleTimeout / 10; interval < maxSessionTouchInterval {
+		return interval
+	}
+	return maxSessionTouchInterval
+}
+
+// NewSessionTimeouts reads the session timeouts from the configuration,
+// falling back to the defaults for any value not provided
+func NewSessionTimeouts(config jutzo.ConfigurationProvider) jutzo.SessionTimeouts {
+	return jutzo.SessionTimeouts{
+		AccessDuration:  configuredDuration(config, "JUTZO_ACCESS_TOKEN_MINUTES", time.Minute, DefaultAccessTokenMinutes),
+		RefreshDuration: configuredDuration(config, "JUTZO_REFRESH_TOKEN_HOURS", time.Hour, DefaultRefreshTokenHours),
+		IdleTimeout:     configuredDuration(config, "JUTZO_SESSION_IDLE_MINUTES", time.Minute, DefaultIdleMinutes),
+	}
+}
+
+// configuredDuration reads a whole number of units from the configuration, or
+// a duration such as "90s" for finer control, falling back to the default
+// number of units if the value isn't provided or isn't positive
+func configuredDuration(config jutzo.ConfigurationProvider, name string, unit time.Duration, defaultUnits int) time.Duration {
+	if units, isPresent := config.GetConfigurationInt(name); isPresent {
+		if units > 0 {
+			return time.Duration(units) * unit
+		}
+	} else if value, isPresent := config.GetConfigurationString(name); isPresent {
+		if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+			return duration
+		}
+	}
+	return time.Duration(defaultUnits) * unit
+}
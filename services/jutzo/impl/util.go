@@ -1,6 +1,10 @@
 package impl
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/url"
 )
@@ -14,3 +18,21 @@ func redactPassword(connectionString string) (string, error) {
 		return connectionString, err
 	}
 }
+
+// newSecretToken creates a random, URL safe token suitable for
+// use as a bearer secret (refresh tokens and the like)
+func newSecretToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err == nil {
+		return base64.RawURLEncoding.EncodeToString(secret), nil
+	} else {
+		return "", err
+	}
+}
+
+// hashToken returns the hex encoded SHA-256 of a secret token. Secret
+// tokens are only ever stored in this form
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,35 @@
+package jutzo
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidOAuthClient is returned when an OAuth client is unknown
+// or fails to authenticate
+var ErrInvalidOAuthClient = errors.New("invalid OAuth client or client credentials")
+
+// OAuthClient is another application that is registered to sign
+// users in with their Jutzo accounts
+type OAuthClient interface {
+
+	// GetClientId the application identifies itself with
+	GetClientId() string
+
+	// GetName of the application, shown to users when they grant access
+	GetName() string
+
+	// GetRedirectURIs the application may receive authorization codes at
+	GetRedirectURIs() []string
+
+	// IsConfidential if the application has a client secret. Public clients
+	// (e.g. single page applications) rely on PKCE alone
+	IsConfidential() bool
+
+	// GetCreationTime of the registration
+	GetCreationTime() time.Time
+}
+
+// RightScopePrefix is prepended to a right to form the OAuth scope that
+// grants a client application that right (e.g. "jutzo:blog")
+const RightScopePrefix = "jutzo:"
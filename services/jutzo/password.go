@@ -0,0 +1,45 @@
+package jutzo
+
+import (
+	"errors"
+	"strings"
+)
+
+// Codes for the ways a password can fail the password policy
+const (
+	PasswordTooShort         = "too_short"
+	PasswordTooLong          = "too_long"
+	PasswordMissingLowercase = "missing_lowercase"
+	PasswordMissingUppercase = "missing_uppercase"
+	PasswordMissingDigit     = "missing_digit"
+	PasswordMissingSymbol    = "missing_symbol"
+	PasswordMatchesUsername  = "matches_username"
+	PasswordMatchesEmail     = "matches_email"
+	PasswordBreached         = "breached"
+)
+
+// Errors returned when changing or resetting a password
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
+	ErrNoLocalPassword   = errors.New("the user signs in with an external provider and has no local password")
+)
+
+// PasswordViolation describes one way a password fails the password policy
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned when a new password fails the password
+// policy, listing every rule the password broke
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (err *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(err.Violations))
+	for _, violation := range err.Violations {
+		messages = append(messages, violation.Message)
+	}
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
@@ -0,0 +1,39 @@
+package jutzo
+
+import (
+	"time"
+)
+
+// LinkedIdentity is an identity at an external identity provider
+// that has been linked to a local user
+type LinkedIdentity struct {
+	Provider     string    `json:"provider"`
+	Subject      string    `json:"subject"`
+	CreationTime time.Time `json:"creationTime"`
+}
+
+// DeletionRequest is a user's request to delete their account. The account is
+// kept until the due time, so that the user can change their mind. Anonymized
+// accounts are kept (without anything that identifies the user) rather than deleted
+type DeletionRequest struct {
+	Username    string    `json:"username"`
+	Anonymize   bool      `json:"anonymize"`
+	RequestTime time.Time `json:"requestTime"`
+	DueTime     time.Time `json:"dueTime"`
+}
+
+// UserDataExport is everything held about a user, for them to download
+type UserDataExport struct {
+	ExportTime time.Time
+	User       UserInfo
+	Sessions   []UserSession
+	APIKeys    []APIKey
+	Identities []LinkedIdentity
+	Invites    []Invite
+
+	// AuditEvents where the user is the actor or the target, newest first
+	AuditEvents []AuditEvent
+
+	// Deletion is the user's pending deletion request (nil if there isn't one)
+	Deletion *DeletionRequest
+}
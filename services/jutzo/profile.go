@@ -0,0 +1,85 @@
+package jutzo
+
+import (
+	"fmt"
+)
+
+// How often a user is sent a digest of new content
+const (
+	DigestNever  = "never"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// NotificationPreferences decide what the user is told about, and how often
+type NotificationPreferences struct {
+	SecurityAlerts bool   `json:"securityAlerts"`
+	NewContent     bool   `json:"newContent"`
+	Digest         string `json:"digest"`
+}
+
+// DefaultNotificationPreferences are those of a user who hasn't chosen any
+var DefaultNotificationPreferences = NotificationPreferences{SecurityAlerts: true, Digest: DigestNever}
+
+// UserProfile is what the user tells us about themselves. The timezone is an
+// IANA name (e.g. "Europe/Paris") and the locale a BCP 47 tag (e.g. "en-GB")
+type UserProfile struct {
+	DisplayName   string                  `json:"displayName"`
+	Bio           string                  `json:"bio"`
+	AvatarURL     string                  `json:"avatarUrl"`
+	Timezone      string                  `json:"timezone"`
+	Locale        string                  `json:"locale"`
+	Notifications NotificationPreferences `json:"notifications"`
+}
+
+// ProfilePatch changes the fields of a profile that are present (not nil),
+// leaving the others as they are
+type ProfilePatch struct {
+	DisplayName   *string            `json:"displayName"`
+	Bio           *string            `json:"bio"`
+	AvatarURL     *string            `json:"avatarUrl"`
+	Timezone      *string            `json:"timezone"`
+	Locale        *string            `json:"locale"`
+	Notifications *NotificationPatch `json:"notifications"`
+}
+
+// NotificationPatch changes the notification preferences that are present
+type NotificationPatch struct {
+	SecurityAlerts *bool   `json:"securityAlerts"`
+	NewContent     *bool   `json:"newContent"`
+	Digest         *string `json:"digest"`
+}
+
+// Apply the patch to the profile, returning the changed profile
+func (patch ProfilePatch) Apply(profile UserProfile) UserProfile {
+	set := func(value *string, field *string) {
+		if value != nil {
+			*field = *value
+		}
+	}
+	set(patch.DisplayName, &profile.DisplayName)
+	set(patch.Bio, &profile.Bio)
+	set(patch.AvatarURL, &profile.AvatarURL)
+	set(patch.Timezone, &profile.Timezone)
+	set(patch.Locale, &profile.Locale)
+	if notifications := patch.Notifications; notifications != nil {
+		if notifications.SecurityAlerts != nil {
+			profile.Notifications.SecurityAlerts = *notifications.SecurityAlerts
+		}
+		if notifications.NewContent != nil {
+			profile.Notifications.NewContent = *notifications.NewContent
+		}
+		set(notifications.Digest, &profile.Notifications.Digest)
+	}
+	return profile
+}
+
+// InvalidProfileError is returned when a field of a profile isn't valid
+type InvalidProfileError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (err *InvalidProfileError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", err.Field, err.Reason)
+}
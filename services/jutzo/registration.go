@@ -0,0 +1,67 @@
+package jutzo
+
+import (
+	"errors"
+	"time"
+)
+
+// The registration modes, which decide who can register themselves
+const (
+	// RegistrationOpen lets anyone register
+	RegistrationOpen = "open"
+
+	// RegistrationClosed stops all registration
+	RegistrationClosed = "closed"
+
+	// RegistrationInvitation requires an invite code to register
+	RegistrationInvitation = "invitation"
+
+	// RegistrationDomain lets anyone with an email in one of the allowed domains
+	// register. Invite codes can be used to register with other emails
+	RegistrationDomain = "domain"
+)
+
+// InviteRight lets a user who isn't an administrator create invite codes
+const InviteRight = "invite"
+
+// Errors returned when registration is refused, or an invite can't be created
+var (
+	ErrRegistrationClosed    = errors.New("registration is closed")
+	ErrInviteRequired        = errors.New("an invite code is required to register")
+	ErrInvalidInvite         = errors.New("invalid, used or expired invite code")
+	ErrEmailDomainNotAllowed = errors.New("registration is not open to this email domain")
+	ErrInvalidRegistration   = errors.New("invalid registration mode or domain")
+)
+
+// RegistrationSettings decide who can register. They can be changed while
+// the service is running
+type RegistrationSettings struct {
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowedDomains"`
+}
+
+// Invite is a single use code that lets someone register, and gives them
+// rights when they do. Only a hash of the code itself is stored
+type Invite interface {
+
+	// GetId of the invite, used to list and revoke it
+	GetId() string
+
+	// GetCreatedBy is the username of the user that created the invite
+	GetCreatedBy() string
+
+	// GetRights given to the user that registers with the invite. These are
+	// always a subset of the rights of the creator
+	GetRights() []string
+
+	// GetCreationTime of the invite
+	GetCreationTime() time.Time
+
+	// GetExpirationTime of the invite; the zero time if it never expires
+	GetExpirationTime() time.Time
+
+	// GetUsedBy is the username of the user that registered with the
+	// invite, "(deleted)" if that user has since been deleted, or "" if
+	// it hasn't been used
+	GetUsedBy() string
+}
@@ -0,0 +1,37 @@
+package jutzo
+
+import (
+	"errors"
+)
+
+// The roles that every installation has. New users are given the user
+// role; the administrator role includes the admin right
+const (
+	DefaultUserRole   = "user"
+	AdministratorRole = "administrator"
+)
+
+// Errors returned when defining or removing roles
+var (
+	ErrRoleCycle   = errors.New("a role cannot inherit from itself, directly or indirectly")
+	ErrBuiltInRole = errors.New("the built-in roles cannot be redefined or deleted")
+	ErrInvalidRole = errors.New("role names must be non-empty and cannot contain commas or whitespace")
+	ErrLastAdmin   = errors.New("the change would leave no enabled administrator")
+)
+
+// Role is a named bundle of rights that can be assigned to users. A role
+// also holds all the rights of the roles it inherits from
+type Role interface {
+
+	// GetName of the role
+	GetName() string
+
+	// GetDescription of what the role is for
+	GetDescription() string
+
+	// GetRights bundled in the role itself (not including inherited rights)
+	GetRights() []string
+
+	// GetInheritedRoles whose rights are included in this role
+	GetInheritedRoles() []string
+}
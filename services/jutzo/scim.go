@@ -0,0 +1,27 @@
+package jutzo
+
+import (
+	"errors"
+	"time"
+)
+
+// SCIMTokenPrefix starts every SCIM token we issue, so that they can't be
+// mistaken for API keys or access tokens
+const SCIMTokenPrefix = "jutzo_scim_"
+
+// Errors returned by SCIM provisioning
+var (
+	ErrInvalidSCIMToken = errors.New("invalid or revoked SCIM token")
+	ErrEmailInUse       = errors.New("the email is registered to another user")
+)
+
+// SCIMToken lets an identity management system provision users and groups
+// through the SCIM endpoints. Tokens are issued by administrators, and only a
+// hash of the token itself is stored
+type SCIMToken struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	CreatedBy    string    `json:"createdBy"`
+	CreationTime time.Time `json:"creationTime"`
+	LastUsed     time.Time `json:"lastUsed,omitempty"`
+}
@@ -6,9 +6,72 @@
 package jutzo
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrInvalidRefreshToken is returned when a refresh token cannot be
+// matched to a live session, or was never issued for it
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// ErrSessionNotFound is returned when there is no live session with the ID given
+var ErrSessionNotFound = errors.New("no such session, or it has expired")
+
+// ErrRefreshTokenReused is returned when a refresh token that has already
+// been exchanged is presented again. The session the token belonged to
+// is destroyed when this happens, as the token has probably been stolen
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected; session revoked")
+
+// The policies for a session that is used from a different client (IP
+// address or user agent) than the one it was created from
+const (
+	// FingerprintIgnore lets the session carry on as normal
+	FingerprintIgnore = "ignore"
+
+	// FingerprintLog lets the session carry on, logging the change
+	FingerprintLog = "log"
+
+	// FingerprintReject refuses the request; the user has to log in again
+	FingerprintReject = "reject"
+
+	// FingerprintStepUp refuses the request until the user confirms the session
+	// with their password, which binds the session to the new client
+	FingerprintStepUp = "stepup"
+)
+
+// ErrSessionClientChanged is returned when a session is used from a different
+// client than it was created from, and the fingerprint policy rejects it
+var ErrSessionClientChanged = errors.New("session is being used from a different client")
+
+// ErrStepUpRequired is returned when a session is used from a different client
+// than it was created from, and has to be confirmed with the user's password
+var ErrStepUpRequired = errors.New("session must be confirmed with the user's password")
+
+// SessionTimeouts defines the lifetimes that govern a user session
+type SessionTimeouts struct {
+
+	// AccessDuration is the lifetime of a single access (JWT) token
+	AccessDuration time.Duration
+
+	// RefreshDuration is the absolute lifetime of the session; refresh
+	// tokens can be exchanged until this much time has passed since login
+	RefreshDuration time.Duration
+
+	// IdleTimeout is how long a session survives without being used
+	IdleTimeout time.Duration
+}
+
+// ClientInfo describes the client that a session was created from
+type ClientInfo struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+
+	// ClientID of the OAuth client application the session was delegated
+	// to, and the scope the user granted it. Empty for a normal login
+	ClientID string   `json:"clientId,omitempty"`
+	Scope    []string `json:"scope,omitempty"`
+}
+
 // UserSession defines the information that we know about a logged in user
 type UserSession interface {
 
@@ -20,6 +83,20 @@ type UserSession interface {
 
 	// GetDuration of the session from when it was initialized
 	GetDuration() time.Duration
+
+	// GetCreationTime of the session (i.e. when the user logged in)
+	GetCreationTime() time.Time
+
+	// GetLastSeen is the last time the session was used
+	GetLastSeen() time.Time
+
+	// GetClientInfo describing the client the session was created from
+	GetClientInfo() ClientInfo
+
+	// GetRefreshToken that can be exchanged for a new access token. This is
+	// only populated on the session returned when the session is created or
+	// refreshed; the cache only holds a hash of the token
+	GetRefreshToken() string
 }
 
 type UserSessionCache interface {
@@ -31,14 +108,57 @@ type UserSessionCache interface {
 	Disconnect() error
 
 	// GetUserSessionByID will look for the ID in the cache and return it
-	// if it exists and isn't expired. It will return nil if the session
-	// cannot be found, and an error if there is a problem communicating
-	// with the cache
+	// if it exists and isn't expired. It will return ErrSessionNotFound if the
+	// session cannot be found, and another error if there is a problem
+	// communicating with the cache. Retrieving a session extends its idle timeout
 	GetUserSessionByID(uniqueID string) (UserSession, error)
 
-	// CacheUserSession so that it can be retrieved again by the unique ID
-	CacheUserSession(userInfo UserInfo) (UserSession, error)
+	// CacheUserSession so that it can be retrieved again by the unique ID. The
+	// session is also indexed by username so that it can be listed and revoked
+	CacheUserSession(userInfo UserInfo, client ClientInfo) (UserSession, error)
+
+	// RefreshUserSession exchanges a refresh token for a new one, rotating
+	// the token held by the session. Presenting a token that has already been
+	// exchanged destroys the session and returns ErrRefreshTokenReused; any other
+	// token returns ErrInvalidRefreshToken and leaves the session alone
+	RefreshUserSession(refreshToken string) (UserSession, error)
 
 	// InvalidateUserSession by removing the session from the cache
 	InvalidateUserSession(uniqueID string) error
+
+	// ListUserSessions returns all the live sessions for the given user,
+	// most recently used first
+	ListUserSessions(username string) ([]UserSession, error)
+
+	// InvalidateUserSessions removes all the sessions for the given user,
+	// except for the session with the ID given in except (which may be "")
+	InvalidateUserSessions(username string, except string) error
+
+	// UpdateUserSessions replaces the user information held by each of the
+	// user's live sessions with what update returns for that session, so that
+	// changes to the user (such as revoked rights) take effect immediately
+	UpdateUserSessions(username string, update func(userSession UserSession) UserInfo) error
+
+	// RebindUserSession to the client given, once the user has confirmed that
+	// the session is theirs. Returns ErrInvalidRefreshToken if there is no such session
+	RebindUserSession(uniqueID string, client ClientInfo) error
+
+	// StoreTransient keeps a short-lived value, such as the state of a login
+	// in progress, until it is taken or the time to live has passed
+	StoreTransient(key string, value []byte, ttl time.Duration) error
+
+	// TakeTransient retrieves and removes a value stored with StoreTransient,
+	// so that it can only be used once. Returns nil if there is no such value
+	TakeTransient(key string) ([]byte, error)
+
+	// GetTransientTimeToLive returns how long the transient value has left
+	// before it expires, or zero if there is no such value
+	GetTransientTimeToLive(key string) (time.Duration, error)
+
+	// IncrementCounter adds one to the counter with the given key, returning the
+	// new count. The counter is discarded once ttl passes without an increment
+	IncrementCounter(key string, ttl time.Duration) (int64, error)
+
+	// DeleteCounter with the given key, resetting it to zero
+	DeleteCounter(key string) error
 }
@@ -0,0 +1,17 @@
+package jutzo
+
+import (
+	"fmt"
+	"time"
+)
+
+// LoginThrottledError is returned by Login when there have been too many
+// failed attempts for the username or from the client's address. No
+// password is checked until RetryAfter has passed
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (err *LoginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts; retry after %s", err.RetryAfter)
+}
@@ -1,9 +1,28 @@
 package jutzo
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrInvalidUsername is returned when a username breaks the rules for the
+// characters it can contain, or is too long
+var ErrInvalidUsername = errors.New("usernames must be up to 64 letters, digits, dots, underscores or hyphens, starting with a letter or digit")
+
+// ErrInvalidUserQuery is returned when a user query's cursor is malformed
+// or was returned for a different order, or its sort isn't known
+var ErrInvalidUserQuery = errors.New("invalid user query sort or cursor")
+
+// How a user authenticates, which never changes once the user is created.
+// Local users log in with a password Jutzo holds, external users through an
+// identity provider (they may have been provisioned through SCIM), and
+// directory users with a password the LDAP directory checks
+const (
+	AuthSourceLocal     = "local"
+	AuthSourceExternal  = "external"
+	AuthSourceDirectory = "directory"
+)
+
 type UserInfo interface {
 
 	// GetUsername associated with this user
@@ -12,24 +31,115 @@ type UserInfo interface {
 	// GetEmail associated with this user
 	GetEmail() string
 
+	// SetEmail associated with this user
+	SetEmail(email string)
+
 	// GetPasswordHash associated with this user
 	GetPasswordHash() []byte
 
+	// GetAuthSource tells how the user authenticates (AuthSourceLocal,
+	// AuthSourceExternal or AuthSourceDirectory)
+	GetAuthSource() string
+
 	// IsEmailValidated for this user
 	IsEmailValidated() bool
 
-	// HasRights will return true if the user contains ALL the rights requested
+	// IsDisabled determines if an administrator has disabled the user's login.
+	// A disabled user can't log in or use their API keys, whatever their rights
+	IsDisabled() bool
+
+	// SetDisabled enables or disables the user's login
+	SetDisabled(disabled bool)
+
+	// HasRights will return true if the user holds ALL the rights requested,
+	// whether granted directly or through a role
 	HasRights(requested []string) bool
 
-	// HasAnyRight will return true if the user has ANY of the rights requested
+	// HasAnyRight will return true if the user holds ANY of the rights requested
 	HasAnyRight(requested []string) bool
 
-	// GetAllRights that the user has been granted as a string array
+	// GetAllRights that the user holds (their effective rights), including
+	// those from their roles and the roles those inherit from
 	GetAllRights() []string
 
-	// GrantRight to the user. A no-op if the right is already in place
+	// GetGrantedRights that were granted to the user directly rather than through a role
+	GetGrantedRights() []string
+
+	// GetRoles that have been assigned to the user
+	GetRoles() []string
+
+	// GrantRight to the user directly. A no-op if the right is already in place
 	GrantRight(right string)
 
+	// RevokeRight that was granted to the user directly. The user still holds
+	// the right if one of their roles includes it
+	RevokeRight(right string)
+
+	// AssignRole to the user. A no-op if the role is already assigned. The
+	// rights of the role are only included in the effective rights once the
+	// user has been updated and retrieved again
+	AssignRole(role string)
+
+	// RemoveRole from the user
+	RemoveRole(role string)
+
 	// GetCreationTime for the user
 	GetCreationTime() time.Time
+
+	// GetProfile the user has filled in about themselves
+	GetProfile() UserProfile
+
+	// SetProfile of the user
+	SetProfile(profile UserProfile)
+}
+
+// The orders users can be listed in
+const (
+	UserSortUsername = "username"
+	UserSortCreated  = "created"
+)
+
+// UserQuery selects users for an administrator. Empty fields don't restrict
+// the users selected. To page through the users, pass the NextCursor of the
+// page returned as the Cursor of the next query (with the same filters and order)
+type UserQuery struct {
+
+	// EmailContains selects users whose email contains the text, ignoring case
+	EmailContains string
+
+	// Right selects users who hold the right, whether directly or through a role
+	Right string
+
+	// Role selects users the role is assigned to
+	Role string
+
+	// Validated selects users whose email is (or isn't) validated
+	Validated *bool
+
+	// CreatedSince and CreatedUntil select users who registered in the period
+	CreatedSince time.Time
+	CreatedUntil time.Time
+
+	// Sort is UserSortUsername (the default) or UserSortCreated
+	Sort       string
+	Descending bool
+	Cursor     string
+	Limit      int
+}
+
+// KeyCollisions counts the users whose username or email was the same as an
+// earlier user's, ignoring case, when usernames and emails started to be
+// compared that way. Until an administrator resolves them, these users can
+// only be found by their exact username or email
+type KeyCollisions struct {
+	Usernames int `json:"usernames"`
+	Emails    int `json:"emails"`
+}
+
+// UserPage is a page of the users selected by a query, along with the total
+// number of users the query selects. NextCursor is empty on the last page
+type UserPage struct {
+	Users      []UserInfo
+	Total      int
+	NextCursor string
 }
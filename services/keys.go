@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"os"
+)
+
+// JSONWebKey is the public half of one of our signing keys, in
+// the format defined by RFC 7517
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	Modulus   string `json:"n,omitempty"`
+	Exponent  string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is the document served from /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// signingKey is an asymmetric key that tokens are signed or verified
+// with. Keys that are only used for verification have no private key
+type signingKey struct {
+	id         string
+	method     jwt.SigningMethod
+	privateKey crypto.PrivateKey
+	publicKey  crypto.PublicKey
+}
+
+// loadSigningKeyFile reads a PEM encoded key from the file given. The file
+// may contain either a private key (PKCS#1, PKCS#8 or SEC 1) or a public
+// key (PKIX); the signing algorithm is determined by the key type
+func loadSigningKeyFile(fileName string) (*signingKey, error) {
+	if contents, err := os.ReadFile(fileName); err == nil {
+		if key, err := parseSigningKey(contents); err == nil {
+			return key, nil
+		} else {
+			return nil, fmt.Errorf("unable to load key from %s: %s", fileName, err.Error())
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// parseSigningKey decodes a PEM encoded key and works out how to use it
+func parseSigningKey(contents []byte) (*signingKey, error) {
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key := new(signingKey)
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key.privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key.privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key.privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key.publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the public key from the private key if that's what we were given
+	if signer, ok := key.privateKey.(crypto.Signer); ok {
+		key.publicKey = signer.Public()
+	}
+
+	// Pick the signing method that goes with the key
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch publicKey.Curve {
+		case elliptic.P256():
+			key.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.publicKey)
+	}
+
+	// The key ID is derived from the public key, so that every server
+	// configured with the same key file agrees on it
+	if der, err := x509.MarshalPKIXPublicKey(key.publicKey); err == nil {
+		sum := sha256.Sum256(der)
+		key.id = base64.RawURLEncoding.EncodeToString(sum[:12])
+	} else {
+		return nil, err
+	}
+	return key, nil
+}
+
+// toJWK converts the public half of the key to a JSON web key
+func (key *signingKey) toJWK() JSONWebKey {
+	jwk := JSONWebKey{KeyID: key.id, Use: "sig", Algorithm: key.method.Alg()}
+	encode := base64.RawURLEncoding.EncodeToString
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.Modulus = encode(publicKey.N.Bytes())
+		jwk.Exponent = encode(big.NewInt(int64(publicKey.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = publicKey.Curve.Params().Name
+		jwk.X = encode(publicKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = encode(publicKey.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encode(publicKey)
+	}
+	return jwk
+}
+
+// toSigningKey converts a JSON web key published by someone else (e.g. an
+// identity provider) into a key that we can verify their tokens with
+func (jwk JSONWebKey) toSigningKey() (*signingKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	key := &signingKey{id: jwk.KeyID}
+	switch jwk.KeyType {
+	case "RSA":
+		modulus, err := decode(jwk.Modulus)
+		if err != nil {
+			return nil, err
+		}
+		exponent, err := decode(jwk.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		key.publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+		key.method = jwt.SigningMethodRS256
+	case "EC":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := &ecdsa.PublicKey{X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		switch jwk.Curve {
+		case "P-256":
+			publicKey.Curve, key.method = elliptic.P256(), jwt.SigningMethodES256
+		case "P-384":
+			publicKey.Curve, key.method = elliptic.P384(), jwt.SigningMethodES384
+		case "P-521":
+			publicKey.Curve, key.method = elliptic.P521(), jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported elliptic curve %s", jwk.Curve)
+		}
+		key.publicKey = publicKey
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		key.publicKey = ed25519.PublicKey(x)
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.KeyType)
+	}
+
+	// Respect the algorithm if the key specifies one (e.g. PS256 for an RSA key)
+	if jwk.Algorithm != "" {
+		if method := jwt.GetSigningMethod(jwk.Algorithm); method != nil {
+			key.method = method
+		} else {
+			return nil, fmt.Errorf("unsupported algorithm %s", jwk.Algorithm)
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+)
+
+// ldapStubEntry is a directory entry served by the LDAP stub
+type ldapStubEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapStub is a minimal in-process LDAP server. It understands simple
+// binds, and searches with an equality filter on the entries' attributes
+type ldapStub struct {
+	listener net.Listener
+	entries  []ldapStubEntry
+}
+
+func newLDAPStub(t *testing.T, entries []ldapStubEntry) *ldapStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err.Error())
+	}
+	stub := &ldapStub{listener: listener, entries: entries}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (stub *ldapStub) url() string {
+	return "ldap://" + stub.listener.Addr().String()
+}
+
+// serve the requests on one connection until the client unbinds
+func (stub *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		messageID := request.Children[0].Value.(int64)
+		operation := request.Children[1]
+
+		switch operation.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := operation.Children[1].Value.(string)
+			password := operation.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			for _, entry := range stub.entries {
+				if entry.dn == dn && entry.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			_, _ = conn.Write(ldapResponse(messageID, ldap.ApplicationBindResponse, ldapResult(code)...).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(operation.Children[6])
+			for _, entry := range stub.entries {
+				if entry.matches(filter) {
+					attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+					for name, values := range entry.attributes {
+						attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+						attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+						set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+						for _, value := range values {
+							set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+						}
+						attribute.AppendChild(set)
+						attributes.AppendChild(attribute)
+					}
+					dn := ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN")
+					_, _ = conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultEntry, dn, attributes).Bytes())
+				}
+			}
+			_, _ = conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultDone, ldapResult(ldap.LDAPResultSuccess)...).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+// matches determines if the entry satisfies a filter of the form (attribute=value)
+func (entry ldapStubEntry) matches(filter string) bool {
+	name, value, _ := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")"), "=")
+	for _, candidate := range entry.attributes[name] {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ldapResponse wraps a protocol operation in an LDAP message
+func ldapResponse(messageID int64, tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	operation := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Operation")
+	for _, child := range children {
+		operation.AppendChild(child)
+	}
+	packet.AppendChild(operation)
+	return packet
+}
+
+// ldapResult creates the result code, matched DN and diagnostic message of a response
+func ldapResult(code int) []*ber.Packet {
+	return []*ber.Packet{
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"),
+	}
+}
+
+func TestLDAPVerifier(t *testing.T) {
+	stub := newLDAPStub(t, []ldapStubEntry{
+		{dn: "cn=jutzo,dc=example,dc=com", password: "service-pass"},
+		{dn: "uid=alice,ou=people,dc=example,dc=com", password: "alice-pass", attributes: map[string][]string{
+			"uid":      {"alice"},
+			"mail":     {"alice@example.com"},
+			"memberOf": {"CN=Admins,ou=groups,dc=example,dc=com", "cn=other,ou=groups,dc=example,dc=com"},
+		}},
+	})
+	verifier, err := impl.NewLDAPVerifier(TestConfig{map[string]string{
+		"JUTZO_LDAP_URL":           stub.url(),
+		"JUTZO_LDAP_BIND_DN":       "cn=jutzo,dc=example,dc=com",
+		"JUTZO_LDAP_BIND_PASSWORD": "service-pass",
+		"JUTZO_LDAP_BASE_DN":       "dc=example,dc=com",
+		"JUTZO_LDAP_GROUP_RIGHTS":  "admin:cn=admins,ou=groups,dc=example,dc=com;blog:cn=writers,ou=groups,dc=example,dc=com",
+	}})
+	if err != nil || verifier == nil {
+		t.Fatalf("Unable to create verifier: %v", err)
+	}
+
+	// Group membership maps to rights, and the directory manages every mapped right
+	if user, err := verifier.VerifyCredentials("alice", "alice-pass"); err != nil {
+		t.Errorf("Verification failed: %s", err.Error())
+	} else if user.Email != "alice@example.com" || strings.Join(user.Rights, ",") != "login,admin" ||
+		len(user.ManagedRights) != 3 {
+		t.Errorf("Unexpected directory user: %v", user)
+	}
+
+	if _, err = verifier.VerifyCredentials("alice", "wrong"); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Expected invalid credentials, got %v", err)
+	}
+	if _, err = verifier.VerifyCredentials("alice", ""); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Expected empty password to be refused, got %v", err)
+	}
+	if _, err = verifier.VerifyCredentials("bob", "bob-pass"); err != jutzo.ErrUnknownDirectoryUser {
+		t.Errorf("Expected unknown user, got %v", err)
+	}
+
+	// The username can't be used to change the search filter
+	if _, err = verifier.VerifyCredentials("alice)(uid=*", "alice-pass"); err != jutzo.ErrUnknownDirectoryUser {
+		t.Errorf("Expected the filter to be escaped, got %v", err)
+	}
+}
+
+func TestLDAPConfiguration(t *testing.T) {
+	if verifier, err := impl.NewLDAPVerifier(TestConfig{map[string]string{}}); err != nil || verifier != nil {
+		t.Errorf("No directory should be configured by default")
+	}
+	if _, err := impl.NewLDAPVerifier(TestConfig{map[string]string{
+		"JUTZO_LDAP_URL":          "ldap://localhost",
+		"JUTZO_LDAP_BASE_DN":      "dc=example,dc=com",
+		"JUTZO_LDAP_GROUP_RIGHTS": "cn=admins,dc=example,dc=com",
+	}}); err == nil {
+		t.Errorf("Invalid group mapping was accepted")
+	}
+}
+
+// directoryTestEngine is a test engine that checks directory users against
+// an LDAP stub holding the entries given, which all have "directory-pass"
+func directoryTestEngine(t *testing.T, usernames ...string) *impl.EngineImpl {
+	entries := []ldapStubEntry{{dn: "cn=jutzo,dc=example,dc=com", password: "service-pass"}}
+	for _, username := range usernames {
+		entries = append(entries, ldapStubEntry{dn: "uid=" + username + ",ou=people,dc=example,dc=com",
+			password: "directory-pass", attributes: map[string][]string{
+				"uid":      {username},
+				"mail":     {username + "@directory.example.com"},
+				"memberOf": {"cn=admins,ou=groups,dc=example,dc=com"},
+			}})
+	}
+	stub := newLDAPStub(t, entries)
+	return newTestEngine(t, map[string]string{
+		"JUTZO_LDAP_URL":           stub.url(),
+		"JUTZO_LDAP_BIND_DN":       "cn=jutzo,dc=example,dc=com",
+		"JUTZO_LDAP_BIND_PASSWORD": "service-pass",
+		"JUTZO_LDAP_BASE_DN":       "dc=example,dc=com",
+		"JUTZO_LDAP_GROUP_RIGHTS":  "admin:cn=admins,ou=groups,dc=example,dc=com",
+	})
+}
+
+func TestOnlyDirectoryUsersUseTheDirectory(t *testing.T) {
+	engine := directoryTestEngine(t, "carol", "bob", "dave")
+	client := jutzo.ClientInfo{IP: "192.0.2.1"}
+
+	// Users the directory knows are created as directory users when they first log in
+	if _, err := engine.Login("carol", "directory-pass", client); err != nil {
+		t.Fatalf("Unable to log in as a directory user: %s", err.Error())
+	}
+	if carol, _ := engine.GetUser("carol"); carol == nil || carol.GetAuthSource() != jutzo.AuthSourceDirectory {
+		t.Errorf("Unexpected directory user: %+v", carol)
+	}
+
+	// The rights the directory grants are audited as its doing
+	granted, err := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditRightGranted},
+		Actor: "directory", Target: "carol"})
+	grantedAdmin := false
+	for _, event := range granted {
+		grantedAdmin = grantedAdmin || event.Detail == "admin"
+	}
+	if err != nil || !grantedAdmin {
+		t.Errorf("Expected the directory's grant to be audited: %+v %v", granted, err)
+	}
+
+	// A local user is checked against their own password, not the directory's
+	if _, err := engine.Login("bob", "directory-pass", client); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Expected a local user not to log in through the directory, got %v", err)
+	}
+	if _, err := engine.Login("bob", "test-pass", client); err != nil {
+		t.Errorf("Unable to log in as a local user: %s", err.Error())
+	}
+
+	// A user who logs in through an identity provider has no password at all
+	if _, err := engine.LoginExternalIdentity(jutzo.ExternalIdentity{Provider: "idp", Subject: "dave-subject",
+		Email: "dave@example.com", EmailVerified: true, PreferredUsername: "dave"}, client); err != nil {
+		t.Fatalf("Unable to log in with an external identity: %s", err.Error())
+	}
+	if _, err := engine.Login("dave", "directory-pass", client); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Expected an external user not to log in through the directory, got %v", err)
+	}
+	if dave, _ := engine.GetUser("dave"); dave == nil || dave.GetAuthSource() != jutzo.AuthSourceExternal ||
+		dave.GetEmail() != "dave@example.com" || dave.HasRights([]string{"admin"}) {
+		t.Errorf("External user changed by the directory: %+v", dave)
+	}
+}
+
+func TestDirectoryOnlyAdoptsItsOwnUsers(t *testing.T) {
+	engine := directoryTestEngine(t, "carol", "erin")
+	client := jutzo.ClientInfo{IP: "192.0.2.1"}
+
+	// An account that only ever logged in through an identity provider, under a
+	// name the directory also has, can't be entered or changed through the directory
+	if _, err := engine.LoginExternalIdentity(jutzo.ExternalIdentity{Provider: "idp", Subject: "erin-subject",
+		Email: "erin@example.com", EmailVerified: true, PreferredUsername: "erin"}, client); err != nil {
+		t.Fatalf("Unable to log in with an external identity: %s", err.Error())
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := engine.Login("erin", "directory-pass", client); err != jutzo.ErrInvalidCredentials {
+			t.Errorf("Expected the external user not to be adopted, got %v", err)
+		}
+	}
+	if erin, _ := engine.GetUser("erin"); erin == nil || erin.GetAuthSource() != jutzo.AuthSourceExternal ||
+		erin.GetEmail() != "erin@example.com" || erin.HasRights([]string{"admin"}) {
+		t.Errorf("External user adopted by the directory: %+v", erin)
+	}
+
+	// The directory's own users are kept in step with it on every login
+	for attempt := 0; attempt < 2; attempt++ {
+		if userSession, err := engine.Login("carol", "directory-pass", client); err != nil {
+			t.Fatalf("Unable to log in as a directory user: %s", err.Error())
+		} else if carol := userSession.GetUserInfo(); carol.GetEmail() != "carol@directory.example.com" ||
+			!carol.HasRights([]string{"admin"}) {
+			t.Errorf("Directory user not kept in step: %+v", carol)
+		}
+	}
+}
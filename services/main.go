@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -12,12 +13,17 @@ import (
 	"services/jutzo"
 	"services/jutzo/impl"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 const ValidationLinkTemplate = "/v1/user/validateEmail/%s"
 
+// SessionConfirmPath is where a session that has moved to a different client
+// is confirmed, when the fingerprint policy asks for the user's password
+const SessionConfirmPath = "/v1/user/session/confirm"
+
 // Routine to set up the GIN router. This
 // both creates the router, configures it, and
 // defines the endpoints that we support.
@@ -29,18 +35,40 @@ func setupRouter(engine jutzo.Engine, configuration Configuration) (*gin.Engine,
 	// GIN server
 	router := gin.Default()
 
-	// If we are in production, then use
-	// the trusted cloudflare platform
-	if gin.Mode() == gin.ReleaseMode {
-		router.TrustedPlatform = gin.PlatformCloudflare
+	// Only believe the client IP headers set by the proxies we trust
+	if err := configureClientIP(router, configuration); err != nil {
+		return nil, err
 	}
 
 	// Set up CORS middleware options.
 	router.Use(cors.Default())
 
+	// Get the external identity providers users can log in with
+	providers, err := loadOIDCProviders(configuration)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get our JWT token engine
 	if tokenEngine, err := NewTokenEngine(configuration); err == nil {
 
+		// Publish the keys our tokens can be verified with, so that other
+		// services can validate them without sharing a secret
+		router.GET("/.well-known/jwks.json", func(c *gin.Context) { c.JSON(http.StatusOK, tokenEngine.GetJWKS()) })
+
+		// Get the authorization server other applications can sign users in with
+		oauth, err := loadOAuthServer(configuration, engine, tokenEngine)
+		if err != nil {
+			return nil, err
+		}
+		if oauth != nil {
+			router.GET("/.well-known/openid-configuration", oauth.handleDiscovery)
+			router.GET("/oauth/authorize", oauth.handleAuthorize)
+			router.POST("/oauth/token", oauth.handleToken)
+			router.GET("/oauth/userinfo", requireValidJWTToken(engine, tokenEngine), oauth.handleUserInfo)
+			router.POST("/oauth/userinfo", requireValidJWTToken(engine, tokenEngine), oauth.handleUserInfo)
+		}
+
 		// Set up a group so that all endpoints are within the /v1
 		// namespace. This give us flexibility for breaking changes
 		// in the future if needed.
@@ -52,17 +80,85 @@ func setupRouter(engine jutzo.Engine, configuration Configuration) (*gin.Engine,
 		// User management
 		v1.POST("/user/register", func(c *gin.Context) { handleRegisterUser(c, engine) })
 		v1.POST("/user/login", func(c *gin.Context) { handleLogin(c, tokenEngine, engine) })
+		v1.POST("/user/refresh", func(c *gin.Context) { handleRefresh(c, tokenEngine, engine) })
+		v1.POST("/user/password/reset", func(c *gin.Context) { handleResetPassword(c, engine) })
 		v1.GET("/user/validateEmail/:key", func(c *gin.Context) { handleValidateEmail(c, engine) })
+		v1.GET("/user/oidc/:provider/login", func(c *gin.Context) { handleOIDCLogin(c, providers, engine) })
+		v1.GET("/user/oidc/:provider/callback",
+			func(c *gin.Context) { handleOIDCCallback(c, providers, tokenEngine, engine, configuration) })
 
 		// Define a group for endpoints that require authentication but no specific rights
 		authenticated := router.Group("/v1", requireValidJWTToken(engine, tokenEngine))
 		authenticated.GET("/user/getValidationLink",
 			func(c *gin.Context) { handleResendValidateEmailLink(c, engine) })
 		authenticated.GET("/user/logoff", func(c *gin.Context) { handleLogoff(c, engine) })
+		authenticated.PUT("/user/password", func(c *gin.Context) { handleChangePassword(c, engine) })
+		authenticated.POST("/user/session/confirm", func(c *gin.Context) { handleConfirmSession(c, engine) })
+		authenticated.GET("/user/sessions", func(c *gin.Context) { handleListMySessions(c, engine) })
+		authenticated.DELETE("/user/sessions", func(c *gin.Context) { handleRevokeMyOtherSessions(c, engine) })
+		authenticated.DELETE("/user/sessions/:id", func(c *gin.Context) { handleRevokeMySession(c, engine) })
+		authenticated.POST("/user/apiKeys", func(c *gin.Context) { handleCreateAPIKey(c, engine) })
+		authenticated.GET("/user/apiKeys", func(c *gin.Context) { handleListAPIKeys(c, engine) })
+		authenticated.DELETE("/user/apiKeys/:id", func(c *gin.Context) { handleRevokeAPIKey(c, engine) })
+		authenticated.GET("/user/me", handleGetMe)
+		authenticated.PATCH("/user/me", func(c *gin.Context) { handleUpdateMe(c, engine) })
+		authenticated.GET("/user/me/export", func(c *gin.Context) { handleExportMyData(c, engine) })
+		authenticated.POST("/user/me/deletion", func(c *gin.Context) { handleRequestMyDeletion(c, engine) })
+		authenticated.DELETE("/user/me/deletion", func(c *gin.Context) { handleCancelMyDeletion(c, engine) })
+		authenticated.POST("/user/invites", func(c *gin.Context) { handleCreateInvite(c, engine) })
+		authenticated.GET("/user/invites", func(c *gin.Context) { handleListInvites(c, engine) })
+		authenticated.DELETE("/user/invites/:id", func(c *gin.Context) { handleRevokeInvite(c, engine) })
+		if oauth != nil {
+			authenticated.POST("/oauth/authorize", oauth.handleGrant)
+		}
 
 		// Define a group for endpoints that require specific rights to access
 		granted := router.Group("/v1", requireGrants(engine, tokenEngine, []string{"admin"}))
 		granted.GET("/user/list", func(c *gin.Context) { handleListUsers(c, engine) })
+		granted.GET("/user/collisions", func(c *gin.Context) { handleGetKeyCollisions(c, engine) })
+		granted.GET("/admin/user/:username/sessions",
+			func(c *gin.Context) { listSessions(c, engine, c.Param("username"), "") })
+		granted.DELETE("/admin/user/:username/sessions",
+			func(c *gin.Context) { revokeAllSessions(c, engine, c.Param("username"), "") })
+		granted.DELETE("/admin/user/:username/sessions/:id",
+			func(c *gin.Context) { revokeSession(c, engine, c.Param("username"), c.Param("id")) })
+		granted.GET("/admin/settings/registration", func(c *gin.Context) { handleGetRegistrationSettings(c, engine) })
+		granted.PUT("/admin/settings/registration", func(c *gin.Context) { handleSetRegistrationSettings(c, engine) })
+		granted.GET("/admin/audit", func(c *gin.Context) { handleListAuditEvents(c, engine) })
+		granted.POST("/admin/scim/tokens", func(c *gin.Context) { handleCreateSCIMToken(c, engine) })
+		granted.GET("/admin/scim/tokens", func(c *gin.Context) { handleListSCIMTokens(c, engine) })
+		granted.DELETE("/admin/scim/tokens/:id", func(c *gin.Context) { handleRevokeSCIMToken(c, engine) })
+		granted.GET("/admin/roles", func(c *gin.Context) { handleListRoles(c, engine) })
+		granted.PUT("/admin/roles/:name", func(c *gin.Context) { handleDefineRole(c, engine) })
+		granted.DELETE("/admin/roles/:name", func(c *gin.Context) { handleDeleteRole(c, engine) })
+		granted.PUT("/admin/user/:username/roles/:role", func(c *gin.Context) { handleAssignRole(c, engine) })
+		granted.DELETE("/admin/user/:username/roles/:role", func(c *gin.Context) { handleUnassignRole(c, engine) })
+		granted.PUT("/admin/user/:username/rights/:right", func(c *gin.Context) { handleGrantRight(c, engine) })
+		granted.DELETE("/admin/user/:username/rights/:right", func(c *gin.Context) { handleRevokeRight(c, engine) })
+		granted.POST("/admin/user/:username/disable", func(c *gin.Context) { handleSetLoginEnabled(c, engine, false) })
+		granted.POST("/admin/user/:username/enable", func(c *gin.Context) { handleSetLoginEnabled(c, engine, true) })
+		granted.POST("/admin/user/:username/validateEmail", func(c *gin.Context) { handleForceEmailValidation(c, engine) })
+		granted.DELETE("/admin/user/:username", func(c *gin.Context) { handleDeleteUser(c, engine) })
+		granted.POST("/admin/user/:username/unlock", func(c *gin.Context) { handleUnlockUser(c, engine) })
+		granted.POST("/admin/user/:username/passwordReset", func(c *gin.Context) { handleCreatePasswordReset(c, engine) })
+		granted.POST("/admin/oauth/clients", func(c *gin.Context) { handleRegisterOAuthClient(c, engine) })
+		granted.GET("/admin/oauth/clients", func(c *gin.Context) { handleListOAuthClients(c, engine) })
+		granted.DELETE("/admin/oauth/clients/:clientId", func(c *gin.Context) { handleDeleteOAuthClient(c, engine) })
+
+		// SCIM provisioning, for identity management systems holding a SCIM token
+		scim := router.Group(SCIMPath, requireSCIMToken(engine))
+		scim.GET("/ServiceProviderConfig", handleSCIMServiceProviderConfig)
+		scim.GET("/Users", func(c *gin.Context) { handleSCIMListUsers(c, engine) })
+		scim.POST("/Users", func(c *gin.Context) { handleSCIMCreateUser(c, engine) })
+		scim.GET("/Users/:id", func(c *gin.Context) { handleSCIMGetUser(c, engine) })
+		scim.PUT("/Users/:id", func(c *gin.Context) { handleSCIMReplaceUser(c, engine) })
+		scim.PATCH("/Users/:id", func(c *gin.Context) { handleSCIMPatchUser(c, engine) })
+		scim.DELETE("/Users/:id", func(c *gin.Context) { handleSCIMDeleteUser(c, engine) })
+		scim.GET("/Groups", func(c *gin.Context) { handleSCIMListGroups(c, engine) })
+		scim.POST("/Groups", func(c *gin.Context) { handleSCIMCreateGroup(c, engine) })
+		scim.GET("/Groups/:id", func(c *gin.Context) { handleSCIMGetGroup(c, engine) })
+		scim.PATCH("/Groups/:id", func(c *gin.Context) { handleSCIMPatchGroup(c, engine) })
+		scim.DELETE("/Groups/:id", func(c *gin.Context) { handleSCIMDeleteGroup(c, engine) })
 
 		// Blog methods
 		v1.GET("/blog/newest", newest)
@@ -74,13 +170,21 @@ func setupRouter(engine jutzo.Engine, configuration Configuration) (*gin.Engine,
 	}
 }
 
-// Find the bearer token and parse it to the context
+// Find the bearer token and parse it to the context. The bearer token
+// is normally a JWT access token, but it can also be an API key (which
+// can alternatively be provided in the X-API-Key header)
 //
 // This is a helper function for a GIN middleware
 // function. See requireValidJWTToken or requireGrant for the
 // middleware functions
 func parseJWTToken(engine jutzo.Engine, tokenEngine TokenEngine, c *gin.Context) {
 
+	// API keys can be presented in their own header
+	if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+		parseAPIKey(engine, apiKey, c)
+		return
+	}
+
 	// Get the authorization header
 	token := c.Request.Header["Authorization"]
 	if token == nil || 1 != len(token) {
@@ -91,27 +195,61 @@ func parseJWTToken(engine jutzo.Engine, tokenEngine TokenEngine, c *gin.Context)
 		var encoded string
 		if _, err := fmt.Sscanf(token[0], "Bearer %s", &encoded); err != nil {
 			c.AbortWithStatus(http.StatusUnauthorized)
+		} else if strings.HasPrefix(encoded, jutzo.APIKeyPrefix) {
+			parseAPIKey(engine, encoded, c)
 		} else {
-			// Decode the JWT token to get the user session
-			if uniqueID, err := tokenEngine.Decode(encoded); err != nil {
+			// Decode the JWT token to get the user session. This rejects tokens
+			// from other issuers or meant for other audiences
+			if claims, err := tokenEngine.Decode(encoded); err != nil {
 				c.AbortWithStatus(http.StatusUnauthorized)
 			} else {
 
-				// Load the user session from the engine
-				if userSession, err := engine.LoadUserSession(uniqueID); err == nil {
-
-					// Save the user session for downstream usage. We do this by creating a new
-					// request with an updated context that contains the user session as a value
-					ctx := context.WithValue(c.Request.Context(), "userSession", userSession)
-					c.Request = c.Request.WithContext(ctx)
-				} else {
+				// Load the user session from the engine, and make sure it's being used
+				// from the client it was created from (as far as the policy cares)
+				if userSession, err := engine.LoadUserSession(claims.Id); err != nil {
 					c.AbortWithStatus(http.StatusUnauthorized)
+				} else if err = engine.VerifySessionClient(userSession, getClientInfo(c)); err == nil ||
+					(err == jutzo.ErrStepUpRequired && c.FullPath() == SessionConfirmPath) {
+					setUserSessionInContext(c, userSession, false)
+				} else {
+					recordAudit(c, engine, jutzo.AuditSessionClientChanged, userSession.GetUserInfo().GetUsername(), err.Error())
+					if err == jutzo.ErrStepUpRequired {
+						c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "step_up_required", "confirm": SessionConfirmPath})
+					} else {
+						c.AbortWithStatus(http.StatusUnauthorized)
+					}
 				}
 			}
 		}
 	}
 }
 
+// Authenticate an API key, and save the session restricted to the
+// rights of that key to the context
+func parseAPIKey(engine jutzo.Engine, apiKey string, c *gin.Context) {
+	if userSession, err := engine.LoadAPIKeySession(apiKey); err == nil {
+		setUserSessionInContext(c, userSession, true)
+	} else {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// Save the user session for downstream usage. We do this by creating a new
+// request with an updated context that contains the user session as a value,
+// along with a flag indicating if the session came from an API key
+func setUserSessionInContext(c *gin.Context, userSession jutzo.UserSession, fromAPIKey bool) {
+	ctx := context.WithValue(c.Request.Context(), "userSession", userSession)
+	ctx = context.WithValue(ctx, "fromAPIKey", fromAPIKey)
+	c.Request = c.Request.WithContext(ctx)
+}
+
+// Determine if the session in the context was created from an API key
+// rather than an interactive login
+func isAPIKeySession(c *gin.Context) bool {
+	fromAPIKey, _ := c.Request.Context().Value("fromAPIKey").(bool)
+	return fromAPIKey
+}
+
 // Attempt to get the user session. This routine depends on the
 // context having been set up in one of the GIN middleware methods
 // (either requireValidJWTToken or requireGrants), so this should only be
@@ -161,23 +299,27 @@ func handleRegisterUser(c *gin.Context, engine jutzo.Engine) {
 
 	// registerUserPayload is used with the registration POST request
 	type registerUserPayload struct {
-		User  string `json:"user" binding:"required"`
-		Email string `json:"email" binding:"required"`
-		Pass  string `json:"pass" binding:"required"`
+		User   string `json:"user" binding:"required"`
+		Email  string `json:"email" binding:"required"`
+		Pass   string `json:"pass" binding:"required"`
+		Invite string `json:"invite"`
 	}
 
 	// Get the JSON payload from the database
 	var payload registerUserPayload
 	err := c.BindJSON(&payload)
 	if checkValidPayload(c, err) {
-		if status, _, err := engine.RegisterUser(payload.User, payload.Pass, payload.Email); err == nil {
+		if status, userInfo, err := engine.SignUp(payload.User, payload.Pass, payload.Email, payload.Invite); err == nil {
+			if status == jutzo.Success {
+				recordAudit(c, engine, jutzo.AuditUserRegistered, userInfo.GetUsername(), "")
+			}
 
 			// Check the status
 			switch status {
 			case jutzo.Success:
 				{
 					// Successfully inserted, create the email verification url
-					if uniqueID, _, err := engine.CreateUniqueValidationForUser(payload.User); err == nil {
+					if uniqueID, _, err := engine.CreateUniqueValidationForUser(userInfo.GetUsername()); err == nil {
 						c.String(http.StatusOK, createHATEOASURL(c, ValidationLinkTemplate, uniqueID))
 					} else {
 						c.String(http.StatusInternalServerError, "User inserted; error creating validation uuid")
@@ -192,7 +334,11 @@ func handleRegisterUser(c *gin.Context, engine jutzo.Engine) {
 					c.String(http.StatusConflict, "Email is already in use")
 				}
 			}
-		} else {
+		} else if err == jutzo.ErrRegistrationClosed || err == jutzo.ErrInviteRequired || err == jutzo.ErrEmailDomainNotAllowed {
+			c.String(http.StatusForbidden, err.Error())
+		} else if err == jutzo.ErrInvalidInvite || err == jutzo.ErrInvalidUsername {
+			c.String(http.StatusBadRequest, err.Error())
+		} else if !passwordRejected(c, err) {
 			c.String(http.StatusInternalServerError, err.Error())
 		}
 	}
@@ -204,23 +350,24 @@ func handleRegisterUser(c *gin.Context, engine jutzo.Engine) {
 // This routine should be in a route protected by the requireValidJWTToken middleware
 // in order to ensure that the user is logged in
 func handleResendValidateEmailLink(c *gin.Context, engine jutzo.Engine) {
-	if userSession, ok := getUserSessionFromContext(c); ok {
+	if userSession, ok := getInteractiveSession(c); ok {
 		if uniqueID, _, err := engine.CreateUniqueValidationForUser(userSession.GetUserInfo().GetUsername()); err == nil {
 			c.String(http.StatusOK, createHATEOASURL(c, ValidationLinkTemplate, uniqueID))
 		} else {
 			c.String(http.StatusInternalServerError, "Error getting validation uuid: %s", err.Error())
 		}
-	} else {
-		c.String(http.StatusInternalServerError, "Should have userSession context from JTX middleware")
 	}
 }
 
 // Process a request to validate an email
 func handleValidateEmail(c *gin.Context, engine jutzo.Engine) {
 	uniqueID := c.Param("key")
-	if err := engine.ValidateEmail(uniqueID); err == nil {
+	if user, err := engine.ValidateEmail(uniqueID); err == nil {
+		recordAudit(c, engine, jutzo.AuditEmailValidated, user, "")
 		// TODO change to redirect to
 		c.String(http.StatusOK, "OK")
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "Unknown validation")
 	} else {
 		c.String(http.StatusInternalServerError, "Error processing validation: %s", err.Error())
 	}
@@ -229,17 +376,104 @@ func handleValidateEmail(c *gin.Context, engine jutzo.Engine) {
 // Routine to log the user off, destroying the session token
 func handleLogoff(c *gin.Context, engine jutzo.Engine) {
 
-	// Attempt to logoff the user
-	if userSession, ok := getUserSessionFromContext(c); ok {
+	// Attempt to logoff the user. Only an interactive login has a session to
+	// end; a user who isn't authorized is refused, as are API keys and OAuth clients
+	if userSession, ok := getInteractiveSession(c); ok {
 		if err := engine.DestroyUserSession(userSession.GetId()); err == nil {
+			recordAudit(c, engine, jutzo.AuditLogoff, userSession.GetUserInfo().GetUsername(), "")
 			c.String(http.StatusOK, "OK")
 		} else {
 			c.String(http.StatusInternalServerError, "Error logging off")
 		}
+	}
+}
+
+// sessionSummary is the representation of a session returned
+// when a user's sessions are listed
+type sessionSummary struct {
+	ID           string    `json:"id"`
+	CreationTime time.Time `json:"creationTime"`
+	LastSeen     time.Time `json:"lastSeen"`
+	IP           string    `json:"ip"`
+	UserAgent    string    `json:"userAgent"`
+	Current      bool      `json:"current"`
+}
+
+// Routine to list the sessions of the logged-in user. Sessions are only
+// managed from an interactive login, never with an API key or by an OAuth client
+func handleListMySessions(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		listSessions(c, engine, userSession.GetUserInfo().GetUsername(), userSession.GetId())
+	}
+}
+
+// Routine to revoke one of the logged-in user's sessions
+func handleRevokeMySession(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		revokeSession(c, engine, userSession.GetUserInfo().GetUsername(), c.Param("id"))
+	}
+}
+
+// Routine to revoke all the logged-in user's sessions other than
+// the one making the request
+func handleRevokeMyOtherSessions(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		revokeAllSessions(c, engine, userSession.GetUserInfo().GetUsername(), userSession.GetId())
+	}
+}
+
+// List the sessions for the given user. The session with the ID
+// currentID (if any) is flagged as the current session
+func listSessions(c *gin.Context, engine jutzo.Engine, username string, currentID string) {
+	if sessions, err := engine.ListUserSessions(username); err == nil {
+		c.JSON(http.StatusOK, summarizeSessions(sessions, currentID))
 	} else {
-		// User isn't authorized, and wants to logoff. Is this an
-		// error or not? We decide it is
-		c.String(http.StatusUnauthorized, "Invalid session")
+		c.String(http.StatusInternalServerError, "Unable to list sessions: %s", err.Error())
+	}
+}
+
+// summarizeSessions for listing, flagging the session with the ID currentID
+func summarizeSessions(sessions []jutzo.UserSession, currentID string) []sessionSummary {
+	result := make([]sessionSummary, 0, len(sessions))
+	for _, session := range sessions {
+		client := session.GetClientInfo()
+		result = append(result, sessionSummary{
+			ID:           session.GetId(),
+			CreationTime: session.GetCreationTime(),
+			LastSeen:     session.GetLastSeen(),
+			IP:           client.IP,
+			UserAgent:    client.UserAgent,
+			Current:      session.GetId() == currentID,
+		})
+	}
+	return result
+}
+
+// Revoke a single session, making sure that it belongs to the given user
+func revokeSession(c *gin.Context, engine jutzo.Engine, username string, uniqueID string) {
+	if sessions, err := engine.ListUserSessions(username); err == nil {
+		for _, session := range sessions {
+			if session.GetId() == uniqueID {
+				if err = engine.DestroyUserSession(uniqueID); err == nil {
+					c.String(http.StatusOK, "OK")
+				} else {
+					c.String(http.StatusInternalServerError, "Unable to revoke session: %s", err.Error())
+				}
+				return
+			}
+		}
+		c.String(http.StatusNotFound, "Session not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to list sessions: %s", err.Error())
+	}
+}
+
+// Revoke all the sessions of the given user except for the one given
+func revokeAllSessions(c *gin.Context, engine jutzo.Engine, username string, except string) {
+	if err := engine.DestroyUserSessions(username, except); err == nil {
+		c.String(http.StatusOK, "OK")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to revoke sessions: %s", err.Error())
 	}
 }
 
@@ -258,15 +492,16 @@ func handleLogin(c *gin.Context, tokenEngine TokenEngine, engine jutzo.Engine) {
 	var payload validatePasswordPayload
 	if err := c.BindJSON(&payload); err == nil {
 
-		if userSession, err := engine.Login(payload.User, payload.Pass); err == nil {
+		if userSession, err := engine.Login(payload.User, payload.Pass, getClientInfo(c)); err == nil {
 
 			log.Printf("User password accepted, session id: %s", userSession.GetId())
-			user, id, duration := userSession.GetUserInfo().GetUsername(), userSession.GetId(), userSession.GetDuration()
-			if token, err := tokenEngine.Encode(user, id, duration); err == nil {
-				c.Header("Authorization", fmt.Sprintf("Bearer %s", token))
-				c.String(http.StatusOK, "OK")
-			}
+			recordLogin(c, engine, jutzo.AuditLoginSucceeded, payload.User, "password")
+			issueSessionTokens(c, tokenEngine, engine, userSession)
+		} else if throttled, isThrottled := err.(*jutzo.LoginThrottledError); isThrottled {
+			recordLogin(c, engine, jutzo.AuditLoginFailed, payload.User, "throttled")
+			respondThrottled(c, throttled)
 		} else {
+			recordLogin(c, engine, jutzo.AuditLoginFailed, payload.User, err.Error())
 			c.String(http.StatusUnauthorized, "Invalid username or password")
 		}
 
@@ -275,27 +510,95 @@ func handleLogin(c *gin.Context, tokenEngine TokenEngine, engine jutzo.Engine) {
 	}
 }
 
-func handleListUsers(c *gin.Context, engine jutzo.Engine) {
+// respondThrottled tells a client that is locked out when to come back
+func respondThrottled(c *gin.Context, throttled *jutzo.LoginThrottledError) {
+
+	// Retry-After is in whole seconds; round up so the client doesn't come back too early
+	retryAfter := int((throttled.RetryAfter + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.String(http.StatusTooManyRequests, "Too many failed login attempts")
+}
+
+// Routine to confirm a session with the user's password, after it has moved to
+// a different client. The session is bound to the new client from then on
+func handleConfirmSession(c *gin.Context, engine jutzo.Engine) {
+
+	type confirmSessionPayload struct {
+		Pass string `json:"pass" binding:"required"`
+	}
+
+	if userSession, ok := getInteractiveSession(c); ok {
+		var payload confirmSessionPayload
+		err := c.BindJSON(&payload)
+		if checkValidPayload(c, err) {
+			username := userSession.GetUserInfo().GetUsername()
+			if _, err = engine.ConfirmSession(userSession.GetId(), payload.Pass, getClientInfo(c)); err == nil {
+				recordAudit(c, engine, jutzo.AuditSessionConfirmed, username, "")
+				c.String(http.StatusOK, "OK")
+			} else if throttled, isThrottled := err.(*jutzo.LoginThrottledError); isThrottled {
+				respondThrottled(c, throttled)
+			} else if err == jutzo.ErrInvalidCredentials {
+				recordLogin(c, engine, jutzo.AuditLoginFailed, username, "session confirmation")
+				c.String(http.StatusUnauthorized, "Invalid password")
+			} else if err == jutzo.ErrNoLocalPassword || err == jutzo.ErrInvalidRefreshToken {
+				c.String(http.StatusUnauthorized, "Log in again to continue")
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to confirm session: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Routine to exchange a refresh token for a new access token and
+// a new refresh token. Refresh tokens are single use; presenting one
+// twice revokes the session it belongs to. Sessions delegated to an OAuth
+// client can only be refreshed through the token endpoint
+func handleRefresh(c *gin.Context, tokenEngine TokenEngine, engine jutzo.Engine) {
+
+	type refreshPayload struct {
+		RefreshToken string `json:"refreshToken" binding:"required"`
+	}
+
+	var payload refreshPayload
+	err := c.BindJSON(&payload)
+	if checkValidPayload(c, err) {
+
+		// Sessions delegated to an OAuth client are refreshed by the client, which
+		// has to authenticate to do so; make sure of that before using the token up
+		uniqueID, _, _ := strings.Cut(payload.RefreshToken, ".")
+		if userSession, err := engine.LoadUserSession(uniqueID); err == nil && userSession.GetClientInfo().ClientID != "" {
+			c.String(http.StatusUnauthorized, "Invalid or expired refresh token")
+			return
+		}
 
-	// Get the starting username (if provided)
-	startingUsername := c.DefaultQuery("from", "")
-	maxUsersString := c.DefaultQuery("count", "0")
-	if maxUsers, err := strconv.Atoi(maxUsersString); err == nil {
-		log.Printf("Query starting at %s for %d", startingUsername, maxUsers)
+		if userSession, err := engine.RefreshUserSession(payload.RefreshToken); err == nil {
 
-		if users, err := engine.ListUsers(startingUsername, maxUsers); err == nil {
-			if users == nil {
-				c.String(http.StatusNoContent, "")
+			// A session that needs confirming still gets an access token, to confirm it with
+			if err = engine.VerifySessionClient(userSession, getClientInfo(c)); err == jutzo.ErrSessionClientChanged {
+				recordAudit(c, engine, jutzo.AuditSessionClientChanged, userSession.GetUserInfo().GetUsername(), err.Error())
+				c.String(http.StatusUnauthorized, err.Error())
 			} else {
-				c.JSON(http.StatusOK, users)
+				issueSessionTokens(c, tokenEngine, engine, userSession)
 			}
+		} else if err == jutzo.ErrRefreshTokenReused {
+			log.Printf("Refresh token reuse detected, session revoked")
+			c.String(http.StatusUnauthorized, err.Error())
 		} else {
-			c.String(http.StatusInternalServerError, "Unable to list users: %s", err.Error())
+			c.String(http.StatusUnauthorized, "Invalid or expired refresh token")
 		}
-	} else {
-		c.String(http.StatusBadRequest, "Malformed count: %s", err.Error())
 	}
+}
 
+// Create a short-lived access token for the session and return it, along with
+// the session's current refresh token, in the response headers
+func issueSessionTokens(c *gin.Context, tokenEngine TokenEngine, engine jutzo.Engine, userSession jutzo.UserSession) {
+	if token, err := tokenEngine.Encode(userSession, engine.GetSessionTimeouts().AccessDuration); err == nil {
+		c.Header("Authorization", fmt.Sprintf("Bearer %s", token))
+		c.Header("X-Refresh-Token", userSession.GetRefreshToken())
+		c.String(http.StatusOK, "OK")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to create access token")
+	}
 }
 
 func runServer(engine jutzo.Engine, configuration Configuration) {
@@ -322,12 +625,17 @@ func runServer(engine jutzo.Engine, configuration Configuration) {
 			}
 		}()
 
+		// Purge the accounts whose deletion is due
+		done := make(chan struct{})
+		go purgeDeletions(engine, done)
+
 		// Wait for interrupt signal to gracefully shutdown the server with
 		// a timeout of 5 seconds.
-		quit := make(chan os.Signal)
+		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 		<-quit
 		log.Println("Shutdown Server ...")
+		close(done)
 
 		// The context is used to inform the server it has 5 seconds to finish
 		// the request it is currently handling
@@ -351,10 +659,13 @@ func main() {
 	// Create a configuration provider
 	configuration := Configuration{}
 
-	db := impl.NewPostgresConnection(configuration)
+	db, err := impl.NewDatabaseConnection(configuration)
+	if err != nil {
+		log.Fatal("Error configuring database: ", err)
+	}
 	if err := db.Connect(); err == nil {
 
-		if cache, err := impl.NewRedisCache(configuration); err == nil {
+		if cache, err := impl.NewUserSessionCache(configuration); err == nil {
 
 			// Initialize the jutzo engine
 			if engine, err := impl.NewJutzoEngine(configuration, db, cache); err == nil {
@@ -367,7 +678,7 @@ func main() {
 				log.Printf("Jutzo system could not be initialized: %s", err.Error())
 			}
 		} else {
-			log.Printf("Unable to create cache")
+			log.Printf("Unable to create cache: %s", err.Error())
 		}
 	} else {
 		log.Printf("Error connecting to database: %s", err.Error())
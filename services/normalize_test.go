@@ -0,0 +1,78 @@
+package main
+
+import (
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+)
+
+func TestUsernameAndEmailNormalization(t *testing.T) {
+
+	// Names that differ only in case or in how the characters are written are the same
+	sameUsernames := [][2]string{{"Bob", "bob"}, {"ＢＯＢ", "bob"}, {"Straße", "STRASSE"}, {"Zoë", "zoë"}, {" bob ", "bob"}}
+	for _, pair := range sameUsernames {
+		if impl.UsernameKey(pair[0]) != impl.UsernameKey(pair[1]) {
+			t.Errorf("Expected %q and %q to be the same user", pair[0], pair[1])
+		}
+	}
+	if impl.UsernameKey("bob") == impl.UsernameKey("bobby") {
+		t.Errorf("Different usernames share a key")
+	}
+	if impl.EmailKey("Bob@Example.com") != impl.EmailKey("bob@example.com") {
+		t.Errorf("Emails that differ in case have different keys")
+	}
+
+	// Usernames keep the case they were chosen with
+	if normalized := impl.NormalizeUsername(" ＢＯＢ"); normalized != "BOB" {
+		t.Errorf("Unexpected normalized username %q", normalized)
+	}
+
+	for _, username := range []string{"bob", "Zoë", "bob.smith", "bob_smith-2", "1bob", "日本"} {
+		if err := impl.ValidateUsername(impl.NormalizeUsername(username)); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", username, err)
+		}
+	}
+	for _, username := range []string{"", "bob smith", ".bob", "-bob", "bob@example.com", "bob/..", "bob​",
+		strings.Repeat("b", impl.MaxUsernameLength+1)} {
+		if err := impl.ValidateUsername(impl.NormalizeUsername(username)); err != jutzo.ErrInvalidUsername {
+			t.Errorf("Expected %q to be invalid, got %v", username, err)
+		}
+	}
+}
+
+func TestEveryNewUserIsNormalized(t *testing.T) {
+	engine := directoryTestEngine(t, "carol", "carol smith")
+	client := jutzo.ClientInfo{IP: "192.0.2.1"}
+
+	// Directory users are only registered if their name is a valid username
+	if _, err := engine.Login("carol", "directory-pass", client); err != nil {
+		t.Fatalf("Unable to log in as a directory user: %s", err.Error())
+	}
+	if _, err := engine.Login("carol smith", "directory-pass", client); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Expected an invalid directory username to be refused, got %v", err)
+	}
+	if user, _ := engine.GetUser("carol smith"); user != nil {
+		t.Errorf("Invalid username registered: %+v", user)
+	}
+
+	// Usernames made up for an identity provider's users follow the same rules
+	for preferred, expected := range map[string]string{
+		"-Ｄａｖｅ Smith!":           "DaveSmith",
+		"":                       "erin",
+		"..":                     "user",
+		strings.Repeat("é", 100): strings.Repeat("é", impl.MaxUsernameLength-4),
+	} {
+		email := strings.ToLower(expected) + "@example.com"
+		if preferred == "" {
+			email = "erin@example.com"
+		}
+		session, err := engine.LoginExternalIdentity(jutzo.ExternalIdentity{Provider: "idp", Subject: preferred + "-subject",
+			Email: email, EmailVerified: true, PreferredUsername: preferred}, client)
+		if err != nil {
+			t.Fatalf("Unable to log in with an external identity: %s", err.Error())
+		} else if session.GetUserInfo().GetUsername() != expected {
+			t.Errorf("Expected %q to become %q, got %q", preferred, expected, session.GetUserInfo().GetUsername())
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/exp/slices"
+	"log"
+	"net/http"
+	"net/url"
+	"services/jutzo"
+	"strings"
+	"time"
+)
+
+// How long a client has to exchange an authorization code for tokens
+const oauthCodeTimeout = time.Minute
+
+// The standard OpenID Connect scopes we support. Rights are granted
+// with scopes formed from jutzo.RightScopePrefix and the right
+var oauthStandardScopes = []string{"openid", "profile", "email"}
+
+// oauthServer is the authorization server that lets other applications
+// sign users in with their Jutzo accounts, using the authorization code
+// flow with PKCE. It is only enabled when JUTZO_OAUTH_ISSUER is set
+type oauthServer struct {
+	issuer      string
+	consentURL  string
+	engine      jutzo.Engine
+	tokenEngine TokenEngine
+}
+
+// oauthAuthorizationRequest holds the parameters of an authorization request,
+// received from the client as a query string and from the consent page as JSON
+type oauthAuthorizationRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+}
+
+// oauthCode is what we remember about an authorization code until the
+// client exchanges it. It is keyed by the code itself
+type oauthCode struct {
+	ClientID         string   `json:"clientId"`
+	RedirectURI      string   `json:"redirectURI"`
+	RedirectURIGiven bool     `json:"redirectURIGiven"`
+	Username         string   `json:"username"`
+	Scope            []string `json:"scope"`
+	Nonce            string   `json:"nonce"`
+	CodeChallenge    string   `json:"codeChallenge"`
+}
+
+// oauthError is an error response as defined by RFC 6749
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// loadOAuthServer creates the authorization server from the configuration,
+// returning nil if it isn't enabled
+func loadOAuthServer(configuration jutzo.ConfigurationProvider, engine jutzo.Engine, tokenEngine TokenEngine) (*oauthServer, error) {
+	issuer, isPresent := configuration.GetConfigurationString("JUTZO_OAUTH_ISSUER")
+	if !isPresent || issuer == "" {
+		return nil, nil
+	}
+	server := &oauthServer{issuer: strings.TrimSuffix(issuer, "/"), engine: engine, tokenEngine: tokenEngine}
+	if server.consentURL, isPresent = configuration.GetConfigurationString("JUTZO_OAUTH_CONSENT_URL"); !isPresent {
+		return nil, errors.New("JUTZO_OAUTH_CONSENT_URL is required when JUTZO_OAUTH_ISSUER is set")
+	}
+	if tokenEngine.GetSigningAlgorithm() == "" {
+		return nil, errors.New("the OAuth server requires JUTZO_JWT_SIGNING_KEY_FILE to sign ID tokens")
+	}
+	return server, nil
+}
+
+// Routine to publish the OpenID Connect discovery document
+func (server *oauthServer) handleDiscovery(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                server.issuer,
+		"authorization_endpoint":                server.issuer + "/oauth/authorize",
+		"token_endpoint":                        server.issuer + "/oauth/token",
+		"userinfo_endpoint":                     server.issuer + "/oauth/userinfo",
+		"jwks_uri":                              server.issuer + "/.well-known/jwks.json",
+		"scopes_supported":                      oauthStandardScopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{server.tokenEngine.GetSigningAlgorithm()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "preferred_username", "email", "email_verified", "jutzo_rights"},
+	})
+}
+
+// validateAuthorizationRequest checks the client, redirect URI and PKCE challenge of
+// an authorization request. Errors with the client or redirect URI can't be sent back
+// to the client (we can't trust the redirect URI), so redirectable is false for them
+func (server *oauthServer) validateAuthorizationRequest(request *oauthAuthorizationRequest) (client jutzo.OAuthClient, oauthErr *oauthError, redirectable bool) {
+	client, err := server.engine.GetOAuthClient(request.ClientID)
+	if err != nil {
+		return nil, &oauthError{"invalid_client", "Unknown client"}, false
+	}
+
+	// The redirect URI can be left out if the client only has the one
+	if request.RedirectURI == "" && len(client.GetRedirectURIs()) == 1 {
+		request.RedirectURI = client.GetRedirectURIs()[0]
+	}
+	if !server.engine.ValidateOAuthRedirectURI(client, request.RedirectURI) {
+		return nil, &oauthError{"invalid_request", "Redirect URI is not registered for the client"}, false
+	}
+
+	// Only the code flow is supported, and PKCE is required of all clients
+	if request.ResponseType != "code" {
+		return client, &oauthError{"unsupported_response_type", "Only the code response type is supported"}, true
+	} else if request.CodeChallenge == "" || request.CodeChallengeMethod != "S256" {
+		return client, &oauthError{"invalid_request", "A PKCE code challenge using S256 is required"}, true
+	}
+	return client, nil, true
+}
+
+// Routine to start an authorization. After checking the request the user is
+// sent to the consent page, which (once the user has logged in and agreed)
+// completes the authorization with handleGrant
+func (server *oauthServer) handleAuthorize(c *gin.Context) {
+	var request oauthAuthorizationRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.String(http.StatusBadRequest, "Malformed request: %s", err.Error())
+		return
+	}
+
+	if client, oauthErr, redirectable := server.validateAuthorizationRequest(&request); oauthErr == nil {
+		// The redirect URI is passed on as the client gave it, so that the code
+		// is only bound to it if the client asked for it
+		consent := c.Request.URL.Query()
+		consent.Set("client_name", client.GetName())
+		c.Redirect(http.StatusFound, server.consentURL+"?"+consent.Encode())
+	} else if redirectable {
+		c.Redirect(http.StatusFound, authorizationResponseURL(request.RedirectURI,
+			url.Values{"error": {oauthErr.Code}, "error_description": {oauthErr.Description}, "state": {request.State}}))
+	} else {
+		c.String(http.StatusBadRequest, oauthErr.Description)
+	}
+}
+
+// Routine called by the consent page, on behalf of the logged-in user, to
+// grant (or deny) the client's authorization request. The response holds the
+// URL the browser should be sent back to the client with
+//
+// Only the user themselves can grant access: API keys and sessions that were
+// themselves delegated to a client can't be used
+func (server *oauthServer) handleGrant(c *gin.Context) {
+
+	// grantPayload is the authorization request along with the user's decision
+	type grantPayload struct {
+		oauthAuthorizationRequest
+		Approved bool `json:"approved"`
+	}
+
+	userSession, ok := getInteractiveSession(c)
+	if !ok {
+		return
+	}
+	var payload grantPayload
+	err := c.BindJSON(&payload)
+	if !checkValidPayload(c, err) {
+		return
+	}
+
+	request := &payload.oauthAuthorizationRequest
+	redirectURIGiven := request.RedirectURI != ""
+	_, oauthErr, redirectable := server.validateAuthorizationRequest(request)
+	if oauthErr != nil && !redirectable {
+		c.String(http.StatusBadRequest, oauthErr.Description)
+		return
+	} else if oauthErr == nil && !payload.Approved {
+		oauthErr = &oauthError{"access_denied", "The user denied the request"}
+	}
+	if oauthErr != nil {
+		c.JSON(http.StatusOK, gin.H{"redirect": authorizationResponseURL(request.RedirectURI,
+			url.Values{"error": {oauthErr.Code}, "error_description": {oauthErr.Description}, "state": {request.State}})})
+		return
+	}
+
+	// The client only gets the scopes we know about, and only the rights the user holds
+	userInfo := userSession.GetUserInfo()
+	var scope []string
+	for _, requested := range strings.Fields(request.Scope) {
+		if strings.HasPrefix(requested, jutzo.RightScopePrefix) {
+			if userInfo.HasRights([]string{strings.TrimPrefix(requested, jutzo.RightScopePrefix)}) {
+				scope = append(scope, requested)
+			}
+		} else if slices.Contains(oauthStandardScopes, requested) {
+			scope = append(scope, requested)
+		}
+	}
+
+	// Remember the authorization until the client exchanges the code
+	code, err := randomString()
+	if err == nil {
+		stored, _ := json.Marshal(oauthCode{ClientID: request.ClientID, RedirectURI: request.RedirectURI,
+			RedirectURIGiven: redirectURIGiven, Username: userInfo.GetUsername(), Scope: scope, Nonce: request.Nonce,
+			CodeChallenge: request.CodeChallenge})
+		err = server.engine.StoreTransient("oauth-code:"+code, stored, oauthCodeTimeout)
+	}
+	if err == nil {
+		log.Printf("User %s authorized client %s for %v", userInfo.GetUsername(), request.ClientID, scope)
+		c.JSON(http.StatusOK, gin.H{"redirect": authorizationResponseURL(request.RedirectURI,
+			url.Values{"code": {code}, "state": {request.State}})})
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to create authorization code")
+	}
+}
+
+// Routine for clients to exchange an authorization code or refresh token for tokens
+func (server *oauthServer) handleToken(c *gin.Context) {
+
+	// Token responses must never be cached
+	c.Header("Cache-Control", "no-store")
+
+	// Clients authenticate with HTTP basic authentication or form parameters
+	clientID, secret, hasBasic := c.Request.BasicAuth()
+	if hasBasic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	client, err := server.engine.AuthenticateOAuthClient(clientID, secret)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, oauthError{"invalid_client", "Client authentication failed"})
+		return
+	}
+
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		server.exchangeCode(c, client)
+	case "refresh_token":
+		server.exchangeRefreshToken(c, client)
+	default:
+		c.JSON(http.StatusBadRequest, oauthError{"unsupported_grant_type", ""})
+	}
+}
+
+// exchangeCode completes the authorization code flow, creating a session
+// delegated to the client
+func (server *oauthServer) exchangeCode(c *gin.Context, client jutzo.OAuthClient) {
+
+	// The code can only be used once, by the client it was issued to. The redirect
+	// URI has to be the same as in the authorization request, if it was given there
+	// (RFC 6749 section 4.1.3)
+	var authorization oauthCode
+	redirectURI, redirectURIGiven := c.GetPostForm("redirect_uri")
+	if stored, err := server.engine.TakeTransient("oauth-code:" + c.PostForm("code")); err != nil {
+		c.JSON(http.StatusInternalServerError, oauthError{"server_error", ""})
+		return
+	} else if stored == nil || json.Unmarshal(stored, &authorization) != nil || authorization.ClientID != client.GetClientId() ||
+		((authorization.RedirectURIGiven || redirectURIGiven) && authorization.RedirectURI != redirectURI) {
+		c.JSON(http.StatusBadRequest, oauthError{"invalid_grant", "Unknown or expired authorization code"})
+		return
+	}
+
+	// The client has to prove it started the authorization
+	verifier := sha256.Sum256([]byte(c.PostForm("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(verifier[:])), []byte(authorization.CodeChallenge)) != 1 {
+		c.JSON(http.StatusBadRequest, oauthError{"invalid_grant", "PKCE verification failed"})
+		return
+	}
+
+	clientInfo := getClientInfo(c)
+	clientInfo.ClientID = client.GetClientId()
+	clientInfo.Scope = authorization.Scope
+	if userSession, err := server.engine.CreateDelegatedSession(authorization.Username, clientInfo); err == nil {
+		server.issueTokens(c, userSession, authorization.Nonce)
+	} else {
+		c.JSON(http.StatusBadRequest, oauthError{"invalid_grant", "User can no longer log in"})
+	}
+}
+
+// exchangeRefreshToken rotates the refresh token of a session delegated to the client
+func (server *oauthServer) exchangeRefreshToken(c *gin.Context, client jutzo.OAuthClient) {
+	refreshToken := c.PostForm("refresh_token")
+
+	// Make sure the session belongs to the client before using the token up
+	uniqueID, _, _ := strings.Cut(refreshToken, ".")
+	if userSession, err := server.engine.LoadUserSession(uniqueID); err != nil ||
+		userSession.GetClientInfo().ClientID != client.GetClientId() {
+		c.JSON(http.StatusBadRequest, oauthError{"invalid_grant", "Invalid or expired refresh token"})
+		return
+	}
+
+	if userSession, err := server.engine.RefreshUserSession(refreshToken); err == nil {
+		server.issueTokens(c, userSession, "")
+	} else {
+		c.JSON(http.StatusBadRequest, oauthError{"invalid_grant", "Invalid or expired refresh token"})
+	}
+}
+
+// issueTokens returns an access token and refresh token for the delegated
+// session, along with an ID token when the openid scope was granted
+func (server *oauthServer) issueTokens(c *gin.Context, userSession jutzo.UserSession, nonce string) {
+	accessDuration := server.engine.GetSessionTimeouts().AccessDuration
+	accessToken, err := server.tokenEngine.Encode(userSession, accessDuration)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, oauthError{"server_error", ""})
+		return
+	}
+
+	client := userSession.GetClientInfo()
+	response := gin.H{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(accessDuration.Seconds()),
+		"refresh_token": userSession.GetRefreshToken(),
+		"scope":         strings.Join(client.Scope, " "),
+	}
+
+	if slices.Contains(client.Scope, "openid") {
+		now := time.Now()
+		claims := userClaims(userSession)
+		claims["iss"] = server.issuer
+		claims["aud"] = client.ClientID
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(accessDuration).Unix()
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		if response["id_token"], err = server.tokenEngine.Sign(claims); err != nil {
+			c.JSON(http.StatusInternalServerError, oauthError{"server_error", ""})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Routine to return the claims about the user the access token was issued for
+func (server *oauthServer) handleUserInfo(c *gin.Context) {
+	if userSession, ok := getUserSessionFromContext(c); ok {
+		c.JSON(http.StatusOK, userClaims(userSession))
+	} else {
+		c.String(http.StatusUnauthorized, "Invalid session")
+	}
+}
+
+// userClaims are the claims about the user that the session's scope allows
+// the client to see. Sessions that weren't delegated to a client see them all;
+// a client only sees the rights it was granted as jutzo:{right} scopes
+func userClaims(userSession jutzo.UserSession) jwt.MapClaims {
+	userInfo := userSession.GetUserInfo()
+	client := userSession.GetClientInfo()
+	allowed := func(scope string) bool { return client.ClientID == "" || slices.Contains(client.Scope, scope) }
+
+	claims := jwt.MapClaims{"sub": userInfo.GetUsername()}
+	if allowed("profile") {
+		claims["preferred_username"] = userInfo.GetUsername()
+		profile := userInfo.GetProfile()
+		for claim, value := range map[string]string{"name": profile.DisplayName, "picture": profile.AvatarURL,
+			"zoneinfo": profile.Timezone, "locale": profile.Locale} {
+			if value != "" {
+				claims[claim] = value
+			}
+		}
+	}
+	if allowed("email") {
+		claims["email"] = userInfo.GetEmail()
+		claims["email_verified"] = userInfo.IsEmailValidated()
+	}
+	var rights []string
+	for _, right := range userInfo.GetAllRights() {
+		if allowed(jutzo.RightScopePrefix + right) {
+			rights = append(rights, right)
+		}
+	}
+	if len(rights) > 0 {
+		claims["jutzo_rights"] = rights
+	}
+	return claims
+}
+
+// authorizationResponseURL adds the response parameters to the client's
+// redirect URI, keeping any query parameters it already has
+func authorizationResponseURL(redirectURI string, parameters url.Values) string {
+	parsed, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := parsed.Query()
+	for name, values := range parameters {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// Routine for an administrator to register a client application. The
+// client secret (for confidential clients) is only returned here
+func handleRegisterOAuthClient(c *gin.Context, engine jutzo.Engine) {
+
+	// registerClientPayload describes the application being registered
+	type registerClientPayload struct {
+		Name         string   `json:"name" binding:"required"`
+		RedirectURIs []string `json:"redirectURIs" binding:"required"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	var payload registerClientPayload
+	err := c.BindJSON(&payload)
+	if checkValidPayload(c, err) {
+		if secret, client, err := engine.RegisterOAuthClient(payload.Name, payload.RedirectURIs, payload.Confidential); err == nil {
+			c.JSON(http.StatusOK, gin.H{"clientSecret": secret, "client": client})
+		} else {
+			c.String(http.StatusBadRequest, "Unable to register client: %s", err.Error())
+		}
+	}
+}
+
+// Routine for an administrator to list the registered client applications
+func handleListOAuthClients(c *gin.Context, engine jutzo.Engine) {
+	if clients, err := engine.ListOAuthClients(); err == nil {
+		if clients == nil {
+			clients = []jutzo.OAuthClient{}
+		}
+		c.JSON(http.StatusOK, clients)
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to list clients: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to remove a client application
+func handleDeleteOAuthClient(c *gin.Context, engine jutzo.Engine) {
+	if err := engine.DeleteOAuthClient(c.Param("clientId")); err == nil {
+		c.String(http.StatusOK, "OK")
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "Client not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to delete client: %s", err.Error())
+	}
+}
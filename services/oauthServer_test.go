@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oauthTestEngine provides just enough of the engine to run the
+// authorization server against: one client and in-memory sessions
+type oauthTestEngine struct {
+	jutzo.Engine
+	client     *impl.OAuthClientImpl
+	secret     string
+	sessions   map[string]*impl.UserSessionImpl
+	transients map[string][]byte
+}
+
+func (engine *oauthTestEngine) GetOAuthClient(clientID string) (jutzo.OAuthClient, error) {
+	if clientID != engine.client.ClientID {
+		return nil, jutzo.ErrInvalidOAuthClient
+	}
+	return engine.client, nil
+}
+
+func (engine *oauthTestEngine) AuthenticateOAuthClient(clientID string, secret string) (jutzo.OAuthClient, error) {
+	if clientID != engine.client.ClientID || secret != engine.secret {
+		return nil, jutzo.ErrInvalidOAuthClient
+	}
+	return engine.client, nil
+}
+
+func (engine *oauthTestEngine) ValidateOAuthRedirectURI(client jutzo.OAuthClient, redirectURI string) bool {
+	return slices.Contains(client.GetRedirectURIs(), redirectURI)
+}
+
+func (engine *oauthTestEngine) StoreTransient(key string, value []byte, _ time.Duration) error {
+	engine.transients[key] = value
+	return nil
+}
+
+func (engine *oauthTestEngine) TakeTransient(key string) ([]byte, error) {
+	value := engine.transients[key]
+	delete(engine.transients, key)
+	return value, nil
+}
+
+func (engine *oauthTestEngine) CreateDelegatedSession(user string, client jutzo.ClientInfo) (jutzo.UserSession, error) {
+	userSession := testSession("delegated").(*impl.UserSessionImpl)
+	userSession.Client = client
+	userSession.RefreshToken = "delegated.refresh"
+	engine.sessions[userSession.ID] = userSession
+	return userSession, nil
+}
+
+func (engine *oauthTestEngine) LoadUserSession(uniqueID string) (jutzo.UserSession, error) {
+	if userSession, found := engine.sessions[uniqueID]; found {
+		return userSession, nil
+	}
+	return nil, jutzo.ErrInvalidRefreshToken
+}
+
+func (engine *oauthTestEngine) VerifySessionClient(jutzo.UserSession, jutzo.ClientInfo) error {
+	return nil
+}
+
+func (engine *oauthTestEngine) GetSessionTimeouts() jutzo.SessionTimeouts {
+	return jutzo.SessionTimeouts{AccessDuration: time.Minute}
+}
+
+// oauthTestRouter sets up the authorization server routes as setupRouter does,
+// with bob logged in to the "interactive" session
+func oauthTestRouter(t *testing.T) (*gin.Engine, *oauthTestEngine, TokenEngine) {
+	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{
+		"JUTZO_JWT_SIGNING_KEY_FILE": writeKeyFile(t, "signing.pem", privateKey)}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+
+	engine := &oauthTestEngine{
+		client: &impl.OAuthClientImpl{ClientID: "wiki", Name: "Architecture Wiki",
+			RedirectURIs: []string{"https://wiki.example.com/callback"}, Confidential: true},
+		secret:     "wiki-secret",
+		sessions:   map[string]*impl.UserSessionImpl{"interactive": testSession("interactive").(*impl.UserSessionImpl)},
+		transients: map[string][]byte{},
+	}
+	server, err := loadOAuthServer(TestConfig{map[string]string{
+		"JUTZO_OAUTH_ISSUER":      "https://jutzo.example.com",
+		"JUTZO_OAUTH_CONSENT_URL": "https://jutzo.example.com/consent",
+	}}, engine, tokenEngine)
+	if err != nil || server == nil {
+		t.Fatalf("Unable to create OAuth server: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/oauth/authorize", server.handleAuthorize)
+	router.POST("/oauth/token", server.handleToken)
+	router.GET("/oauth/userinfo", requireValidJWTToken(engine, tokenEngine), server.handleUserInfo)
+	router.POST("/v1/oauth/authorize", requireValidJWTToken(engine, tokenEngine), server.handleGrant)
+	return router, engine, tokenEngine
+}
+
+// bearer creates an access token header for the session
+func bearer(t *testing.T, tokenEngine TokenEngine, userSession jutzo.UserSession) string {
+	token, err := tokenEngine.Encode(userSession, time.Minute)
+	if err != nil {
+		t.Fatalf("Unable to encode token: %s", err.Error())
+	}
+	return "Bearer " + token
+}
+
+// grant has bob approve an authorization request for the scope given (and
+// the redirect URI, if any), returning the URL the browser is sent back to the client with
+func grant(t *testing.T, router *gin.Engine, authorization string, scope string, challenge string, redirectURI string) (int, *url.URL) {
+	request := map[string]any{
+		"response_type": "code", "client_id": "wiki", "scope": scope, "state": "xyz", "nonce": "n-0S6",
+		"code_challenge": challenge, "code_challenge_method": "S256", "approved": true,
+	}
+	if redirectURI != "" {
+		request["redirect_uri"] = redirectURI
+	}
+	body, _ := json.Marshal(request)
+	post := httptest.NewRequest(http.MethodPost, "/v1/oauth/authorize", strings.NewReader(string(body)))
+	post.Header.Set("Authorization", authorization)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, post)
+
+	var response struct {
+		Redirect string `json:"redirect"`
+	}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+	redirect, _ := url.Parse(response.Redirect)
+	return recorder.Code, redirect
+}
+
+// exchange posts a code to the token endpoint as the wiki, with the redirect URI if any
+func exchange(router *gin.Engine, code string, verifier string, redirectURI string) *httptest.ResponseRecorder {
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {verifier}}
+	if redirectURI != "" {
+		form.Set("redirect_uri", redirectURI)
+	}
+	request := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("wiki", "wiki-secret")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestOAuthAuthorizationRequest(t *testing.T) {
+	router, _, _ := oauthTestRouter(t)
+	authorize := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+query, nil))
+		return recorder
+	}
+
+	// A good request goes on to the consent page
+	recorder := authorize("response_type=code&client_id=wiki&scope=openid&code_challenge=abc&code_challenge_method=S256")
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusFound ||
+		!strings.HasPrefix(location, "https://jutzo.example.com/consent?") || !strings.Contains(location, "client_name=Architecture+Wiki") {
+		t.Errorf("Expected redirect to consent, got %d %s", recorder.Code, location)
+	}
+
+	// Unknown clients and redirect URIs are never redirected to
+	if recorder = authorize("response_type=code&client_id=other&code_challenge=abc&code_challenge_method=S256"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Unknown client was accepted: %d", recorder.Code)
+	}
+	if recorder = authorize("response_type=code&client_id=wiki&redirect_uri=https://evil.example.com/&code_challenge=abc&code_challenge_method=S256"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Unregistered redirect URI was accepted: %d", recorder.Code)
+	}
+
+	// Other errors are reported back to the client
+	recorder = authorize("response_type=code&client_id=wiki&state=xyz")
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusFound ||
+		!strings.HasPrefix(location, "https://wiki.example.com/callback?") || !strings.Contains(location, "error=invalid_request") {
+		t.Errorf("Expected PKCE error redirect, got %d %s", recorder.Code, location)
+	}
+}
+
+func TestOAuthCodeFlow(t *testing.T) {
+	router, engine, tokenEngine := oauthTestRouter(t)
+	verifier := "the-code-verifier-which-is-long-enough-to-be-valid"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// Bob holds the blog right but not admin, so the admin scope isn't granted
+	status, redirect := grant(t, router, bearer(t, tokenEngine, engine.sessions["interactive"]),
+		"openid email jutzo:blog jutzo:admin", challenge, "")
+	code := redirect.Query().Get("code")
+	if status != http.StatusOK || code == "" || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("Grant failed: %d %v", status, redirect)
+	}
+
+	// The wrong verifier is refused, and uses up the code
+	if recorder := exchange(router, code, "another-verifier", ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Exchange succeeded with the wrong verifier")
+	}
+	_, redirect = grant(t, router, bearer(t, tokenEngine, engine.sessions["interactive"]),
+		"openid email jutzo:blog jutzo:admin", challenge, "")
+	code = redirect.Query().Get("code")
+
+	recorder := exchange(router, code, verifier, "")
+	var tokens struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		Scope        string `json:"scope"`
+	}
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &tokens) != nil {
+		t.Fatalf("Exchange failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if tokens.Scope != "openid email jutzo:blog" || tokens.RefreshToken != "delegated.refresh" {
+		t.Errorf("Unexpected token response: %s", recorder.Body.String())
+	}
+	if client := engine.sessions["delegated"].GetClientInfo(); client.ClientID != "wiki" {
+		t.Errorf("Session was not delegated to the client: %v", client)
+	}
+
+	// The ID token is for the client, signed with a key from our JWKS
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		key, _ := tokenEngine.GetJWKS().Keys[0].toSigningKey()
+		return key.publicKey, nil
+	}); err != nil {
+		t.Errorf("Invalid ID token: %s", err.Error())
+	} else if claims["aud"] != "wiki" || claims["nonce"] != "n-0S6" || claims["sub"] != "bob" ||
+		claims["email"] != "bob@hablutzel.com" || claims["iss"] != "https://jutzo.example.com" {
+		t.Errorf("Unexpected ID token claims: %v", claims)
+	}
+
+	// Codes can only be used once
+	if recorder = exchange(router, code, verifier, ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Code was accepted twice")
+	}
+
+	// The access token gets the user info allowed by the scope, with only the
+	// rights granted to the client
+	request := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	var userInfo map[string]any
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &userInfo) != nil {
+		t.Errorf("User info failed: %d", recorder.Code)
+	} else if _, hasUsername := userInfo["preferred_username"]; hasUsername || userInfo["email"] != "bob@hablutzel.com" ||
+		fmt.Sprint(userInfo["jutzo_rights"]) != "[blog]" {
+		t.Errorf("Unexpected user info: %v", userInfo)
+	}
+
+	// A client can't use its session to authorize other clients
+	if status, _ = grant(t, router, "Bearer "+tokens.AccessToken, "openid", challenge, ""); status != http.StatusForbidden {
+		t.Errorf("Delegated session was able to grant access: %d", status)
+	}
+}
+
+func TestOAuthRedirectURIBinding(t *testing.T) {
+	router, engine, tokenEngine := oauthTestRouter(t)
+	verifier := "the-code-verifier-which-is-long-enough-to-be-valid"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	callback := "https://wiki.example.com/callback"
+	code := func(redirectURI string) string {
+		_, redirect := grant(t, router, bearer(t, tokenEngine, engine.sessions["interactive"]), "openid", challenge, redirectURI)
+		return redirect.Query().Get("code")
+	}
+
+	// A redirect URI left out of the authorization request can be left out of the token request too
+	if recorder := exchange(router, code(""), verifier, ""); recorder.Code != http.StatusOK {
+		t.Errorf("Exchange without a redirect URI failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := exchange(router, code(""), verifier, callback); recorder.Code != http.StatusOK {
+		t.Errorf("Exchange with the default redirect URI failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Once given, it has to be given again, and be the same
+	if recorder := exchange(router, code(callback), verifier, ""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Exchange without the redirect URI given was accepted: %d", recorder.Code)
+	}
+	if recorder := exchange(router, code(callback), verifier, "https://wiki.example.com/other"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Exchange with another redirect URI was accepted: %d", recorder.Code)
+	}
+	if recorder := exchange(router, code(callback), verifier, callback); recorder.Code != http.StatusOK {
+		t.Errorf("Exchange with the redirect URI given failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestOAuthUserInfoOnlyHasGrantedRights(t *testing.T) {
+	router, engine, tokenEngine := oauthTestRouter(t)
+	verifier := "the-code-verifier-which-is-long-enough-to-be-valid"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	// A client that wasn't granted any rights doesn't learn which ones bob holds
+	_, redirect := grant(t, router, bearer(t, tokenEngine, engine.sessions["interactive"]), "openid", challenge, "")
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if recorder := exchange(router, redirect.Query().Get("code"), verifier, ""); recorder.Code != http.StatusOK ||
+		json.Unmarshal(recorder.Body.Bytes(), &tokens) != nil {
+		t.Fatalf("Exchange failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	request := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+	request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	var userInfo map[string]any
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &userInfo) != nil {
+		t.Errorf("User info failed: %d", recorder.Code)
+	} else if _, hasRights := userInfo["jutzo_rights"]; hasRights || userInfo["sub"] != "bob" {
+		t.Errorf("Unexpected user info: %v", userInfo)
+	}
+}
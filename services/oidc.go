@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/exp/slices"
+	"log"
+	"net/http"
+	"net/url"
+	"services/jutzo"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a user has to complete a login at the identity provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcStateCookie ties a login to the browser that started it. It holds a
+// hash of the state, which the callback has to match
+const oidcStateCookie = "jutzo_oidc_state"
+
+// oidcKeyRefreshInterval is the least time between fetches of a provider's
+// keys, so that tokens naming unknown keys can't make us fetch them constantly
+const oidcKeyRefreshInterval = time.Minute
+
+// oidcDiscovery holds the parts of the provider's discovery
+// document (/.well-known/openid-configuration) that we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLoginState is what we remember about a login while the user
+// is away at the identity provider. It is keyed by the state parameter
+type oidcLoginState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"codeVerifier"`
+	Nonce        string `json:"nonce"`
+}
+
+// oidcIDTokenClaims are the claims we use from the provider's ID token
+type oidcIDTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp,omitempty"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	NotBefore         int64        `json:"nbf,omitempty"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     oidcBool     `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// Valid if the ID token has an expiry and issue time, and is within its validity period
+func (claims *oidcIDTokenClaims) Valid() error {
+	now := time.Now().Unix()
+	if claims.ExpiresAt == 0 || claims.IssuedAt == 0 {
+		return errors.New("ID token has no expiry or issue time")
+	} else if now > claims.ExpiresAt {
+		return ErrTokenExpired
+	} else if now < claims.NotBefore {
+		return ErrTokenNotYetValid
+	}
+	return nil
+}
+
+// oidcAudience is the audience of an ID token, which providers send
+// either as a single string or as an array of them
+type oidcAudience []string
+
+// UnmarshalJSON accepts either form of audience
+func (audience *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*audience = oidcAudience{single}
+		return nil
+	}
+	var several []string
+	if err := json.Unmarshal(data, &several); err != nil {
+		return errors.New("ID token audience is neither a string nor an array of strings")
+	}
+	*audience = several
+	return nil
+}
+
+// oidcBool is a boolean claim, which some providers send as the string "true" or "false"
+type oidcBool bool
+
+// UnmarshalJSON accepts either a boolean or a string holding one
+func (value *oidcBool) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		parsed, err := strconv.ParseBool(text)
+		*value = oidcBool(parsed)
+		return err
+	}
+	var parsed bool
+	err := json.Unmarshal(data, &parsed)
+	*value = oidcBool(parsed)
+	return err
+}
+
+// oidcProvider is an OpenID Connect identity provider that users can
+// log in with. We act as a relying party using the authorization code
+// flow with PKCE
+type oidcProvider struct {
+	name         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	httpClient   *http.Client
+
+	// The discovery document and signing keys are fetched on first use;
+	// the keys are fetched again if a token names a key we don't know,
+	// at most once every oidcKeyRefreshInterval
+	lock        sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*signingKey
+	keysFetched time.Time
+}
+
+// loadOIDCProviders reads the identity provider configuration. JUTZO_OIDC_PROVIDERS
+// lists the provider names, and each provider is then configured with variables
+// named after it, e.g. JUTZO_OIDC_GOOGLE_ISSUER for the provider "google"
+func loadOIDCProviders(configuration jutzo.ConfigurationProvider) (map[string]*oidcProvider, error) {
+	providers := make(map[string]*oidcProvider)
+	if names, isPresent := configuration.GetConfigurationString("JUTZO_OIDC_PROVIDERS"); isPresent {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				prefix := fmt.Sprintf("JUTZO_OIDC_%s_", strings.ToUpper(name))
+				provider := &oidcProvider{name: name, httpClient: &http.Client{Timeout: 10 * time.Second}}
+
+				// The issuer, client ID and redirect URL are required
+				var issuerPresent, clientPresent, redirectPresent bool
+				provider.issuer, issuerPresent = configuration.GetConfigurationString(prefix + "ISSUER")
+				provider.clientID, clientPresent = configuration.GetConfigurationString(prefix + "CLIENT_ID")
+				provider.redirectURL, redirectPresent = configuration.GetConfigurationString(prefix + "REDIRECT_URL")
+				if !issuerPresent || !clientPresent || !redirectPresent {
+					return nil, fmt.Errorf("identity provider %s requires %sISSUER, %sCLIENT_ID and %sREDIRECT_URL",
+						name, prefix, prefix, prefix)
+				}
+				provider.issuer = strings.TrimSuffix(provider.issuer, "/")
+
+				// The client secret is optional (public clients rely on PKCE alone)
+				provider.clientSecret, _ = configuration.GetConfigurationString(prefix + "CLIENT_SECRET")
+				if scopes, isPresent := configuration.GetConfigurationString(prefix + "SCOPES"); isPresent {
+					provider.scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+				} else {
+					provider.scopes = []string{"openid", "email", "profile"}
+				}
+				providers[name] = provider
+			}
+		}
+	}
+	return providers, nil
+}
+
+// getDiscovery returns the provider's discovery document, fetching it the first time
+func (provider *oidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if provider.discovery == nil {
+		discovery := new(oidcDiscovery)
+		if err := provider.getJSON(provider.issuer+"/.well-known/openid-configuration", discovery); err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != provider.issuer {
+			return nil, fmt.Errorf("identity provider %s reports issuer %s", provider.name, discovery.Issuer)
+		}
+		provider.discovery = discovery
+	}
+	return provider.discovery, nil
+}
+
+// getKey returns the provider's signing key with the given ID. The key set
+// is fetched again when we don't recognize the key, as providers rotate keys,
+// unless it was fetched within the last oidcKeyRefreshInterval
+func (provider *oidcProvider) getKey(keyID string) (*signingKey, error) {
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	provider.lock.Lock()
+	defer provider.lock.Unlock()
+	if key, found := provider.keys[keyID]; found {
+		return key, nil
+	} else if time.Since(provider.keysFetched) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("identity provider %s has no key %s", provider.name, keyID)
+	}
+
+	provider.keysFetched = time.Now()
+	var keySet JSONWebKeySet
+	if err = provider.getJSON(discovery.JWKSURI, &keySet); err != nil {
+		return nil, err
+	}
+	provider.keys = make(map[string]*signingKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use == "" || jwk.Use == "sig" {
+			if key, err := jwk.toSigningKey(); err == nil {
+				provider.keys[key.id] = key
+			} else {
+				log.Printf("Ignoring key %s from identity provider %s: %s", jwk.KeyID, provider.name, err.Error())
+			}
+		}
+	}
+	if key, found := provider.keys[keyID]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("identity provider %s has no key %s", provider.name, keyID)
+}
+
+// authorizationURL builds the URL we send the user to in order to log
+// in at the provider, using the S256 PKCE code challenge
+func (provider *oidcProvider) authorizationURL(state string, nonce string, codeVerifier string) (string, error) {
+	if discovery, err := provider.getDiscovery(); err == nil {
+		challenge := sha256.Sum256([]byte(codeVerifier))
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {provider.clientID},
+			"redirect_uri":          {provider.redirectURL},
+			"scope":                 {strings.Join(provider.scopes, " ")},
+			"state":                 {state},
+			"nonce":                 {nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		separator := "?"
+		if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+			separator = "&"
+		}
+		return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+	} else {
+		return "", err
+	}
+}
+
+// exchange the authorization code for the provider's tokens, and validate
+// the ID token to get the identity of the user
+func (provider *oidcProvider) exchange(code string, codeVerifier string, nonce string) (jutzo.ExternalIdentity, error) {
+	discovery, err := provider.getDiscovery()
+	if err != nil {
+		return jutzo.ExternalIdentity{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.redirectURL},
+		"client_id":     {provider.clientID},
+		"code_verifier": {codeVerifier},
+	}
+	if provider.clientSecret != "" {
+		form.Set("client_secret", provider.clientSecret)
+	}
+
+	var tokenResponse struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if response, err := provider.httpClient.PostForm(discovery.TokenEndpoint, form); err == nil {
+		defer response.Body.Close()
+		if err = json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil {
+			return jutzo.ExternalIdentity{}, err
+		} else if response.StatusCode != http.StatusOK || tokenResponse.IDToken == "" {
+			return jutzo.ExternalIdentity{}, fmt.Errorf("identity provider %s refused the code: %d %s",
+				provider.name, response.StatusCode, tokenResponse.Error)
+		}
+	} else {
+		return jutzo.ExternalIdentity{}, err
+	}
+
+	if claims, err := provider.validateIDToken(tokenResponse.IDToken, nonce); err == nil {
+		return jutzo.ExternalIdentity{
+			Provider:          provider.name,
+			Subject:           claims.Subject,
+			Email:             claims.Email,
+			EmailVerified:     bool(claims.EmailVerified),
+			PreferredUsername: claims.PreferredUsername,
+		}, nil
+	} else {
+		return jutzo.ExternalIdentity{}, err
+	}
+}
+
+// validateIDToken checks the signature of the ID token against the provider's
+// keys, and that it was issued by the provider, for us, for this login
+func (provider *oidcProvider) validateIDToken(encoded string, nonce string) (*oidcIDTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(encoded, &oidcIDTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		if key, err := provider.getKey(keyID); err == nil {
+			if token.Method.Alg() != key.method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key.publicKey, nil
+		} else {
+			return nil, err
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*oidcIDTokenClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("unable to extract ID token claims")
+	} else if strings.TrimSuffix(claims.Issuer, "/") != provider.issuer {
+		return nil, ErrTokenWrongIssuer
+	} else if !slices.Contains(claims.Audience, provider.clientID) {
+		return nil, ErrTokenWrongAudience
+	} else if (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != provider.clientID {
+		// A token for several audiences has to say that it was issued to us
+		return nil, ErrTokenWrongAudience
+	} else if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match the login")
+	} else if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// getJSON fetches and decodes a JSON document from the provider
+func (provider *oidcProvider) getJSON(documentURL string, result any) error {
+	if response, err := provider.httpClient.Get(documentURL); err == nil {
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("unable to fetch %s: %s", documentURL, response.Status)
+		}
+		return json.NewDecoder(response.Body).Decode(result)
+	} else {
+		return err
+	}
+}
+
+// randomString creates an unguessable URL safe string for the
+// state, nonce and PKCE verifier
+func randomString() (string, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err == nil {
+		return base64.RawURLEncoding.EncodeToString(value), nil
+	} else {
+		return "", err
+	}
+}
+
+// stateHash is what the state cookie holds for the state
+func stateHash(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// setStateCookie for the login, or clears it when the state is empty. The
+// cookie is only sent back to the provider callbacks, and only over HTTPS
+// when that is how the provider sends users back
+func setStateCookie(c *gin.Context, provider *oidcProvider, state string) {
+	value, maxAge := "", -1
+	if state != "" {
+		value, maxAge = stateHash(state), int(oidcLoginTimeout.Seconds())
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, "/v1/user/oidc/", "",
+		strings.HasPrefix(provider.redirectURL, "https://"), true)
+}
+
+// Routine to start a login with an external identity provider. The user
+// is redirected to the provider, which will send them back to the callback
+func handleOIDCLogin(c *gin.Context, providers map[string]*oidcProvider, engine jutzo.Engine) {
+	provider, found := providers[c.Param("provider")]
+	if !found {
+		c.String(http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	// Create the state, nonce and PKCE verifier for this login
+	var state, nonce, verifier string
+	var err error
+	if state, err = randomString(); err == nil {
+		if nonce, err = randomString(); err == nil {
+			verifier, err = randomString()
+		}
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unable to start login")
+		return
+	}
+
+	// Remember the login while the user is away at the provider
+	loginState, _ := json.Marshal(oidcLoginState{Provider: provider.name, CodeVerifier: verifier, Nonce: nonce})
+	if err = engine.StoreTransient("oidc:"+state, loginState, oidcLoginTimeout); err != nil {
+		c.String(http.StatusInternalServerError, "Unable to start login")
+		return
+	}
+
+	if authorizationURL, err := provider.authorizationURL(state, nonce, verifier); err == nil {
+		setStateCookie(c, provider, state)
+		c.Redirect(http.StatusFound, authorizationURL)
+	} else {
+		log.Printf("Unable to reach identity provider %s: %s", provider.name, err.Error())
+		c.String(http.StatusBadGateway, "Unable to reach identity provider")
+	}
+}
+
+// Routine to complete a login when the identity provider sends the user back
+// to us. The code is exchanged for the user's identity, which is mapped to a
+// local user who is then logged in as normal
+func handleOIDCCallback(c *gin.Context, providers map[string]*oidcProvider, tokenEngine TokenEngine,
+	engine jutzo.Engine, configuration jutzo.ConfigurationProvider) {
+
+	provider, found := providers[c.Param("provider")]
+	if !found {
+		c.String(http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+	if providerError := c.Query("error"); providerError != "" {
+		c.String(http.StatusUnauthorized, "Login refused by identity provider: %s", providerError)
+		return
+	}
+
+	// The state has to match a login this browser started (otherwise anyone could
+	// send someone the callback for their own login, logging them in as the sender)
+	// with this provider, and can only be used once
+	state := c.Query("state")
+	if cookie, err := c.Cookie(oidcStateCookie); err != nil ||
+		subtle.ConstantTimeCompare([]byte(cookie), []byte(stateHash(state))) != 1 {
+		c.String(http.StatusBadRequest, "Login was not started in this browser")
+		return
+	}
+	setStateCookie(c, provider, "")
+	var loginState oidcLoginState
+	if stored, err := engine.TakeTransient("oidc:" + state); err != nil {
+		c.String(http.StatusInternalServerError, "Unable to complete login")
+		return
+	} else if stored == nil || json.Unmarshal(stored, &loginState) != nil || loginState.Provider != provider.name {
+		c.String(http.StatusBadRequest, "Unknown or expired login")
+		return
+	}
+
+	if identity, err := provider.exchange(c.Query("code"), loginState.CodeVerifier, loginState.Nonce); err == nil {
+		if userSession, err := engine.LoginExternalIdentity(identity, getClientInfo(c)); err == nil {
+			log.Printf("User %s logged in with %s, session id: %s",
+				userSession.GetUserInfo().GetUsername(), provider.name, userSession.GetId())
+			recordLogin(c, engine, jutzo.AuditLoginSucceeded, userSession.GetUserInfo().GetUsername(), provider.name)
+
+			// Browsers are sent on to the front end with the tokens in the fragment;
+			// without somewhere to send them we return the tokens as for a normal login
+			if completionURL, isPresent := configuration.GetConfigurationString("JUTZO_OIDC_COMPLETION_URL"); isPresent {
+				if token, err := tokenEngine.Encode(userSession, engine.GetSessionTimeouts().AccessDuration); err == nil {
+					fragment := url.Values{"accessToken": {token}, "refreshToken": {userSession.GetRefreshToken()}}
+					c.Redirect(http.StatusFound, completionURL+"#"+fragment.Encode())
+				} else {
+					c.String(http.StatusInternalServerError, "Unable to create access token")
+				}
+			} else {
+				issueSessionTokens(c, tokenEngine, engine, userSession)
+			}
+		} else if err == jutzo.ErrExternalEmailConflict {
+			c.String(http.StatusConflict, err.Error())
+		} else if err == jutzo.ErrRegistrationClosed || err == jutzo.ErrInviteRequired || err == jutzo.ErrEmailDomainNotAllowed ||
+			err == jutzo.ErrExternalEmailUnverified {
+			c.String(http.StatusForbidden, err.Error())
+		} else {
+			c.String(http.StatusUnauthorized, "Unable to log in: %s", err.Error())
+		}
+	} else {
+		log.Printf("Login with identity provider %s failed: %s", provider.name, err.Error())
+		c.String(http.StatusUnauthorized, "Login with identity provider failed")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockIdentityProvider is a minimal OpenID Connect provider, serving
+// discovery, keys and a token endpoint, for testing the relying party
+type mockIdentityProvider struct {
+	server *httptest.Server
+	key    *signingKey
+
+	// The challenge and nonce of the (single) login in progress,
+	// the claims to issue for it, and how often the keys were fetched
+	codeChallenge string
+	nonce         string
+	claims        jwt.MapClaims
+	keyFetches    int
+}
+
+func newMockIdentityProvider(t *testing.T) *mockIdentityProvider {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp := &mockIdentityProvider{key: &signingKey{id: "mock-key", method: jwt.SigningMethodRS256,
+		privateKey: privateKey, publicKey: &privateKey.PublicKey}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.keyFetches++
+		_ = json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{idp.key.toJWK()}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+
+		// The PKCE verifier has to match the challenge from the authorization request
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if r.PostFormValue("code") != "mock-code" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := jwt.MapClaims{"nonce": idp.nonce}
+		for name, value := range idp.claims {
+			claims[name] = value
+		}
+		token := jwt.NewWithClaims(idp.key.method, claims)
+		token.Header["kid"] = idp.key.id
+		idToken, _ := token.SignedString(idp.key.privateKey)
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	idp.claims = jwt.MapClaims{
+		"iss":                idp.server.URL,
+		"aud":                "jutzo-client",
+		"sub":                "external-subject",
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"email":              "reader@example.com",
+		"email_verified":     true,
+		"preferred_username": "reader",
+	}
+	return idp
+}
+
+// authorize simulates the user logging in at the provider, remembering
+// the challenge and nonce from the authorization URL
+func (idp *mockIdentityProvider) authorize(t *testing.T, authorizationURL string) {
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatalf("Invalid authorization URL: %s", err.Error())
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "jutzo-client" {
+		t.Errorf("Unexpected authorization request: %s", authorizationURL)
+	}
+	idp.codeChallenge = query.Get("code_challenge")
+	idp.nonce = query.Get("nonce")
+}
+
+func mockProvider(t *testing.T, idp *mockIdentityProvider) *oidcProvider {
+	providers, err := loadOIDCProviders(TestConfig{map[string]string{
+		"JUTZO_OIDC_PROVIDERS":          "mock",
+		"JUTZO_OIDC_MOCK_ISSUER":        idp.server.URL,
+		"JUTZO_OIDC_MOCK_CLIENT_ID":     "jutzo-client",
+		"JUTZO_OIDC_MOCK_CLIENT_SECRET": "secret",
+		"JUTZO_OIDC_MOCK_REDIRECT_URL":  "http://localhost/v1/user/oidc/mock/callback",
+	}})
+	if err != nil || providers["mock"] == nil {
+		t.Fatalf("Unable to configure provider: %v", err)
+	}
+	return providers["mock"]
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	provider := mockProvider(t, idp)
+
+	authorizationURL, err := provider.authorizationURL("state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatalf("Unable to build authorization URL: %s", err.Error())
+	}
+	idp.authorize(t, authorizationURL)
+
+	if identity, err := provider.exchange("mock-code", "the-verifier", "the-nonce"); err != nil {
+		t.Errorf("Exchange failed: %s", err.Error())
+	} else if identity.Provider != "mock" || identity.Subject != "external-subject" ||
+		identity.Email != "reader@example.com" || !identity.EmailVerified || identity.PreferredUsername != "reader" {
+		t.Errorf("Unexpected identity: %v", identity)
+	}
+
+	// The wrong PKCE verifier is refused by the provider, and an ID
+	// token for a different login (nonce) is refused by us
+	if _, err := provider.exchange("mock-code", "another-verifier", "the-nonce"); err == nil {
+		t.Errorf("Exchange succeeded with the wrong verifier")
+	}
+	if _, err := provider.exchange("mock-code", "the-verifier", "another-nonce"); err == nil {
+		t.Errorf("Exchange succeeded with the wrong nonce")
+	}
+
+	// Providers can send the audience as an array, and whether the email is verified as a string
+	idp.claims["aud"] = []string{"jutzo-client", "another-client"}
+	idp.claims["azp"] = "jutzo-client"
+	idp.claims["email_verified"] = "true"
+	if identity, err := provider.exchange("mock-code", "the-verifier", "the-nonce"); err != nil || !identity.EmailVerified {
+		t.Errorf("Unexpected identity: %v %v", identity, err)
+	}
+	idp.claims["email_verified"] = "false"
+	if identity, err := provider.exchange("mock-code", "the-verifier", "the-nonce"); err != nil || identity.EmailVerified {
+		t.Errorf("Unexpected identity: %v %v", identity, err)
+	}
+
+	// ID tokens meant for another client are refused, as are those for several
+	// clients that weren't issued to us
+	for _, claims := range []jwt.MapClaims{
+		{"aud": "another-client", "azp": nil},
+		{"aud": []string{"jutzo-client", "another-client"}, "azp": nil},
+		{"aud": []string{"jutzo-client", "another-client"}, "azp": "another-client"},
+	} {
+		for name, value := range claims {
+			if value == nil {
+				delete(idp.claims, name)
+			} else {
+				idp.claims[name] = value
+			}
+		}
+		if _, err := provider.exchange("mock-code", "the-verifier", "the-nonce"); err != ErrTokenWrongAudience {
+			t.Errorf("Expected wrong audience for %v, got %v", claims, err)
+		}
+	}
+	idp.claims["aud"] = "jutzo-client"
+
+	// ID tokens have to say when they were issued and when they expire
+	for _, claim := range []string{"exp", "iat"} {
+		value := idp.claims[claim]
+		delete(idp.claims, claim)
+		if _, err := provider.exchange("mock-code", "the-verifier", "the-nonce"); err == nil {
+			t.Errorf("Exchange succeeded without %s", claim)
+		}
+		idp.claims[claim] = value
+	}
+	idp.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := provider.exchange("mock-code", "the-verifier", "the-nonce"); err == nil {
+		t.Errorf("Exchange succeeded with an expired ID token")
+	}
+}
+
+func TestOIDCKeysAreOnlyRefetchedOccasionally(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	provider := mockProvider(t, idp)
+	if _, err := provider.getKey("mock-key"); err != nil || idp.keyFetches != 1 {
+		t.Fatalf("Unable to get the key: %v (%d fetches)", err, idp.keyFetches)
+	}
+
+	// Tokens naming keys the provider doesn't have don't make us ask it each time
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := provider.getKey("forged-key"); err == nil {
+			t.Errorf("Unknown key was found")
+		}
+	}
+	if idp.keyFetches != 1 {
+		t.Errorf("Expected the keys to be fetched once, got %d", idp.keyFetches)
+	}
+	if _, err := provider.getKey("mock-key"); err != nil {
+		t.Errorf("Known key was lost: %s", err.Error())
+	}
+}
+
+func TestOIDCLoginIsTiedToTheBrowser(t *testing.T) {
+	idp := newMockIdentityProvider(t)
+	providers := map[string]*oidcProvider{"mock": mockProvider(t, idp)}
+	engine := newTestEngine(t, nil)
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/v1/user/oidc/:provider/login", func(c *gin.Context) { handleOIDCLogin(c, providers, engine) })
+	router.GET("/v1/user/oidc/:provider/callback", func(c *gin.Context) {
+		handleOIDCCallback(c, providers, tokenEngine, engine, TestConfig{map[string]string{}})
+	})
+
+	// startLogin returns the state and the cookie the browser was given
+	startLogin := func() (string, *http.Cookie) {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/user/oidc/mock/login", nil))
+		location := recorder.Header().Get("Location")
+		cookies := recorder.Result().Cookies()
+		if recorder.Code != http.StatusFound || len(cookies) != 1 || !cookies[0].HttpOnly ||
+			cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("Unexpected login start: %d %v", recorder.Code, cookies)
+		}
+		idp.authorize(t, location)
+		parsed, _ := url.Parse(location)
+		return parsed.Query().Get("state"), cookies[0]
+	}
+	callback := func(state string, cookie *http.Cookie) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/v1/user/oidc/mock/callback?code=mock-code&state="+state, nil)
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// A callback for a login started elsewhere, or that this browser didn't start, is refused
+	state, _ := startLogin()
+	_, otherCookie := startLogin()
+	if code := callback(state, nil); code != http.StatusBadRequest {
+		t.Errorf("Expected a callback without the cookie to be refused, got %d", code)
+	}
+	if code := callback(state, otherCookie); code != http.StatusBadRequest {
+		t.Errorf("Expected a callback with another login's cookie to be refused, got %d", code)
+	}
+
+	// The browser that started the login completes it
+	state, cookie := startLogin()
+	if code := callback(state, cookie); code != http.StatusOK {
+		t.Errorf("Expected the login to complete, got %d", code)
+	}
+}
+
+func TestOIDCProviderConfiguration(t *testing.T) {
+	if providers, err := loadOIDCProviders(TestConfig{map[string]string{}}); err != nil || len(providers) != 0 {
+		t.Errorf("No providers should be configured by default")
+	}
+	if _, err := loadOIDCProviders(TestConfig{map[string]string{
+		"JUTZO_OIDC_PROVIDERS":         "incomplete",
+		"JUTZO_OIDC_INCOMPLETE_ISSUER": "https://idp.example.com",
+	}}); err == nil {
+		t.Errorf("Incomplete provider configuration was accepted")
+	}
+}
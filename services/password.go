@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"services/jutzo"
+)
+
+// Routine for a logged-in user to change their password. The user's other
+// sessions are ended, in case the password was changed because it leaked
+func handleChangePassword(c *gin.Context, engine jutzo.Engine) {
+
+	type changePasswordPayload struct {
+		CurrentPass string `json:"currentPass" binding:"required"`
+		Pass        string `json:"pass" binding:"required"`
+	}
+
+	if userSession, ok := getInteractiveSession(c); ok {
+		var payload changePasswordPayload
+		err := c.BindJSON(&payload)
+		if checkValidPayload(c, err) {
+			username := userSession.GetUserInfo().GetUsername()
+			if err = engine.ChangePassword(username, payload.CurrentPass, payload.Pass, getClientInfo(c)); err == nil {
+				recordAudit(c, engine, jutzo.AuditPasswordChanged, username, "")
+				if err = engine.DestroyUserSessions(username, userSession.GetId()); err != nil {
+					log.Printf("Unable to end other sessions for %s: %s", username, err.Error())
+				}
+				c.String(http.StatusOK, "OK")
+			} else if throttled, isThrottled := err.(*jutzo.LoginThrottledError); isThrottled {
+				respondThrottled(c, throttled)
+			} else if !passwordRejected(c, err) {
+				if err == jutzo.ErrInvalidCredentials {
+					c.String(http.StatusForbidden, "Current password is incorrect")
+				} else if err == jutzo.ErrNoLocalPassword {
+					c.String(http.StatusBadRequest, err.Error())
+				} else {
+					c.String(http.StatusInternalServerError, "Unable to change password: %s", err.Error())
+				}
+			}
+		}
+	}
+}
+
+// Routine for an administrator to create a password reset token for a user.
+// The administrator passes the token on to the user, who sets a new password
+// with it at /v1/user/password/reset
+func handleCreatePasswordReset(c *gin.Context, engine jutzo.Engine) {
+	if token, err := engine.CreatePasswordReset(c.Param("username")); err == nil {
+		recordAudit(c, engine, jutzo.AuditPasswordResetIssued, c.Param("username"), "")
+		c.JSON(http.StatusOK, gin.H{"token": token})
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "User not found")
+	} else if err == jutzo.ErrNoLocalPassword {
+		c.String(http.StatusBadRequest, err.Error())
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to create password reset: %s", err.Error())
+	}
+}
+
+// Routine to set a new password with a password reset token
+func handleResetPassword(c *gin.Context, engine jutzo.Engine) {
+
+	type resetPasswordPayload struct {
+		Token string `json:"token" binding:"required"`
+		Pass  string `json:"pass" binding:"required"`
+	}
+
+	var payload resetPasswordPayload
+	err := c.BindJSON(&payload)
+	if checkValidPayload(c, err) {
+		if user, err := engine.ResetPassword(payload.Token, payload.Pass); err == nil {
+			recordAudit(c, engine, jutzo.AuditPasswordReset, user, "")
+			c.String(http.StatusOK, "OK")
+		} else if !passwordRejected(c, err) {
+			if err == jutzo.ErrInvalidResetToken {
+				c.String(http.StatusBadRequest, err.Error())
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to reset password: %s", err.Error())
+			}
+		}
+	}
+}
+
+// passwordRejected responds with the policy violations if the error is
+// a password policy error, returning true if it was
+func passwordRejected(c *gin.Context, err error) bool {
+	if policyError, isPolicyError := err.(*jutzo.PasswordPolicyError); isPolicyError {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "password_policy", "violations": policyError.Violations})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/exp/slices"
+	"os"
+	"path/filepath"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// violationCodes of a password policy error, or nil if the password was accepted
+func violationCodes(err error) []string {
+	var codes []string
+	if policyError, ok := err.(*jutzo.PasswordPolicyError); ok {
+		for _, violation := range policyError.Violations {
+			codes = append(codes, violation.Code)
+		}
+	}
+	return codes
+}
+
+// writeBreachedList of the hashes of the passwords given and of a few thousand
+// others, sorted as the Pwned Passwords downloads are, returning its path
+func writeBreachedList(t *testing.T, passwords ...string) string {
+	var lines []string
+	for i := 0; i < 5000; i++ {
+		passwords = append(passwords, fmt.Sprintf("breached-%d", i))
+	}
+	for i, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, fmt.Sprintf("%s:%d\r\n", strings.ToUpper(hex.EncodeToString(sum[:])), i*37%100000))
+	}
+	sort.Strings(lines)
+	breachedList := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(breachedList, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatalf("Unable to write breached list: %s", err.Error())
+	}
+	return breachedList
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breachedList := writeBreachedList(t, "Password1!", "Summer2024!")
+
+	policy, err := impl.NewPasswordPolicy(TestConfig{map[string]string{
+		"JUTZO_PASSWORD_MIN_LENGTH":       "10",
+		"JUTZO_PASSWORD_REQUIRED_CLASSES": "lower,upper,digit",
+		"JUTZO_PASSWORD_BREACHED_LIST":    breachedList,
+	}})
+	if err != nil {
+		t.Fatalf("Unable to create policy: %s", err.Error())
+	}
+
+	tests := []struct {
+		password string
+		expected string
+	}{
+		{"Tr0ub4dor&3x", ""},
+		{"short", "too_short,missing_uppercase,missing_digit"},
+		{"alllowercase1", "missing_uppercase"},
+		{"BobTheBuilder1", "matches_username"},
+		{"bob@example.com", "missing_uppercase,missing_digit,matches_email"},
+		{"Password1!", "breached"},
+		{"Summer2024!", "breached"},
+	}
+	for _, test := range tests {
+		codes := strings.Join(violationCodes(policy.Check(test.password, "bobthebuilder1", "bob@example.com")), ",")
+		if codes != test.expected {
+			t.Errorf("Password %q: expected violations %q, got %q", test.password, test.expected, codes)
+		}
+	}
+
+	// Every hash in the list is found, wherever it is in the file
+	for i := 0; i < 5000; i++ {
+		if codes := violationCodes(policy.Check(fmt.Sprintf("breached-%d", i), "", "")); !slices.Contains(codes, "breached") {
+			t.Fatalf("Breached password %d not found: %v", i, codes)
+		}
+	}
+	if codes := violationCodes(policy.Check("breached-5000", "", "")); slices.Contains(codes, "breached") {
+		t.Errorf("Password not in the list was found: %v", codes)
+	}
+
+	// Bad configuration is refused at startup
+	if _, err = impl.NewPasswordPolicy(TestConfig{map[string]string{"JUTZO_PASSWORD_REQUIRED_CLASSES": "emoji"}}); err == nil {
+		t.Errorf("Unknown character class was accepted")
+	}
+	if err = os.WriteFile(breachedList, []byte("not-a-hash\n"), 0600); err == nil {
+		if _, err = impl.NewPasswordPolicy(TestConfig{map[string]string{"JUTZO_PASSWORD_BREACHED_LIST": breachedList}}); err == nil {
+			t.Errorf("Malformed breached list was accepted")
+		}
+	}
+}
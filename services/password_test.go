@@ -0,0 +1,90 @@
+package main
+
+import (
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+)
+
+func newTestHasher(t *testing.T, settings map[string]string) *impl.PasswordHasher {
+	hasher, err := impl.NewPasswordHasher(TestConfig{settings})
+	if err != nil {
+		t.Fatalf("Unable to create hasher: %s", err.Error())
+	}
+	return hasher
+}
+
+func TestPasswordHashing(t *testing.T) {
+	bcryptHasher := newTestHasher(t, map[string]string{"JUTZO_HASH_COST": "4"})
+	strongerBcrypt := newTestHasher(t, map[string]string{"JUTZO_HASH_COST": "5"})
+	argonHasher := newTestHasher(t, map[string]string{"JUTZO_HASH_ALGORITHM": "argon2id",
+		"JUTZO_ARGON2_MEMORY_KB": "64", "JUTZO_ARGON2_ITERATIONS": "1", "JUTZO_ARGON2_THREADS": "1"})
+	strongerArgon := newTestHasher(t, map[string]string{"JUTZO_HASH_ALGORITHM": "argon2id",
+		"JUTZO_ARGON2_MEMORY_KB": "128", "JUTZO_ARGON2_ITERATIONS": "1", "JUTZO_ARGON2_THREADS": "1"})
+
+	bcryptHash, _ := bcryptHasher.Hash("correct horse")
+	argonHash, err := argonHasher.Hash("correct horse")
+	if err != nil || !strings.HasPrefix(string(argonHash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Unexpected Argon2id hash: %s", argonHash)
+	}
+
+	// Any hasher can verify hashes of either kind
+	for _, hash := range [][]byte{bcryptHash, argonHash} {
+		if !strongerArgon.Verify(hash, "correct horse") || !bcryptHasher.Verify(hash, "correct horse") {
+			t.Errorf("Password not verified against %s", hash)
+		}
+		if argonHasher.Verify(hash, "wrong horse") {
+			t.Errorf("Wrong password verified against %s", hash)
+		}
+	}
+	if bcryptHasher.Verify([]byte("$argon2id$v=19$m=64,t=1,p=1$bad"), "correct horse") {
+		t.Errorf("Malformed hash was verified")
+	}
+
+	// Hashes are upgraded when the settings are stronger, but Argon2id is never downgraded
+	if bcryptHasher.NeedsRehash(bcryptHash) || !strongerBcrypt.NeedsRehash(bcryptHash) || !argonHasher.NeedsRehash(bcryptHash) {
+		t.Errorf("Unexpected rehash decision for bcrypt")
+	}
+	if argonHasher.NeedsRehash(argonHash) || !strongerArgon.NeedsRehash(argonHash) || strongerBcrypt.NeedsRehash(argonHash) {
+		t.Errorf("Unexpected rehash decision for Argon2id")
+	}
+
+	if _, err = impl.NewPasswordHasher(TestConfig{map[string]string{"JUTZO_HASH_ALGORITHM": "md5"}}); err == nil {
+		t.Errorf("Unsupported algorithm was accepted")
+	}
+}
+
+func TestPasswordResetsAreOnlyForLocalUsers(t *testing.T) {
+	engine := directoryTestEngine(t, "carol")
+	client := jutzo.ClientInfo{IP: "192.0.2.1"}
+	if _, err := engine.Login("carol", "directory-pass", client); err != nil {
+		t.Fatalf("Unable to log in as a directory user: %s", err.Error())
+	}
+	if _, err := engine.LoginExternalIdentity(jutzo.ExternalIdentity{Provider: "idp", Subject: "dave-subject",
+		Email: "dave@example.com", EmailVerified: true, PreferredUsername: "dave"}, client); err != nil {
+		t.Fatalf("Unable to log in with an external identity: %s", err.Error())
+	}
+	for _, user := range []string{"carol", "dave"} {
+		if _, err := engine.CreatePasswordReset(user); err != jutzo.ErrNoLocalPassword {
+			t.Errorf("Expected no reset for %s, got %v", user, err)
+		}
+	}
+
+	// A local user without a password (such as one left by the upgrade that
+	// recorded how users log in) can be given one
+	if _, err := engine.GetDatabase().StoreUser("erin", "erin@example.com", []byte{}, jutzo.AuthSourceLocal); err != nil {
+		t.Fatalf("Unable to store a user: %s", err.Error())
+	}
+	_ = engine.GetDatabase().MarkEmailValidated("erin")
+	token, err := engine.CreatePasswordReset("erin")
+	if err != nil {
+		t.Fatalf("Unable to create a reset: %s", err.Error())
+	}
+	if _, err = engine.ResetPassword(token, "Another-pass-1"); err != nil {
+		t.Fatalf("Unable to reset the password: %s", err.Error())
+	}
+	if _, err = engine.Login("erin", "Another-pass-1", client); err != nil {
+		t.Errorf("Unable to log in with the new password: %s", err.Error())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"services/jutzo"
+	"strconv"
+	"time"
+)
+
+// deletionPurgeInterval is how often accounts whose deletion is due are purged
+const deletionPurgeInterval = time.Hour
+
+// Routine for the logged-in user to download everything we hold about
+// them, as a JSON attachment
+func handleExportMyData(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		username := userSession.GetUserInfo().GetUsername()
+		if export, err := engine.ExportUserData(username); err == nil {
+			profile := userDetails(export.User)
+			apiKeys, invites, identities, events := export.APIKeys, export.Invites, export.Identities, export.AuditEvents
+			if apiKeys == nil {
+				apiKeys = []jutzo.APIKey{}
+			}
+			if invites == nil {
+				invites = []jutzo.Invite{}
+			}
+			if identities == nil {
+				identities = []jutzo.LinkedIdentity{}
+			}
+			if events == nil {
+				events = []jutzo.AuditEvent{}
+			}
+
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="jutzo-%s.json"`, username))
+			c.IndentedJSON(http.StatusOK, gin.H{
+				"exportTime":  export.ExportTime,
+				"profile":     profile,
+				"sessions":    summarizeSessions(export.Sessions, userSession.GetId()),
+				"apiKeys":     apiKeys,
+				"identities":  identities,
+				"invites":     invites,
+				"auditEvents": events,
+				"deletion":    export.Deletion,
+			})
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to export user data: %s", err.Error())
+		}
+	}
+}
+
+// Routine for the logged-in user to ask for their account to be deleted. The
+// account is kept for a grace period, during which the request can be cancelled.
+// With anonymize set the account is kept without anything that identifies the user
+func handleRequestMyDeletion(c *gin.Context, engine jutzo.Engine) {
+
+	type deletionPayload struct {
+		Anonymize bool `json:"anonymize"`
+	}
+
+	if userSession, ok := getInteractiveSession(c); ok {
+		var payload deletionPayload
+		err := c.BindJSON(&payload)
+		if checkValidPayload(c, err) {
+			if request, err := engine.RequestAccountDeletion(userSession.GetUserInfo().GetUsername(), payload.Anonymize); err == nil {
+				recordAudit(c, engine, jutzo.AuditDeletionRequested, request.Username, "anonymize="+strconv.FormatBool(request.Anonymize))
+				c.JSON(http.StatusOK, request)
+			} else if err == jutzo.ErrLastAdmin {
+				c.String(http.StatusConflict, err.Error())
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to request deletion: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Routine for the logged-in user to cancel the deletion of their account
+func handleCancelMyDeletion(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		if err := engine.CancelAccountDeletion(userSession.GetUserInfo().GetUsername()); err == nil {
+			recordAudit(c, engine, jutzo.AuditDeletionCancelled, userSession.GetUserInfo().GetUsername(), "")
+			c.String(http.StatusOK, "OK")
+		} else if err == sql.ErrNoRows {
+			c.String(http.StatusNotFound, "No deletion pending")
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to cancel deletion: %s", err.Error())
+		}
+	}
+}
+
+// purgeDeletions periodically deletes the accounts whose deletion is due,
+// until the done channel is closed
+func purgeDeletions(engine jutzo.Engine, done <-chan struct{}) {
+	ticker := time.NewTicker(deletionPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if count, err := engine.PurgeAccountDeletions(); err != nil {
+			log.Printf("Unable to purge deleted accounts: %s", err.Error())
+		} else if count > 0 {
+			log.Printf("Purged %d deleted accounts", count)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
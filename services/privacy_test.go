@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"strings"
+	"testing"
+	"time"
+)
+
+// privacyTestEngine exports bob's data, and keeps the deletion he asks for
+type privacyTestEngine struct {
+	jutzo.Engine
+	deletion    *jutzo.DeletionRequest
+	deletionErr error
+}
+
+func (engine *privacyTestEngine) RecordAuditEvent(jutzo.AuditEvent) error {
+	return nil
+}
+
+func (engine *privacyTestEngine) ExportUserData(user string) (*jutzo.UserDataExport, error) {
+	userSession := testSession("interactive")
+	return &jutzo.UserDataExport{ExportTime: time.Now(), User: userSession.GetUserInfo(),
+		Sessions: []jutzo.UserSession{userSession, testSession("other")}, Deletion: engine.deletion}, nil
+}
+
+func (engine *privacyTestEngine) RequestAccountDeletion(user string, anonymize bool) (jutzo.DeletionRequest, error) {
+	if engine.deletionErr != nil {
+		return jutzo.DeletionRequest{}, engine.deletionErr
+	}
+	engine.deletion = &jutzo.DeletionRequest{Username: user, Anonymize: anonymize, DueTime: time.Now().Add(time.Hour)}
+	return *engine.deletion, nil
+}
+
+func (engine *privacyTestEngine) CancelAccountDeletion(string) error {
+	if engine.deletion == nil {
+		return sql.ErrNoRows
+	}
+	engine.deletion = nil
+	return nil
+}
+
+func TestUserDataExportAndDeletion(t *testing.T) {
+	engine := &privacyTestEngine{}
+	gin.SetMode(gin.TestMode)
+	call := func(handler func(*gin.Context, jutzo.Engine), method string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(method, "/user/me", strings.NewReader(body))
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), "userSession", testSession("interactive")))
+		handler(c, engine)
+		return recorder
+	}
+
+	// The deletion is only pending until it's cancelled
+	if recorder := call(handleRequestMyDeletion, http.MethodPost, `{"anonymize": true}`); recorder.Code != http.StatusOK ||
+		engine.deletion == nil || !engine.deletion.Anonymize {
+		t.Errorf("Deletion request failed: %d", recorder.Code)
+	}
+
+	// The export is an attachment, with the profile, sessions and pending deletion,
+	// but nothing secret
+	recorder := call(handleExportMyData, http.MethodGet, "")
+	var export struct {
+		Profile  map[string]any   `json:"profile"`
+		Sessions []sessionSummary `json:"sessions"`
+		APIKeys  []any            `json:"apiKeys"`
+		Deletion *jutzo.DeletionRequest
+	}
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &export) != nil {
+		t.Fatalf("Export failed: %d", recorder.Code)
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("Export is not an attachment")
+	}
+	if export.Profile["email"] != "bob@hablutzel.com" || len(export.Sessions) != 2 || !export.Sessions[0].Current ||
+		export.APIKeys == nil || export.Deletion == nil {
+		t.Errorf("Unexpected export: %s", recorder.Body.String())
+	}
+	if strings.Contains(recorder.Body.String(), "passwordHash") || strings.Contains(recorder.Body.String(), "refresh") {
+		t.Errorf("Export includes secrets: %s", recorder.Body.String())
+	}
+
+	if recorder = call(handleCancelMyDeletion, http.MethodDelete, ""); recorder.Code != http.StatusOK || engine.deletion != nil {
+		t.Errorf("Cancel failed: %d", recorder.Code)
+	}
+	if recorder = call(handleCancelMyDeletion, http.MethodDelete, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected no deletion to cancel, got %d", recorder.Code)
+	}
+
+	// The last administrator can't leave
+	engine.deletionErr = jutzo.ErrLastAdmin
+	if recorder = call(handleRequestMyDeletion, http.MethodPost, `{}`); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected the last admin to be refused, got %d", recorder.Code)
+	}
+}
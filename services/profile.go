@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"services/jutzo"
+	"strings"
+)
+
+// userDetails are what the user can see about themselves: their rights along
+// with their email, when they registered and their profile
+func userDetails(userInfo jutzo.UserInfo) gin.H {
+	details := userRights(userInfo)
+	details["email"] = userInfo.GetEmail()
+	details["creationTime"] = userInfo.GetCreationTime()
+	details["profile"] = userInfo.GetProfile()
+	return details
+}
+
+// Routine to return the logged-in user's details and profile
+func handleGetMe(c *gin.Context) {
+	if userSession, ok := getUserSessionFromContext(c); ok {
+		c.JSON(http.StatusOK, userDetails(userSession.GetUserInfo()))
+	} else {
+		c.String(http.StatusUnauthorized, "Invalid session")
+	}
+}
+
+// Routine for the logged-in user to change their profile. Only the fields
+// present in the payload are changed
+func handleUpdateMe(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInteractiveSession(c); ok {
+		var patch jutzo.ProfilePatch
+		err := c.BindJSON(&patch)
+		if checkValidPayload(c, err) {
+			username := userSession.GetUserInfo().GetUsername()
+			var invalid *jutzo.InvalidProfileError
+			if userInfo, err := engine.UpdateProfile(username, patch); err == nil {
+				recordAudit(c, engine, jutzo.AuditProfileUpdated, username, strings.Join(patchedFields(patch), ","))
+				c.JSON(http.StatusOK, userDetails(userInfo))
+			} else if errors.As(err, &invalid) {
+				c.JSON(http.StatusBadRequest, invalid)
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to update profile: %s", err.Error())
+			}
+		}
+	}
+}
+
+// patchedFields are the names of the fields the patch changes, for the audit log
+func patchedFields(patch jutzo.ProfilePatch) []string {
+	var fields []string
+	add := func(present bool, field string) {
+		if present {
+			fields = append(fields, field)
+		}
+	}
+	add(patch.DisplayName != nil, "displayName")
+	add(patch.Bio != nil, "bio")
+	add(patch.AvatarURL != nil, "avatarUrl")
+	add(patch.Timezone != nil, "timezone")
+	add(patch.Locale != nil, "locale")
+	add(patch.Notifications != nil, "notifications")
+	return fields
+}
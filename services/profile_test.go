@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+)
+
+// profileTestEngine keeps the profile bob gives himself
+type profileTestEngine struct {
+	jutzo.Engine
+	userInfo jutzo.UserInfo
+	events   []jutzo.AuditEvent
+}
+
+func (engine *profileTestEngine) RecordAuditEvent(event jutzo.AuditEvent) error {
+	engine.events = append(engine.events, event)
+	return nil
+}
+
+func (engine *profileTestEngine) UpdateProfile(user string, patch jutzo.ProfilePatch) (jutzo.UserInfo, error) {
+	if patch.Timezone != nil && *patch.Timezone == "Mars/Olympus_Mons" {
+		return nil, &jutzo.InvalidProfileError{Field: "timezone", Reason: "unknown timezone"}
+	}
+	engine.userInfo.SetProfile(patch.Apply(engine.userInfo.GetProfile()))
+	return engine.userInfo, nil
+}
+
+func TestProfileEndpoint(t *testing.T) {
+	userSession := testSession("interactive")
+	engine := &profileTestEngine{userInfo: userSession.GetUserInfo()}
+	gin.SetMode(gin.TestMode)
+	call := func(method string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(method, "/user/me", strings.NewReader(body))
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), "userSession", userSession))
+		if method == http.MethodGet {
+			handleGetMe(c)
+		} else {
+			handleUpdateMe(c, engine)
+		}
+		return recorder
+	}
+	var me struct {
+		Email   string            `json:"email"`
+		Profile jutzo.UserProfile `json:"profile"`
+	}
+
+	// A new user gets the default notifications
+	recorder := call(http.MethodGet, "")
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &me) != nil {
+		t.Fatalf("Get failed: %d", recorder.Code)
+	}
+	if me.Email != "bob@hablutzel.com" || me.Profile.Notifications != jutzo.DefaultNotificationPreferences {
+		t.Errorf("Unexpected details: %s", recorder.Body.String())
+	}
+
+	// Patching changes only the fields present
+	recorder = call(http.MethodPatch, `{"displayName": "Bob", "timezone": "Europe/Paris", "notifications": {"digest": "weekly"}}`)
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &me) != nil {
+		t.Fatalf("Patch failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if me.Profile.DisplayName != "Bob" || me.Profile.Timezone != "Europe/Paris" || me.Profile.Bio != "" ||
+		me.Profile.Notifications.Digest != jutzo.DigestWeekly || !me.Profile.Notifications.SecurityAlerts {
+		t.Errorf("Unexpected profile: %s", recorder.Body.String())
+	}
+	if len(engine.events) != 1 || engine.events[0].Type != jutzo.AuditProfileUpdated ||
+		engine.events[0].Detail != "displayName,timezone,notifications" {
+		t.Errorf("Unexpected audit events: %v", engine.events)
+	}
+
+	if recorder = call(http.MethodPatch, `{"timezone": "Mars/Olympus_Mons"}`); recorder.Code != http.StatusBadRequest ||
+		!strings.Contains(recorder.Body.String(), `"field":"timezone"`) {
+		t.Errorf("Expected an invalid timezone, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestProfileValidation(t *testing.T) {
+	text := func(value string) *string { return &value }
+	engine := new(impl.EngineImpl)
+	for field, patch := range map[string]jutzo.ProfilePatch{
+		"displayName":          {DisplayName: text("Bob\x07")},
+		"bio":                  {Bio: text(strings.Repeat("b", impl.MaxBioLength+1))},
+		"avatarUrl":            {AvatarURL: text("http://example.com/bob.png")},
+		"timezone":             {Timezone: text("Mars/Olympus_Mons")},
+		"locale":               {Locale: text("not a locale")},
+		"notifications.digest": {Notifications: &jutzo.NotificationPatch{Digest: text("hourly")}},
+	} {
+		// Invalid patches are refused before anything is stored
+		var invalid *jutzo.InvalidProfileError
+		if _, err := engine.UpdateProfile("bob", patch); !errors.As(err, &invalid) || invalid.Field != field {
+			t.Errorf("Expected %s to be invalid, got %v", field, err)
+		}
+	}
+}
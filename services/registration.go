@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"services/jutzo"
+	"strings"
+	"time"
+)
+
+// Routine for an administrator to see who can register
+func handleGetRegistrationSettings(c *gin.Context, engine jutzo.Engine) {
+	if settings, err := engine.GetRegistrationSettings(); err == nil {
+		c.JSON(http.StatusOK, settings)
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to get registration settings: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to change who can register
+func handleSetRegistrationSettings(c *gin.Context, engine jutzo.Engine) {
+	var payload jutzo.RegistrationSettings
+	err := c.BindJSON(&payload)
+	if checkValidPayload(c, err) {
+		if settings, err := engine.SetRegistrationSettings(payload); err == nil {
+			recordAudit(c, engine, jutzo.AuditSettingsChanged, "registration",
+				"mode="+settings.Mode+" domains="+strings.Join(settings.AllowedDomains, ","))
+			c.JSON(http.StatusOK, settings)
+		} else if err == jutzo.ErrInvalidRegistration {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to change registration settings: %s", err.Error())
+		}
+	}
+}
+
+// Routine to create an invite code. Administrators and users with the invite
+// right can create invites, which can give any of the creator's rights to the
+// user who registers with them. The code is returned in the response and
+// cannot be retrieved again
+func handleCreateInvite(c *gin.Context, engine jutzo.Engine) {
+
+	// createInvitePayload gives the rights the invite carries, and
+	// optionally when it expires
+	type createInvitePayload struct {
+		Rights        []string `json:"rights"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+
+	if userSession, ok := getInviterSession(c); ok {
+		var payload createInvitePayload
+		err := c.BindJSON(&payload)
+		if checkValidPayload(c, err) {
+			expiresIn := time.Duration(payload.ExpiresInDays) * 24 * time.Hour
+			username := userSession.GetUserInfo().GetUsername()
+			if code, invite, err := engine.CreateInvite(username, payload.Rights, expiresIn); err == nil {
+				c.JSON(http.StatusOK, gin.H{"code": code, "invite": invite})
+			} else if err == jutzo.ErrRightNotHeld {
+				c.String(http.StatusForbidden, "An invite cannot carry rights the creator does not hold")
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to create invite: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Routine to list the invites the logged-in user has created
+func handleListInvites(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInviterSession(c); ok {
+		if invites, err := engine.ListInvites(userSession.GetUserInfo().GetUsername()); err == nil {
+			if invites == nil {
+				invites = []jutzo.Invite{}
+			}
+			c.JSON(http.StatusOK, invites)
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to list invites: %s", err.Error())
+		}
+	}
+}
+
+// Routine to revoke one of the logged-in user's invites
+func handleRevokeInvite(c *gin.Context, engine jutzo.Engine) {
+	if userSession, ok := getInviterSession(c); ok {
+		if err := engine.RevokeInvite(userSession.GetUserInfo().GetUsername(), c.Param("id")); err == nil {
+			c.String(http.StatusOK, "OK")
+		} else if err == sql.ErrNoRows {
+			c.String(http.StatusNotFound, "Invite not found")
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to revoke invite: %s", err.Error())
+		}
+	}
+}
+
+// Get the interactive session from the context, making sure the user is
+// allowed to manage invites. If not, the request is rejected and false is returned
+func getInviterSession(c *gin.Context) (jutzo.UserSession, bool) {
+	if userSession, ok := getInteractiveSession(c); !ok {
+		return nil, false
+	} else if !userSession.GetUserInfo().HasAnyRight([]string{"admin", jutzo.InviteRight}) {
+		c.String(http.StatusForbidden, "Creating invites requires the admin or invite right")
+		return nil, false
+	} else {
+		return userSession, true
+	}
+}
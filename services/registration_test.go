@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistrationModes(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/user/register", func(c *gin.Context) { handleRegisterUser(c, engine) })
+	register := func(user string, email string, password string, invite string) int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/user/register",
+			strings.NewReader(`{"user": "`+user+`", "email": "`+email+`", "pass": "`+password+`", "invite": "`+invite+`"}`)))
+		return recorder.Code
+	}
+	setMode := func(mode string, domains ...string) {
+		if _, err := engine.SetRegistrationSettings(jutzo.RegistrationSettings{Mode: mode, AllowedDomains: domains}); err != nil {
+			t.Fatalf("Unable to set the registration mode: %s", err.Error())
+		}
+	}
+	_, _ = engine.GrantRight("bob", jutzo.InviteRight)
+	code, _, err := engine.CreateInvite("bob", []string{jutzo.InviteRight}, 0)
+	if err != nil {
+		t.Fatalf("Unable to create an invite: %s", err.Error())
+	}
+
+	// Nobody can register while registration is closed, not even with an invite
+	setMode(jutzo.RegistrationClosed)
+	if status := register("carol", "carol@example.com", "a good password", code); status != http.StatusForbidden {
+		t.Errorf("Expected registration to be closed, got %d", status)
+	}
+
+	// An invite is needed in the invitation mode, and can only be used once. A
+	// registration that fails gives the invite back
+	setMode(jutzo.RegistrationInvitation)
+	for _, test := range []struct {
+		user     string
+		password string
+		invite   string
+		expected int
+	}{
+		{"carol", "a good password", "", http.StatusForbidden},
+		{"carol", "a good password", "not-an-invite", http.StatusBadRequest},
+		{"carol", "short", code, http.StatusBadRequest},
+		{"carol bob", "a good password", code, http.StatusBadRequest},
+		{"carol", "a good password", code, http.StatusOK},
+		{"dave", "a good password", code, http.StatusBadRequest},
+	} {
+		if status := register(test.user, test.user+"@example.com", test.password, test.invite); status != test.expected {
+			t.Errorf("Expected %d registering %q with invite %q, got %d", test.expected, test.user, test.invite, status)
+		}
+	}
+	if carol, err := engine.GetUser("carol"); err != nil || !carol.HasRights([]string{jutzo.InviteRight}) {
+		t.Errorf("Invited user did not get the invite's rights: %v %v", carol, err)
+	}
+	granted, err := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditRightGranted}, Target: "carol"})
+	if err != nil || len(granted) != 1 || granted[0].Actor != "bob" || granted[0].Detail != jutzo.InviteRight {
+		t.Errorf("Expected the invite's rights to be audited as granted by bob: %+v %v", granted, err)
+	}
+
+	// Only emails in the allowed domains can register in the domain mode
+	setMode(jutzo.RegistrationDomain, "Example.ORG")
+	if status := register("dave", "dave@example.com", "a good password", ""); status != http.StatusForbidden {
+		t.Errorf("Expected the domain to be refused, got %d", status)
+	}
+	if status := register("dave", "dave@EXAMPLE.org", "a good password", ""); status != http.StatusOK {
+		t.Errorf("Expected the domain to be allowed, got %d", status)
+	}
+}
+
+func TestRegistrationDomains(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	if _, err := engine.SetRegistrationSettings(jutzo.RegistrationSettings{Mode: jutzo.RegistrationDomain}); err != jutzo.ErrInvalidRegistration {
+		t.Errorf("Expected the domain mode to need a domain, got %v", err)
+	}
+	if _, err := engine.SetRegistrationSettings(jutzo.RegistrationSettings{Mode: jutzo.RegistrationDomain,
+		AllowedDomains: []string{"example.org", "corp.example.com"}}); err != nil {
+		t.Fatalf("Unable to set the registration mode: %s", err.Error())
+	}
+
+	// The domain has to match exactly, after the last @
+	for email, allowed := range map[string]bool{
+		"a@example.org":             true,
+		"b@Corp.Example.COM":        true,
+		"c@mail.example.org":        false,
+		"d@example.com":             false,
+		"e@example.org.example.net": false,
+		"f@example.org@example.net": false,
+		"g.example.org":             false,
+	} {
+		user := email[:1]
+		_, _, err := engine.SignUp(user, "a good password", email, "")
+		if allowed && err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", email, err)
+		} else if !allowed && err != jutzo.ErrEmailDomainNotAllowed {
+			t.Errorf("Expected %s to be refused, got %v", email, err)
+		}
+	}
+}
+
+func TestInviteClaims(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	db := engine.GetDatabase()
+	if _, err := db.StoreInvite("bob", "fresh", nil, time.Time{}); err != nil {
+		t.Fatalf("Unable to store an invite: %s", err.Error())
+	}
+	_, _ = db.StoreInvite("bob", "expired", nil, time.Now().Add(-time.Minute))
+
+	// Of several claims at once, only one gets the invite
+	var wait sync.WaitGroup
+	var lock sync.Mutex
+	claimed := 0
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := db.ClaimInvite("fresh", "carol"); err == nil {
+				lock.Lock()
+				claimed++
+				lock.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+	if claimed != 1 {
+		t.Errorf("Expected the invite to be claimed once, got %d", claimed)
+	}
+
+	// A released invite can be claimed again; an expired or unknown one never can
+	if err := db.ReleaseInvite("fresh"); err != nil {
+		t.Fatalf("Unable to release the invite: %s", err.Error())
+	}
+	if invite, err := db.ClaimInvite("fresh", "dave"); err != nil || invite.GetCreatedBy() != "bob" {
+		t.Errorf("Unable to claim the released invite: %v %v", invite, err)
+	}
+	if _, err := db.ClaimInvite("expired", "dave"); err != sql.ErrNoRows {
+		t.Errorf("Expected the expired invite not to be claimed, got %v", err)
+	}
+	if _, err := db.ClaimInvite("unknown", "dave"); err != sql.ErrNoRows {
+		t.Errorf("Expected the unknown invite not to be claimed, got %v", err)
+	}
+}
+
+func TestExternalRegistrationFollowsTheMode(t *testing.T) {
+	engine := newTestEngine(t, map[string]string{
+		"JUTZO_OIDC_TRUSTED_REGISTRATION_EXEMPT": "true",
+		"JUTZO_OIDC_GOOGLE_LINK_ACCOUNTS":        "true",
+	})
+	registerTestUser(t, engine, "frank")
+	login := func(provider string, subject string, email string, verified bool) error {
+		identity := jutzo.ExternalIdentity{Provider: provider, Subject: subject, Email: email, EmailVerified: verified}
+		_, err := engine.LoginExternalIdentity(identity, jutzo.ClientInfo{})
+		return err
+	}
+
+	// New users can't register through a provider while registration is closed,
+	// but existing users can still link their identity
+	_, _ = engine.SetRegistrationSettings(jutzo.RegistrationSettings{Mode: jutzo.RegistrationClosed})
+	if err := login("google", "carol", "carol@example.org", true); err != jutzo.ErrRegistrationClosed {
+		t.Errorf("Expected registration to be closed, got %v", err)
+	}
+	if err := login("google", "frank", "frank@example.com", true); err != nil {
+		t.Errorf("Unable to link an existing user: %s", err.Error())
+	}
+	if err := login("trusted", "erin", "erin@example.net", true); err != nil {
+		t.Errorf("Expected the exempt provider to register the user, got %v", err)
+	}
+
+	// There is no invite to give in the invitation mode
+	_, _ = engine.SetRegistrationSettings(jutzo.RegistrationSettings{Mode: jutzo.RegistrationInvitation})
+	if err := login("google", "carol", "carol@example.org", true); err != jutzo.ErrInviteRequired {
+		t.Errorf("Expected an invite to be required, got %v", err)
+	}
+
+	// The domain mode only believes emails the provider has verified
+	_, _ = engine.SetRegistrationSettings(jutzo.RegistrationSettings{Mode: jutzo.RegistrationDomain, AllowedDomains: []string{"example.org"}})
+	if err := login("google", "dave", "dave@example.com", true); err != jutzo.ErrEmailDomainNotAllowed {
+		t.Errorf("Expected the domain to be refused, got %v", err)
+	}
+	if err := login("google", "carol", "carol@example.org", false); err != jutzo.ErrEmailDomainNotAllowed {
+		t.Errorf("Expected the unverified email to be refused, got %v", err)
+	}
+	if err := login("google", "carol", "carol@example.org", true); err != nil {
+		t.Errorf("Expected the verified email to be allowed, got %v", err)
+	}
+}
+
+func TestExternalIdentitiesOnlyTakeWhatTheyAreTrustedWith(t *testing.T) {
+	engine := newTestEngine(t, map[string]string{"JUTZO_OIDC_GOOGLE_LINK_ACCOUNTS": "true"})
+	registerTestUser(t, engine, "carol")
+	login := func(provider string, subject string, email string, verified bool) error {
+		identity := jutzo.ExternalIdentity{Provider: provider, Subject: subject, Email: email, EmailVerified: verified}
+		_, err := engine.LoginExternalIdentity(identity, jutzo.ClientInfo{})
+		return err
+	}
+
+	// A new user needs an email the provider has verified, and nothing is left behind without one
+	if err := login("google", "dave", "dave@example.com", false); err != jutzo.ErrExternalEmailUnverified {
+		t.Errorf("Expected the unverified email to be refused, got %v", err)
+	}
+	if exists, emailExists, _ := engine.GetDatabase().CheckForUsernameOrEmail("dave", "dave@example.com"); exists || emailExists {
+		t.Errorf("A user was created for the unverified email")
+	}
+
+	// Existing accounts are only linked by providers trusted to, and never administrators
+	if err := login("github", "carol", "carol@example.com", true); err != jutzo.ErrExternalEmailConflict {
+		t.Errorf("Expected the provider not to be allowed to link, got %v", err)
+	}
+	if err := login("google", "bob", "bob@hablutzel.com", true); err != jutzo.ErrExternalEmailConflict {
+		t.Errorf("Expected the administrator not to be linked, got %v", err)
+	}
+	if err := login("google", "carol", "carol@example.com", true); err != nil {
+		t.Errorf("Unable to link an existing user: %s", err.Error())
+	}
+}
+
+func TestCreateInviteRequiresRight(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	registerTestUser(t, engine, "carol")
+	gin.SetMode(gin.TestMode)
+	createInvite := func() int {
+		userSession, err := engine.Login("carol", "test-pass", jutzo.ClientInfo{})
+		if err != nil {
+			t.Fatalf("Unable to log in: %s", err.Error())
+		}
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(http.MethodPost, "/user/invites", strings.NewReader(`{"rights": ["blog"]}`))
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), "userSession", userSession))
+		handleCreateInvite(c, engine)
+		return recorder.Code
+	}
+	invites := func() int {
+		invites, _ := engine.ListInvites("carol")
+		return len(invites)
+	}
+
+	// Carol can only create invites once she has the invite right (or is an admin)
+	if status := createInvite(); status != http.StatusForbidden || invites() != 0 {
+		t.Errorf("Invite created without the invite right: %d", status)
+	}
+	_, _ = engine.GrantRight("carol", jutzo.InviteRight)
+	if status := createInvite(); status != http.StatusOK || invites() != 1 {
+		t.Errorf("Invite refused with the invite right: %d", status)
+	}
+	_, _ = engine.RevokeRight("carol", jutzo.InviteRight)
+	_, _ = engine.GrantRight("carol", "admin")
+	if status := createInvite(); status != http.StatusOK || invites() != 2 {
+		t.Errorf("Invite refused for an admin: %d", status)
+	}
+}
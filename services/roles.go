@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"services/jutzo"
+	"strings"
+)
+
+// Routine for an administrator to list the roles that are defined
+func handleListRoles(c *gin.Context, engine jutzo.Engine) {
+	if roles, err := engine.ListRoles(); err == nil {
+		if roles == nil {
+			roles = []jutzo.Role{}
+		}
+		c.JSON(http.StatusOK, roles)
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to list roles: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to define (or redefine) a role
+func handleDefineRole(c *gin.Context, engine jutzo.Engine) {
+
+	// defineRolePayload holds the rights the role bundles and the
+	// roles it inherits rights from
+	type defineRolePayload struct {
+		Description string   `json:"description"`
+		Rights      []string `json:"rights"`
+		Inherits    []string `json:"inherits"`
+	}
+
+	var payload defineRolePayload
+	err := c.BindJSON(&payload)
+	if checkValidPayload(c, err) {
+		if role, err := engine.DefineRole(c.Param("name"), payload.Description, payload.Rights, payload.Inherits); err == nil {
+			recordAudit(c, engine, jutzo.AuditRoleDefined, c.Param("name"), "rights="+strings.Join(role.GetRights(), ",")+
+				" inherits="+strings.Join(role.GetInheritedRoles(), ","))
+			c.JSON(http.StatusOK, role)
+		} else if err == jutzo.ErrInvalidRole || err == jutzo.ErrRoleCycle || err == jutzo.ErrBuiltInRole {
+			c.String(http.StatusBadRequest, err.Error())
+		} else if err == jutzo.ErrLastAdmin {
+			c.String(http.StatusConflict, err.Error())
+		} else if err == sql.ErrNoRows {
+			c.String(http.StatusBadRequest, "Inherited role not found")
+		} else {
+			c.String(http.StatusInternalServerError, "Unable to define role: %s", err.Error())
+		}
+	}
+}
+
+// Routine for an administrator to delete a role
+func handleDeleteRole(c *gin.Context, engine jutzo.Engine) {
+	if err := engine.DeleteRole(c.Param("name")); err == nil {
+		recordAudit(c, engine, jutzo.AuditRoleDeleted, c.Param("name"), "")
+		c.String(http.StatusOK, "OK")
+	} else if err == jutzo.ErrBuiltInRole {
+		c.String(http.StatusBadRequest, err.Error())
+	} else if err == jutzo.ErrLastAdmin {
+		c.String(http.StatusConflict, err.Error())
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "Role not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to delete role: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to assign a role to a user
+func handleAssignRole(c *gin.Context, engine jutzo.Engine) {
+	if userInfo, err := engine.AssignRole(c.Param("username"), c.Param("role")); err == nil {
+		recordAudit(c, engine, jutzo.AuditRoleAssigned, c.Param("username"), c.Param("role"))
+		c.JSON(http.StatusOK, userRights(userInfo))
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "User or role not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to assign role: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to remove a role from a user
+func handleUnassignRole(c *gin.Context, engine jutzo.Engine) {
+	if userInfo, err := engine.UnassignRole(c.Param("username"), c.Param("role")); err == nil {
+		recordAudit(c, engine, jutzo.AuditRoleUnassigned, c.Param("username"), c.Param("role"))
+		c.JSON(http.StatusOK, userRights(userInfo))
+	} else if err == jutzo.ErrLastAdmin {
+		c.String(http.StatusConflict, err.Error())
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "User not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to remove role: %s", err.Error())
+	}
+}
+
+// userRights describes the roles, rights and status of a user, without
+// anything sensitive (such as the password hash)
+func userRights(userInfo jutzo.UserInfo) gin.H {
+	return gin.H{
+		"username":       userInfo.GetUsername(),
+		"emailValidated": userInfo.IsEmailValidated(),
+		"disabled":       userInfo.IsDisabled(),
+		"roles":          userInfo.GetRoles(),
+		"grantedRights":  userInfo.GetGrantedRights(),
+		"rights":         userInfo.GetAllRights(),
+	}
+}
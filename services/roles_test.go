@@ -0,0 +1,76 @@
+package main
+
+import (
+	"golang.org/x/exp/slices"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"testing"
+	"time"
+)
+
+func TestUserRights(t *testing.T) {
+	userInfo := impl.NewUserInfo("bob", "bob@hablutzel.com", nil, true, []string{"login", "login", "blog"}, time.Now())
+
+	// Duplicates are dropped, and can't make up for a right that isn't held
+	if !slices.Equal(userInfo.GetAllRights(), []string{"login", "blog"}) {
+		t.Errorf("Unexpected rights: %v", userInfo.GetAllRights())
+	}
+	if userInfo.HasRights([]string{"login", "admin"}) || userInfo.HasRights([]string{"admin", "admin"}) {
+		t.Errorf("User should not have the admin right")
+	}
+	if !userInfo.HasRights([]string{"login", "login"}) || !userInfo.HasRights([]string{}) {
+		t.Errorf("User should have the login right")
+	}
+
+	// Rights are matched exactly, so sysadmin is not admin
+	userInfo.GrantRight("sysadmin")
+	if userInfo.HasAnyRight([]string{"admin"}) || !userInfo.HasAnyRight([]string{"admin", "sysadmin"}) {
+		t.Errorf("Rights should be matched exactly")
+	}
+
+	// Direct grants can be revoked; roles are tracked separately
+	userInfo.RevokeRight("blog")
+	userInfo.AssignRole("writer")
+	userInfo.AssignRole("writer")
+	if !slices.Equal(userInfo.GetGrantedRights(), []string{"login", "sysadmin"}) ||
+		!slices.Equal(userInfo.GetRoles(), []string{"writer"}) {
+		t.Errorf("Unexpected grants %v and roles %v", userInfo.GetGrantedRights(), userInfo.GetRoles())
+	}
+	userInfo.RemoveRole("writer")
+	if len(userInfo.GetRoles()) != 0 {
+		t.Errorf("Role was not removed")
+	}
+}
+
+func TestRoleChangesKeepAnAdministrator(t *testing.T) {
+	engine := newTestEngine(t, nil)
+
+	// The built-in roles can't be redefined, so administrator keeps the admin right
+	if _, err := engine.DefineRole(jutzo.AdministratorRole, "", []string{"blog"}, nil); err != jutzo.ErrBuiltInRole {
+		t.Errorf("Expected the administrator role to be refused, got %v", err)
+	}
+	if _, err := engine.DefineRole(jutzo.DefaultUserRole, "", nil, nil); err != jutzo.ErrBuiltInRole {
+		t.Errorf("Expected the user role to be refused, got %v", err)
+	}
+
+	// Once a custom role makes the only administrator, it can't lose the admin right or be deleted
+	registerTestUser(t, engine, "carol")
+	if _, err := engine.DefineRole("keeper", "", []string{"admin"}, nil); err != nil {
+		t.Fatalf("Unable to define the role: %s", err.Error())
+	}
+	if _, err := engine.AssignRole("carol", "keeper"); err != nil {
+		t.Fatalf("Unable to assign the role: %s", err.Error())
+	}
+	if _, err := engine.UnassignRole("bob", jutzo.AdministratorRole); err != nil {
+		t.Fatalf("Unable to unassign the role: %s", err.Error())
+	}
+	if _, err := engine.DefineRole("keeper", "", []string{"blog"}, nil); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept, got %v", err)
+	}
+	if err := engine.DeleteRole("keeper"); err != jutzo.ErrLastAdmin {
+		t.Errorf("Expected the last administrator to be kept, got %v", err)
+	}
+	if carol, _ := engine.GetUser("carol"); !carol.HasRights([]string{"admin"}) {
+		t.Errorf("Administrator lost the admin right: %v", carol.GetAllRights())
+	}
+}
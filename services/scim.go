@@ -0,0 +1,942 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCIMPath is where the SCIM 2.0 (RFC 7643 and 7644) endpoints are served
+const SCIMPath = "/scim/v2"
+
+// The SCIM schemas we use
+const (
+	scimUserSchema            = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema           = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimServiceProviderSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimListSchema            = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema           = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// The number of resources returned by a list without a count
+const defaultSCIMCount = 100
+
+// scimFilter matches the filters we support, e.g. userName eq "bob"
+var scimFilter = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+(?i:eq)\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// scimMemberFilter matches the path used to remove a single member from a
+// group, e.g. members[value eq "bob"]
+var scimMemberFilter = regexp.MustCompile(`^(?i:members)\[\s*(?i:value)\s+(?i:eq)\s+("(?:[^"\\]|\\.)*")\s*]$`)
+
+// scimError is the body of every SCIM error response
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (err *scimError) Error() string {
+	return err.detail
+}
+
+// scimPatchOperation is one of the operations in a SCIM PATCH request
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimPatchPayload is the body of a SCIM PATCH request
+type scimPatchPayload struct {
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+// scimEmail is one of the emails of a SCIM user. We only keep one email, the
+// primary one (or the first, if none is marked primary)
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary"`
+}
+
+// scimMember is a member of a SCIM group; the value is the username
+type scimMember struct {
+	Value string `json:"value"`
+}
+
+// scimUserPayload is the body of a request to create or replace a user
+type scimUserPayload struct {
+	UserName    string      `json:"userName"`
+	Password    string      `json:"password"`
+	Active      *bool       `json:"active"`
+	DisplayName string      `json:"displayName"`
+	Emails      []scimEmail `json:"emails"`
+	Name        struct {
+		Formatted  string `json:"formatted"`
+		GivenName  string `json:"givenName"`
+		FamilyName string `json:"familyName"`
+	} `json:"name"`
+}
+
+// email of the user: the primary one, or the first
+func (payload *scimUserPayload) email() string {
+	return primaryEmail(payload.Emails)
+}
+
+// displayName of the user, made up from their name if it isn't given
+func (payload *scimUserPayload) displayName() string {
+	if payload.DisplayName != "" {
+		return payload.DisplayName
+	} else if payload.Name.Formatted != "" {
+		return payload.Name.Formatted
+	}
+	return strings.TrimSpace(payload.Name.GivenName + " " + payload.Name.FamilyName)
+}
+
+// scimGroupPayload is the body of a request to create a group
+type scimGroupPayload struct {
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+}
+
+// requireSCIMToken authenticates the bearer token of a SCIM request, saving
+// the token in the context so that changes can be attributed to it
+func requireSCIMToken(engine jutzo.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var encoded string
+		if _, err := fmt.Sscanf(c.GetHeader("Authorization"), "Bearer %s", &encoded); err != nil {
+			abortSCIM(c, &scimError{status: http.StatusUnauthorized, detail: "A SCIM bearer token is required"})
+		} else if scimToken, err := engine.AuthenticateSCIMToken(encoded); err == nil {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), "scimToken", scimToken))
+			c.Next()
+		} else if err == jutzo.ErrInvalidSCIMToken {
+			abortSCIM(c, &scimError{status: http.StatusUnauthorized, detail: err.Error()})
+		} else {
+			abortSCIM(c, &scimError{status: http.StatusInternalServerError, detail: err.Error()})
+		}
+	}
+}
+
+// recordSCIMAudit of a change made through the SCIM endpoints. The actor is
+// the name of the SCIM token, as there is no logged-in user
+func recordSCIMAudit(c *gin.Context, engine jutzo.Engine, eventType string, target string, detail string) {
+	scimToken, _ := c.Request.Context().Value("scimToken").(jutzo.SCIMToken)
+	storeAuditEvent(c, engine, jutzo.AuditEvent{Type: eventType, Actor: "scim:" + scimToken.Name, Target: target, Detail: detail})
+}
+
+// respondSCIM with a SCIM resource or message
+func respondSCIM(c *gin.Context, status int, body any) {
+	c.Header("Content-Type", "application/scim+json")
+	c.JSON(status, body)
+}
+
+// abortSCIM with the error, as a SCIM error message
+func abortSCIM(c *gin.Context, err error) {
+	scimErr, ok := err.(*scimError)
+	if !ok {
+		scimErr = scimErrorFor(err)
+	}
+	body := gin.H{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(scimErr.status), "detail": scimErr.detail}
+	if scimErr.scimType != "" {
+		body["scimType"] = scimErr.scimType
+	}
+	c.Header("Content-Type", "application/scim+json")
+	c.AbortWithStatusJSON(scimErr.status, body)
+}
+
+// scimErrorFor an error returned by the engine
+func scimErrorFor(err error) *scimError {
+	var policyError *jutzo.PasswordPolicyError
+	var profileError *jutzo.InvalidProfileError
+	switch {
+	case err == sql.ErrNoRows:
+		return &scimError{status: http.StatusNotFound, detail: "Resource not found"}
+	case err == jutzo.ErrEmailInUse:
+		return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: err.Error()}
+	case err == jutzo.ErrLastAdmin:
+		return &scimError{status: http.StatusConflict, detail: err.Error()}
+	case err == jutzo.ErrBuiltInRole:
+		return &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: err.Error()}
+	case err == jutzo.ErrInvalidRole || err == jutzo.ErrInvalidUserQuery || err == jutzo.ErrInvalidUsername:
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+	case errors.As(err, &policyError), errors.As(err, &profileError):
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: err.Error()}
+	default:
+		return &scimError{status: http.StatusInternalServerError, detail: err.Error()}
+	}
+}
+
+// scimLocation of a resource
+func scimLocation(c *gin.Context, resourceType string, id string) string {
+	return createHATEOASURL(c, "%s/%s/%s", SCIMPath, resourceType, url.PathEscape(id))
+}
+
+// scimUser describes the user as a SCIM user resource. The user's ID is their username
+func scimUser(c *gin.Context, userInfo jutzo.UserInfo) gin.H {
+	username := userInfo.GetUsername()
+	groups := make([]gin.H, 0, len(userInfo.GetRoles()))
+	for _, role := range userInfo.GetRoles() {
+		groups = append(groups, gin.H{"value": role, "display": role, "$ref": scimLocation(c, "Groups", role)})
+	}
+	user := gin.H{
+		"schemas":  []string{scimUserSchema},
+		"id":       username,
+		"userName": username,
+		"active":   !userInfo.IsDisabled(),
+		"emails":   []gin.H{{"value": userInfo.GetEmail(), "primary": true}},
+		"groups":   groups,
+		"meta": gin.H{
+			"resourceType": "User",
+			"created":      userInfo.GetCreationTime().UTC().Format(time.RFC3339),
+			"location":     scimLocation(c, "Users", username),
+		},
+	}
+	if profile := userInfo.GetProfile(); profile.DisplayName != "" {
+		user["displayName"] = profile.DisplayName
+		user["name"] = gin.H{"formatted": profile.DisplayName}
+	}
+	return user
+}
+
+// scimGroup describes the role as a SCIM group resource, whose members are
+// the users the role is assigned to. The group's ID is the role name
+func scimGroup(c *gin.Context, role jutzo.Role, members []string) gin.H {
+	group := gin.H{
+		"schemas":     []string{scimGroupSchema},
+		"id":          role.GetName(),
+		"displayName": role.GetName(),
+		"meta":        gin.H{"resourceType": "Group", "location": scimLocation(c, "Groups", role.GetName())},
+	}
+	if members != nil {
+		values := make([]gin.H, 0, len(members))
+		for _, member := range members {
+			values = append(values, gin.H{"value": member, "display": member, "$ref": scimLocation(c, "Users", member)})
+		}
+		group["members"] = values
+	}
+	return group
+}
+
+// scimList is a SCIM list response
+func scimList(resources []gin.H, total int, startIndex int) gin.H {
+	return gin.H{"schemas": []string{scimListSchema}, "totalResults": total, "startIndex": startIndex,
+		"itemsPerPage": len(resources), "Resources": resources}
+}
+
+// scimPaging reads the 1-based startIndex and the count of a list request
+func scimPaging(c *gin.Context) (startIndex int, count int, err error) {
+	startIndex, count = 1, defaultSCIMCount
+	if value := c.Query("startIndex"); value != "" {
+		if startIndex, err = strconv.Atoi(value); err != nil {
+			return 0, 0, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Malformed startIndex"}
+		} else if startIndex < 1 {
+			startIndex = 1
+		}
+	}
+	if value := c.Query("count"); value != "" {
+		if count, err = strconv.Atoi(value); err != nil {
+			return 0, 0, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Malformed count"}
+		} else if count < 0 {
+			count = 0
+		} else if count > impl.MaxUserQueryLimit {
+			count = impl.MaxUserQueryLimit
+		}
+	}
+	return startIndex, count, nil
+}
+
+// parseSCIMFilter of the form `attribute eq "value"`, the only form we support
+func parseSCIMFilter(filter string) (attribute string, value string, err error) {
+	if match := scimFilter.FindStringSubmatch(filter); match != nil {
+		if err = json.Unmarshal([]byte(match[2]), &value); err == nil {
+			return strings.ToLower(match[1]), value, nil
+		}
+	}
+	return "", "", &scimError{status: http.StatusBadRequest, scimType: "invalidFilter",
+		detail: `Only filters of the form attribute eq "value" are supported`}
+}
+
+// Routine to describe what our SCIM service supports
+func handleSCIMServiceProviderConfig(c *gin.Context) {
+	respondSCIM(c, http.StatusOK, gin.H{
+		"schemas":        []string{scimServiceProviderSchema},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": impl.MaxUserQueryLimit},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{"type": "oauthbearertoken", "name": "Bearer token",
+			"description": "A SCIM token issued by a Jutzo administrator"}},
+	})
+}
+
+// Routine to list users, optionally filtered by userName or emails
+func handleSCIMListUsers(c *gin.Context, engine jutzo.Engine) {
+	startIndex, count, err := scimPaging(c)
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	}
+
+	// A filter selects a single user
+	if filter := c.Query("filter"); filter != "" {
+		attribute, value, err := parseSCIMFilter(filter)
+		if err != nil {
+			abortSCIM(c, err)
+			return
+		}
+		var userInfo jutzo.UserInfo
+		switch attribute {
+		case "username":
+			userInfo, err = engine.GetUser(value)
+		case "emails", "emails.value":
+			userInfo, err = engine.GetUserByEmail(value)
+		default:
+			abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter",
+				detail: "Users can only be filtered by userName or emails"})
+			return
+		}
+		resources := []gin.H{}
+		if err == nil && startIndex == 1 && count > 0 {
+			resources = append(resources, scimUser(c, userInfo))
+		} else if err != nil && err != sql.ErrNoRows {
+			abortSCIM(c, err)
+			return
+		}
+		total := 1
+		if err == sql.ErrNoRows {
+			total = 0
+		}
+		respondSCIM(c, http.StatusOK, scimList(resources, total, startIndex))
+		return
+	}
+
+	// Otherwise page through all the users, skipping those before the start
+	resources := []gin.H{}
+	query := jutzo.UserQuery{Limit: impl.MaxUserQueryLimit}
+	skip, total := startIndex-1, 0
+	for {
+		page, err := engine.ListUsers(query)
+		if err != nil {
+			abortSCIM(c, err)
+			return
+		}
+		total = page.Total
+		for _, userInfo := range page.Users {
+			if skip > 0 {
+				skip--
+			} else if len(resources) < count {
+				resources = append(resources, scimUser(c, userInfo))
+			}
+		}
+		if page.NextCursor == "" || len(resources) == count {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	respondSCIM(c, http.StatusOK, scimList(resources, total, startIndex))
+}
+
+// Routine to get a single user
+func handleSCIMGetUser(c *gin.Context, engine jutzo.Engine) {
+	if userInfo, err := engine.GetUser(c.Param("id")); err == nil {
+		respondSCIM(c, http.StatusOK, scimUser(c, userInfo))
+	} else {
+		abortSCIM(c, err)
+	}
+}
+
+// Routine to provision a new user. The email is taken as validated. Users
+// provisioned without a password can only log in through an external identity
+// provider or directory
+func handleSCIMCreateUser(c *gin.Context, engine jutzo.Engine) {
+	var payload scimUserPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+		return
+	}
+	email := payload.email()
+	if payload.UserName == "" || email == "" {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "userName and emails are required"})
+		return
+	}
+
+	result, userInfo, err := engine.ProvisionUser(payload.UserName, payload.Password, email)
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	} else if result == jutzo.DuplicateUsername {
+		abortSCIM(c, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "The userName is already in use"})
+		return
+	} else if result == jutzo.DuplicateEmail {
+		abortSCIM(c, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "The email is already in use"})
+		return
+	}
+	username := userInfo.GetUsername()
+
+	// The rest of the user is filled in once it exists. If that fails, the user is
+	// removed again so that the identity management system can retry the whole request
+	displayName := payload.displayName()
+	if displayName != "" {
+		userInfo, err = engine.UpdateProfile(username, jutzo.ProfilePatch{DisplayName: &displayName})
+	}
+	if err == nil && payload.Active != nil && !*payload.Active {
+		userInfo, err = engine.SetLoginEnabled(username, false)
+	}
+	if err != nil {
+		if _, deleteErr := engine.DeleteUser(username); deleteErr != nil {
+			log.Printf("Unable to remove partly provisioned user %s: %s", username, deleteErr.Error())
+		}
+		abortSCIM(c, err)
+		return
+	}
+
+	recordSCIMAudit(c, engine, jutzo.AuditUserRegistered, username, "provisioned")
+	if userInfo.IsDisabled() {
+		recordSCIMAudit(c, engine, jutzo.AuditLoginDisabled, username, "")
+	}
+	c.Header("Location", scimLocation(c, "Users", username))
+	respondSCIM(c, http.StatusCreated, scimUser(c, userInfo))
+}
+
+// scimUserChanges are the changes a PUT or PATCH request makes to a user
+type scimUserChanges struct {
+	email       *string
+	displayName *string
+	active      *bool
+}
+
+// Routine to replace a user. Users can't be renamed, and passwords can't be
+// changed through SCIM
+func handleSCIMReplaceUser(c *gin.Context, engine jutzo.Engine) {
+	var payload scimUserPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+		return
+	}
+	if payload.UserName != "" && payload.UserName != c.Param("id") {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: "userName cannot be changed"})
+		return
+	}
+
+	displayName := payload.displayName()
+	changes := scimUserChanges{displayName: &displayName, active: payload.Active}
+	if email := payload.email(); email != "" {
+		changes.email = &email
+	}
+	applySCIMUserChanges(c, engine, changes)
+}
+
+// Routine to change some of the attributes of a user: active (to deactivate
+// or reactivate them), emails and displayName (or name.formatted)
+func handleSCIMPatchUser(c *gin.Context, engine jutzo.Engine) {
+	var payload scimPatchPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+		return
+	}
+
+	var changes scimUserChanges
+	for _, operation := range payload.Operations {
+		err := forEachSCIMAttribute(operation, func(op string, path string, value json.RawMessage) error {
+			return patchSCIMUser(&changes, c.Param("id"), op, path, value)
+		})
+		if err != nil {
+			abortSCIM(c, err)
+			return
+		}
+	}
+	applySCIMUserChanges(c, engine, changes)
+}
+
+// forEachSCIMAttribute the operation changes. An operation without a path
+// changes each of the attributes in its value
+func forEachSCIMAttribute(operation scimPatchOperation, change func(op string, path string, value json.RawMessage) error) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: "Unknown operation " + operation.Op}
+	}
+	if operation.Path != "" {
+		return change(op, operation.Path, operation.Value)
+	}
+
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &attributes); err != nil {
+		return &scimError{status: http.StatusBadRequest, scimType: "noTarget", detail: "An operation without a path needs an object value"}
+	}
+	for path, value := range attributes {
+		if err := change(op, path, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchSCIMUser records the change the operation makes to the attribute
+func patchSCIMUser(changes *scimUserChanges, username string, op string, path string, value json.RawMessage) error {
+	invalidValue := &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Invalid value for " + path}
+	attribute := strings.ToLower(path)
+	switch {
+	case attribute == "active":
+		// Some identity management systems send booleans as strings
+		var active bool
+		var text string
+		if err := json.Unmarshal(value, &active); err != nil {
+			if err = json.Unmarshal(value, &text); err != nil {
+				return invalidValue
+			} else if active, err = strconv.ParseBool(text); err != nil {
+				return invalidValue
+			}
+		}
+		changes.active = &active
+
+	case attribute == "displayname" || attribute == "name.formatted":
+		var displayName string
+		if op != "remove" && json.Unmarshal(value, &displayName) != nil {
+			return invalidValue
+		}
+		changes.displayName = &displayName
+
+	case attribute == "name":
+		var name struct {
+			Formatted string `json:"formatted"`
+		}
+		if op != "remove" && json.Unmarshal(value, &name) != nil {
+			return invalidValue
+		}
+		changes.displayName = &name.Formatted
+
+	case strings.HasPrefix(attribute, "emails"):
+		if op == "remove" {
+			return &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: "Users must have an email"}
+		}
+		var email string
+		var emails []scimEmail
+		if json.Unmarshal(value, &email) != nil {
+			if json.Unmarshal(value, &emails) != nil {
+				return invalidValue
+			}
+			email = primaryEmail(emails)
+		}
+		if email == "" {
+			return invalidValue
+		}
+		changes.email = &email
+
+	case attribute == "username":
+		var newName string
+		if json.Unmarshal(value, &newName) != nil || newName != username {
+			return &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: "userName cannot be changed"}
+		}
+
+	default:
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "Unsupported attribute " + path}
+	}
+	return nil
+}
+
+// primaryEmail of the emails: the one marked primary, or the first
+func primaryEmail(emails []scimEmail) string {
+	for _, email := range emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// applySCIMUserChanges to the user, responding with the updated user
+func applySCIMUserChanges(c *gin.Context, engine jutzo.Engine, changes scimUserChanges) {
+	username := c.Param("id")
+	userInfo, err := engine.GetUser(username)
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	}
+
+	if changes.displayName != nil && *changes.displayName != userInfo.GetProfile().DisplayName {
+		if userInfo, err = engine.UpdateProfile(username, jutzo.ProfilePatch{DisplayName: changes.displayName}); err != nil {
+			abortSCIM(c, err)
+			return
+		}
+		recordSCIMAudit(c, engine, jutzo.AuditProfileUpdated, username, "displayName")
+	}
+	if changes.email != nil && *changes.email != userInfo.GetEmail() {
+		if userInfo, err = engine.ChangeEmail(username, *changes.email); err != nil {
+			abortSCIM(c, err)
+			return
+		}
+		recordSCIMAudit(c, engine, jutzo.AuditEmailChanged, username, "")
+	}
+	if changes.active != nil && *changes.active == userInfo.IsDisabled() {
+		if userInfo, err = engine.SetLoginEnabled(username, *changes.active); err != nil {
+			abortSCIM(c, err)
+			return
+		}
+		if *changes.active {
+			recordSCIMAudit(c, engine, jutzo.AuditLoginEnabled, username, "")
+		} else {
+			recordSCIMAudit(c, engine, jutzo.AuditLoginDisabled, username, "")
+		}
+	}
+	respondSCIM(c, http.StatusOK, scimUser(c, userInfo))
+}
+
+// Routine to delete a user
+func handleSCIMDeleteUser(c *gin.Context, engine jutzo.Engine) {
+	if pseudonym, err := engine.DeleteUser(c.Param("id")); err == nil {
+		recordSCIMAudit(c, engine, jutzo.AuditUserDeleted, pseudonym, "")
+		c.Status(http.StatusNoContent)
+	} else {
+		abortSCIM(c, err)
+	}
+}
+
+// findRole with the given name, returning sql.ErrNoRows if there is no such role
+func findRole(engine jutzo.Engine, name string) (jutzo.Role, error) {
+	if roles, err := engine.ListRoles(); err == nil {
+		for _, role := range roles {
+			if role.GetName() == name {
+				return role, nil
+			}
+		}
+		return nil, sql.ErrNoRows
+	} else {
+		return nil, err
+	}
+}
+
+// scimRoleDescription describes the roles created through SCIM
+const scimRoleDescription = "Provisioned through SCIM"
+
+// isSCIMGroup determines if the role is one that SCIM manages. These are the
+// roles SCIM created (or an administrator has since described as if it had),
+// but never the built-in roles or a role that brings the administrator role,
+// so that an identity management system can't make anyone an administrator
+func isSCIMGroup(role jutzo.Role) bool {
+	return role.GetDescription() == scimRoleDescription && role.GetName() != jutzo.AdministratorRole &&
+		role.GetName() != jutzo.DefaultUserRole && !slices.Contains(role.GetInheritedRoles(), jutzo.AdministratorRole)
+}
+
+// findSCIMGroup with the given name, returning sql.ErrNoRows if there is no
+// such role or it isn't one that SCIM manages
+func findSCIMGroup(engine jutzo.Engine, name string) (jutzo.Role, error) {
+	if role, err := findRole(engine, name); err != nil {
+		return nil, err
+	} else if !isSCIMGroup(role) {
+		return nil, sql.ErrNoRows
+	} else {
+		return role, nil
+	}
+}
+
+// describeSCIMGroup with its members, unless the request excludes them
+func describeSCIMGroup(c *gin.Context, engine jutzo.Engine, role jutzo.Role) (gin.H, error) {
+	var members []string
+	if !strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members") {
+		var err error
+		if members, err = engine.ListRoleMembers(role.GetName()); err != nil {
+			return nil, err
+		}
+	}
+	return scimGroup(c, role, members), nil
+}
+
+// Routine to list the groups (which are the roles SCIM manages), optionally
+// filtered by displayName
+func handleSCIMListGroups(c *gin.Context, engine jutzo.Engine) {
+	startIndex, count, err := scimPaging(c)
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	}
+	allRoles, err := engine.ListRoles()
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	}
+	var roles []jutzo.Role
+	for _, role := range allRoles {
+		if isSCIMGroup(role) {
+			roles = append(roles, role)
+		}
+	}
+
+	if filter := c.Query("filter"); filter != "" {
+		attribute, value, err := parseSCIMFilter(filter)
+		if err != nil {
+			abortSCIM(c, err)
+			return
+		} else if attribute != "displayname" && attribute != "id" {
+			abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidFilter",
+				detail: "Groups can only be filtered by displayName"})
+			return
+		}
+		var selected []jutzo.Role
+		for _, role := range roles {
+			if role.GetName() == value {
+				selected = append(selected, role)
+			}
+		}
+		roles = selected
+	}
+
+	resources := []gin.H{}
+	for index := startIndex - 1; index < len(roles) && len(resources) < count; index++ {
+		if group, err := describeSCIMGroup(c, engine, roles[index]); err == nil {
+			resources = append(resources, group)
+		} else {
+			abortSCIM(c, err)
+			return
+		}
+	}
+	respondSCIM(c, http.StatusOK, scimList(resources, len(roles), startIndex))
+}
+
+// Routine to get a single group
+func handleSCIMGetGroup(c *gin.Context, engine jutzo.Engine) {
+	role, err := findSCIMGroup(engine, c.Param("id"))
+	if err == nil {
+		var group gin.H
+		if group, err = describeSCIMGroup(c, engine, role); err == nil {
+			respondSCIM(c, http.StatusOK, group)
+			return
+		}
+	}
+	abortSCIM(c, err)
+}
+
+// Routine to create a group. This defines a role with no rights of its own;
+// an administrator decides what rights the role brings its members
+func handleSCIMCreateGroup(c *gin.Context, engine jutzo.Engine) {
+	var payload scimGroupPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+		return
+	}
+	if _, err := findRole(engine, payload.DisplayName); err == nil {
+		abortSCIM(c, &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "The group already exists"})
+		return
+	} else if err != sql.ErrNoRows {
+		abortSCIM(c, err)
+		return
+	}
+
+	// Every member has to exist before anything is created
+	for _, member := range payload.Members {
+		if _, err := engine.GetUser(member.Value); err != nil {
+			abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Unknown member " + member.Value})
+			return
+		}
+	}
+
+	role, err := engine.DefineRole(payload.DisplayName, scimRoleDescription, nil, nil)
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	}
+	recordSCIMAudit(c, engine, jutzo.AuditRoleDefined, role.GetName(), "provisioned")
+	for _, member := range payload.Members {
+		if _, err := engine.AssignRole(member.Value, role.GetName()); err != nil {
+			abortSCIM(c, err)
+			return
+		}
+		recordSCIMAudit(c, engine, jutzo.AuditRoleAssigned, member.Value, role.GetName())
+	}
+
+	if group, err := describeSCIMGroup(c, engine, role); err == nil {
+		c.Header("Location", scimLocation(c, "Groups", role.GetName()))
+		respondSCIM(c, http.StatusCreated, group)
+	} else {
+		abortSCIM(c, err)
+	}
+}
+
+// Routine to add members to, remove members from, or replace the members of
+// a group. Groups can't be renamed, and only the roles SCIM manages are groups
+func handleSCIMPatchGroup(c *gin.Context, engine jutzo.Engine) {
+	var payload scimPatchPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		abortSCIM(c, &scimError{status: http.StatusBadRequest, scimType: "invalidSyntax", detail: err.Error()})
+		return
+	}
+	role, err := findSCIMGroup(engine, c.Param("id"))
+	if err != nil {
+		abortSCIM(c, err)
+		return
+	}
+	name := role.GetName()
+
+	for _, operation := range payload.Operations {
+		err := forEachSCIMAttribute(operation, func(op string, path string, value json.RawMessage) error {
+			return patchSCIMGroup(c, engine, name, op, path, value)
+		})
+		if err != nil {
+			abortSCIM(c, err)
+			return
+		}
+	}
+
+	if group, err := describeSCIMGroup(c, engine, role); err == nil {
+		respondSCIM(c, http.StatusOK, group)
+	} else {
+		abortSCIM(c, err)
+	}
+}
+
+// patchSCIMGroup makes the change the operation asks of the group's members
+func patchSCIMGroup(c *gin.Context, engine jutzo.Engine, role string, op string, path string, value json.RawMessage) error {
+	if strings.EqualFold(path, "displayName") {
+		var displayName string
+		if json.Unmarshal(value, &displayName) != nil || displayName != role {
+			return &scimError{status: http.StatusBadRequest, scimType: "mutability", detail: "Groups cannot be renamed"}
+		}
+		return nil
+	}
+
+	// A single member can be removed with a filter in the path
+	if match := scimMemberFilter.FindStringSubmatch(path); match != nil && op == "remove" {
+		var member string
+		if err := json.Unmarshal([]byte(match[1]), &member); err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidFilter", detail: "Malformed member filter"}
+		}
+		return unassignSCIMMember(c, engine, role, member)
+	} else if !strings.EqualFold(path, "members") {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidPath", detail: "Unsupported attribute " + path}
+	}
+
+	var members []scimMember
+	if len(value) > 0 && json.Unmarshal(value, &members) != nil {
+		return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Invalid value for members"}
+	}
+
+	// Removing without a value, or replacing, starts by removing the members not wanted
+	if op == "replace" || (op == "remove" && len(members) == 0) {
+		current, err := engine.ListRoleMembers(role)
+		if err != nil {
+			return err
+		}
+		for _, username := range current {
+			if !containsMember(members, username) || op == "remove" {
+				if err = unassignSCIMMember(c, engine, role, username); err != nil {
+					return err
+				}
+			}
+		}
+		if op == "remove" {
+			return nil
+		}
+	}
+
+	for _, member := range members {
+		if op == "remove" {
+			if err := unassignSCIMMember(c, engine, role, member.Value); err != nil {
+				return err
+			}
+		} else if userInfo, err := engine.GetUser(member.Value); err != nil {
+			return &scimError{status: http.StatusBadRequest, scimType: "invalidValue", detail: "Unknown member " + member.Value}
+		} else if !slices.Contains(userInfo.GetRoles(), role) {
+			if _, err = engine.AssignRole(member.Value, role); err != nil {
+				return err
+			}
+			recordSCIMAudit(c, engine, jutzo.AuditRoleAssigned, member.Value, role)
+		}
+	}
+	return nil
+}
+
+// unassignSCIMMember from the group (the role)
+func unassignSCIMMember(c *gin.Context, engine jutzo.Engine, role string, username string) error {
+	if _, err := engine.UnassignRole(username, role); err != nil {
+		return err
+	}
+	recordSCIMAudit(c, engine, jutzo.AuditRoleUnassigned, username, role)
+	return nil
+}
+
+// containsMember determines if the user is one of the members
+func containsMember(members []scimMember, username string) bool {
+	for _, member := range members {
+		if member.Value == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Routine to delete a group, which deletes the role. Only the roles SCIM
+// manages can be deleted
+func handleSCIMDeleteGroup(c *gin.Context, engine jutzo.Engine) {
+	if _, err := findSCIMGroup(engine, c.Param("id")); err != nil {
+		abortSCIM(c, err)
+	} else if err = engine.DeleteRole(c.Param("id")); err == nil {
+		recordSCIMAudit(c, engine, jutzo.AuditRoleDeleted, c.Param("id"), "")
+		c.Status(http.StatusNoContent)
+	} else {
+		abortSCIM(c, err)
+	}
+}
+
+// Routine for an administrator to issue a SCIM token for an identity
+// management system. The token is returned in the response and cannot be
+// retrieved again
+func handleCreateSCIMToken(c *gin.Context, engine jutzo.Engine) {
+
+	// createSCIMTokenPayload names the system the token is for
+	type createSCIMTokenPayload struct {
+		Name string `json:"name" binding:"required"`
+	}
+
+	if userSession, ok := getInteractiveSession(c); ok {
+		var payload createSCIMTokenPayload
+		err := c.BindJSON(&payload)
+		if checkValidPayload(c, err) {
+			if token, scimToken, err := engine.CreateSCIMToken(userSession.GetUserInfo().GetUsername(), payload.Name); err == nil {
+				recordAudit(c, engine, jutzo.AuditSCIMTokenIssued, scimToken.ID, scimToken.Name)
+				c.JSON(http.StatusOK, gin.H{"token": token, "scimToken": scimToken})
+			} else {
+				c.String(http.StatusInternalServerError, "Unable to create SCIM token: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Routine for an administrator to list the SCIM tokens that have been issued
+func handleListSCIMTokens(c *gin.Context, engine jutzo.Engine) {
+	if tokens, err := engine.ListSCIMTokens(); err == nil {
+		if tokens == nil {
+			tokens = []jutzo.SCIMToken{}
+		}
+		c.JSON(http.StatusOK, tokens)
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to list SCIM tokens: %s", err.Error())
+	}
+}
+
+// Routine for an administrator to revoke a SCIM token
+func handleRevokeSCIMToken(c *gin.Context, engine jutzo.Engine) {
+	if err := engine.RevokeSCIMToken(c.Param("id")); err == nil {
+		recordAudit(c, engine, jutzo.AuditSCIMTokenRevoked, c.Param("id"), "")
+		c.String(http.StatusOK, "OK")
+	} else if err == sql.ErrNoRows {
+		c.String(http.StatusNotFound, "SCIM token not found")
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to revoke SCIM token: %s", err.Error())
+	}
+}
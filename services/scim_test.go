@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scimSender sends a SCIM request with the token given, returning the response
+// and its body decoded
+type scimSender func(method string, path string, token string, body string) (*httptest.ResponseRecorder, map[string]any)
+
+// scimTestRouter serves the SCIM endpoints from the engine, returning a
+// sender for them and a token bob issued to "okta"
+func scimTestRouter(t *testing.T, engine *impl.EngineImpl) (scimSender, string) {
+	token, _, err := engine.CreateSCIMToken("bob", "okta")
+	if err != nil {
+		t.Fatalf("Unable to create a SCIM token: %s", err.Error())
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	scim := router.Group(SCIMPath, requireSCIMToken(engine))
+	scim.GET("/Users", func(c *gin.Context) { handleSCIMListUsers(c, engine) })
+	scim.POST("/Users", func(c *gin.Context) { handleSCIMCreateUser(c, engine) })
+	scim.PATCH("/Users/:id", func(c *gin.Context) { handleSCIMPatchUser(c, engine) })
+	scim.GET("/Groups", func(c *gin.Context) { handleSCIMListGroups(c, engine) })
+	scim.POST("/Groups", func(c *gin.Context) { handleSCIMCreateGroup(c, engine) })
+	scim.GET("/Groups/:id", func(c *gin.Context) { handleSCIMGetGroup(c, engine) })
+	scim.PATCH("/Groups/:id", func(c *gin.Context) { handleSCIMPatchGroup(c, engine) })
+	scim.DELETE("/Groups/:id", func(c *gin.Context) { handleSCIMDeleteGroup(c, engine) })
+	return func(method string, path string, token string, body string) (*httptest.ResponseRecorder, map[string]any) {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, SCIMPath+path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Content-Type", "application/scim+json")
+		router.ServeHTTP(recorder, request)
+		var response map[string]any
+		_ = json.Unmarshal(recorder.Body.Bytes(), &response)
+		return recorder, response
+	}, token
+}
+
+func TestSCIMProvisioning(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	send, token := scimTestRouter(t, engine)
+
+	// Only our tokens are accepted
+	if recorder, response := send(http.MethodGet, "/Users", "jutzo_scim_wrong", ""); recorder.Code != http.StatusUnauthorized ||
+		response["status"] != "401" {
+		t.Errorf("Expected an unauthorized SCIM error, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Creating a user, then creating it again
+	user := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "carol",
+		"name": {"givenName": "Carol", "familyName": "Smith"}, "emails": [{"value": "carol@example.com", "primary": true}]}`
+	recorder, response := send(http.MethodPost, "/Users", token, user)
+	if recorder.Code != http.StatusCreated || response["id"] != "carol" || response["displayName"] != "Carol Smith" ||
+		response["active"] != true || !strings.HasSuffix(recorder.Header().Get("Location"), "/scim/v2/Users/carol") {
+		t.Fatalf("Create failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, response = send(http.MethodPost, "/Users", token, user); recorder.Code != http.StatusConflict ||
+		response["scimType"] != "uniqueness" {
+		t.Errorf("Expected a uniqueness conflict, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if events, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditUserRegistered}}); len(events) != 1 ||
+		events[0].Actor != "scim:okta" || events[0].Target != "carol" {
+		t.Errorf("Creation was not audited: %+v", events)
+	}
+
+	// Filtering finds the user by userName or email
+	for filter, expected := range map[string]float64{`userName eq "carol"`: 1, `emails.value eq "carol@example.com"`: 1,
+		`userName eq "dave"`: 0} {
+		recorder, response = send(http.MethodGet, "/Users?filter="+strings.ReplaceAll(filter, " ", "%20"), token, "")
+		if recorder.Code != http.StatusOK || response["totalResults"] != expected {
+			t.Errorf("Unexpected result for %s: %d %s", filter, recorder.Code, recorder.Body.String())
+		}
+	}
+	if recorder, response = send(http.MethodGet, `/Users?filter=title%20co%20"x"`, token, ""); recorder.Code != http.StatusBadRequest ||
+		response["scimType"] != "invalidFilter" {
+		t.Errorf("Expected an invalid filter, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Deactivating, with the boolean sent as a string as some systems do
+	patch := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "Replace", "path": "active", "value": "False"}]}`
+	recorder, response = send(http.MethodPatch, "/Users/carol", token, patch)
+	if carol, _ := engine.GetUser("carol"); recorder.Code != http.StatusOK || response["active"] != false || !carol.IsDisabled() {
+		t.Errorf("Deactivate failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Group membership is role assignment
+	if recorder, _ = send(http.MethodPost, "/Groups", token, `{"displayName": "staff"}`); recorder.Code != http.StatusCreated {
+		t.Fatalf("Unable to create a group: %d %s", recorder.Code, recorder.Body.String())
+	}
+	patch = `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "carol"}]}]}`
+	recorder, response = send(http.MethodPatch, "/Groups/staff", token, patch)
+	if carol, _ := engine.GetUser("carol"); recorder.Code != http.StatusOK || !slices.Contains(carol.GetRoles(), "staff") {
+		t.Errorf("Adding a member failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if members, _ := response["members"].([]any); len(members) != 1 {
+		t.Errorf("Unexpected members: %s", recorder.Body.String())
+	}
+	patch = `{"Operations": [{"op": "remove", "path": "members[value eq \"carol\"]"}]}`
+	recorder, _ = send(http.MethodPatch, "/Groups/staff", token, patch)
+	if carol, _ := engine.GetUser("carol"); recorder.Code != http.StatusOK || slices.Contains(carol.GetRoles(), "staff") {
+		t.Errorf("Removing a member failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	patch = `{"Operations": [{"op": "replace", "path": "displayName", "value": "employees"}]}`
+	if recorder, response = send(http.MethodPatch, "/Groups/staff", token, patch); recorder.Code != http.StatusBadRequest ||
+		response["scimType"] != "mutability" {
+		t.Errorf("Expected groups not to be renamed, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, _ = send(http.MethodGet, "/Groups/nobody", token, ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown group not to be found, got %d", recorder.Code)
+	}
+}
+
+func TestSCIMOnlyManagesItsOwnGroups(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	send, token := scimTestRouter(t, engine)
+	registerTestUser(t, engine, "carol")
+	if _, err := engine.DefineRole("editors", "Edits the blog", []string{"blog"}, nil); err != nil {
+		t.Fatalf("Unable to define a role: %s", err.Error())
+	}
+	if _, err := engine.DefineRole("deputies", "Provisioned through SCIM", nil, []string{jutzo.AdministratorRole}); err != nil {
+		t.Fatalf("Unable to define a role: %s", err.Error())
+	}
+
+	// The administrator role, roles an administrator defined, and SCIM roles that
+	// have since been made to bring the administrator role, aren't groups
+	patch := `{"Operations": [{"op": "add", "path": "members", "value": [{"value": "carol"}]}]}`
+	for _, role := range []string{jutzo.AdministratorRole, jutzo.DefaultUserRole, "editors", "deputies"} {
+		if recorder, _ := send(http.MethodPatch, "/Groups/"+role, token, patch); recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be a group, got %d %s", role, recorder.Code, recorder.Body.String())
+		}
+		if recorder, _ := send(http.MethodGet, "/Groups/"+role, token, ""); recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be found, got %d", role, recorder.Code)
+		}
+		if recorder, _ := send(http.MethodDelete, "/Groups/"+role, token, ""); recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected %s not to be deleted, got %d", role, recorder.Code)
+		}
+	}
+	if carol, _ := engine.GetUser("carol"); len(carol.GetRoles()) != 1 || carol.HasRights([]string{"admin"}) {
+		t.Errorf("SCIM changed the roles of the user: %+v", carol)
+	}
+	if admins, _ := engine.ListRoleMembers(jutzo.AdministratorRole); !slices.Equal(admins, []string{"bob"}) {
+		t.Errorf("SCIM changed the administrators: %v", admins)
+	}
+
+	// Only the groups SCIM created are listed
+	if recorder, _ := send(http.MethodPost, "/Groups", token, `{"displayName": "staff"}`); recorder.Code != http.StatusCreated {
+		t.Fatalf("Unable to create a group: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, response := send(http.MethodGet, "/Groups", token, ""); recorder.Code != http.StatusOK ||
+		response["totalResults"] != float64(1) {
+		t.Errorf("Unexpected groups: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder, _ := send(http.MethodPost, "/Groups", token, `{"displayName": "editors"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected an existing role not to be taken over, got %d", recorder.Code)
+	}
+}
+
+func TestSCIMUsersWithoutPasswords(t *testing.T) {
+	engine := directoryTestEngine(t, "carol", "dave")
+	client := jutzo.ClientInfo{IP: "192.0.2.1"}
+
+	// A user provisioned without a password logs in through an identity provider,
+	// and can't be taken over by a directory entry with the same name
+	if result, carol, err := engine.ProvisionUser("carol", "", "carol@example.com"); err != nil || result != jutzo.Success ||
+		carol.GetAuthSource() != jutzo.AuthSourceExternal || !carol.IsEmailValidated() {
+		t.Fatalf("Unable to provision a user: %d %+v %v", result, carol, err)
+	}
+	if _, err := engine.Login("carol", "directory-pass", client); err != jutzo.ErrInvalidCredentials {
+		t.Errorf("Expected the provisioned user not to log in through the directory, got %v", err)
+	}
+	if carol, _ := engine.GetUser("carol"); carol.GetAuthSource() != jutzo.AuthSourceExternal ||
+		carol.GetEmail() != "carol@example.com" || carol.HasRights([]string{"admin"}) {
+		t.Errorf("Provisioned user changed by the directory: %+v", carol)
+	}
+
+	// With a password, the user logs in with it
+	if result, dave, err := engine.ProvisionUser("dave", "a good password", "dave@example.com"); err != nil ||
+		result != jutzo.Success || dave.GetAuthSource() != jutzo.AuthSourceLocal {
+		t.Fatalf("Unable to provision a user: %d %+v %v", result, dave, err)
+	}
+	if _, err := engine.Login("dave", "a good password", client); err != nil {
+		t.Errorf("Unable to log in as the provisioned user: %s", err.Error())
+	}
+	if result, _, _ := engine.ProvisionUser("Dave", "", "other@example.com"); result != jutzo.DuplicateUsername {
+		t.Errorf("Expected a duplicate username, got %d", result)
+	}
+}
+
+func TestSCIMChangeEmail(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	registerTestUser(t, engine, "carol")
+	registerTestUser(t, engine, "dave")
+
+	// Another user's email is refused, whatever its case; the user's own is fine
+	if _, err := engine.ChangeEmail("carol", "DAVE@example.com"); err != jutzo.ErrEmailInUse {
+		t.Errorf("Expected another user's email to be refused, got %v", err)
+	}
+	if carol, err := engine.ChangeEmail("carol", "Carol@Example.com"); err != nil || carol.GetEmail() != "Carol@Example.com" {
+		t.Errorf("Unable to change the case of the email: %+v %v", carol, err)
+	}
+
+	// Of two users changing to the same email at once, only one gets it
+	var wait sync.WaitGroup
+	results := make([]error, 2)
+	for index, user := range []string{"carol", "dave"} {
+		wait.Add(1)
+		go func(index int, user string) {
+			defer wait.Done()
+			_, results[index] = engine.ChangeEmail(user, "shared@example.com")
+		}(index, user)
+	}
+	wait.Wait()
+	if (results[0] == nil) == (results[1] == nil) || (results[0] != nil && results[0] != jutzo.ErrEmailInUse) ||
+		(results[1] != nil && results[1] != jutzo.ErrEmailInUse) {
+		t.Errorf("Expected exactly one change to succeed: %v", results)
+	}
+	if owner, err := engine.GetDatabase().RetrieveUserByEmail("shared@example.com"); err != nil || !owner.IsEmailValidated() {
+		t.Errorf("Unexpected owner of the email: %+v %v", owner, err)
+	}
+}
+
+func TestSCIMTokens(t *testing.T) {
+	engine := newTestEngine(t, nil)
+	token, scimToken, err := engine.CreateSCIMToken("bob", "okta")
+	if err != nil || !strings.HasPrefix(token, jutzo.SCIMTokenPrefix) || scimToken.Name != "okta" || scimToken.CreatedBy != "bob" {
+		t.Fatalf("Unable to create a token: %+v %v", scimToken, err)
+	}
+
+	// Only the hash of the token is stored
+	db := engine.GetDatabase()
+	if _, err = db.RetrieveSCIMTokenByHash(token); err != sql.ErrNoRows {
+		t.Errorf("Expected the token itself not to be stored, got %v", err)
+	}
+	sum := sha256.Sum256([]byte(token))
+	if stored, err := db.RetrieveSCIMTokenByHash(hex.EncodeToString(sum[:])); err != nil || stored.ID != scimToken.ID {
+		t.Errorf("Expected the token's hash to be stored: %+v %v", stored, err)
+	}
+
+	// The token authenticates until it is revoked; nothing else does
+	if authenticated, err := engine.AuthenticateSCIMToken(token); err != nil || authenticated.ID != scimToken.ID {
+		t.Errorf("Unable to authenticate with the token: %+v %v", authenticated, err)
+	}
+	for _, other := range []string{token + "x", strings.TrimPrefix(token, jutzo.SCIMTokenPrefix), ""} {
+		if _, err = engine.AuthenticateSCIMToken(other); err != jutzo.ErrInvalidSCIMToken {
+			t.Errorf("Expected %q not to authenticate, got %v", other, err)
+		}
+	}
+	if err = engine.RevokeSCIMToken(scimToken.ID); err != nil {
+		t.Fatalf("Unable to revoke the token: %s", err.Error())
+	}
+	if _, err = engine.AuthenticateSCIMToken(token); err != jutzo.ErrInvalidSCIMToken {
+		t.Errorf("Expected the revoked token not to authenticate, got %v", err)
+	}
+}
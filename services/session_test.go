@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionTestRouter routes the login and session endpoints to a real engine
+// on the memory backends, with bob as its administrator
+func sessionTestRouter(t *testing.T) (*gin.Engine, *impl.EngineImpl, TokenEngine) {
+	engine := newTestEngine(t, nil)
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/v1/user/login", func(c *gin.Context) { handleLogin(c, tokenEngine, engine) })
+	router.POST("/v1/user/refresh", func(c *gin.Context) { handleRefresh(c, tokenEngine, engine) })
+
+	authenticated := router.Group("/v1", requireValidJWTToken(engine, tokenEngine))
+	authenticated.GET("/user/getValidationLink", func(c *gin.Context) { handleResendValidateEmailLink(c, engine) })
+	authenticated.GET("/user/logoff", func(c *gin.Context) { handleLogoff(c, engine) })
+	authenticated.GET("/user/sessions", func(c *gin.Context) { handleListMySessions(c, engine) })
+	authenticated.DELETE("/user/sessions", func(c *gin.Context) { handleRevokeMyOtherSessions(c, engine) })
+	authenticated.DELETE("/user/sessions/:id", func(c *gin.Context) { handleRevokeMySession(c, engine) })
+
+	granted := router.Group("/v1", requireGrants(engine, tokenEngine, []string{"admin"}))
+	granted.GET("/admin/user/:username/sessions",
+		func(c *gin.Context) { listSessions(c, engine, c.Param("username"), "") })
+	granted.DELETE("/admin/user/:username/sessions",
+		func(c *gin.Context) { revokeAllSessions(c, engine, c.Param("username"), "") })
+	granted.DELETE("/admin/user/:username/sessions/:id",
+		func(c *gin.Context) { revokeSession(c, engine, c.Param("username"), c.Param("id")) })
+	return router, engine, tokenEngine
+}
+
+// loginTo the router, returning the access and refresh tokens issued
+func loginTo(t *testing.T, router *gin.Engine, username string, password string) (string, string) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/user/login",
+		strings.NewReader(`{"user": "`+username+`", "pass": "`+password+`"}`))
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unable to log in as %s: %d %s", username, w.Code, w.Body.String())
+	}
+	return w.Header().Get("Authorization"), w.Header().Get("X-Refresh-Token")
+}
+
+// refreshWith exchanges the refresh token through the router
+func refreshWith(router *gin.Engine, refreshToken string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/user/refresh", strings.NewReader(`{"refreshToken": "`+refreshToken+`"}`))
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRefreshRotation(t *testing.T) {
+	router, engine, _ := sessionTestRouter(t)
+	_, first := loginTo(t, router, "bob", "test-pass")
+	sessionID, _, _ := strings.Cut(first, ".")
+
+	// Each refresh hands back a new access token and a new refresh token
+	w := refreshWith(router, first)
+	second := w.Header().Get("X-Refresh-Token")
+	if w.Code != http.StatusOK || second == "" || second == first || w.Header().Get("Authorization") == "" {
+		t.Fatalf("Unexpected refresh: %d %s %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w = refreshWith(router, "not-a-token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a malformed token to be refused, got %d", w.Code)
+	}
+
+	// Anyone can see the session ID, so a token that was never issued is
+	// refused without logging the user out
+	if w = refreshWith(router, sessionID+".forged"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a forged token to be refused, got %d", w.Code)
+	}
+	if _, err := engine.LoadUserSession(sessionID); err != nil {
+		t.Errorf("Session revoked by a forged token: %v", err)
+	}
+	w = refreshWith(router, second)
+	third := w.Header().Get("X-Refresh-Token")
+	if w.Code != http.StatusOK || third == "" {
+		t.Fatalf("Unable to refresh after a forged token: %d %s", w.Code, w.Body.String())
+	}
+
+	// Presenting a rotated out token again revokes the session, and with it
+	// the token most recently issued
+	if w = refreshWith(router, first); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "reuse") {
+		t.Errorf("Expected reuse to be detected: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := engine.LoadUserSession(sessionID); err == nil {
+		t.Errorf("Session not revoked after reuse")
+	}
+	if w = refreshWith(router, third); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked session not to refresh, got %d", w.Code)
+	}
+}
+
+// sessionRequest makes a request to the router with the authorization given
+func sessionRequest(router *gin.Engine, method string, path string, authorization string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", authorization)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// listedSessions lists the sessions at the path, failing unless that succeeds
+func listedSessions(t *testing.T, router *gin.Engine, path string, authorization string) []sessionSummary {
+	w := sessionRequest(router, "GET", path, authorization)
+	var sessions []sessionSummary
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unable to list sessions: %d %s", w.Code, w.Body.String())
+	} else if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+		t.Fatalf("Unable to decode sessions: %s", err.Error())
+	}
+	return sessions
+}
+
+func TestListAndRevokeMySessions(t *testing.T) {
+	router, engine, _ := sessionTestRouter(t)
+	registerTestUser(t, engine, "alice")
+	current, _ := loginTo(t, router, "bob", "test-pass")
+	other, otherRefresh := loginTo(t, router, "bob", "test-pass")
+	_, aliceRefresh := loginTo(t, router, "alice", "test-pass")
+	otherID, _, _ := strings.Cut(otherRefresh, ".")
+	aliceID, _, _ := strings.Cut(aliceRefresh, ".")
+
+	// Only the user's own sessions are listed, with the current one flagged
+	sessions := listedSessions(t, router, "/v1/user/sessions", current)
+	if len(sessions) != 2 || sessions[0].Current == sessions[1].Current {
+		t.Fatalf("Unexpected sessions: %+v", sessions)
+	}
+	if w := sessionRequest(router, "GET", "/v1/user/sessions", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected sessions not to be listed without a token, got %d", w.Code)
+	}
+
+	// Other users' sessions can't be revoked
+	if w := sessionRequest(router, "DELETE", "/v1/user/sessions/"+aliceID, current); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's session not to be found, got %d", w.Code)
+	}
+	if _, err := engine.LoadUserSession(aliceID); err != nil {
+		t.Errorf("Another user's session was revoked: %v", err)
+	}
+
+	// A revoked session can't be used again
+	if w := sessionRequest(router, "DELETE", "/v1/user/sessions/"+otherID, current); w.Code != http.StatusOK {
+		t.Errorf("Unable to revoke session: %d %s", w.Code, w.Body.String())
+	}
+	if w := sessionRequest(router, "GET", "/v1/user/sessions", other); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked session to be refused, got %d", w.Code)
+	}
+	if w := sessionRequest(router, "DELETE", "/v1/user/sessions/"+otherID, current); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the revoked session not to be found, got %d", w.Code)
+	}
+
+	// Revoking the other sessions keeps the current one
+	third, _ := loginTo(t, router, "bob", "test-pass")
+	if w := sessionRequest(router, "DELETE", "/v1/user/sessions", current); w.Code != http.StatusOK {
+		t.Errorf("Unable to revoke other sessions: %d %s", w.Code, w.Body.String())
+	}
+	if w := sessionRequest(router, "GET", "/v1/user/sessions", third); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the other session to be revoked, got %d", w.Code)
+	}
+	if sessions = listedSessions(t, router, "/v1/user/sessions", current); len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestAdminListAndRevokeSessions(t *testing.T) {
+	router, engine, _ := sessionTestRouter(t)
+	registerTestUser(t, engine, "alice")
+	admin, _ := loginTo(t, router, "bob", "test-pass")
+	alice, aliceRefresh := loginTo(t, router, "alice", "test-pass")
+	other, _ := loginTo(t, router, "alice", "test-pass")
+	aliceID, _, _ := strings.Cut(aliceRefresh, ".")
+
+	// Only administrators can see and revoke other users' sessions
+	if w := sessionRequest(router, "GET", "/v1/admin/user/bob/sessions", alice); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a user without admin to be forbidden, got %d", w.Code)
+	}
+	if w := sessionRequest(router, "DELETE", "/v1/admin/user/bob/sessions", alice); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a user without admin to be forbidden, got %d", w.Code)
+	}
+	sessions := listedSessions(t, router, "/v1/admin/user/alice/sessions", admin)
+	if len(sessions) != 2 || sessions[0].Current || sessions[1].Current {
+		t.Fatalf("Unexpected sessions: %+v", sessions)
+	}
+
+	// Sessions are only revoked for the user they belong to
+	if w := sessionRequest(router, "DELETE", "/v1/admin/user/bob/sessions/"+aliceID, admin); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the session not to be found for another user, got %d", w.Code)
+	}
+	if w := sessionRequest(router, "DELETE", "/v1/admin/user/alice/sessions/"+aliceID, admin); w.Code != http.StatusOK {
+		t.Errorf("Unable to revoke session: %d %s", w.Code, w.Body.String())
+	}
+	if w := sessionRequest(router, "GET", "/v1/user/sessions", alice); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked session to be refused, got %d", w.Code)
+	}
+
+	// Revoking all a user's sessions leaves the administrator's alone
+	if w := sessionRequest(router, "DELETE", "/v1/admin/user/alice/sessions", admin); w.Code != http.StatusOK {
+		t.Errorf("Unable to revoke sessions: %d %s", w.Code, w.Body.String())
+	}
+	if w := sessionRequest(router, "GET", "/v1/user/sessions", other); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked session to be refused, got %d", w.Code)
+	}
+	if sessions = listedSessions(t, router, "/v1/admin/user/alice/sessions", admin); len(sessions) != 0 {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+	if sessions = listedSessions(t, router, "/v1/user/sessions", admin); len(sessions) != 1 {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+}
+
+func TestSessionsNeedInteractiveLogin(t *testing.T) {
+	router, engine, tokenEngine := sessionTestRouter(t)
+	interactive, _ := loginTo(t, router, "bob", "test-pass")
+	key, _, err := engine.CreateAPIKey("bob", "automation", []string{"login"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Unable to create API key: %s", err.Error())
+	}
+	delegated, err := engine.CreateDelegatedSession("bob", jutzo.ClientInfo{ClientID: "client"})
+	if err != nil {
+		t.Fatalf("Unable to create delegated session: %s", err.Error())
+	}
+
+	// Neither an API key nor an OAuth client can see or end the user's sessions,
+	// or log off a session that was never there
+	for _, authorization := range []string{"Bearer " + key, bearer(t, tokenEngine, delegated)} {
+		for _, request := range []struct{ method, path string }{
+			{"GET", "/v1/user/sessions"},
+			{"DELETE", "/v1/user/sessions"},
+			{"DELETE", "/v1/user/sessions/" + delegated.GetId()},
+			{"GET", "/v1/user/getValidationLink"},
+			{"GET", "/v1/user/logoff"},
+		} {
+			if w := sessionRequest(router, request.method, request.path, authorization); w.Code != http.StatusForbidden {
+				t.Errorf("Expected %s %s to be forbidden, got %d", request.method, request.path, w.Code)
+			}
+		}
+	}
+	if sessions := listedSessions(t, router, "/v1/user/sessions", interactive); len(sessions) != 2 {
+		t.Errorf("Unexpected sessions: %+v", sessions)
+	}
+	if logoffs, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditLogoff}}); len(logoffs) != 0 {
+		t.Errorf("Unexpected logoffs: %+v", logoffs)
+	}
+
+	// The interactive login logs off its own session
+	if w := sessionRequest(router, "GET", "/v1/user/logoff", interactive); w.Code != http.StatusOK {
+		t.Errorf("Unable to log off: %d", w.Code)
+	}
+	if w := sessionRequest(router, "GET", "/v1/user/sessions", interactive); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to be gone, got %d", w.Code)
+	}
+	if logoffs, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditLogoff}}); len(logoffs) != 1 ||
+		logoffs[0].Actor != "bob" {
+		t.Errorf("Expected the logoff to be audited: %+v", logoffs)
+	}
+}
+
+func TestRefreshRefusesDelegatedSessions(t *testing.T) {
+	router, engine, _ := sessionTestRouter(t)
+	delegated, err := engine.CreateDelegatedSession("bob", jutzo.ClientInfo{ClientID: "client", Scope: []string{"openid"}})
+	if err != nil {
+		t.Fatalf("Unable to create delegated session: %s", err.Error())
+	}
+
+	// Only the client, authenticating at the token endpoint, can refresh the
+	// session, and the token isn't used up by trying elsewhere
+	if w := refreshWith(router, delegated.GetRefreshToken()); w.Code != http.StatusUnauthorized ||
+		w.Header().Get("X-Refresh-Token") != "" {
+		t.Errorf("Expected a delegated session not to refresh, got %d", w.Code)
+	}
+	if _, err = engine.RefreshUserSession(delegated.GetRefreshToken()); err != nil {
+		t.Errorf("Refresh token used up by the refused refresh: %v", err)
+	}
+}
+
+func TestRevokedAdminsLoseAccessImmediately(t *testing.T) {
+	router, engine, _ := sessionTestRouter(t)
+	registerTestUser(t, engine, "carol")
+	if _, err := engine.DefineRole("keeper", "", []string{"admin"}, nil); err != nil {
+		t.Fatalf("Unable to define the role: %s", err.Error())
+	}
+	if _, err := engine.DefineRole("deputy", "", nil, []string{"keeper"}); err != nil {
+		t.Fatalf("Unable to define the role: %s", err.Error())
+	}
+	if _, err := engine.AssignRole("carol", "deputy"); err != nil {
+		t.Fatalf("Unable to assign the role: %s", err.Error())
+	}
+	if members, err := engine.GetDatabase().ListRoleMembers("keeper"); err != nil || len(members) != 1 || members[0] != "carol" {
+		t.Errorf("Expected carol to hold the role through inheritance: %v %v", members, err)
+	}
+	if members, err := engine.ListRoleMembers("keeper"); err != nil || len(members) != 0 {
+		t.Errorf("Expected only those assigned the role to be listed: %v %v", members, err)
+	}
+	carol, _ := loginTo(t, router, "carol", "test-pass")
+	expect := func(status int, change string) {
+		t.Helper()
+		if w := sessionRequest(router, "GET", "/v1/admin/user/bob/sessions", carol); w.Code != status {
+			t.Errorf("Expected %d %s, got %d", status, change, w.Code)
+		}
+	}
+	expect(http.StatusOK, "holding the admin right through a role")
+
+	// The live session follows changes to the roles behind the right
+	_, _ = engine.DefineRole("keeper", "", []string{"blog"}, nil)
+	expect(http.StatusForbidden, "once the role lost the right")
+	_, _ = engine.DefineRole("keeper", "", []string{"admin"}, nil)
+	expect(http.StatusOK, "once the role has the right again")
+	_ = engine.DeleteRole("keeper")
+	expect(http.StatusForbidden, "once the inherited role was deleted")
+
+	// And to direct grants, and the login being disabled
+	_, _ = engine.GrantRight("carol", "admin")
+	expect(http.StatusOK, "once the right was granted")
+	_, _ = engine.RevokeRight("carol", "admin")
+	expect(http.StatusForbidden, "once the right was revoked")
+	_, _ = engine.GrantRight("carol", "admin")
+	_, _ = engine.SetLoginEnabled("carol", false)
+	expect(http.StatusUnauthorized, "once the login was disabled")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"strings"
+	"testing"
+)
+
+// throttleTestRouter routes logins to a real engine on the memory backends
+// that locks a username out after two failures, and an address after three.
+// The client IP is taken from CF-Connecting-IP when the proxy at 10.0.0.1 sets it
+func throttleTestRouter(t *testing.T) (*gin.Engine, jutzo.Engine) {
+	engine := newTestEngine(t, map[string]string{
+		"JUTZO_LOGIN_FREE_ATTEMPTS":        "2",
+		"JUTZO_LOGIN_FREE_ATTEMPTS_PER_IP": "3",
+	})
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	err = configureClientIP(router, withSettings(map[string]string{
+		"JUTZO_TRUSTED_PROXIES":  "10.0.0.1",
+		"JUTZO_CLIENT_IP_HEADER": "CF-Connecting-IP",
+	}, nil))
+	if err != nil {
+		t.Fatalf("Unable to configure the client IP: %s", err.Error())
+	}
+	router.POST("/user/login", func(c *gin.Context) { handleLogin(c, tokenEngine, engine) })
+	return router, engine
+}
+
+// loginFrom the given address, with the client IP header given (if any)
+func loginFrom(router *gin.Engine, address string, clientIP string, user string, password string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/user/login",
+		strings.NewReader(`{"user": "`+user+`", "pass": "`+password+`"}`))
+	request.RemoteAddr = address + ":4321"
+	if clientIP != "" {
+		request.Header.Set("CF-Connecting-IP", clientIP)
+	}
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestLoginThrottling(t *testing.T) {
+	router, engine := throttleTestRouter(t)
+	viaProxy := func(clientIP string, password string) *httptest.ResponseRecorder {
+		return loginFrom(router, "10.0.0.1", clientIP, "bob", password)
+	}
+
+	// Failures look the same until the free attempts run out
+	for attempt := 1; attempt <= 3; attempt++ {
+		if recorder := viaProxy("203.0.113.1", "guess"); recorder.Code != http.StatusUnauthorized ||
+			recorder.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected 401 for attempt %d, got %d", attempt, recorder.Code)
+		}
+	}
+
+	// Then the username is locked out, even with the right password, and the
+	// client is told when to come back, rounded up to whole seconds
+	if recorder := viaProxy("203.0.113.2", "test-pass"); recorder.Code != http.StatusTooManyRequests ||
+		recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	events, _ := engine.ListAuditEvents(jutzo.AuditQuery{Types: []string{jutzo.AuditLoginFailed}})
+	if len(events) != 4 || events[0].Detail != "throttled" || events[0].Target != "bob" || events[0].Actor != "" ||
+		events[0].IP != "203.0.113.2" || events[1].IP != "203.0.113.1" {
+		t.Errorf("Unexpected audit events: %v", events)
+	}
+
+	// An administrator can lift the lockout
+	if err := engine.UnlockUser("bob"); err != nil {
+		t.Fatalf("Unable to unlock: %s", err.Error())
+	}
+	if recorder := viaProxy("203.0.113.2", "test-pass"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected to log in once unlocked, got %d", recorder.Code)
+	}
+}
+
+func TestLoginThrottlingByAddress(t *testing.T) {
+	router, _ := throttleTestRouter(t)
+
+	// Failures against different usernames lock out the address they come from.
+	// A client that isn't a trusted proxy can't choose the address it is blamed as
+	for _, user := range []string{"alice", "carol", "dave", "erin"} {
+		if recorder := loginFrom(router, "192.0.2.9", "203.0.113.3", user, "guess"); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for %s, got %d", user, recorder.Code)
+		}
+	}
+	if recorder := loginFrom(router, "192.0.2.9", "203.0.113.4", "bob", "test-pass"); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address to be locked out, got %d", recorder.Code)
+	}
+	if recorder := loginFrom(router, "10.0.0.1", "203.0.113.3", "bob", "test-pass"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected the forged address not to be locked out, got %d", recorder.Code)
+	}
+}
+
+func TestClientIPOnlyFromTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clientIP := func(settings map[string]string, address string, headers map[string]string) (string, error) {
+		router := gin.New()
+		if err := configureClientIP(router, withSettings(settings, nil)); err != nil {
+			return "", err
+		}
+		router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, getClientInfo(c).IP) })
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/ip", nil)
+		request.RemoteAddr = address + ":4321"
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder.Body.String(), nil
+	}
+	forwarded := map[string]string{"X-Forwarded-For": "203.0.113.1", "CF-Connecting-IP": "203.0.113.2"}
+	proxies := map[string]string{"JUTZO_TRUSTED_PROXIES": "10.0.0.0/8, 192.168.1.1"}
+	cloudflare := map[string]string{"JUTZO_TRUSTED_PROXIES": "10.0.0.0/8", "JUTZO_CLIENT_IP_HEADER": "CF-Connecting-IP"}
+	platform := map[string]string{"JUTZO_TRUSTED_PLATFORM": "cloudflare"}
+
+	for _, test := range []struct {
+		settings map[string]string
+		address  string
+		expected string
+	}{
+		{nil, "10.0.0.1", "10.0.0.1"},
+		{proxies, "10.1.2.3", "203.0.113.1"},
+		{proxies, "192.168.1.1", "203.0.113.1"},
+		{proxies, "192.168.1.2", "192.168.1.2"},
+		{cloudflare, "10.1.2.3", "203.0.113.2"},
+		{cloudflare, "192.0.2.9", "192.0.2.9"},
+		{platform, "192.0.2.9", "203.0.113.2"},
+	} {
+		if ip, err := clientIP(test.settings, test.address, forwarded); err != nil || ip != test.expected {
+			t.Errorf("Expected %s from %s with %v, got %s %v", test.expected, test.address, test.settings, ip, err)
+		}
+	}
+
+	// Mistakes are refused rather than trusting everyone (or no one) by accident
+	if _, err := clientIP(map[string]string{"JUTZO_TRUSTED_PROXIES": "10.0.0.0/33"}, "10.0.0.1", nil); err == nil {
+		t.Errorf("Expected an invalid proxy to be refused")
+	}
+	if _, err := clientIP(map[string]string{"JUTZO_CLIENT_IP_HEADER": "CF-Connecting-IP"}, "10.0.0.1", nil); err == nil {
+		t.Errorf("Expected a header without proxies to be refused")
+	}
+	if _, err := clientIP(map[string]string{"JUTZO_TRUSTED_PLATFORM": "heroku"}, "10.0.0.1", nil); err == nil {
+		t.Errorf("Expected an unknown platform to be refused")
+	}
+
+	// In production, without proxies, the client IP comes from Cloudflare
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+	for _, test := range []struct {
+		settings map[string]string
+		address  string
+		expected string
+	}{
+		{nil, "192.0.2.9", "203.0.113.2"},
+		{proxies, "10.1.2.3", "203.0.113.1"},
+		{map[string]string{"JUTZO_TRUSTED_PLATFORM": "none"}, "192.0.2.9", "192.0.2.9"},
+	} {
+		if ip, err := clientIP(test.settings, test.address, forwarded); err != nil || ip != test.expected {
+			t.Errorf("Expected %s in release mode with %v, got %s %v", test.expected, test.settings, ip, err)
+		}
+	}
+}
+
+func TestPasswordChangesAreThrottled(t *testing.T) {
+	router, engine := throttleTestRouter(t)
+	client := jutzo.ClientInfo{IP: "203.0.113.1"}
+
+	// Guesses at the current password count against the user as failed logins do
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := engine.ChangePassword("bob", "guess", "Another-pass-1", client); err != jutzo.ErrInvalidCredentials {
+			t.Errorf("Expected invalid credentials for attempt %d, got %v", attempt, err)
+		}
+	}
+	if err := engine.ChangePassword("bob", "test-pass", "Another-pass-1", client); err == nil {
+		t.Errorf("Password changed while locked out")
+	} else if _, isThrottled := err.(*jutzo.LoginThrottledError); !isThrottled {
+		t.Errorf("Expected the change to be throttled, got %v", err)
+	}
+	if recorder := loginFrom(router, "192.0.2.9", "", "bob", "test-pass"); recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the login to be locked out too, got %d", recorder.Code)
+	}
+
+	// Once unlocked the right password changes it
+	_ = engine.UnlockUser("bob")
+	if err := engine.ChangePassword("bob", "test-pass", "Another-pass-1", client); err != nil {
+		t.Errorf("Unable to change the password: %s", err.Error())
+	}
+}
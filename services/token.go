@@ -5,42 +5,175 @@ import (
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
+	"services/jutzo"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Defaults for the claims we issue and validate
+const (
+	DefaultTokenIssuer      = "Jutzo Service"
+	DefaultTokenAudience    = "jutzo-api"
+	DefaultClockSkewSeconds = 60
+)
+
+// Errors returned when a token is correctly signed but not acceptable
+var (
+	ErrTokenWrongIssuer   = errors.New("token was not issued by this service")
+	ErrTokenWrongAudience = errors.New("token is intended for a different audience")
+	ErrTokenExpired       = errors.New("token has expired")
+	ErrTokenNotYetValid   = errors.New("token is not valid yet")
+	ErrNoSigningKey       = errors.New("tokens for other parties require an asymmetric signing key")
+)
+
+// TokenClaims are the claims carried in the access tokens we issue. The
+// standard ID claim (jti) identifies the user session in the cache
+type TokenClaims struct {
+	jwt.StandardClaims
+
+	// Rights of the user when the token was issued. Only present when
+	// JUTZO_JWT_EMBED_RIGHTS is set; the session remains authoritative
+	Rights []string `json:"rights,omitempty"`
+}
+
 type TokenEngine interface {
-	Encode(user string, uniqueID string, duration time.Duration) (string, error)
-	Decode(encoded string) (string, error)
+
+	// Encode an access token for the user session, valid for the duration given
+	Encode(userSession jutzo.UserSession, duration time.Duration) (string, error)
+
+	// Decode an access token, verifying the signature and validating the
+	// issuer, audience and validity period before returning the claims
+	Decode(encoded string) (*TokenClaims, error)
+
+	// GetJWKS returns the public keys that can be used to verify the
+	// tokens we issue, for publication at /.well-known/jwks.json
+	GetJWKS() JSONWebKeySet
+
+	// Sign a token for another party (e.g. an OpenID Connect ID token) with
+	// our asymmetric signing key. Such tokens can't be signed with the shared
+	// secret, as the other party couldn't verify them without it
+	Sign(claims jwt.Claims) (string, error)
+
+	// GetSigningAlgorithm that Sign uses, or "" if there is no signing key
+	GetSigningAlgorithm() string
 }
 
 type TokenEngineImpl struct {
+
+	// The shared secret for HS256 tokens. When no signing key is
+	// configured this is used to sign tokens; otherwise it is only
+	// used to verify tokens issued before the switch to asymmetric keys
 	jwtSecret []byte
+
+	// The key used to sign new tokens (nil when signing with the secret)
+	signingKey *signingKey
+
+	// All the keys that tokens can be verified with, indexed by key ID.
+	// This includes the signing key and any keys being rotated in or out
+	verificationKeys map[string]*signingKey
+
+	// The issuer and audience we put in our tokens and require on the
+	// tokens presented to us, and how much clock skew we tolerate
+	issuer      string
+	audience    string
+	clockSkew   time.Duration
+	embedRights bool
 }
 
-func NewTokenEngine(configuration Configuration) (TokenEngine, error) {
+func NewTokenEngine(configuration jutzo.ConfigurationProvider) (TokenEngine, error) {
+
+	engine := new(TokenEngineImpl)
+	engine.verificationKeys = make(map[string]*signingKey)
+
+	// Get the claim settings, using the defaults for anything not configured
+	var isPresent bool
+	if engine.issuer, isPresent = configuration.GetConfigurationString("JUTZO_JWT_ISSUER"); !isPresent {
+		engine.issuer = DefaultTokenIssuer
+	}
+	if engine.audience, isPresent = configuration.GetConfigurationString("JUTZO_JWT_AUDIENCE"); !isPresent {
+		engine.audience = DefaultTokenAudience
+	}
+	clockSkew, isPresent := configuration.GetConfigurationInt("JUTZO_JWT_CLOCK_SKEW_SECONDS")
+	if !isPresent || clockSkew < 0 {
+		clockSkew = DefaultClockSkewSeconds
+	}
+	engine.clockSkew = time.Duration(clockSkew) * time.Second
+	if embedRights, isPresent := configuration.GetConfigurationString("JUTZO_JWT_EMBED_RIGHTS"); isPresent {
+		engine.embedRights, _ = strconv.ParseBool(embedRights)
+	}
 
 	// Get the JWT secret string, and convert it to the hex byte sequence
 	if rawString, isPresent := configuration.GetConfigurationString("JUTZO_JWT_SECRET"); isPresent {
-		engine := new(TokenEngineImpl)
-		jwtSecret, err := hex.DecodeString(rawString)
-		engine.jwtSecret = jwtSecret
-		return engine, err
-	} else {
-		return nil, errors.New("could not get the JWT secret key from configuration")
+		if jwtSecret, err := hex.DecodeString(rawString); err == nil {
+			engine.jwtSecret = jwtSecret
+		} else {
+			return nil, err
+		}
+	}
+
+	// Load the asymmetric signing key, if there is one
+	if keyFile, isPresent := configuration.GetConfigurationString("JUTZO_JWT_SIGNING_KEY_FILE"); isPresent {
+		if key, err := loadSigningKeyFile(keyFile); err == nil {
+			if key.privateKey == nil {
+				return nil, fmt.Errorf("signing key file %s does not contain a private key", keyFile)
+			}
+			engine.signingKey = key
+			engine.verificationKeys[key.id] = key
+		} else {
+			return nil, err
+		}
+	}
+
+	// Load the other keys we accept. These are typically the previous signing key
+	// (so that outstanding tokens keep working) and the next one (so that other
+	// services already know it by the time we start signing with it)
+	if keyFiles, isPresent := configuration.GetConfigurationString("JUTZO_JWT_VERIFICATION_KEY_FILES"); isPresent {
+		for _, keyFile := range strings.Split(keyFiles, ",") {
+			if keyFile = strings.TrimSpace(keyFile); keyFile != "" {
+				if key, err := loadSigningKeyFile(keyFile); err == nil {
+					engine.verificationKeys[key.id] = key
+				} else {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if engine.signingKey == nil && len(engine.jwtSecret) == 0 {
+		return nil, errors.New("could not get the JWT secret key or signing key from configuration")
 	}
+	return engine, nil
 }
 
-func (engine *TokenEngineImpl) Encode(user string, uniqueID string, duration time.Duration) (string, error) {
+func (engine *TokenEngineImpl) Encode(userSession jutzo.UserSession, duration time.Duration) (string, error) {
 
 	// Create a JWT token that will give us the information we need to get back
 	// to that user session. Effectively we just store the Id, which will point to the
-	// Redis UserSession object, but we add the Subject, Issuer, and ExpiresAt as well
-	// (our sessions are 8 hours)
-	cookie := jwt.StandardClaims{
-		Issuer:    "Jutzo Service",
-		Subject:   user,
-		Id:        uniqueID,
-		ExpiresAt: time.Now().Local().Add(duration).Unix(),
+	// Redis UserSession object, but we add the Subject, Issuer, Audience and validity
+	// period as well. The duration is the (short) access token lifetime; the session
+	// itself lives on in the cache and is extended using refresh tokens
+	now := time.Now()
+	cookie := TokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    engine.issuer,
+			Audience:  engine.audience,
+			Subject:   userSession.GetUserInfo().GetUsername(),
+			Id:        userSession.GetId(),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(duration).Unix(),
+		},
+	}
+	if engine.embedRights {
+		cookie.Rights = userSession.GetUserInfo().GetAllRights()
+	}
+
+	// Sign with the asymmetric key if we have one, identifying the key
+	// in the header so verifiers can find it in our key set
+	if engine.signingKey != nil {
+		return engine.Sign(cookie)
 	}
 
 	// Create the token
@@ -51,29 +184,100 @@ func (engine *TokenEngineImpl) Encode(user string, uniqueID string, duration tim
 
 }
 
-func (engine *TokenEngineImpl) Decode(encoded string) (string, error) {
-	// Attempt to parse the token. This will give us a set of standard
-	// claims, of which the Id will point us to the user session in Redis
-	token, err := jwt.ParseWithClaims(encoded, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
-
-		// Validate that we got the right signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-
-		return engine.jwtSecret, nil
-	})
+func (engine *TokenEngineImpl) Decode(encoded string) (*TokenClaims, error) {
+	// Attempt to parse the token. This will give us our claims, of which the Id
+	// will point us to the user session in Redis. The library validation of the
+	// claims doesn't allow for clock skew, so we validate them ourselves
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(encoded, &TokenClaims{}, engine.findVerificationKey)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	} else {
 
-		claims, ok := token.Claims.(*jwt.StandardClaims)
+		claims, ok := token.Claims.(*TokenClaims)
 		if ok && token.Valid {
-			return claims.Id, nil
+			if err = engine.validateClaims(claims); err == nil {
+				return claims, nil
+			} else {
+				return nil, err
+			}
 		} else {
-			return "", errors.New("unable to extract JWT claims")
+			return nil, errors.New("unable to extract JWT claims")
 		}
 	}
 
 }
+
+// validateClaims makes sure the token was issued by us, for us, and is
+// currently valid (allowing for some clock skew between servers)
+func (engine *TokenEngineImpl) validateClaims(claims *TokenClaims) error {
+	now := time.Now()
+	if !claims.VerifyIssuer(engine.issuer, true) {
+		return ErrTokenWrongIssuer
+	} else if !claims.VerifyAudience(engine.audience, true) {
+		return ErrTokenWrongAudience
+	} else if !claims.VerifyExpiresAt(now.Add(-engine.clockSkew).Unix(), true) {
+		return ErrTokenExpired
+	} else if !claims.VerifyNotBefore(now.Add(engine.clockSkew).Unix(), false) ||
+		!claims.VerifyIssuedAt(now.Add(engine.clockSkew).Unix(), false) {
+		return ErrTokenNotYetValid
+	}
+	return nil
+}
+
+// GetJWKS returns the public keys that can be used to verify the
+// tokens we issue. The HS256 secret is, of course, never published
+func (engine *TokenEngineImpl) GetJWKS() JSONWebKeySet {
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range engine.verificationKeys {
+		keySet.Keys = append(keySet.Keys, key.toJWK())
+	}
+	sort.Slice(keySet.Keys, func(i, j int) bool { return keySet.Keys[i].KeyID < keySet.Keys[j].KeyID })
+	return keySet
+}
+
+// Sign a token for another party with our asymmetric signing key
+func (engine *TokenEngineImpl) Sign(claims jwt.Claims) (string, error) {
+	if key := engine.signingKey; key != nil {
+		token := jwt.NewWithClaims(key.method, claims)
+		token.Header["kid"] = key.id
+		return token.SignedString(key.privateKey)
+	} else {
+		return "", ErrNoSigningKey
+	}
+}
+
+// GetSigningAlgorithm that Sign uses, or "" if there is no signing key
+func (engine *TokenEngineImpl) GetSigningAlgorithm() string {
+	if key := engine.signingKey; key != nil {
+		return key.method.Alg()
+	}
+	return ""
+}
+
+// findVerificationKey is the jwt.Keyfunc used to select the key a token
+// is verified with. The key is chosen by the algorithm and key ID in the
+// token header, and the algorithm must match the key we hold for that ID
+// so that a token can't (for example) claim HS256 with our public key
+func (engine *TokenEngineImpl) findVerificationKey(token *jwt.Token) (interface{}, error) {
+
+	// HMAC tokens can only be verified with the shared secret
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(engine.jwtSecret) == 0 {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return engine.jwtSecret, nil
+	}
+
+	// Everything else must name one of our keys
+	keyID, _ := token.Header["kid"].(string)
+	if key, found := engine.verificationKeys[keyID]; found {
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v for key %s", token.Header["alg"], keyID)
+		}
+		return key.publicKey, nil
+	} else {
+		return nil, fmt.Errorf("unknown signing key: %s", keyID)
+	}
+}
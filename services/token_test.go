@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"testing"
+	"time"
+)
+
+// testSession creates a user session to issue tokens for
+func testSession(uniqueID string) jutzo.UserSession {
+	userInfo := impl.NewUserInfo("bob", "bob@hablutzel.com", nil, true, []string{"blog", "login"}, time.Now())
+	return &impl.UserSessionImpl{ID: uniqueID, Info: userInfo.(*impl.UserInfoImpl)}
+}
+
+// writeKeyFile generates a PEM file for the given private key
+// in the test's temporary directory and returns its name
+func writeKeyFile(t *testing.T, name string, privateKey any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %s", err.Error())
+	}
+	fileName := filepath.Join(t.TempDir(), name)
+	if err = os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Unable to write key: %s", err.Error())
+	}
+	return fileName
+}
+
+func TestSecretTokenRoundTrip(t *testing.T) {
+	tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+	if encoded, err := tokenEngine.Encode(testSession("session-id"), time.Minute); err != nil {
+		t.Errorf("Unable to encode: %s", err.Error())
+	} else if claims, err := tokenEngine.Decode(encoded); err != nil || claims.Id != "session-id" {
+		t.Errorf("Decode failed: %v", err)
+	}
+
+	// The secret must never appear in the published keys
+	if len(tokenEngine.GetJWKS().Keys) != 0 {
+		t.Errorf("Secret based engine should publish no keys")
+	}
+}
+
+func TestMissingTokenConfiguration(t *testing.T) {
+	if _, err := NewTokenEngine(TestConfig{map[string]string{}}); err == nil {
+		t.Errorf("Token engine created without a secret or key")
+	}
+}
+
+func TestAsymmetricTokens(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	expectedAlgorithms := map[string]string{"rsa.pem": "RS256", "ec.pem": "ES256", "ed.pem": "EdDSA"}
+	for name, key := range map[string]any{"rsa.pem": rsaKey, "ec.pem": ecKey, "ed.pem": edKey} {
+		tokenEngine, err := NewTokenEngine(TestConfig{map[string]string{
+			"JUTZO_JWT_SIGNING_KEY_FILE": writeKeyFile(t, name, key),
+		}})
+		if err != nil {
+			t.Fatalf("Unable to create token engine for %s: %s", name, err.Error())
+		}
+
+		// The key should be published with the expected algorithm
+		keySet := tokenEngine.GetJWKS()
+		if len(keySet.Keys) != 1 || keySet.Keys[0].Algorithm != expectedAlgorithms[name] || keySet.Keys[0].KeyID == "" {
+			t.Errorf("Unexpected key set for %s: %v", name, keySet)
+		}
+
+		if encoded, err := tokenEngine.Encode(testSession("session-id"), time.Minute); err != nil {
+			t.Errorf("Unable to encode with %s: %s", name, err.Error())
+		} else if claims, err := tokenEngine.Decode(encoded); err != nil || claims.Id != "session-id" {
+			t.Errorf("Decode with %s failed: %v", name, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	oldKeyFile, newKeyFile := writeKeyFile(t, "old.pem", oldKey), writeKeyFile(t, "new.pem", newKey)
+
+	// Issue a token with the old key, alongside the HS256 secret
+	oldEngine, err := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SIGNING_KEY_FILE": oldKeyFile}})
+	if err != nil {
+		t.Fatalf("Unable to create token engine: %s", err.Error())
+	}
+	secretEngine, _ := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SECRET": "0123456789abcdef"}})
+	oldToken, _ := oldEngine.Encode(testSession("old-session"), time.Minute)
+	secretToken, _ := secretEngine.Encode(testSession("secret-session"), time.Minute)
+
+	// Rotate to the new key, keeping the old one for verification
+	rotatedEngine, err := NewTokenEngine(TestConfig{map[string]string{
+		"JUTZO_JWT_SECRET":                 "0123456789abcdef",
+		"JUTZO_JWT_SIGNING_KEY_FILE":       newKeyFile,
+		"JUTZO_JWT_VERIFICATION_KEY_FILES": oldKeyFile,
+	}})
+	if err != nil {
+		t.Fatalf("Unable to create rotated token engine: %s", err.Error())
+	}
+	if len(rotatedEngine.GetJWKS().Keys) != 2 {
+		t.Errorf("Both keys should be published during rotation")
+	}
+	if claims, err := rotatedEngine.Decode(oldToken); err != nil || claims.Id != "old-session" {
+		t.Errorf("Token from the old key should still verify: %v", err)
+	}
+	if claims, err := rotatedEngine.Decode(secretToken); err != nil || claims.Id != "secret-session" {
+		t.Errorf("Token from the secret should still verify: %v", err)
+	}
+
+	// Once the old key is retired its tokens are rejected
+	retiredEngine, _ := NewTokenEngine(TestConfig{map[string]string{"JUTZO_JWT_SIGNING_KEY_FILE": newKeyFile}})
+	if _, err := retiredEngine.Decode(oldToken); err == nil {
+		t.Errorf("Token from a retired key was accepted")
+	}
+	if _, err := retiredEngine.Decode(secretToken); err == nil {
+		t.Errorf("HS256 token was accepted without a secret")
+	}
+}
+
+func TestTokenClaimValidation(t *testing.T) {
+	const secret = "0123456789abcdef"
+	tokenEngine, _ := NewTokenEngine(TestConfig{map[string]string{
+		"JUTZO_JWT_SECRET":       secret,
+		"JUTZO_JWT_EMBED_RIGHTS": "true",
+	}})
+
+	// Rights are embedded on request, and the standard claims are filled in
+	encoded, _ := tokenEngine.Encode(testSession("session-id"), time.Minute)
+	if claims, err := tokenEngine.Decode(encoded); err != nil {
+		t.Errorf("Unable to decode: %s", err.Error())
+	} else if claims.Subject != "bob" || claims.Issuer != DefaultTokenIssuer ||
+		claims.Audience != DefaultTokenAudience || len(claims.Rights) != 2 {
+		t.Errorf("Unexpected claims: %v", claims)
+	}
+
+	// A token for another audience, or from another issuer, is rejected
+	otherAudience, _ := NewTokenEngine(TestConfig{map[string]string{
+		"JUTZO_JWT_SECRET":   secret,
+		"JUTZO_JWT_AUDIENCE": "some-other-service",
+	}})
+	if _, err := otherAudience.Decode(encoded); err != ErrTokenWrongAudience {
+		t.Errorf("Expected wrong audience, got %v", err)
+	}
+	otherIssuer, _ := NewTokenEngine(TestConfig{map[string]string{
+		"JUTZO_JWT_SECRET": secret,
+		"JUTZO_JWT_ISSUER": "Someone Else",
+	}})
+	if _, err := otherIssuer.Decode(encoded); err != ErrTokenWrongIssuer {
+		t.Errorf("Expected wrong issuer, got %v", err)
+	}
+
+	// Expired tokens are accepted within the clock skew, but not beyond it
+	recentlyExpired, _ := tokenEngine.Encode(testSession("session-id"), -30*time.Second)
+	if _, err := tokenEngine.Decode(recentlyExpired); err != nil {
+		t.Errorf("Token within clock skew was rejected: %v", err)
+	}
+	longExpired, _ := tokenEngine.Encode(testSession("session-id"), -2*time.Minute)
+	if _, err := tokenEngine.Decode(longExpired); err != ErrTokenExpired {
+		t.Errorf("Expected expired token, got %v", err)
+	}
+}
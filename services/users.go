@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"services/jutzo"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Routine for an administrator to find users. The users can be filtered by
+// email (a case-insensitive substring), right (held directly or through a
+// role), role, validated (true or false) and when they registered (createdSince
+// and createdUntil, in RFC 3339 format), and sorted by username or created, in
+// asc or desc order. The next page starts at the nextCursor of the response.
+// With format=csv every user selected is returned as a CSV attachment
+func handleListUsers(c *gin.Context, engine jutzo.Engine) {
+	query := jutzo.UserQuery{
+		EmailContains: c.Query("email"),
+		Right:         c.Query("right"),
+		Role:          c.Query("role"),
+		Sort:          c.Query("sort"),
+		Cursor:        c.Query("cursor"),
+	}
+
+	var err error
+	if validated := c.Query("validated"); validated != "" {
+		if isValidated, err := strconv.ParseBool(validated); err == nil {
+			query.Validated = &isValidated
+		} else {
+			c.String(http.StatusBadRequest, "Malformed validated: %s", err.Error())
+			return
+		}
+	}
+	if since := c.Query("createdSince"); since != "" {
+		if query.CreatedSince, err = time.Parse(time.RFC3339, since); err != nil {
+			c.String(http.StatusBadRequest, "Malformed createdSince: %s", err.Error())
+			return
+		}
+	}
+	if until := c.Query("createdUntil"); until != "" {
+		if query.CreatedUntil, err = time.Parse(time.RFC3339, until); err != nil {
+			c.String(http.StatusBadRequest, "Malformed createdUntil: %s", err.Error())
+			return
+		}
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		c.String(http.StatusBadRequest, "Malformed order: must be asc or desc")
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			c.String(http.StatusBadRequest, "Malformed limit: %s", err.Error())
+			return
+		}
+	}
+
+	if page, err := engine.ListUsers(query); err == nil {
+		if c.Query("format") == "csv" {
+			writeUsersCSV(c, engine, query, page)
+		} else {
+			users := make([]gin.H, 0, len(page.Users))
+			for _, userInfo := range page.Users {
+				users = append(users, userDetails(userInfo))
+			}
+			c.JSON(http.StatusOK, gin.H{"users": users, "total": page.Total, "nextCursor": page.NextCursor})
+		}
+	} else if err == jutzo.ErrInvalidUserQuery {
+		c.String(http.StatusBadRequest, err.Error())
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to list users: %s", err.Error())
+	}
+}
+
+// writeUsersCSV sends the users selected by the query as a CSV attachment,
+// with a header row, starting with the page already retrieved and following
+// the cursor to the end
+func writeUsersCSV(c *gin.Context, engine jutzo.Engine, query jutzo.UserQuery, page jutzo.UserPage) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="jutzo-users.csv"`)
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	_ = writer.Write([]string{"username", "email", "emailValidated", "disabled", "creationTime", "roles",
+		"grantedRights", "rights", "displayName"})
+	for {
+		for _, userInfo := range page.Users {
+			_ = writer.Write([]string{csvSafe(userInfo.GetUsername()), csvSafe(userInfo.GetEmail()),
+				strconv.FormatBool(userInfo.IsEmailValidated()), strconv.FormatBool(userInfo.IsDisabled()),
+				userInfo.GetCreationTime().UTC().Format(time.RFC3339), strings.Join(userInfo.GetRoles(), ","),
+				strings.Join(userInfo.GetGrantedRights(), ","), strings.Join(userInfo.GetAllRights(), ","),
+				csvSafe(userInfo.GetProfile().DisplayName)})
+		}
+		if page.NextCursor == "" {
+			break
+		}
+
+		// The response has started, so a failure can only cut the file short
+		var err error
+		query.Cursor = page.NextCursor
+		if page, err = engine.ListUsers(query); err != nil {
+			log.Printf("Unable to list users: %s", err.Error())
+			break
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Unable to write users: %s", err.Error())
+	}
+}
+
+// handleGetKeyCollisions reports how many users' usernames and emails were the
+// same as another user's, ignoring case, when the database was upgraded
+func handleGetKeyCollisions(c *gin.Context, engine jutzo.Engine) {
+	if collisions, err := engine.GetKeyCollisions(); err == nil {
+		c.JSON(http.StatusOK, collisions)
+	} else {
+		c.String(http.StatusInternalServerError, "Unable to count the collisions: %s", err.Error())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"services/jutzo"
+	"services/jutzo/impl"
+	"testing"
+	"time"
+)
+
+// usersTestEngine returns one user per page, alice then bob, and remembers the last query
+type usersTestEngine struct {
+	jutzo.Engine
+	query jutzo.UserQuery
+}
+
+func (engine *usersTestEngine) ListUsers(query jutzo.UserQuery) (jutzo.UserPage, error) {
+	engine.query = query
+	created := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	switch query.Cursor {
+	case "":
+		alice := impl.NewUserInfo("alice", "=alice@example.com", nil, true, []string{"admin"}, created)
+		return jutzo.UserPage{Users: []jutzo.UserInfo{alice}, Total: 2, NextCursor: "bob"}, nil
+	case "bob":
+		bob := impl.NewUserInfo("bob", "bob@example.com", nil, false, []string{"blog"}, created)
+		return jutzo.UserPage{Users: []jutzo.UserInfo{bob}, Total: 2}, nil
+	default:
+		return jutzo.UserPage{}, jutzo.ErrInvalidUserQuery
+	}
+}
+
+func (engine *usersTestEngine) GetKeyCollisions() (jutzo.KeyCollisions, error) {
+	return jutzo.KeyCollisions{Usernames: 1, Emails: 2}, nil
+}
+
+func TestUserQuery(t *testing.T) {
+	engine := &usersTestEngine{}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/user/list", func(c *gin.Context) { handleListUsers(c, engine) })
+	query := func(parameters string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/user/list?"+parameters, nil))
+		return recorder
+	}
+
+	// The filters are passed on to the engine, and the page comes with the total
+	recorder := query("email=Example&right=blog&validated=false&createdSince=2022-05-01T00:00:00Z&sort=created&order=desc&limit=1")
+	var page struct {
+		Users []struct {
+			Username     string `json:"username"`
+			PasswordHash []byte `json:"passwordHash"`
+		} `json:"users"`
+		Total      int    `json:"total"`
+		NextCursor string `json:"nextCursor"`
+	}
+	if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &page) != nil {
+		t.Fatalf("Query failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if page.Total != 2 || page.NextCursor != "bob" || len(page.Users) != 1 || page.Users[0].Username != "alice" ||
+		page.Users[0].PasswordHash != nil {
+		t.Errorf("Unexpected page: %s", recorder.Body.String())
+	}
+	if engine.query.EmailContains != "Example" || engine.query.Right != "blog" || engine.query.Validated == nil ||
+		*engine.query.Validated || engine.query.CreatedSince.Day() != 1 || engine.query.Sort != jutzo.UserSortCreated ||
+		!engine.query.Descending || engine.query.Limit != 1 {
+		t.Errorf("Unexpected query: %v", engine.query)
+	}
+
+	// Malformed filters and cursors are refused
+	for _, parameters := range []string{"validated=maybe", "createdUntil=yesterday", "order=sideways", "cursor=nonsense"} {
+		if recorder = query(parameters); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d", parameters, recorder.Code)
+		}
+	}
+
+	// The CSV export follows the cursor to the last page
+	recorder = query("format=csv&limit=1")
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if recorder.Code != http.StatusOK || err != nil || len(rows) != 3 {
+		t.Fatalf("Unexpected CSV: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if rows[0][0] != "username" || rows[1][1] != "'=alice@example.com" || rows[2][0] != "bob" || rows[2][2] != "false" ||
+		rows[1][4] != "2022-05-01T12:00:00Z" || rows[1][7] != "admin" {
+		t.Errorf("Unexpected CSV rows: %v", rows)
+	}
+}
+
+func TestKeyCollisionsReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/user/collisions", func(c *gin.Context) { handleGetKeyCollisions(c, &usersTestEngine{}) })
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/user/collisions", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"usernames":1,"emails":2}` {
+		t.Errorf("Unexpected report: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"os"
+	"services/jutzo"
+	"strings"
 )
 
 // Make sure that the payload provided by the user matches the expected JSON payload
@@ -32,3 +35,60 @@ func createHATEOASURL(c *gin.Context, format string, args ...any) string {
 	root := fmt.Sprintf("http%s://%s", scheme, c.Request.Host)
 	return fmt.Sprintf("%s%s", root, fmt.Sprintf(format, args...))
 }
+
+// configureClientIP decides which requests the client IP can be taken from a
+// header for: only those from the trusted proxies (comma separated addresses
+// or CIDRs in JUTZO_TRUSTED_PROXIES), none by default. The header is
+// X-Forwarded-For (or X-Real-IP), unless JUTZO_CLIENT_IP_HEADER names another.
+// Behind a platform that always sets the client IP, JUTZO_TRUSTED_PLATFORM
+// takes it from the platform's header instead; in release mode, without
+// trusted proxies, that is Cloudflare's CF-Connecting-IP. Otherwise the
+// client IP is the address the request came from
+func configureClientIP(router *gin.Engine, configuration jutzo.ConfigurationProvider) error {
+	var proxies []string
+	if trusted, isPresent := configuration.GetConfigurationString("JUTZO_TRUSTED_PROXIES"); isPresent {
+		for _, proxy := range strings.Split(trusted, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return fmt.Errorf("invalid JUTZO_TRUSTED_PROXIES: %w", err)
+	}
+	if header, isPresent := configuration.GetConfigurationString("JUTZO_CLIENT_IP_HEADER"); isPresent && header != "" {
+		if len(proxies) == 0 {
+			return errors.New("JUTZO_CLIENT_IP_HEADER needs the proxies that set it in JUTZO_TRUSTED_PROXIES")
+		}
+		router.RemoteIPHeaders = []string{header}
+	}
+
+	// A platform header is believed whoever sent it, so it is only used when
+	// the platform is all that requests can come through
+	platform, isPresent := configuration.GetConfigurationString("JUTZO_TRUSTED_PLATFORM")
+	if !isPresent || platform == "" {
+		platform = "none"
+		if gin.Mode() == gin.ReleaseMode && len(proxies) == 0 {
+			platform = "cloudflare"
+		}
+	}
+	switch platform {
+	case "cloudflare":
+		router.TrustedPlatform = gin.PlatformCloudflare
+	case "none":
+		router.TrustedPlatform = ""
+	default:
+		return fmt.Errorf("unsupported JUTZO_TRUSTED_PLATFORM %s", platform)
+	}
+	return nil
+}
+
+// Describe the client making the request. The client IP is only taken from
+// a header set by one of the trusted proxies or the trusted platform (see
+// configureClientIP)
+func getClientInfo(c *gin.Context) jutzo.ClientInfo {
+	return jutzo.ClientInfo{
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}